@@ -10,12 +10,15 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	ipfsfetcher "github.com/GopeedLab/gopeed/internal/protocol/ipfs"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/download"
 	"github.com/GopeedLab/gopeed/pkg/rest"
 	"github.com/GopeedLab/gopeed/pkg/rest/model"
 
@@ -50,9 +53,6 @@ var (
 	ipfsNode    *ipfs.IpfsMobile
 	ipfsContext context.Context
 	ipfsCancel  context.CancelFunc
-	// 用于存储下载进度的并发安全 Map
-	// key: string (downloadID), value: *DownloadProgress
-	downloadProgressMap sync.Map
 
 	// --- 用于存储 HTTP 服务器 Listener ---
 	apiListener     net.Listener
@@ -68,18 +68,6 @@ type DirectoryEntry struct {
 	Size int64  `json:"size"` // 条目大小 (文件大小)
 }
 
-// DownloadProgress 存储单个文件下载的进度信息
-type DownloadProgress struct {
-	DownloadID     string    `json:"downloadID"` // 唯一标识符
-	FilePath       string    `json:"filePath"`   // 本地保存路径
-	TotalBytes     int64     `json:"totalBytes"`
-	BytesRetrieved int64     `json:"bytesRetrieved"`
-	StartTime      time.Time `json:"startTime"`
-	IsCompleted    bool      `json:"isCompleted"`
-	ErrorMessage   string    `json:"errorMessage"` // 用于记录错误
-	HasError       bool      `json:"hasError"`     // <--- 添加 HasError 字段
-}
-
 // ProgressInfo 用于从 Go 传递进度信息给 Dart
 type ProgressInfo struct {
 	TotalBytes     int64   `json:"totalBytes"`
@@ -91,12 +79,6 @@ type ProgressInfo struct {
 	ErrorMessage   string  `json:"errorMessage"`
 }
 
-// progressWriter 实现了 io.Writer，用于在写入本地文件的同时更新进度
-type progressWriter struct {
-	progressID string
-	written    int64 // 原子更新或使用互斥锁保证并发安全（io.Copy 在单个 goroutine 中调用，暂时不用锁）
-}
-
 // NodeInfo 用于统一返回文件或目录的信息
 type NodeInfo struct {
 	Cid     string            `json:"cid"`     // 输入的 CID
@@ -106,23 +88,6 @@ type NodeInfo struct {
 	Error   string            `json:"error"`   // 如果解析或获取信息时出错
 }
 
-// --- 为 progressWriter 添加 Write 方法以实现 io.Writer ---
-func (pw *progressWriter) Write(p []byte) (n int, err error) {
-	n = len(p) // 假设写入总是成功，实际写入由 MultiWriter 的其他 Writer (outFile) 处理
-	pw.written += int64(n)
-
-	// 更新全局进度 Map
-	val, ok := downloadProgressMap.Load(pw.progressID)
-	if ok {
-		progress := val.(*DownloadProgress)
-		progress.BytesRetrieved = pw.written // 更新已下载字节
-		// 注意：这里只更新 BytesRetrieved，速率等在 Query 时计算
-		downloadProgressMap.Store(pw.progressID, progress) // 存回更新后的对象
-	}
-	// 返回 len(p) 和 nil 错误，表明这部分（进度跟踪）逻辑成功
-	return n, nil
-}
-
 //
 // Gopeed 下载功能
 //
@@ -133,7 +98,12 @@ func Start(cfg string) (int, error) {
 		return 0, err
 	}
 	config.ProductionMode = true
-	return rest.Start(&config)
+	port, err := rest.Start(&config)
+	if err != nil {
+		return 0, err
+	}
+	attachIPFSNode()
+	return port, nil
 }
 
 func Stop() {
@@ -203,6 +173,9 @@ func StartIPFS(repoPath string) (string, error) {
 		return "", err
 	}
 
+	// 下载器的 ipfs 任务通过内嵌节点获取数据块
+	attachIPFSNode()
+
 	// 返回节点ID
 	return ipfsNode.PeerHost().ID().String(), nil
 }
@@ -405,8 +378,10 @@ func StopIPFS() error {
 
 	if ipfsNode != nil {
 		fmt.Println("正在关闭 IPFS 核心节点...")
-		err := ipfsNode.IpfsNode.Close() // Close the core node first
-		ipfsNode = nil                   // Clear the global reference
+		node := ipfsNode
+		ipfsNode = nil               // Clear the global reference
+		attachIPFSNode()             // Detach the node from the ipfs tasks before it is closed
+		err := node.IpfsNode.Close() // Close the core node
 		if ipfsCancel != nil {
 			ipfsCancel()
 			ipfsCancel = nil
@@ -542,354 +517,155 @@ func ListDirectoryFromIPFS(cid string) (string, error) { // <--- 返回类型改
 	return string(jsonData), nil // <--- 返回 JSON 字符串
 }
 
-// DownloadAndSaveFile: 流式下载单个文件到本地，并记录进度
-// downloadID 是 Flutter 端生成的唯一 ID，用于后续查询进度
-func DownloadAndSaveFile(cid string, localFilePath string, downloadID string) error {
-	if ipfsNode == nil {
-		return fmt.Errorf("IPFS node is not running")
+// ipfsDownloadIDLabel 是任务标签的键，保存 Flutter 端生成的 downloadID，用于查询进度
+const ipfsDownloadIDLabel = "ipfsDownloadID"
+
+// attachIPFSNode 将内嵌节点的 DAG 服务交给下载器的 ipfs 协议，节点停止时切换回网关
+// 下载器和 IPFS 节点分别启动，所以两者启动和停止时都需要调用
+func attachIPFSNode() {
+	if rest.Downloader == nil {
+		return
 	}
-	api, err := coreapi.NewCoreAPI(ipfsNode.IpfsNode)
-	if err != nil {
-		return fmt.Errorf("failed to get CoreAPI: %w", err)
-	}
-
-	// --- 确保 downloadID 唯一性 (如果需要，可以先检查 Map) ---
-	_, loaded := downloadProgressMap.LoadOrStore(downloadID, &DownloadProgress{
-		DownloadID:     downloadID,
-		FilePath:       localFilePath,
-		TotalBytes:     -1, // 初始未知
-		BytesRetrieved: 0,
-		StartTime:      time.Now(),
-		IsCompleted:    false,
-		ErrorMessage:   "",
-	})
-	if loaded {
-		// 如果 ID 已存在且未完成，可能需要处理恢复逻辑或报错
-		// 简单起见，先假设不会重复使用未完成的 ID
-		// 或者，可以先删除旧的再存入新的
-		// downloadProgressMap.Delete(downloadID)
-		// downloadProgressMap.Store(...)
-		fmt.Printf("Warning: Download ID %s already exists. Overwriting progress.\n", downloadID)
-		// 重新存储以确保 StartTime 是最新的
-		downloadProgressMap.Store(downloadID, &DownloadProgress{
-			DownloadID:     downloadID,
-			FilePath:       localFilePath,
-			TotalBytes:     -1,
-			BytesRetrieved: 0,
-			StartTime:      time.Now(),
-			IsCompleted:    false,
-			ErrorMessage:   "",
-		})
+	fm, ok := rest.Downloader.GetFetcherManager("ipfs").(*ipfsfetcher.FetcherManager)
+	if !ok {
+		return
 	}
-
-	// 获取初始进度对象，以便后续更新 TotalBytes
-	initialProgressVal, _ := downloadProgressMap.Load(downloadID)
-	initialProgress := initialProgressVal.(*DownloadProgress)
-
-	// --- 获取 IPFS 文件节点 ---
-	p, err := ipfspath.NewPath("/ipfs/" + cid)
-	if err != nil {
-		initialProgress.ErrorMessage = fmt.Sprintf("failed to create IPFS path: %s", err)
-		initialProgress.HasError = true
-		downloadProgressMap.Store(downloadID, initialProgress)
-		return err // 直接返回，不用清理文件，因为还没创建
+	if ipfsNode == nil || ipfsNode.IpfsNode == nil {
+		fm.SetNode(nil)
+		return
 	}
+	fm.SetNode(ipfsNode.IpfsNode.DAG)
+}
 
-	// 使用 ResolvePath 获取不可变路径
-	resolvedPath, _, err := api.ResolvePath(ipfsContext, p)
+// createIPFSTask 解析 IPFS 路径并通过下载器创建任务，返回任务 ID
+func createIPFSTask(req *base.Request, opts func(res *base.Resource) (*base.Options, error)) (string, error) {
+	if rest.Downloader == nil {
+		return "", errors.New("downloader is not running")
+	}
+	rr, err := rest.Downloader.Resolve(req)
 	if err != nil {
-		initialProgress.ErrorMessage = fmt.Sprintf("failed to resolve IPFS path %s: %s", p, err)
-		initialProgress.HasError = true
-		downloadProgressMap.Store(downloadID, initialProgress)
-		return err
+		return "", err
 	}
-
-	node, err := api.Unixfs().Get(ipfsContext, resolvedPath)
+	o, err := opts(rr.Res)
 	if err != nil {
-		initialProgress.ErrorMessage = fmt.Sprintf("failed to get node for path %s: %s", resolvedPath, err)
-		initialProgress.HasError = true
-		downloadProgressMap.Store(downloadID, initialProgress)
-		return err
+		return "", err
 	}
+	return rest.Downloader.Create(rr.ID, o)
+}
 
-	f, ok := node.(files.File)
-	if !ok {
-		err = fmt.Errorf("node for path %s is not a file", resolvedPath)
-		initialProgress.ErrorMessage = err.Error()
-		initialProgress.HasError = true
-		downloadProgressMap.Store(downloadID, initialProgress)
-		return err
-	}
-	defer f.Close()
+// DownloadAndSaveFile: 通过下载器创建单个文件的下载任务
+// downloadID 是 Flutter 端生成的唯一 ID，保存在任务标签中，用于后续查询进度
+func DownloadAndSaveFile(cid string, localFilePath string, downloadID string) error {
+	_, err := createIPFSTask(&base.Request{
+		URL:    "/ipfs/" + cid,
+		Labels: map[string]string{ipfsDownloadIDLabel: downloadID},
+	}, func(res *base.Resource) (*base.Options, error) {
+		return &base.Options{
+			Name: filepath.Base(localFilePath),
+			Path: filepath.Dir(localFilePath),
+		}, nil
+	})
+	return err
+}
 
-	// --- 获取文件总大小并更新进度 ---
-	totalSize, err := f.Size()
-	if err != nil {
-		// 大小未知，依然尝试下载，但在进度报告中体现
-		initialProgress.TotalBytes = -1 // 标记大小未知
-		fmt.Printf("Warning: failed to get size for file %s: %v. Proceeding without total size.\n", cid, err)
-	} else {
-		initialProgress.TotalBytes = totalSize
-	}
-	downloadProgressMap.Store(downloadID, initialProgress) // 存回带有 TotalBytes 的进度
-
-	// --- 创建本地文件和目录 ---
-	dirPath := filepath.Dir(localFilePath)
-	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
-		initialProgress.ErrorMessage = fmt.Sprintf("failed to create directory %s: %s", dirPath, err)
-		initialProgress.HasError = true
-		downloadProgressMap.Store(downloadID, initialProgress)
-		return err
-	}
-	outFile, err := os.Create(localFilePath)
-	if err != nil {
-		initialProgress.ErrorMessage = fmt.Sprintf("failed to create local file %s: %s", localFilePath, err)
-		initialProgress.HasError = true
-		downloadProgressMap.Store(downloadID, initialProgress)
-		return err
+// findIPFSTask 按任务 ID 或 downloadID 标签查找任务，同一 downloadID 取最新创建的任务
+func findIPFSTask(downloadID string) *download.Task {
+	if rest.Downloader == nil {
+		return nil
 	}
-	defer outFile.Close()
-
-	// --- 创建进度写入器 ---
-	progWriter := &progressWriter{
-		progressID: downloadID,
-		written:    0, // written 会在 Write 方法中累加
+	if task := rest.Downloader.GetTask(downloadID); task != nil {
+		return task
 	}
-
-	// --- 使用 io.Copy 进行流式复制 ---
-	multiWriter := io.MultiWriter(outFile, progWriter) // 同时写入文件和更新进度
-	_, err = io.Copy(multiWriter, f)
-	if err != nil {
-		outFile.Close()          // 确保文件关闭以便删除
-		os.Remove(localFilePath) // 出错时删除不完整文件
-		// 更新进度为错误状态
-		finalProgressVal, ok := downloadProgressMap.Load(downloadID)
-		if ok {
-			finalProgress := finalProgressVal.(*DownloadProgress)
-			finalProgress.ErrorMessage = fmt.Sprintf("failed to copy content: %s", err)
-			finalProgress.HasError = true
-			downloadProgressMap.Store(downloadID, finalProgress)
+	var found *download.Task
+	for _, task := range rest.Downloader.GetTasks() {
+		if task.Meta.Req.Labels[ipfsDownloadIDLabel] != downloadID {
+			continue
 		}
-		return fmt.Errorf("failed to copy content to local file %s: %w", localFilePath, err)
-	}
-
-	// --- 下载完成，更新最终状态 ---
-	finalProgressVal, ok := downloadProgressMap.Load(downloadID)
-	if ok {
-		finalProgress := finalProgressVal.(*DownloadProgress)
-		finalProgress.IsCompleted = true
-		// 确保最终字节数正确，特别是如果 totalSize 未知
-		finalProgress.BytesRetrieved = progWriter.written
-		if finalProgress.TotalBytes == -1 { // 如果之前大小未知，现在更新为实际写入大小
-			finalProgress.TotalBytes = progWriter.written
-		} else if finalProgress.BytesRetrieved != finalProgress.TotalBytes {
-			// 如果已知大小和写入大小不符，可能需要记录警告
-			fmt.Printf("Warning: Final byte count mismatch for %s. Expected %d, got %d\n", downloadID, finalProgress.TotalBytes, finalProgress.BytesRetrieved)
-			// 纠正为实际写入大小
-			finalProgress.TotalBytes = finalProgress.BytesRetrieved
+		if found == nil || task.CreatedAt.After(found.CreatedAt) {
+			found = task
 		}
-		downloadProgressMap.Store(downloadID, finalProgress)
 	}
-
-	fmt.Printf("Successfully downloaded and saved %s to %s\n", cid, localFilePath)
-	return nil // 下载并保存成功
+	return found
 }
 
 // QueryDownloadProgress: 查询指定下载任务的进度信息，返回 JSON 字符串
-func QueryDownloadProgress(downloadID string) (string, error) { // <--- 返回类型改为 string
-	val, ok := downloadProgressMap.Load(downloadID)
-	if !ok {
-		// 对于 gomobile，返回空字符串和错误可能更清晰
-		return "", fmt.Errorf("download ID %s not found or already cleaned up", downloadID)
+// downloadID 可以是 DownloadAndSaveFile 的 downloadID，也可以是 StartDownloadSelected 返回的任务 ID
+func QueryDownloadProgress(downloadID string) (string, error) {
+	task := findIPFSTask(downloadID)
+	if task == nil {
+		return "", fmt.Errorf("download ID %s not found", downloadID)
 	}
-	progress := val.(*DownloadProgress)
 
-	elapsedTime := time.Since(progress.StartTime)
-	elapsedSeconds := elapsedTime.Seconds()
+	elapsedSeconds := float64(task.Progress.Used) / float64(time.Second)
 	if elapsedSeconds < 0.01 {
 		elapsedSeconds = 0.01
 	}
-
-	speedBps := float64(progress.BytesRetrieved) / elapsedSeconds
-
 	info := ProgressInfo{
-		TotalBytes:     progress.TotalBytes,
-		BytesRetrieved: progress.BytesRetrieved,
-		SpeedBps:       speedBps,
+		TotalBytes:     -1, // 解析前大小未知
+		BytesRetrieved: task.Progress.Downloaded,
+		SpeedBps:       float64(task.Progress.Speed),
 		ElapsedTimeSec: elapsedSeconds,
-		IsCompleted:    progress.IsCompleted,
-		HasError:       progress.ErrorMessage != "", // 直接计算 HasError
-		ErrorMessage:   progress.ErrorMessage,
+		IsCompleted:    task.Status == base.DownloadStatusDone,
+		HasError:       task.Status == base.DownloadStatusError,
+	}
+	if task.Meta.Res != nil {
+		info.TotalBytes = task.Meta.Res.Size
+	}
+	if info.HasError {
+		info.ErrorMessage = "download failed"
 	}
 
-	// 将结果序列化为 JSON 字符串
 	jsonData, err := json.Marshal(info)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal progress info to JSON: %w", err)
 	}
-
-	return string(jsonData), nil // <--- 返回 JSON 字符串
+	return string(jsonData), nil
 }
 
-// downloadRecursiveHelper: 内部递归辅助函数
-// currentRelativeDir: 当前正在处理的目录相对于顶层目录的路径 (例如 "subdir1/subdir2")
-// selectedPaths: key 是相对于 topCid 的完整相对路径
-func downloadRecursiveHelper(currentCid string, localCurrentPath string, currentRelativeDir string, selectedPaths map[string]bool, downloadIDPrefix string) error {
-
-	// ListDirectoryFromIPFS 现在返回 JSON 字符串
-	entriesJson, err := ListDirectoryFromIPFS(currentCid)
-	if err != nil {
-		// 如果当前 CID 不是目录或列出失败，记录错误并可能停止这个分支
-		fmt.Printf("Error listing directory %s (%s): %v\n", currentRelativeDir, currentCid, err)
-		return err // 返回错误，让上层决定如何处理
-	}
-
-	// --- 反序列化 JSON ---
-	var entries []DirectoryEntry
-	if err := json.Unmarshal([]byte(entriesJson), &entries); err != nil {
-		// 处理 JSON 反序列化错误
-		fmt.Printf("Error unmarshaling directory entries for %s: %v\n", currentCid, err)
-		return fmt.Errorf("failed to parse directory listing for %s: %w", currentCid, err)
-	}
-	// --- ---
-
-	// 确保当前本地目录存在
-	if err := os.MkdirAll(localCurrentPath, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create directory %s: %w", localCurrentPath, err)
-	}
-
-	// 现在迭代反序列化后的 entries
-	for _, entry := range entries {
-		// --- 构造条目的相对路径和本地路径 ---
-		entryRelativePath := filepath.Join(currentRelativeDir, entry.Name) // 使用 filepath.Join 更安全
-		localEntryPath := filepath.Join(localCurrentPath, entry.Name)
-
-		// --- 检查是否需要处理这个条目 ---
-		isSelected, containsSelectedChildren := checkSelection(entryRelativePath, entry.Type == "directory", selectedPaths)
-
-		if isSelected || containsSelectedChildren {
-			switch entry.Type {
-			case "file":
-				if isSelected { // 只有当文件本身被选中时才下载
-					// 生成唯一 ID
-					fileID := fmt.Sprintf("%s_%s", downloadIDPrefix, strings.ReplaceAll(entryRelativePath, string(filepath.Separator), "_"))
-					// 启动 goroutine 下载文件
-					go func(fileCid, filePath, id string) {
-						err := DownloadAndSaveFile(fileCid, filePath, id)
-						if err != nil {
-							fmt.Printf("Error downloading %s: %v\n", filePath, err)
-							// 可以在这里更新进度状态为 error
-							val, loaded := downloadProgressMap.Load(id)
-							if loaded {
-								prog := val.(*DownloadProgress)
-								prog.HasError = true
-								prog.ErrorMessage = err.Error()
-								downloadProgressMap.Store(id, prog)
-							} else {
-								// 如果启动时就失败，可能需要创建一个错误状态的条目
-								downloadProgressMap.Store(id, &DownloadProgress{
-									DownloadID: id, FilePath: filePath, TotalBytes: -1, BytesRetrieved: -1,
-									HasError: true, ErrorMessage: err.Error(),
-								})
-							}
-						}
-					}(entry.Cid, localEntryPath, fileID)
-				}
-
-			case "directory":
-				// 递归调用处理子目录
-				// 递归调用总是需要的，因为它可能包含选中的子文件
-				err := downloadRecursiveHelper(entry.Cid, localEntryPath, entryRelativePath, selectedPaths, downloadIDPrefix)
-				if err != nil {
-					// 处理子目录下载的整体错误（例如无法列出子目录）
-					fmt.Printf("Error processing subdirectory %s: %v\n", localEntryPath, err)
-					// 可以选择继续处理其他条目，或者向上传递错误
-					// return err // 如果希望一个子错误导致整个任务失败
-				}
-			}
+// isPathSelected: 判断文件的相对路径是否被选中，选中的目录包含其下所有文件
+func isPathSelected(filePath string, selectedPaths []string) bool {
+	for _, selected := range selectedPaths {
+		if selected == "." || selected == filePath || strings.HasPrefix(filePath, selected+"/") {
+			return true
 		}
 	}
-	return nil // 当前目录处理完成（或遇到可忽略的错误）
+	return false
 }
 
-// checkSelection: 辅助函数，判断当前条目是否需要处理
-// isDirectory: 当前条目是否是目录
-// selectedPaths: 用户选择的所有相对路径 (文件或目录)
-// 返回值:
-//
-//	bool: 当前条目本身是否被精确选中
-//	bool: selectedPaths 中是否包含当前目录下的子条目 (仅当 isDirectory 为 true 时有意义)
-func checkSelection(currentRelativePath string, isDirectory bool, selectedPaths map[string]bool) (isSelected bool, containsSelectedChildren bool) {
-	// 1. 检查当前路径是否被精确选中
-	if _, ok := selectedPaths[currentRelativePath]; ok {
-		isSelected = true
-	}
-
-	// 2. 如果是目录，检查是否有子路径被选中
-	if isDirectory {
-		prefix := currentRelativePath + string(filepath.Separator)
-		if currentRelativePath == "." { // 根目录特殊处理
-			prefix = ""
-		}
-		for path := range selectedPaths {
-			if strings.HasPrefix(path, prefix) && path != currentRelativePath { // 确保是真正的子路径
-				containsSelectedChildren = true
-				break
-			}
-		}
-	}
-
-	// 如果目录本身被选中，则认为其下所有内容也需要处理（隐含选中）
-	if isSelected && isDirectory {
-		containsSelectedChildren = true
-	}
-
-	return isSelected, containsSelectedChildren
-}
-
-// StartDownloadSelected: 启动下载任务的入口函数 (导出)
-// selectedPathsJson: 包含 ["path1", "path2"] 格式的 JSON 字符串
-func StartDownloadSelected(topCid string, localBasePath string, selectedPathsJson string) (string, error) { // <--- 修改参数类型
-	if ipfsNode == nil {
-		return "", fmt.Errorf("IPFS node is not running")
-	}
-
-	// --- 反序列化 selectedPaths ---
+// StartDownloadSelected: 通过下载器创建目录中选中文件的下载任务，返回任务 ID
+// selectedPathsJson: 包含 ["path1", "path2"] 格式的 JSON 字符串，路径相对于 topCid
+func StartDownloadSelected(topCid string, localBasePath string, selectedPathsJson string) (string, error) {
 	var selectedPaths []string
 	if err := json.Unmarshal([]byte(selectedPathsJson), &selectedPaths); err != nil {
 		return "", fmt.Errorf("failed to parse selected paths JSON: %w", err)
 	}
-	// --- ---
-
-	// 检查 localBasePath 是否有效 (例如，是否是绝对路径，是否有权限等)
-	// ...
-
-	selectedMap := make(map[string]bool)
-	for _, p := range selectedPaths { // 使用反序列化后的 selectedPaths
-		// 规范化路径分隔符，以匹配 filepath.Join 的结果
-		cleanPath := filepath.Clean(strings.ReplaceAll(p, "/", string(filepath.Separator)))
-		selectedMap[cleanPath] = true
+	for i, p := range selectedPaths {
+		selectedPaths[i] = path.Clean(filepath.ToSlash(p))
 	}
 
-	// 为整个下载任务生成唯一 ID 前缀
-	downloadTaskIDPrefix := fmt.Sprintf("task_%d", time.Now().UnixNano())
-
-	// 异步启动递归下载
-	go func() {
-		fmt.Printf("Starting download task %s for CID %s to %s\n", downloadTaskIDPrefix, topCid, localBasePath)
-		err := downloadRecursiveHelper(topCid, localBasePath, ".", selectedMap, downloadTaskIDPrefix) // 初始相对路径为 "."
-		if err != nil {
-			// 整个任务启动或执行中遇到不可恢复的错误
-			fmt.Printf("Download task %s failed: %v\n", downloadTaskIDPrefix, err)
-			// 需要一种方式通知 Flutter 任务失败 (例如，通过一个特殊进度条目或事件)
-			// 可以在 map 中存一个 "task_..." 的状态
-		} else {
-			fmt.Printf("Download task %s processing initiated.\n", downloadTaskIDPrefix)
-			// 可以在 map 中存一个 "task_..." 的状态标记完成（所有 goroutine 已启动）
+	return createIPFSTask(&base.Request{
+		URL: "/ipfs/" + topCid,
+	}, func(res *base.Resource) (*base.Options, error) {
+		var selectFiles []int
+		for i, file := range res.Files {
+			if isPathSelected(path.Join(file.Path, file.Name), selectedPaths) {
+				selectFiles = append(selectFiles, i)
+			}
 		}
-	}()
-
-	return downloadTaskIDPrefix, nil // 立即返回任务前缀
+		if len(selectFiles) == 0 {
+			return nil, errors.New("no file is selected")
+		}
+		// 目录下的文件保存到 localBasePath 下，单个文件保存到 localBasePath 中
+		opts := &base.Options{
+			Path:        localBasePath,
+			SelectFiles: selectFiles,
+		}
+		if res.Name != "" {
+			opts.Path = filepath.Dir(localBasePath)
+			opts.Name = filepath.Base(localBasePath)
+		}
+		return opts, nil
+	})
 }
 
 // GetIpfsNodeInfo 获取指定 CID 节点的信息 (类型、大小或目录内容)
@@ -1,7 +1,12 @@
 package controller
 
 import (
+	"crypto/tls"
+	"github.com/GopeedLab/gopeed/internal/hostlimit"
+	"github.com/GopeedLab/gopeed/internal/resolver"
 	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/util"
+	"golang.org/x/time/rate"
 	"net/http"
 	"net/url"
 	"os"
@@ -10,7 +15,22 @@ import (
 
 type Controller struct {
 	GetConfig func(v any)
-	GetProxy  func(requestProxy *base.RequestProxy) func(*http.Request) (*url.URL, error)
+	// GetProtocolConfig returns the config of another protocol, e.g. the http config of the files of a metalink
+	GetProtocolConfig func(name string, v any)
+	GetProxy          func(requestProxy *base.RequestProxy) func(*http.Request) (*url.URL, error)
+	// GetTLSConfig returns the tls config of the request, the request tls config overrides the global one
+	GetTLSConfig func(requestTLS *base.TLSConfig, skipVerifyCert bool) (*tls.Config, error)
+	// GetCookieJar returns the persistent cookie jar of the profile, nil means the profile is not supported
+	GetCookieJar func(profile string) http.CookieJar
+	// DownloadLimiter and UploadLimiter are the global rate limiters shared by all tasks
+	DownloadLimiter *rate.Limiter
+	UploadLimiter   *rate.Limiter
+	// GetBind returns the bind config of the request, the request bind config overrides the global one
+	GetBind func(requestBind *base.BindConfig) *base.BindConfig
+	// Resolver resolves the host names of the connections, it is shared by all tasks
+	Resolver *resolver.Resolver
+	// HostLimiter limits the connections to each host, it is shared by all tasks
+	HostLimiter *hostlimit.Limiter
 	FileController
 	//ContextDialer() (proxy.Dialer, error)
 }
@@ -20,15 +40,31 @@ type FileController interface {
 }
 
 type DefaultFileController struct {
+	// Allocation is the disk space allocation mode of the touched files, empty means sparse
+	Allocation base.FileAllocation
 }
 
 func NewController() *Controller {
 	return &Controller{
-		GetConfig: func(v any) {},
+		GetConfig:         func(v any) {},
+		GetProtocolConfig: func(name string, v any) {},
 		GetProxy: func(requestProxy *base.RequestProxy) func(*http.Request) (*url.URL, error) {
 			return requestProxy.ToHandler()
 		},
-		FileController: &DefaultFileController{},
+		GetTLSConfig: func(requestTLS *base.TLSConfig, skipVerifyCert bool) (*tls.Config, error) {
+			return base.BuildTLSConfig(skipVerifyCert, requestTLS)
+		},
+		GetCookieJar: func(profile string) http.CookieJar {
+			return nil
+		},
+		GetBind: func(requestBind *base.BindConfig) *base.BindConfig {
+			return requestBind
+		},
+		DownloadLimiter: util.NewRateLimiter(0),
+		UploadLimiter:   util.NewRateLimiter(0),
+		Resolver:        resolver.New(nil),
+		HostLimiter:     hostlimit.New(nil),
+		FileController:  &DefaultFileController{},
 	}
 }
 
@@ -42,8 +78,15 @@ func (c *DefaultFileController) Touch(name string, size int64) (file *os.File, e
 		return
 	}
 	if size > 0 {
-		err = os.Truncate(name, size)
+		switch c.Allocation {
+		case base.FileAllocationNone:
+		case base.FileAllocationFull:
+			err = util.Preallocate(file, size)
+		default:
+			err = file.Truncate(size)
+		}
 		if err != nil {
+			file.Close()
 			return nil, err
 		}
 	}
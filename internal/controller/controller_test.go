@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/util"
+)
+
+func TestDefaultFileController_Touch(t *testing.T) {
+	const size = 1024 * 1024
+	tests := []struct {
+		allocation base.FileAllocation
+		wantSize   int64
+		wantUsage  int64
+	}{
+		{allocation: base.FileAllocationNone, wantSize: 0},
+		{allocation: base.FileAllocationSparse, wantSize: size},
+		{allocation: base.FileAllocationFull, wantSize: size, wantUsage: size},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.allocation), func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "dir", "touch.data")
+			c := &DefaultFileController{Allocation: tt.allocation}
+			file, err := c.Touch(name, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			info, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != tt.wantSize {
+				t.Errorf("Touch() size = %v, want %v", info.Size(), tt.wantSize)
+			}
+			if usage := util.DiskUsage(name); usage < tt.wantUsage {
+				t.Errorf("Touch() disk usage = %v, want >= %v", usage, tt.wantUsage)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package dialer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/resolver"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	connectTimeout = 15 * time.Second
+	maxHeadSize    = 64 * 1024
+)
+
+// Dialer dials the tcp connections of the protocols which are not transferred over http,
+// the connections go through the proxy of the request, or the resolver and the bind addresses if there is no proxy.
+type Dialer struct {
+	proxy *url.URL
+	dial  func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// New builds the dialer of the request, the nth dialer is bound to the nth local address first.
+func New(ctl *controller.Controller, req *base.Request, n int) (*Dialer, error) {
+	var locals []net.IP
+	if ctl.GetBind != nil {
+		var err error
+		if locals, err = ctl.GetBind(req.Bind).LocalIPs(); err != nil {
+			return nil, err
+		}
+		locals = resolver.Rotate(locals, n)
+	}
+	d := &Dialer{
+		dial: ctl.Resolver.DialContext(&net.Dialer{Timeout: connectTimeout}, locals),
+	}
+	if proxyFunc := ctl.GetProxy(req.Proxy); proxyFunc != nil {
+		target, err := url.Parse(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		if d.proxy, err = proxyFunc(&http.Request{URL: target}); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Proxied returns whether the connections go through a proxy, the proxied connections can't accept the incoming connections.
+func (d *Dialer) Proxied() bool {
+	return d.proxy != nil
+}
+
+// DialContext connects the address directly or by the proxy, the http proxies are tunneled by CONNECT.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.proxy == nil {
+		return d.dial(ctx, network, addr)
+	}
+	switch d.proxy.Scheme {
+	case "socks5", "socks5h":
+		pd, err := proxy.FromURL(d.proxy, contextDialer(d.dial))
+		if err != nil {
+			return nil, err
+		}
+		return pd.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	case "http", "https":
+		return d.dialConnect(ctx, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", d.proxy.Scheme)
+	}
+}
+
+// dialConnect tunnels the connection through the http proxy by CONNECT
+func (d *Dialer) dialConnect(ctx context.Context, addr string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		port := "80"
+		if d.proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+	conn, err := d.dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+	}
+	// The handshake is interrupted by closing the connection when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	head, err := readHead(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s failed: %s", addr, resp.Status)
+	}
+	return conn, nil
+}
+
+// readHead reads the response head of CONNECT byte by byte, so the data sent by the server after it is left in the connection
+func readHead(conn net.Conn) ([]byte, error) {
+	var (
+		head []byte
+		b    = make([]byte, 1)
+	)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= maxHeadSize {
+			return nil, errors.New("proxy CONNECT response head too large")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		head = append(head, b[0])
+	}
+	return head, nil
+}
+
+type contextDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
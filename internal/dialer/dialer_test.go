@@ -0,0 +1,132 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/test"
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+// startGreetingServer starts a server which greets first, like ftp and ssh servers
+func startGreetingServer() net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello\r\n"))
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+// startConnectProxy starts a http proxy which only supports CONNECT, the tunnel is replied with the first data of the target.
+func startConnectProxy(usr, pwd string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(usr+":"+pwd)) {
+					conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+				greeting := make([]byte, 7)
+				io.ReadFull(target, greeting)
+				// The response head and the target data arrive in the same packet
+				conn.Write(append([]byte("HTTP/1.1 200 Connection established\r\n\r\n"), greeting...))
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestDialer_DialContext(t *testing.T) {
+	server := startGreetingServer()
+	defer server.Close()
+	connectProxy := startConnectProxy("usr", "pwd")
+	defer connectProxy.Close()
+	socks5Proxy := test.StartSocks5Server("usr", "pwd")
+	defer socks5Proxy.Close()
+
+	tests := []struct {
+		name  string
+		proxy *base.RequestProxy
+	}{
+		{"direct", nil},
+		{"http", &base.RequestProxy{Mode: base.RequestProxyModeCustom, Scheme: "http", Host: connectProxy.Addr().String(), Usr: "usr", Pwd: "pwd"}},
+		{"socks5", &base.RequestProxy{Mode: base.RequestProxyModeCustom, Scheme: "socks5", Host: socks5Proxy.Addr().String(), Usr: "usr", Pwd: "pwd"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := New(controller.NewController(), &base.Request{
+				URL:   "ftp://" + server.Addr().String(),
+				Proxy: tt.proxy,
+			}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Proxied() != (tt.proxy != nil) {
+				t.Errorf("Proxied() got = %v, want %v", d.Proxied(), tt.proxy != nil)
+			}
+			conn, err := d.DialContext(context.Background(), "tcp", server.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			greeting, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(greeting) != "hello\r\n" {
+				t.Errorf("DialContext() got = %q, want %q", greeting, "hello\r\n")
+			}
+		})
+	}
+}
+
+func TestDialer_DialContextProxyAuth(t *testing.T) {
+	connectProxy := startConnectProxy("usr", "pwd")
+	defer connectProxy.Close()
+
+	d, err := New(controller.NewController(), &base.Request{
+		URL:   "ftp://127.0.0.1:21",
+		Proxy: &base.RequestProxy{Mode: base.RequestProxyModeCustom, Scheme: "http", Host: connectProxy.Addr().String()},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:21"); err == nil {
+		t.Errorf("DialContext() got = %v, want error", err)
+	}
+}
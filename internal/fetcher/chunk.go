@@ -0,0 +1,363 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/util"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// MinChunkSize is the min size of the chunks a single file is split into
+	MinChunkSize        = 1024 * 1024
+	defaultChunkBufSize = 32 * 1024
+)
+
+// Chunk is a range of a resource file, the chunks are stored to resume the download
+type Chunk struct {
+	// File is the index of the file in the resource
+	File       int
+	Begin      int64
+	End        int64
+	Downloaded int64
+	Completed  bool
+
+	// lock guards Downloaded and Completed, they are written by the worker while the progress is read,
+	// the worker reads them without the lock.
+	lock sync.Mutex
+}
+
+// Remain returns the bytes remain to download
+func (c *Chunk) Remain() int64 {
+	return c.End - c.Begin + 1 - c.Downloaded
+}
+
+// Restart downloads the chunk from the beginning, e.g. the server ignores the range
+func (c *Chunk) Restart() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Downloaded = 0
+}
+
+func (c *Chunk) add(n int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Downloaded += n
+}
+
+func (c *Chunk) complete() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Completed = true
+}
+
+// snapshot returns the downloaded bytes and whether the chunk is completed
+func (c *Chunk) snapshot() (int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Downloaded, c.Completed
+}
+
+// Worker downloads the chunks one at a time
+type Worker struct {
+	// Index is the index of the worker, the connections are spread across the bind addresses by it
+	Index int
+	// Conn is the connection opened by the source, it is reused by the next chunks of the worker
+	// and closed after a failed chunk.
+	Conn io.Closer
+}
+
+// CloseConn closes the connection of the worker, the next chunk opens a new one
+func (w *Worker) CloseConn() {
+	if w.Conn != nil {
+		w.Conn.Close()
+		w.Conn = nil
+	}
+}
+
+// ChunkSource is implemented by the protocols which download the files by ranges
+type ChunkSource interface {
+	// Host returns the host of the file, the connections to it are limited by the host limiter, empty means no limit.
+	Host(file int) string
+	// Open returns the reader of the chunk from Begin+Downloaded to End, it may reuse or open the connection of the worker.
+	// The reader must be interrupted when the context is done, it is closed after the chunk is read.
+	Open(ctx context.Context, w *Worker, c *Chunk) (io.ReadCloser, error)
+}
+
+// ChunkRetryable is implemented by the sources which have errors that can't be retried, e.g. the object is changed
+type ChunkRetryable interface {
+	Retryable(err error) bool
+}
+
+// ChunkDownloader downloads the chunks of the selected files in parallel, the failed chunks are retried by the retry policy.
+type ChunkDownloader struct {
+	Ctl    *controller.Controller
+	Meta   *FetcherMeta
+	Source ChunkSource
+	Retry  *base.RetryPolicy
+	// BufSize is the size of the read buffer, 32KiB if it is zero
+	BufSize int
+
+	// limiter limits the download speed of the task
+	limiter *rate.Limiter
+	cancel  context.CancelFunc
+	eg      *errgroup.Group
+}
+
+// SplitChunks splits a single file into the chunks downloaded in parallel, the files of a directory are not split,
+// they are downloaded in parallel instead.
+func SplitChunks(meta *FetcherMeta, connections int) []*Chunk {
+	var chunks []*Chunk
+	for _, index := range meta.SelectedFiles() {
+		size := meta.Res.Files[index].Size
+		n := int64(1)
+		if meta.Res.Range && meta.Res.Name == "" {
+			n = max(1, min(int64(connections), size/MinChunkSize))
+		}
+		chunkSize := size / n
+		for i := int64(0); i < n; i++ {
+			begin := chunkSize * i
+			end := begin + chunkSize - 1
+			if i == n-1 {
+				end = size - 1
+			}
+			chunks = append(chunks, &Chunk{
+				File:  index,
+				Begin: begin,
+				End:   end,
+			})
+		}
+	}
+	return chunks
+}
+
+// ChunksProgress returns the downloaded bytes of each selected file
+func ChunksProgress(meta *FetcherMeta, chunks []*Chunk) Progress {
+	p := make(Progress, 0)
+	if meta.Res == nil || meta.Opts == nil || len(chunks) == 0 {
+		return p
+	}
+	positions := make(map[int]int)
+	for i, index := range meta.SelectedFiles() {
+		positions[index] = i
+		p = append(p, 0)
+	}
+	for _, c := range chunks {
+		if i, ok := positions[c.File]; ok {
+			downloaded, _ := c.snapshot()
+			p[i] += downloaded
+		}
+	}
+	return p
+}
+
+// CompletedChunks returns the count of the completed chunks
+func CompletedChunks(chunks []*Chunk) int {
+	completed := 0
+	for _, c := range chunks {
+		if _, ok := c.snapshot(); ok {
+			completed++
+		}
+	}
+	return completed
+}
+
+// CloneChunks returns the copies of the chunks, the chunks being downloaded are stored by the copies
+func CloneChunks(chunks []*Chunk) []*Chunk {
+	if chunks == nil {
+		return nil
+	}
+	clones := make([]*Chunk, len(chunks))
+	for i, c := range chunks {
+		downloaded, completed := c.snapshot()
+		clones[i] = &Chunk{
+			File:       c.File,
+			Begin:      c.Begin,
+			End:        c.End,
+			Downloaded: downloaded,
+			Completed:  completed,
+		}
+	}
+	return clones
+}
+
+// Start creates the selected files and downloads the incomplete chunks by the connections in the background,
+// done is called with the first chunk error after all the workers exit, it is not called if paused.
+func (d *ChunkDownloader) Start(chunks []*Chunk, connections int, done func(ctx context.Context, err error)) error {
+	// The files are created before downloading, the chunks of a file write it concurrently
+	for _, index := range d.Meta.SelectedFiles() {
+		name := d.Meta.Filepath(index)
+		if _, err := os.Stat(name); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		file, err := d.Ctl.Touch(name, d.Meta.Res.Files[index].Size)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+	d.limiter = util.NewRateLimiter(d.Meta.Opts.DownloadLimit)
+
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	d.eg, _ = errgroup.WithContext(ctx)
+
+	queue := make(chan *Chunk, len(chunks))
+	for _, c := range chunks {
+		if !c.Completed {
+			queue <- c
+		}
+	}
+	close(queue)
+
+	var (
+		errLock  sync.Mutex
+		chunkErr error
+	)
+	workers := min(connections, len(queue))
+	for i := 0; i < workers; i++ {
+		w := &Worker{Index: i}
+		d.eg.Go(func() error {
+			defer w.CloseConn()
+			for c := range queue {
+				if err := d.download(ctx, w, c); err != nil {
+					// if canceled, fail fast
+					if errors.Is(err, context.Canceled) {
+						return err
+					}
+					errLock.Lock()
+					if chunkErr == nil {
+						chunkErr = err
+					}
+					errLock.Unlock()
+					return nil
+				}
+			}
+			return nil
+		})
+	}
+
+	go func() {
+		err := d.eg.Wait()
+		// error returned only if canceled, just return
+		if err != nil {
+			return
+		}
+		done(ctx, chunkErr)
+	}()
+	return nil
+}
+
+// Pause stops the workers and waits for them to exit
+func (d *ChunkDownloader) Pause() {
+	if d.cancel != nil {
+		d.cancel()
+		// wait for pause handle complete
+		d.eg.Wait()
+	}
+}
+
+func (d *ChunkDownloader) download(ctx context.Context, w *Worker, c *Chunk) error {
+	var retryable func(err error) bool
+	if r, ok := d.Source.(ChunkRetryable); ok {
+		retryable = r.Retryable
+	}
+	return Retry(ctx, d.Retry, retryable, func() error {
+		err := d.doDownload(ctx, w, c)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	})
+}
+
+func (d *ChunkDownloader) doDownload(ctx context.Context, w *Worker, c *Chunk) (err error) {
+	// The file can't be downloaded from the offset, download from the beginning
+	if !d.Meta.Res.Range {
+		c.Restart()
+	}
+	if c.Remain() <= 0 {
+		c.complete()
+		return nil
+	}
+	// Queue for a connection slot of the host, the slots are shared by the connections of all tasks
+	if host := d.Source.Host(c.File); host != "" {
+		release, err := d.Ctl.HostLimiter.Acquire(ctx, host)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	defer func() {
+		if err != nil {
+			w.CloseConn()
+		}
+	}()
+
+	file, err := os.OpenFile(d.Meta.Filepath(c.File), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := d.Source.Open(ctx, w, c)
+	if err != nil {
+		return err
+	}
+	err = d.read(ctx, r, file, c)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if c.Remain() > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	c.complete()
+	return nil
+}
+
+// read writes the chunk to the file until the chunk or the reader ends
+func (d *ChunkDownloader) read(ctx context.Context, r io.Reader, file *os.File, c *Chunk) error {
+	bufSize := d.BufSize
+	if bufSize <= 0 {
+		bufSize = defaultChunkBufSize
+	}
+	buf := make([]byte, bufSize)
+	for c.Remain() > 0 {
+		n, err := r.Read(buf[:min(int64(len(buf)), c.Remain())])
+		if n > 0 {
+			if err := d.waitRateLimit(ctx, n); err != nil {
+				return err
+			}
+			if _, err := file.WriteAt(buf[:n], c.Begin+c.Downloaded); err != nil {
+				return err
+			}
+			c.add(int64(n))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitRateLimit blocks until the read bytes are allowed by both the task and the global speed limits
+func (d *ChunkDownloader) waitRateLimit(ctx context.Context, n int) error {
+	if err := util.WaitRateLimit(ctx, d.limiter, n); err != nil {
+		return err
+	}
+	return util.WaitRateLimit(ctx, d.Ctl.DownloadLimiter, n)
+}
@@ -0,0 +1,170 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+var errNotRetryable = errors.New("not retryable")
+
+// memSource serves the chunks from the memory, the first failures opens fail
+type memSource struct {
+	data     []byte
+	failures atomic.Int32
+	err      error
+	opens    atomic.Int32
+}
+
+func (s *memSource) Host(file int) string {
+	return "127.0.0.1"
+}
+
+func (s *memSource) Open(ctx context.Context, w *Worker, c *Chunk) (io.ReadCloser, error) {
+	s.opens.Add(1)
+	if s.failures.Add(-1) >= 0 {
+		return nil, s.err
+	}
+	return io.NopCloser(bytes.NewReader(s.data[c.Begin+c.Downloaded : c.End+1])), nil
+}
+
+func (s *memSource) Retryable(err error) bool {
+	return !errors.Is(err, errNotRetryable)
+}
+
+func buildChunkDownloader(t *testing.T, source *memSource) *ChunkDownloader {
+	return &ChunkDownloader{
+		Ctl: controller.NewController(),
+		Meta: &FetcherMeta{
+			Res: &base.Resource{
+				Range: true,
+				Files: []*base.FileInfo{{Name: "test.data", Size: int64(len(source.data))}},
+			},
+			Opts: &base.Options{Path: t.TempDir()},
+		},
+		Source: source,
+		Retry: &base.RetryPolicy{
+			MaxAttempts: 2,
+			BaseBackoff: 1,
+			MaxBackoff:  1,
+		},
+	}
+}
+
+func TestSplitChunks(t *testing.T) {
+	meta := &FetcherMeta{
+		Res: &base.Resource{
+			Range: true,
+			Files: []*base.FileInfo{{Name: "test.data", Size: MinChunkSize*3 + 1}},
+		},
+		Opts: &base.Options{},
+	}
+	chunks := SplitChunks(meta, 4)
+	if len(chunks) != 3 {
+		t.Fatalf("SplitChunks() got = %v chunks, want %v", len(chunks), 3)
+	}
+	if got := chunks[2].End; got != MinChunkSize*3 {
+		t.Errorf("SplitChunks() last end got = %v, want %v", got, MinChunkSize*3)
+	}
+
+	// The file which can't be read by ranges is not split
+	meta.Res.Range = false
+	if got := len(SplitChunks(meta, 4)); got != 1 {
+		t.Errorf("SplitChunks() got = %v chunks, want %v", got, 1)
+	}
+}
+
+func TestChunkDownloader_Start(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int32
+		err       error
+		wantErr   bool
+		wantOpens int32
+	}{
+		{name: "success", wantOpens: 3},
+		{name: "retry", failures: 2, err: errors.New("reset"), wantOpens: 5},
+		{name: "retry times used up", failures: 9, err: errors.New("reset"), wantErr: true},
+		{name: "not retryable", failures: 1, err: errNotRetryable, wantErr: true, wantOpens: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("gopeed"), MinChunkSize/2)
+			source := &memSource{data: data, err: tt.err}
+			source.failures.Store(tt.failures)
+			d := buildChunkDownloader(t, source)
+			chunks := SplitChunks(d.Meta, 3)
+
+			doneCh := make(chan error, 1)
+			if err := d.Start(chunks, 1, func(ctx context.Context, err error) {
+				doneCh <- err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			err := <-doneCh
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Start() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantOpens > 0 && source.opens.Load() != tt.wantOpens {
+				t.Errorf("Start() opens got = %v, want %v", source.opens.Load(), tt.wantOpens)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := os.ReadFile(d.Meta.Filepath(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Start() file content mismatch")
+			}
+			if got := CompletedChunks(chunks); got != len(chunks) {
+				t.Errorf("CompletedChunks() got = %v, want %v", got, len(chunks))
+			}
+			if got := ChunksProgress(d.Meta, chunks).TotalDownloaded(); got != int64(len(data)) {
+				t.Errorf("ChunksProgress() got = %v, want %v", got, len(data))
+			}
+		})
+	}
+}
+
+func TestChunkDownloader_ProgressWhileDownloading(t *testing.T) {
+	data := bytes.Repeat([]byte("gopeed"), MinChunkSize)
+	d := buildChunkDownloader(t, &memSource{data: data})
+	d.BufSize = 1024
+	chunks := SplitChunks(d.Meta, 4)
+
+	doneCh := make(chan error, 1)
+	if err := d.Start(chunks, 4, func(ctx context.Context, err error) {
+		doneCh <- err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The progress is read and the chunks are stored while the workers write them, it must pass the race detector
+	for {
+		ChunksProgress(d.Meta, chunks)
+		CompletedChunks(chunks)
+		if _, err := json.Marshal(CloneChunks(chunks)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-doneCh:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ChunksProgress(d.Meta, chunks).TotalDownloaded(); got != int64(len(data)) {
+				t.Errorf("ChunksProgress() got = %v, want %v", got, len(data))
+			}
+			return
+		default:
+		}
+	}
+}
@@ -3,10 +3,16 @@ package fetcher
 import (
 	"github.com/GopeedLab/gopeed/internal/controller"
 	"github.com/GopeedLab/gopeed/pkg/base"
+	"net/url"
 	"path"
+	"path/filepath"
 	"strings"
 )
 
+// PartSuffix is the suffix of the temporary path which the task is downloaded to,
+// it is renamed to the real path when the download is complete.
+const PartSuffix = ".part"
+
 // Fetcher defines the interface for a download protocol.
 // Each download task will have a corresponding Fetcher instance for the management of the download task
 type Fetcher interface {
@@ -29,6 +35,26 @@ type Fetcher interface {
 	Wait() error
 }
 
+// Syncer is implemented by the fetchers which write the downloaded data to disk by themselves,
+// Sync flushes the data to disk and snapshots the progress for Store, so the stored progress never exceeds the data on disk.
+type Syncer interface {
+	Sync() error
+}
+
+// RequestMatcher is implemented by the fetcher managers which also match the requests by the request extra,
+// e.g. the http urls opted in another protocol, the matchers take precedence over the scheme filters.
+type RequestMatcher interface {
+	// MatchRequest returns whether the request is handled by the fetcher manager, it must not modify the request.
+	MatchRequest(req *base.Request) bool
+}
+
+// RequestChecker is implemented by the fetchers which can't handle every matched request in the current environment,
+// e.g. the ipfs requests without the embedded node or the gateways, the request is refused before the task is created.
+type RequestChecker interface {
+	// CheckRequest returns the error if the request can't be handled, it must not modify the request.
+	CheckRequest(req *base.Request) error
+}
+
 type Uploader interface {
 	Upload() error
 	UploadedBytes() int64
@@ -63,6 +89,37 @@ func (m *FetcherMeta) SingleFilepath() string {
 	return path.Join(m.Opts.Path, file.Path, fileName)
 }
 
+// Filepath return the path of the nth file, the single file may be renamed.
+func (m *FetcherMeta) Filepath(index int) string {
+	if m.Res.Name == "" {
+		return m.SingleFilepath()
+	}
+	file := m.Res.Files[index]
+	return path.Join(m.FolderPath(), file.Path, file.Name)
+}
+
+// SelectedFiles return the indexes of the files to download, all files are selected if none is.
+func (m *FetcherMeta) SelectedFiles() []int {
+	if len(m.Opts.SelectFiles) > 0 {
+		return m.Opts.SelectFiles
+	}
+	files := make([]int, len(m.Res.Files))
+	for i := range files {
+		files[i] = i
+	}
+	return files
+}
+
+// PartFilepath return the temporary path of the single file.
+func (m *FetcherMeta) PartFilepath() string {
+	return m.SingleFilepath() + PartSuffix
+}
+
+// PartFolderPath return the temporary path of the folder.
+func (m *FetcherMeta) PartFolderPath() string {
+	return m.FolderPath() + PartSuffix
+}
+
 // RootDirPath return the root dir path of the task file.
 func (m *FetcherMeta) RootDirPath() string {
 	if m.Res.Name != "" {
@@ -72,6 +129,23 @@ func (m *FetcherMeta) RootDirPath() string {
 	}
 }
 
+// IsLocalName returns whether the file or directory name listed by the remote stays in the download directory,
+// the names which are empty, . or .. or contain the path separators are rejected.
+func IsLocalName(name string) bool {
+	return name != "." && filepath.IsLocal(name) && !strings.ContainsAny(name, `/\`)
+}
+
+// IsLocalPath returns whether the slash separated relative path listed by the remote stays in the download directory,
+// each name of the path must be a local name.
+func IsLocalPath(rel string) bool {
+	for _, name := range strings.Split(rel, "/") {
+		if !IsLocalName(name) {
+			return false
+		}
+	}
+	return true
+}
+
 type FilterType int
 
 const (
@@ -95,6 +169,10 @@ func (s *SchemeFilter) Match(uri string) bool {
 	case FilterTypeUrl:
 		return strings.HasPrefix(uriUpper, patternUpper+":")
 	case FilterTypeFile:
+		// The query and fragment are not part of the file name, e.g. https://github.com/index.m3u8?token=xxx
+		if u, err := url.Parse(uri); err == nil && u.Host != "" {
+			uriUpper = strings.ToUpper(u.Path)
+		}
 		return strings.HasSuffix(uriUpper, "."+patternUpper)
 	case FilterTypeBase64:
 		return strings.HasPrefix(uriUpper, "DATA:"+patternUpper+";BASE64,")
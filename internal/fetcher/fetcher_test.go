@@ -60,6 +60,28 @@ func TestSchemeFilter_Match(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "file url with query match",
+			fields: fields{
+				Type:    FilterTypeFile,
+				Pattern: "m3u8",
+			},
+			args: args{
+				uri: "https://github.com/index.m3u8?token=xxx#t=1",
+			},
+			want: true,
+		},
+		{
+			name: "file url query not match",
+			fields: fields{
+				Type:    FilterTypeFile,
+				Pattern: "m3u8",
+			},
+			args: args{
+				uri: "https://github.com/play?file=index.m3u8",
+			},
+			want: false,
+		},
 		{
 			name: "base64 match",
 			fields: fields{
@@ -95,3 +117,46 @@ func TestSchemeFilter_Match(t *testing.T) {
 		})
 	}
 }
+
+func TestIsLocalName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"file.txt", true},
+		{"..file", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../file", false},
+		{"dir/file", false},
+		{`..\file`, false},
+		{"/file", false},
+	}
+	for _, tt := range tests {
+		if got := IsLocalName(tt.name); got != tt.want {
+			t.Errorf("IsLocalName(%q) got = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsLocalPath(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"file.txt", true},
+		{"dir/sub/file.txt", true},
+		{"", false},
+		{"dir/../../file", false},
+		{"dir//file", false},
+		{"dir/./file", false},
+		{`dir/..\file`, false},
+		{"/dir/file", false},
+	}
+	for _, tt := range tests {
+		if got := IsLocalPath(tt.rel); got != tt.want {
+			t.Errorf("IsLocalPath(%q) got = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+const (
+	defaultMaxAttempts = 3
+	defaultBaseBackoff = 1000
+	defaultMaxBackoff  = 30000
+)
+
+// RetryDelayer is implemented by the errors which carry the delay requested by the server,
+// e.g. the Retry-After header of http.
+type RetryDelayer interface {
+	RetryDelay() time.Duration
+}
+
+// BuildRetryPolicy merges the retry policies in order, zero fields use the earlier values or the defaults.
+func BuildRetryPolicy(policies ...*base.RetryPolicy) *base.RetryPolicy {
+	result := &base.RetryPolicy{
+		MaxAttempts: defaultMaxAttempts,
+		BaseBackoff: defaultBaseBackoff,
+		MaxBackoff:  defaultMaxBackoff,
+	}
+	for _, p := range policies {
+		if p == nil {
+			continue
+		}
+		if p.MaxAttempts > 0 {
+			result.MaxAttempts = p.MaxAttempts
+		}
+		if p.BaseBackoff > 0 {
+			result.BaseBackoff = p.BaseBackoff
+		}
+		if p.MaxBackoff > 0 {
+			result.MaxBackoff = p.MaxBackoff
+		}
+		if p.Jitter > 0 {
+			result.Jitter = min(p.Jitter, 1)
+		}
+		if len(p.RetryableCodes) > 0 {
+			result.RetryableCodes = p.RetryableCodes
+		}
+	}
+	if result.MaxBackoff < result.BaseBackoff {
+		result.MaxBackoff = result.BaseBackoff
+	}
+	return result
+}
+
+// Backoff returns the delay before the next retry after the consecutive failures,
+// the delay requested by the error has higher priority, both are limited by the max backoff.
+func Backoff(policy *base.RetryPolicy, failures int, err error) time.Duration {
+	var rd RetryDelayer
+	if errors.As(err, &rd) && rd.RetryDelay() > 0 {
+		return min(rd.RetryDelay(), time.Duration(policy.MaxBackoff)*time.Millisecond)
+	}
+	delay := float64(policy.BaseBackoff) * math.Pow(2, float64(max(failures-1, 0)))
+	delay = min(delay, float64(policy.MaxBackoff))
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// RetryDelayExceeded returns whether the delay requested by the error exceeds the max backoff,
+// the error is returned instead of retrying earlier than the server allows.
+func RetryDelayExceeded(policy *base.RetryPolicy, err error) bool {
+	var rd RetryDelayer
+	return errors.As(err, &rd) && rd.RetryDelay() > time.Duration(policy.MaxBackoff)*time.Millisecond
+}
+
+// SleepBackoff waits for the backoff, returns the context error if canceled.
+func SleepBackoff(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Retry calls fn until it succeeds, the retry times of the policy are used up or the error can't be retried,
+// a nil retryable means all errors except the cancellation can be retried.
+func Retry(ctx context.Context, policy *base.RetryPolicy, retryable func(err error) bool, fn func() error) (err error) {
+	for failures := 1; ; failures++ {
+		err = fn()
+		if err == nil || errors.Is(err, context.Canceled) || failures > policy.MaxAttempts {
+			return
+		}
+		if (retryable != nil && !retryable(err)) || RetryDelayExceeded(policy, err) {
+			return
+		}
+		if sleepErr := SleepBackoff(ctx, Backoff(policy, failures, err)); sleepErr != nil {
+			return sleepErr
+		}
+	}
+}
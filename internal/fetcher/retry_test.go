@@ -0,0 +1,132 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+func TestBuildRetryPolicy(t *testing.T) {
+	got := BuildRetryPolicy(&base.RetryPolicy{
+		MaxAttempts: 5,
+		BaseBackoff: 500,
+		Jitter:      2,
+	}, &base.RetryPolicy{
+		MaxAttempts:    10,
+		RetryableCodes: []int{429, 503},
+	}, nil)
+	want := &base.RetryPolicy{
+		MaxAttempts:    10,
+		BaseBackoff:    500,
+		MaxBackoff:     defaultMaxBackoff,
+		Jitter:         1,
+		RetryableCodes: []int{429, 503},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildRetryPolicy() got = %v, want %v", got, want)
+	}
+}
+
+type delayError time.Duration
+
+func (e delayError) Error() string {
+	return "delay error"
+}
+
+func (e delayError) RetryDelay() time.Duration {
+	return time.Duration(e)
+}
+
+func TestBackoff(t *testing.T) {
+	policy := BuildRetryPolicy(&base.RetryPolicy{
+		BaseBackoff: 100,
+		MaxBackoff:  1000,
+	})
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, 1000 * time.Millisecond},
+		{100, 1000 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := Backoff(policy, tt.failures, errors.New("error")); got != tt.want {
+			t.Errorf("Backoff() got = %v, want %v", got, tt.want)
+		}
+	}
+
+	if got := Backoff(policy, 1, delayError(500*time.Millisecond)); got != 500*time.Millisecond {
+		t.Errorf("Backoff() got = %v, want %v", got, 500*time.Millisecond)
+	}
+	// The oversized Retry-After is limited by the max backoff
+	if got := Backoff(policy, 1, delayError(24*time.Hour)); got != time.Second {
+		t.Errorf("Backoff() got = %v, want %v", got, time.Second)
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := Backoff(policy, 1, nil); got < 50*time.Millisecond || got > 150*time.Millisecond {
+			t.Errorf("Backoff() got = %v, want in [50ms, 150ms]", got)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := BuildRetryPolicy(&base.RetryPolicy{
+		MaxAttempts: 2,
+		BaseBackoff: 1,
+	})
+	errFatal := errors.New("fatal")
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"recovered", []error{errors.New("error"), nil}, 2, nil},
+		{"used up", []error{errors.New("error"), errors.New("error"), errFatal}, 3, errFatal},
+		{"not retryable", []error{errFatal}, 1, errFatal},
+		{"canceled", []error{context.Canceled}, 1, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := Retry(context.Background(), policy, func(err error) bool {
+				return err != errFatal
+			}, func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if calls != tt.wantCalls || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Retry() calls = %v, err = %v, want %v, %v", calls, err, tt.wantCalls, tt.wantErr)
+			}
+		})
+	}
+
+	// The server asks to retry later than the max backoff, the error is returned without waiting
+	calls := 0
+	err := delayError(24 * time.Hour)
+	if got := Retry(context.Background(), policy, nil, func() error {
+		calls++
+		return err
+	}); got != err || calls != 1 {
+		t.Errorf("Retry() calls = %v, err = %v, want %v, %v", calls, got, 1, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Retry(ctx, BuildRetryPolicy(nil), nil, func() error {
+		return errors.New("error")
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Retry() got = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,128 @@
+package hostlimit
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+// Limiter limits the connections to each host, it is shared by all tasks.
+// The connections over the limit wait in a queue and take the released slots in order.
+type Limiter struct {
+	lock  sync.Mutex
+	cfg   *base.HostLimitConfig
+	hosts map[string]*host
+}
+
+type host struct {
+	active  int
+	waiters []chan struct{}
+}
+
+func New(cfg *base.HostLimitConfig) *Limiter {
+	l := &Limiter{
+		hosts: make(map[string]*host),
+	}
+	l.Update(cfg)
+	return l
+}
+
+// Update applies the config, the waiting connections take the slots added by raising the limits.
+func (l *Limiter) Update(cfg *base.HostLimitConfig) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cfg = cfg
+	for name, h := range l.hosts {
+		l.grant(name, h)
+	}
+}
+
+// Acquire waits for a connection slot of the host, the returned release function must be called when the connection is done.
+// The nil limiter doesn't limit the connections.
+func (l *Limiter) Acquire(ctx context.Context, name string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	name = strings.ToLower(name)
+
+	l.lock.Lock()
+	h := l.hosts[name]
+	if h == nil {
+		h = &host{}
+		l.hosts[name] = h
+	}
+	limit := l.cfg.Limit(name)
+	if len(h.waiters) == 0 && (limit == 0 || h.active < limit) {
+		h.active++
+		l.lock.Unlock()
+		return l.releaseFunc(name, h), nil
+	}
+	ready := make(chan struct{})
+	h.waiters = append(h.waiters, ready)
+	l.lock.Unlock()
+
+	select {
+	case <-ready:
+		return l.releaseFunc(name, h), nil
+	case <-ctx.Done():
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		select {
+		case <-ready:
+			// The slot is granted while canceling, give it to the next waiter
+			h.active--
+			l.grant(name, h)
+		default:
+			for i, w := range h.waiters {
+				if w == ready {
+					h.waiters = append(h.waiters[:i], h.waiters[i+1:]...)
+					break
+				}
+			}
+			l.drop(name, h)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Active returns the number of the connections holding the slots of the host.
+func (l *Limiter) Active(name string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if h := l.hosts[strings.ToLower(name)]; h != nil {
+		return h.active
+	}
+	return 0
+}
+
+func (l *Limiter) releaseFunc(name string, h *host) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			h.active--
+			l.grant(name, h)
+		})
+	}
+}
+
+// grant gives the free slots to the waiters in order, the caller must hold the lock.
+func (l *Limiter) grant(name string, h *host) {
+	limit := l.cfg.Limit(name)
+	for len(h.waiters) > 0 && (limit == 0 || h.active < limit) {
+		h.active++
+		close(h.waiters[0])
+		h.waiters = h.waiters[1:]
+	}
+	l.drop(name, h)
+}
+
+// drop removes the idle host, the caller must hold the lock.
+func (l *Limiter) drop(name string, h *host) {
+	if h.active == 0 && len(h.waiters) == 0 {
+		delete(l.hosts, name)
+	}
+}
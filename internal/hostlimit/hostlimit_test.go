@@ -0,0 +1,113 @@
+package hostlimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+func TestLimiter_Acquire(t *testing.T) {
+	l := New(&base.HostLimitConfig{MaxConnections: 2})
+
+	release1, err := l.Acquire(context.Background(), "gopeed.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := l.Acquire(context.Background(), "GOPEED.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The other hosts have their own slots
+	releaseOther, err := l.Acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOther()
+
+	// The third connection waits until a slot is released
+	acquired := make(chan func())
+	go func() {
+		release, err := l.Acquire(context.Background(), "gopeed.com")
+		if err == nil {
+			acquired <- release
+		}
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Acquire() got a slot over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release1()
+	// Releasing twice doesn't free another slot
+	release1()
+	var release3 func()
+	select {
+	case release3 = <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Acquire() didn't get the released slot")
+	}
+	if got := l.Active("gopeed.com"); got != 2 {
+		t.Errorf("Active() got = %v, want %v", got, 2)
+	}
+
+	release2()
+	release3()
+	if got := l.Active("gopeed.com"); got != 0 {
+		t.Errorf("Active() got = %v, want %v", got, 0)
+	}
+	if len(l.hosts) != 0 {
+		t.Errorf("hosts got = %v, want empty", l.hosts)
+	}
+}
+
+func TestLimiter_AcquireCanceled(t *testing.T) {
+	l := New(&base.HostLimitConfig{MaxConnections: 1})
+	release, err := l.Acquire(context.Background(), "gopeed.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, "gopeed.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Acquire() got = %v, want %v", err, context.DeadlineExceeded)
+	}
+	release()
+	if len(l.hosts) != 0 {
+		t.Errorf("hosts got = %v, want empty", l.hosts)
+	}
+}
+
+func TestLimiter_Update(t *testing.T) {
+	l := New(&base.HostLimitConfig{MaxConnections: 1})
+	if _, err := l.Acquire(context.Background(), "gopeed.com"); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		if _, err := l.Acquire(context.Background(), "gopeed.com"); err == nil {
+			close(acquired)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Raising the limit gives the new slot to the waiting connection
+	l.Update(&base.HostLimitConfig{MaxConnections: 2})
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Acquire() didn't get the added slot")
+	}
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	var l *Limiter
+	release, err := l.Acquire(context.Background(), "gopeed.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -0,0 +1,69 @@
+package bt
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/GopeedLab/gopeed/internal/resolver"
+	"github.com/anacrolix/torrent"
+)
+
+// bindListeners are the tcp listeners bound to the local addresses, the client doesn't close the added listeners
+var bindListeners []net.Listener
+
+// bindIPs returns the first local address of each family, nil if the family has no local address
+func bindIPs(locals []net.IP) (ip4 net.IP, ip6 net.IP) {
+	return resolver.LocalIP(locals, net.IPv4zero), resolver.LocalIP(locals, net.IPv6zero)
+}
+
+// applyBind binds the utp sockets and the dht of the client to the local addresses,
+// the families without a local address are disabled.
+func applyBind(cfg *torrent.ClientConfig, locals []net.IP) {
+	if len(locals) == 0 {
+		return
+	}
+	ip4, ip6 := bindIPs(locals)
+	cfg.ListenHost = func(network string) string {
+		if strings.HasSuffix(network, "4") {
+			return ip4.String()
+		}
+		return ip6.String()
+	}
+	cfg.DisableIPv4 = ip4 == nil
+	cfg.DisableIPv6 = ip6 == nil
+	// The tcp dialers of the client are not bound to the listen address,
+	// so the tcp listeners and dialers are added by addBindTCP after the client is created.
+	cfg.DisableTCP = true
+}
+
+// addBindTCP listens on the client port and dials the peers from the local addresses over tcp
+func addBindTCP(cl *torrent.Client, locals []net.IP) error {
+	if len(locals) == 0 {
+		return nil
+	}
+	ip4, ip6 := bindIPs(locals)
+	for network, ip := range map[string]net.IP{"tcp4": ip4, "tcp6": ip6} {
+		if ip == nil {
+			continue
+		}
+		l, err := net.Listen(network, net.JoinHostPort(ip.String(), strconv.Itoa(cl.LocalPort())))
+		if err != nil {
+			return err
+		}
+		bindListeners = append(bindListeners, l)
+		cl.AddListener(l)
+		cl.AddDialer(torrent.NetworkDialer{
+			Network: network,
+			Dialer:  &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}},
+		})
+	}
+	return nil
+}
+
+func closeBindListeners() {
+	for _, l := range bindListeners {
+		l.Close()
+	}
+	bindListeners = nil
+}
@@ -9,4 +9,10 @@ type config struct {
 	SeedRatio float64 `json:"seedRatio"`
 	// SeedTime is the time in seconds to seed after downloading is complete.
 	SeedTime int64 `json:"seedTime"`
+	// PartFile downloads to a temporary .part path and renames it on completion, nil means enabled
+	PartFile *bool `json:"partFile"`
+}
+
+func (c *config) partFile() bool {
+	return c.PartFile == nil || *c.PartFile
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/dialer"
 	"github.com/GopeedLab/gopeed/internal/fetcher"
 	"github.com/GopeedLab/gopeed/pkg/base"
 	"github.com/GopeedLab/gopeed/pkg/protocol/bt"
@@ -12,6 +13,8 @@ import (
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -43,6 +46,8 @@ type Fetcher struct {
 	torrentDropCtx  context.Context
 	torrentDropFunc func()
 	uploadDoneCh    chan any
+	// part is true if the files are downloaded to the temporary part path
+	part bool
 }
 
 func (f *Fetcher) Setup(ctl *controller.Controller) {
@@ -76,6 +81,28 @@ func (f *Fetcher) initClient() (err error) {
 	cfg.ExtendedHandshakeClientVersion = fmt.Sprintf("Gopeed %s", base.Version)
 	cfg.ListenPort = f.config.ListenPort
 	cfg.HTTPProxy = f.ctl.GetProxy(f.meta.Req.Proxy)
+	// The client is shared by all tasks, so only the global bind config applies
+	locals, err := f.ctl.GetBind(nil).LocalIPs()
+	if err != nil {
+		return
+	}
+	applyBind(cfg, locals)
+	tlsConfig, err := f.ctl.GetTLSConfig(f.meta.Req.TLS, f.meta.Req.SkipVerifyCert)
+	if err != nil {
+		return
+	}
+	// WebTransport is used by the web seeds and the http requests of the client,
+	// the announce requests of http trackers are sent by the tracker package with its own transport,
+	// which verifies the https trackers by the tls config through applyTrackerTLS.
+	dial := f.ctl.Resolver.DialContext(&net.Dialer{}, locals)
+	cfg.WebTransport = &http.Transport{
+		DialContext:     dial,
+		Proxy:           cfg.HTTPProxy,
+		TLSClientConfig: tlsConfig,
+		MaxConnsPerHost: 10,
+	}
+	cfg.DownloadRateLimiter = f.ctl.DownloadLimiter
+	cfg.UploadRateLimiter = f.ctl.UploadLimiter
 	cfg.DefaultStorage = newFileOpts(newFileClientOpts{
 		ClientBaseDir: cfg.DataDir,
 		HandleFileTorrent: func(infoHash metainfo.Hash, ft *fileTorrentImpl) {
@@ -85,17 +112,23 @@ func (f *Fetcher) initClient() (err error) {
 			ftMap[infoHash.String()] = ft
 		},
 	})
-	dnsResolver := &DnsCacheResolver{RefreshTimeout: 5 * time.Minute}
-	cfg.TrackerDialContext = dnsResolver.DialContext
+	cfg.TrackerDialContext = dial
+	applyTrackerTLS(cfg, tlsConfig, func(ctx context.Context, tracker *url.URL, network, addr string) (net.Conn, error) {
+		d, err := dialer.New(f.ctl, &base.Request{URL: tracker.String(), Proxy: f.meta.Req.Proxy}, 0)
+		if err != nil {
+			return nil, err
+		}
+		return d.DialContext(ctx, network, addr)
+	})
 	client, err = torrent.NewClient(cfg)
 	if err != nil {
 		return
 	}
-
-	closeCtx, closeFunc = context.WithCancel(context.Background())
-	go func() {
-		dnsResolver.Run(closeCtx)
-	}()
+	if err = addBindTCP(client, locals); err != nil {
+		client.Close()
+		client = nil
+		closeBindListeners()
+	}
 	return
 }
 
@@ -123,7 +156,8 @@ func (f *Fetcher) Start() (err error) {
 		}
 	}
 	if ft, ok := ftMap[f.meta.Res.Hash]; ok {
-		ft.setTorrentDir(f.meta.Opts.Path)
+		f.applyFilePaths(ft)
+		ft.setRateLimit(f.meta.Opts.DownloadLimit, f.meta.Opts.UploadLimit)
 	}
 	files := f.torrent.Files()
 	// If the user does not specify the file to download, all files will be downloaded by default
@@ -213,6 +247,7 @@ func (f *Fetcher) Wait() (err error) {
 		case <-time.After(time.Second):
 			if f.torrentReady.Load() && len(f.meta.Opts.SelectFiles) > 0 {
 				if f.isDone() {
+					ft := ftMap[f.meta.Res.Hash]
 					// remove unselected files
 					for i, file := range f.torrent.Files() {
 						selected := false
@@ -223,9 +258,16 @@ func (f *Fetcher) Wait() (err error) {
 							}
 						}
 						if !selected {
-							util.SafeRemove(filepath.Join(f.meta.Opts.Path, f.meta.Res.Name, file.Path()))
+							if ft != nil {
+								util.SafeRemove(ft.filePath(i))
+							} else {
+								util.SafeRemove(filepath.Join(f.meta.Opts.Path, f.meta.Res.Name, file.Path()))
+							}
 						}
 					}
+					if f.part && ft != nil {
+						return f.finishPart(ft)
+					}
 					return
 				}
 			}
@@ -233,6 +275,74 @@ func (f *Fetcher) Wait() (err error) {
 	}
 }
 
+// rootPath returns the real path of the torrent, it is the folder of the directory torrent
+// or the file of the single file torrent.
+func (f *Fetcher) rootPath() string {
+	if f.meta.Res.Name != "" {
+		return f.meta.FolderPath()
+	}
+	return f.meta.SingleFilepath()
+}
+
+// applyFilePaths places the files of the torrent, the files are downloaded to the temporary part path
+// if the part file is enabled, the task started before it was enabled keeps the original paths.
+func (f *Fetcher) applyFilePaths(ft *fileTorrentImpl) {
+	f.part = false
+	if !f.config.partFile() {
+		ft.setTorrentDir(f.meta.Opts.Path)
+		return
+	}
+	root := f.rootPath()
+	partRoot := root + fetcher.PartSuffix
+	switch {
+	case exists(partRoot):
+		ft.setTorrentRoot(partRoot)
+		f.part = true
+	case exists(root):
+		// The download is complete or started before the part file was enabled
+		ft.setTorrentRoot(root)
+	case f.data.Progress == nil || f.data.Progress.TotalDownloaded() == 0:
+		ft.setTorrentRoot(partRoot)
+		f.part = true
+	default:
+		ft.setTorrentDir(f.meta.Opts.Path)
+	}
+}
+
+// finishPart flushes the downloaded files to disk and renames the part path to the real path.
+func (f *Fetcher) finishPart(ft *fileTorrentImpl) error {
+	for _, selectIndex := range f.meta.Opts.SelectFiles {
+		if err := syncFile(ft.filePath(selectIndex)); err != nil {
+			return err
+		}
+	}
+	root := f.rootPath()
+	if err := os.Rename(root+fetcher.PartSuffix, root); err != nil {
+		return err
+	}
+	ft.setTorrentRoot(root)
+	f.part = false
+	return nil
+}
+
+func syncFile(name string) error {
+	file, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		// The zero length files are not written
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
 func (f *Fetcher) isDone() bool {
 	if f.meta.Opts == nil {
 		return false
@@ -417,6 +527,13 @@ func (f *Fetcher) addTorrent(req *base.Request, fromUpload bool) (err error) {
 		f.torrent.AddTrackers(announceList)
 	}
 	<-f.torrent.GotInfo()
+	// Apply the task speed limits when the torrent is restored for uploading
+	if ft, ok := ftMap[f.torrent.InfoHash().String()]; ok && f.meta.Opts != nil {
+		if f.meta.Res != nil {
+			f.applyFilePaths(ft)
+		}
+		ft.setRateLimit(f.meta.Opts.DownloadLimit, f.meta.Opts.UploadLimit)
+	}
 	f.torrentReady.Store(true)
 
 	go f.doUpload(fromUpload)
@@ -457,6 +574,7 @@ func closeClient() error {
 			return errs[0]
 		}
 		client = nil
+		closeBindListeners()
 		closeCtx = nil
 		closeFunc = nil
 	}
@@ -514,12 +632,14 @@ func (fm *FetcherManager) AutoRename() bool {
 }
 
 func (fm *FetcherManager) DefaultConfig() any {
+	partFile := true
 	return &config{
 		ListenPort: 0,
 		Trackers:   []string{},
 		SeedKeep:   false,
 		SeedRatio:  1.0,
 		SeedTime:   120 * 60,
+		PartFile:   &partFile,
 	}
 }
 
@@ -162,6 +162,73 @@ func doResolve(t *testing.T, fetcher fetcher.Fetcher) {
 	})
 }
 
+func TestFetcher_PartFile(t *testing.T) {
+	dir := t.TempDir()
+	newFetcher := func(partFile bool) (*Fetcher, *fileTorrentImpl) {
+		f := &Fetcher{
+			config: &config{PartFile: &partFile},
+			data:   &fetcherData{},
+			meta: &fetcher.FetcherMeta{
+				Res: &base.Resource{
+					Name: "root",
+				},
+				Opts: &base.Options{
+					Path:        dir,
+					Name:        "renamed",
+					SelectFiles: []int{0, 1},
+				},
+			},
+		}
+		ft := &fileTorrentImpl{
+			files: []file{
+				{rawPath: filepath.Join("root", "a.txt"), innerPath: "a.txt"},
+				{rawPath: filepath.Join("root", "sub", "b.txt"), innerPath: filepath.Join("sub", "b.txt")},
+			},
+		}
+		return f, ft
+	}
+
+	f, ft := newFetcher(true)
+	f.applyFilePaths(ft)
+	if want := filepath.Join(dir, "renamed.part", "sub", "b.txt"); !f.part || ft.filePath(1) != want {
+		t.Fatalf("applyFilePaths() got = %v, want %v", ft.filePath(1), want)
+	}
+	for i := range ft.files {
+		if err := os.MkdirAll(filepath.Dir(ft.filePath(i)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(ft.filePath(i), []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.finishPart(ft); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "renamed", "sub", "b.txt"); ft.filePath(1) != want {
+		t.Errorf("finishPart() got = %v, want %v", ft.filePath(1), want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renamed", "a.txt")); err != nil {
+		t.Errorf("finishPart() file not renamed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renamed.part")); !os.IsNotExist(err) {
+		t.Errorf("finishPart() part folder exists: %v", err)
+	}
+
+	// The completed task is seeded from the real path
+	f, ft = newFetcher(true)
+	f.data.Progress = fetcher.Progress{4, 4}
+	f.applyFilePaths(ft)
+	if want := filepath.Join(dir, "renamed", "a.txt"); f.part || ft.filePath(0) != want {
+		t.Errorf("applyFilePaths() got = %v, want %v", ft.filePath(0), want)
+	}
+
+	f, ft = newFetcher(false)
+	f.applyFilePaths(ft)
+	if want := filepath.Join(dir, "root", "a.txt"); f.part || ft.filePath(0) != want {
+		t.Errorf("applyFilePaths() got = %v, want %v", ft.filePath(0), want)
+	}
+}
+
 func TestFetcherManager_ParseName(t *testing.T) {
 	type args struct {
 		u string
@@ -5,7 +5,9 @@ package bt
 import (
 	"context"
 	"fmt"
+	"github.com/GopeedLab/gopeed/pkg/util"
 	"github.com/anacrolix/torrent/storage"
+	"golang.org/x/time/rate"
 	"io"
 	"os"
 	"path/filepath"
@@ -63,9 +65,10 @@ func (fs fileClientImpl) OpenTorrent(ctx context.Context, info *metainfo.Info, i
 			File: &fileInfo,
 		}))
 		f := file{
-			rawPath: filePath,
-			path:    filePath,
-			length:  fileInfo.Length,
+			rawPath:   filePath,
+			innerPath: filepath.Join(fileInfo.Path...),
+			path:      filePath,
+			length:    fileInfo.Length,
 		}
 		if f.length == 0 {
 			err = CreateNativeZeroLengthFile(f.path)
@@ -76,11 +79,16 @@ func (fs fileClientImpl) OpenTorrent(ctx context.Context, info *metainfo.Info, i
 		}
 		files = append(files, f)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	t := &fileTorrentImpl{
-		files,
-		segments.NewIndex(common.LengthIterFromUpvertedFiles(upvertedFiles)),
-		infoHash,
-		fs.opts.PieceCompletion,
+		ctx:             ctx,
+		cancel:          cancel,
+		files:           files,
+		segmentLocater:  segments.NewIndex(common.LengthIterFromUpvertedFiles(upvertedFiles)),
+		infoHash:        infoHash,
+		completion:      fs.opts.PieceCompletion,
+		downloadLimiter: util.NewRateLimiter(0),
+		uploadLimiter:   util.NewRateLimiter(0),
 	}
 	fs.opts.HandleFileTorrent(infoHash, t)
 	return storage.TorrentImpl{
@@ -92,8 +100,10 @@ func (fs fileClientImpl) OpenTorrent(ctx context.Context, info *metainfo.Info, i
 type file struct {
 	// The safe, OS-local file path.
 	rawPath string
-	path    string
-	length  int64
+	// innerPath is the path relative to the torrent root, it is empty for the single file torrent.
+	innerPath string
+	path      string
+	length    int64
 }
 
 type fileTorrentImpl struct {
@@ -101,6 +111,14 @@ type fileTorrentImpl struct {
 	segmentLocater segments.Index
 	infoHash       metainfo.Hash
 	completion     storage.PieceCompletion
+	// downloadLimiter and uploadLimiter limit the speed of the torrent by throttling the piece writes and reads,
+	// the client doesn't support the per torrent limit of the peer connections.
+	downloadLimiter *rate.Limiter
+	uploadLimiter   *rate.Limiter
+	// ctx is canceled when the storage is closed, which happens when the torrent is paused or dropped,
+	// so the piece writes and reads waiting for the limiters don't block the client.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (fts *fileTorrentImpl) Piece(p metainfo.Piece) storage.PieceImpl {
@@ -116,15 +134,33 @@ func (fts *fileTorrentImpl) Piece(p metainfo.Piece) storage.PieceImpl {
 }
 
 func (fts *fileTorrentImpl) Close() error {
+	fts.cancel()
 	return nil
 }
 
+func (fts *fileTorrentImpl) setRateLimit(download int64, upload int64) {
+	util.SetRateLimit(fts.downloadLimiter, download)
+	util.SetRateLimit(fts.uploadLimiter, upload)
+}
+
 func (fts *fileTorrentImpl) setTorrentDir(dir string) {
 	for i, f := range fts.files {
 		fts.files[i].path = filepath.Join(dir, f.rawPath)
 	}
 }
 
+// setTorrentRoot places the files under the root instead of the torrent name,
+// the root is the file path itself for the single file torrent.
+func (fts *fileTorrentImpl) setTorrentRoot(root string) {
+	for i, f := range fts.files {
+		fts.files[i].path = filepath.Join(root, f.innerPath)
+	}
+}
+
+func (fts *fileTorrentImpl) filePath(index int) string {
+	return fts.files[index].path
+}
+
 // A helper to create zero-length files which won't appear for file-orientated storage since no
 // writes will ever occur to them (no torrent data is associated with a zero-length file). The
 // caller should make sure the file name provided is safe/sanitized.
@@ -3,6 +3,7 @@
 package bt
 
 import (
+	"github.com/GopeedLab/gopeed/pkg/util"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/storage"
 	"io"
@@ -59,3 +60,24 @@ func (fs *filePieceImpl) MarkComplete() error {
 func (fs *filePieceImpl) MarkNotComplete() error {
 	return fs.completion.Set(fs.pieceKey(), false)
 }
+
+// WriteAt writes the piece data received from peers, it is throttled by the download limiter of the torrent.
+func (fs *filePieceImpl) WriteAt(b []byte, off int64) (n int, err error) {
+	if err = util.WaitRateLimit(fs.ctx, fs.downloadLimiter, len(b)); err != nil {
+		return
+	}
+	return fs.WriterAt.WriteAt(b, off)
+}
+
+// ReadAt reads the piece data which is uploaded to peers, it is throttled by the upload limiter of the torrent.
+func (fs *filePieceImpl) ReadAt(b []byte, off int64) (n int, err error) {
+	if err = util.WaitRateLimit(fs.ctx, fs.uploadLimiter, len(b)); err != nil {
+		return
+	}
+	return fs.ReaderAt.ReadAt(b, off)
+}
+
+// WriteTo is used to hash the piece, it reads the piece data directly without throttling.
+func (fs *filePieceImpl) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, io.NewSectionReader(fs.ReaderAt, 0, fs.p.Length()))
+}
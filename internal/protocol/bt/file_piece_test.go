@@ -0,0 +1,44 @@
+package bt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/GopeedLab/gopeed/pkg/util"
+)
+
+type discardWriterAt struct{}
+
+func (discardWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	return len(b), nil
+}
+
+func TestFilePieceImpl_WriteAtClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ft := &fileTorrentImpl{
+		ctx:             ctx,
+		cancel:          cancel,
+		downloadLimiter: util.NewRateLimiter(0),
+		uploadLimiter:   util.NewRateLimiter(0),
+	}
+	ft.setRateLimit(1, 1)
+	fp := &filePieceImpl{fileTorrentImpl: ft, WriterAt: discardWriterAt{}}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := fp.WriteAt(make([]byte, 1024*1024), 0)
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ft.Close()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("WriteAt() got error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteAt() is still blocked after the storage is closed")
+	}
+}
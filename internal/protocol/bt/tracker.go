@@ -0,0 +1,74 @@
+package bt
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/anacrolix/torrent"
+)
+
+// trackerTLSKey is the context key of the https tracker url, the announce to it is sent over the tls connection of the tracker dialer
+type trackerTLSKey struct{}
+
+// applyTrackerTLS makes the announces of https trackers verify the server and present the client certificate by the tls config,
+// the http tracker client of anacrolix skips the verification and doesn't accept a custom transport,
+// so the https announces are sent as plain http by the tracker client over the tls connections established by the tracker dialer.
+// The dialTracker dials the tracker address of the https announce, it tunnels through the proxy if the client has one.
+func applyTrackerTLS(cfg *torrent.ClientConfig, tlsConfig *tls.Config,
+	dialTracker func(ctx context.Context, tracker *url.URL, network, addr string) (net.Conn, error)) {
+	dial := cfg.TrackerDialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	proxy := cfg.HTTPProxy
+
+	cfg.HttpRequestDirector = func(req *http.Request) error {
+		if req.URL.Scheme != "https" {
+			return nil
+		}
+		tracker := *req.URL
+		port := req.URL.Port()
+		if port == "" {
+			port = "443"
+		}
+		req.URL.Scheme = "http"
+		req.URL.Host = net.JoinHostPort(req.URL.Hostname(), port)
+		*req = *req.WithContext(context.WithValue(req.Context(), trackerTLSKey{}, &tracker))
+		return nil
+	}
+	if proxy != nil {
+		// The https announce is proxied by the tracker dialer, the plain http request must not be sent to the proxy
+		cfg.HTTPProxy = func(req *http.Request) (*url.URL, error) {
+			if req.Context().Value(trackerTLSKey{}) != nil {
+				return nil, nil
+			}
+			return proxy(req)
+		}
+	}
+	cfg.TrackerDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		tracker, ok := ctx.Value(trackerTLSKey{}).(*url.URL)
+		if !ok {
+			return dial(ctx, network, addr)
+		}
+		conn, err := dialTracker(ctx, tracker, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		var config *tls.Config
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		} else {
+			config = &tls.Config{}
+		}
+		config.ServerName = tracker.Hostname()
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,78 @@
+package bt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/tracker"
+)
+
+func TestApplyTrackerTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	clientCert := server.TLS.Certificates[0]
+
+	tests := []struct {
+		name      string
+		tlsConfig *tls.Config
+		wantErr   bool
+	}{
+		{
+			name:      "trusted",
+			tlsConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}},
+		},
+		{
+			name:      "untrusted",
+			tlsConfig: &tls.Config{Certificates: []tls.Certificate{clientCert}},
+			wantErr:   true,
+		},
+		{
+			name:      "no client cert",
+			tlsConfig: &tls.Config{RootCAs: pool},
+			wantErr:   true,
+		},
+		{
+			name:      "skip verify",
+			tlsConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := torrent.NewDefaultClientConfig()
+			cfg.TrackerDialContext = (&net.Dialer{}).DialContext
+			cfg.HTTPProxy = func(req *gohttp.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:1")
+			}
+			applyTrackerTLS(cfg, tt.tlsConfig, func(ctx context.Context, tracker *url.URL, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			})
+
+			u, _ := url.Parse(server.URL + "/announce")
+			_, err := tracker.Announce{
+				TrackerUrl:          u.String(),
+				HttpProxy:           cfg.HTTPProxy,
+				HttpRequestDirector: cfg.HttpRequestDirector,
+				DialContext:         cfg.TrackerDialContext,
+				HostHeader:          u.Host,
+				ServerName:          u.Hostname(),
+			}.Do()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Announce() got error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
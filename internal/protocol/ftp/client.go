@@ -0,0 +1,511 @@
+package ftp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GopeedLab/gopeed/internal/dialer"
+)
+
+const (
+	commandTimeout = 15 * time.Second
+	readTimeout    = 15 * time.Second
+)
+
+type entryType int
+
+const (
+	entryTypeFile entryType = iota
+	entryTypeDir
+	entryTypeOther
+)
+
+type entry struct {
+	name  string
+	typ   entryType
+	size  int64
+	mtime *time.Time
+}
+
+type dialOptions struct {
+	// addr is the host:port of the server
+	addr     string
+	user     string
+	password string
+	// implicitTLS wraps the connection in TLS before the greeting, explicitTLS upgrades it by AUTH TLS
+	implicitTLS bool
+	explicitTLS bool
+	tlsConfig   *tls.Config
+	active      bool
+	dialer      *dialer.Dialer
+}
+
+// client is a ftp client of a control connection, the files are transferred over the data connections one at a time.
+type client struct {
+	conn net.Conn
+	text *textproto.Conn
+	// host is the host of the server, the passive data connections are connected to it instead of the address in the reply,
+	// the address is often a private one behind NAT.
+	host   string
+	dialer *dialer.Dialer
+	// tlsConfig protects the data connections, nil if the control connection is not protected
+	tlsConfig *tls.Config
+	active    bool
+	features  map[string]string
+	// broken is true if the control connection is out of sync, e.g. a transfer was aborted, it can't be reused
+	broken bool
+}
+
+// dial connects and logs in the server, the connection is closed if the context is done before it returns.
+func dial(ctx context.Context, opts *dialOptions) (c *client, err error) {
+	conn, err := opts.dialer.DialContext(ctx, "tcp", opts.addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(opts.addr)
+	c = &client{
+		host:   host,
+		dialer: opts.dialer,
+		// The server can't connect back through the proxy
+		active:   opts.active && !opts.dialer.Proxied(),
+		features: make(map[string]string),
+	}
+	if opts.implicitTLS || opts.explicitTLS {
+		c.tlsConfig = &tls.Config{}
+		if opts.tlsConfig != nil {
+			c.tlsConfig = opts.tlsConfig.Clone()
+		}
+		if c.tlsConfig.ServerName == "" {
+			c.tlsConfig.ServerName = host
+		}
+		// The data connections resume the tls session of the control connection, some servers require it
+		c.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if opts.implicitTLS {
+		conn = tls.Client(conn, c.tlsConfig)
+	}
+	c.setConn(conn)
+	defer func() {
+		if err != nil {
+			c.conn.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+		}
+	}()
+
+	c.conn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, _, err = c.text.ReadResponse(2); err != nil {
+		return
+	}
+	if opts.explicitTLS {
+		if _, err = c.cmd(2, "AUTH TLS"); err != nil {
+			return
+		}
+		c.setConn(tls.Client(c.conn, c.tlsConfig))
+	}
+	if err = c.login(opts.user, opts.password); err != nil {
+		return
+	}
+	if c.tlsConfig != nil {
+		if _, err = c.cmd(2, "PBSZ 0"); err != nil {
+			return
+		}
+		if _, err = c.cmd(2, "PROT P"); err != nil {
+			return
+		}
+	}
+	c.feat()
+	if _, ok := c.features["UTF8"]; ok {
+		// The file names are sent as is if the server refuses
+		c.cmd(2, "OPTS UTF8 ON")
+	}
+	if _, err = c.cmd(2, "TYPE I"); err != nil {
+		return
+	}
+	return c, nil
+}
+
+func (c *client) setConn(conn net.Conn) {
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+}
+
+func (c *client) login(user string, password string) error {
+	if user == "" {
+		user, password = "anonymous", "anonymous@"
+	}
+	code, msg, err := c.rawCmd("USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+		return nil
+	case 331, 332:
+		_, err = c.cmd(2, "PASS %s", password)
+		return err
+	default:
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+}
+
+// feat reads the features of the server, the servers which don't support FEAT have no features
+func (c *client) feat() {
+	msg, err := c.cmd(211, "FEAT")
+	if err != nil {
+		return
+	}
+	lines := strings.Split(msg, "\n")
+	// The first and the last lines are the status texts
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(strings.ToUpper(line), "END") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		c.features[strings.ToUpper(name)] = value
+	}
+}
+
+// cmd sends the command and reads the reply, the reply code must match the expected code, e.g. 2 matches 2xx
+func (c *client) cmd(expectCode int, format string, args ...any) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return "", err
+	}
+	_, msg, err := c.text.ReadResponse(expectCode)
+	return msg, err
+}
+
+// rawCmd sends the command and returns the reply of any code
+func (c *client) rawCmd(format string, args ...any) (int, string, error) {
+	c.conn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.text.ReadResponse(0)
+}
+
+// stat returns the entry of the path, MLST is used if supported, otherwise SIZE, MDTM and CWD.
+func (c *client) stat(p string) (*entry, error) {
+	if _, ok := c.features["MLST"]; ok {
+		msg, err := c.cmd(250, "MLST %s", p)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(msg, "\n") {
+			// The facts line starts with a space
+			if strings.HasPrefix(line, " ") {
+				e := parseFacts(strings.TrimPrefix(line, " "))
+				e.name = path.Base(p)
+				return e, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid MLST reply: %s", msg)
+	}
+
+	e := &entry{name: path.Base(p)}
+	msg, err := c.cmd(213, "SIZE %s", p)
+	if err != nil {
+		// SIZE fails on the directories
+		if _, cwdErr := c.cmd(2, "CWD %s", p); cwdErr == nil {
+			e.typ = entryTypeDir
+			return e, nil
+		}
+		return nil, err
+	}
+	if e.size, err = strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err != nil {
+		return nil, err
+	}
+	if _, ok := c.features["MDTM"]; ok {
+		if msg, err = c.cmd(213, "MDTM %s", p); err == nil {
+			e.mtime = parseTime(strings.TrimSpace(msg))
+		}
+	}
+	return e, nil
+}
+
+// supportsRest returns whether the server can restart the transfers at an offset
+func (c *client) supportsRest() bool {
+	rest, ok := c.features["REST"]
+	return ok && strings.Contains(strings.ToUpper(rest), "STREAM")
+}
+
+// list returns the entries of the directory, MLSD is used if supported, otherwise LIST in the unix ls format.
+func (c *client) list(ctx context.Context, dir string) ([]*entry, error) {
+	command := "LIST %s"
+	_, mlsd := c.features["MLST"]
+	if mlsd {
+		command = "MLSD %s"
+	}
+	r, err := c.transfer(ctx, 0, command, dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*entry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		var e *entry
+		if mlsd {
+			facts, name, ok := strings.Cut(line, " ")
+			if !ok {
+				continue
+			}
+			e = parseFacts(facts)
+			e.name = name
+		} else {
+			if e = parseListLine(line); e == nil {
+				continue
+			}
+		}
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err = scanner.Err(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if err = r.Close(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// retr starts downloading the file from the offset, the reader must be closed before the next command.
+func (c *client) retr(ctx context.Context, p string, offset int64) (*dataReader, error) {
+	return c.transfer(ctx, offset, "RETR %s", p)
+}
+
+func (c *client) transfer(ctx context.Context, offset int64, format string, args ...any) (r *dataReader, err error) {
+	var (
+		conn     net.Conn
+		listener net.Listener
+	)
+	if c.active {
+		if listener, err = c.port(); err != nil {
+			return
+		}
+		defer listener.Close()
+	} else {
+		if conn, err = c.pasv(ctx); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				conn.Close()
+			}
+		}()
+	}
+	if offset > 0 {
+		if _, err = c.cmd(350, "REST %d", offset); err != nil {
+			return
+		}
+	}
+	if _, err = c.cmd(1, format, args...); err != nil {
+		return
+	}
+	if c.active {
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(commandTimeout))
+		if conn, err = listener.Accept(); err != nil {
+			c.broken = true
+			return
+		}
+	}
+	if c.tlsConfig != nil {
+		conn = tls.Client(conn, c.tlsConfig)
+	}
+	return &dataReader{
+		client: c,
+		conn:   conn,
+	}, nil
+}
+
+// pasv opens the passive data connection, EPSV is tried first and PASV is the fallback
+func (c *client) pasv(ctx context.Context) (net.Conn, error) {
+	var port int
+	msg, err := c.cmd(229, "EPSV")
+	if err == nil {
+		// Entering Extended Passive Mode (|||port|)
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid EPSV reply: %s", msg)
+		}
+		fields := strings.Split(msg[start+1:end], "|")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("invalid EPSV reply: %s", msg)
+		}
+		if port, err = strconv.Atoi(fields[3]); err != nil {
+			return nil, err
+		}
+	} else {
+		if msg, err = c.cmd(227, "PASV"); err != nil {
+			return nil, err
+		}
+		// Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid PASV reply: %s", msg)
+		}
+		fields := strings.Split(msg[start+1:end], ",")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid PASV reply: %s", msg)
+		}
+		p1, err1 := strconv.Atoi(fields[4])
+		p2, err2 := strconv.Atoi(fields[5])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid PASV reply: %s", msg)
+		}
+		port = p1<<8 | p2
+	}
+	return c.dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+}
+
+// port listens on the local address of the control connection for the active data connection
+func (c *client) port() (net.Listener, error) {
+	local, ok := c.conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("invalid local address: %s", c.conn.LocalAddr())
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(local.IP.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	if ip4 := local.IP.To4(); ip4 != nil {
+		_, err = c.cmd(2, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+	} else {
+		_, err = c.cmd(2, "EPRT |2|%s|%d|", local.IP.String(), port)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Close quits the session and closes the control connection
+func (c *client) Close() error {
+	if !c.broken {
+		c.conn.SetDeadline(time.Now().Add(time.Second))
+		c.text.Cmd("QUIT")
+	}
+	return c.conn.Close()
+}
+
+// dataReader reads the data connection of a transfer, the transfer result is read from the control connection on close.
+type dataReader struct {
+	client *client
+	conn   net.Conn
+	eof    bool
+}
+
+func (r *dataReader) Read(p []byte) (n int, err error) {
+	r.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	n, err = r.conn.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return
+}
+
+// Close closes the data connection, the transfer closed before the end is aborted,
+// the reply of the aborted transfer varies between the servers, so the control connection is marked broken.
+func (r *dataReader) Close() error {
+	r.conn.Close()
+	if !r.eof {
+		r.client.broken = true
+		return nil
+	}
+	r.client.conn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, _, err := r.client.text.ReadResponse(2); err != nil {
+		r.client.broken = true
+		return err
+	}
+	return nil
+}
+
+// parseFacts parses the facts of MLST and MLSD, e.g. type=file;size=1024;modify=20240101120000;
+func parseFacts(facts string) *entry {
+	e := &entry{typ: entryTypeOther}
+	for _, fact := range strings.Split(facts, ";") {
+		key, value, ok := strings.Cut(fact, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "type":
+			switch strings.ToLower(value) {
+			case "file":
+				e.typ = entryTypeFile
+			case "dir":
+				e.typ = entryTypeDir
+			}
+		case "size":
+			e.size, _ = strconv.ParseInt(value, 10, 64)
+		case "modify":
+			e.mtime = parseTime(value)
+		}
+	}
+	return e
+}
+
+// parseTime parses the time of MDTM and MLST facts, e.g. 20240101120000 or 20240101120000.123
+func parseTime(value string) *time.Time {
+	value, _, _ = strings.Cut(value, ".")
+	t, err := time.Parse("20060102150405", value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// parseListLine parses the line of LIST in the unix ls format, e.g.
+// -rw-r--r--   1 owner    group        1024 Jan  1 12:00 name
+func parseListLine(line string) *entry {
+	fields := strings.Fields(line)
+	if len(fields) < 9 {
+		return nil
+	}
+	e := &entry{typ: entryTypeOther}
+	switch fields[0][0] {
+	case '-':
+		e.typ = entryTypeFile
+	case 'd':
+		e.typ = entryTypeDir
+	}
+	e.size, _ = strconv.ParseInt(fields[4], 10, 64)
+	// The name may contain spaces, it is the rest of the line after the time field
+	// The fields may be separated by tabs
+	rest := line
+	for i := 0; i < 8; i++ {
+		rest = strings.TrimLeft(rest, " \t")
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			return nil
+		}
+		rest = rest[end:]
+	}
+	e.name = strings.TrimLeft(rest, " \t")
+	return e
+}
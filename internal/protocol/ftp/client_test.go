@@ -0,0 +1,46 @@
+package ftp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFacts(t *testing.T) {
+	e := parseFacts("Type=file;Size=1024;Modify=20240102030405.123;perm=r;")
+	if e.typ != entryTypeFile || e.size != 1024 || e.mtime == nil || !e.mtime.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("parseFacts() got = %+v", e)
+	}
+	if e := parseFacts("type=cdir;"); e.typ != entryTypeOther {
+		t.Errorf("parseFacts() got = %v, want %v", e.typ, entryTypeOther)
+	}
+	if e := parseFacts("type=dir;"); e.typ != entryTypeDir {
+		t.Errorf("parseFacts() got = %v, want %v", e.typ, entryTypeDir)
+	}
+}
+
+func TestParseListLine(t *testing.T) {
+	tests := []struct {
+		line string
+		typ  entryType
+		size int64
+		name string
+	}{
+		{"-rw-r--r--   1 owner    group        1024 Jan  1 12:00 file name.zip", entryTypeFile, 1024, "file name.zip"},
+		{"drwxr-xr-x   2 owner    group        4096 Dec 31  2023 pub", entryTypeDir, 4096, "pub"},
+		{"lrwxrwxrwx   1 owner    group           4 Jan  1 12:00 link -> pub", entryTypeOther, 4, "link -> pub"},
+		{"-rw-r--r--\t1\towner\tgroup\t1024\tJan\t1\t12:00\tfile name.zip", entryTypeFile, 1024, "file name.zip"},
+	}
+	for _, tt := range tests {
+		e := parseListLine(tt.line)
+		if e == nil || e.typ != tt.typ || e.size != tt.size || e.name != tt.name {
+			t.Errorf("parseListLine(%s) got = %+v", tt.line, e)
+		}
+	}
+	// The fields separated by the other spaces are not parsed
+	if e := parseListLine("-rw-r--r--\v1 owner group 1024 Jan 1 12:00 name"); e != nil {
+		t.Errorf("parseListLine() got = %+v, want nil", e)
+	}
+	if e := parseListLine("total 8"); e != nil {
+		t.Errorf("parseListLine() got = %+v, want nil", e)
+	}
+}
@@ -0,0 +1,13 @@
+package ftp
+
+import (
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/protocol/ftp"
+)
+
+type config struct {
+	Connections int `json:"connections"`
+	// Mode is the data connection mode, empty means passive
+	Mode  ftp.Mode          `json:"mode"`
+	Retry *base.RetryPolicy `json:"retry"`
+}
@@ -0,0 +1,401 @@
+package ftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/dialer"
+	"github.com/GopeedLab/gopeed/internal/fetcher"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/protocol/ftp"
+)
+
+var ErrEmptyDirectory = errors.New("empty directory")
+
+type Fetcher struct {
+	ctl    *controller.Controller
+	config *config
+	doneCh chan error
+
+	meta *fetcher.FetcherMeta
+	data *fetcherData
+
+	downloader *fetcher.ChunkDownloader
+}
+
+func (f *Fetcher) Setup(ctl *controller.Controller) {
+	f.ctl = ctl
+	f.doneCh = make(chan error, 1)
+	if f.meta == nil {
+		f.meta = &fetcher.FetcherMeta{}
+	}
+	if f.data == nil {
+		f.data = &fetcherData{}
+	}
+	f.ctl.GetConfig(&f.config)
+	return
+}
+
+func (f *Fetcher) Resolve(req *base.Request) error {
+	if err := base.ParseReqExtra[ftp.ReqExtra](req); err != nil {
+		return err
+	}
+	f.meta.Req = req
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	c, err := f.dial(ctx, 0)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	p := remoteRoot(u)
+	e, err := c.stat(p)
+	if err != nil {
+		return err
+	}
+	res := &base.Resource{
+		Range: c.supportsRest(),
+	}
+	if e.typ == entryTypeDir {
+		res.Name = parseName(u)
+		if res.Files, err = walk(ctx, c, p, ""); err != nil {
+			return err
+		}
+		if len(res.Files) == 0 {
+			return ErrEmptyDirectory
+		}
+	} else {
+		res.Files = []*base.FileInfo{
+			{
+				Name:  parseName(u),
+				Size:  e.size,
+				Ctime: e.mtime,
+			},
+		}
+	}
+	res.CalcSize(nil)
+	f.meta.Res = res
+	return nil
+}
+
+// walk lists the files of the directory recursively, the file paths are relative to the root directory
+func walk(ctx context.Context, c *client, root string, rel string) ([]*base.FileInfo, error) {
+	entries, err := c.list(ctx, path.Join(root, rel))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	var files []*base.FileInfo
+	for _, e := range entries {
+		// The names come from the untrusted server, they must not escape the download directory
+		if !fetcher.IsLocalName(e.name) {
+			continue
+		}
+		switch e.typ {
+		case entryTypeFile:
+			files = append(files, &base.FileInfo{
+				Name:  e.name,
+				Path:  rel,
+				Size:  e.size,
+				Ctime: e.mtime,
+			})
+		case entryTypeDir:
+			subFiles, err := walk(ctx, c, root, path.Join(rel, e.name))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, subFiles...)
+		}
+	}
+	return files, nil
+}
+
+func (f *Fetcher) Create(opts *base.Options) error {
+	f.meta.Opts = opts
+
+	if err := base.ParseOptsExtra[ftp.OptsExtra](f.meta.Opts); err != nil {
+		return err
+	}
+	if opts.Extra == nil {
+		opts.Extra = &ftp.OptsExtra{}
+	}
+	extra := opts.Extra.(*ftp.OptsExtra)
+	if extra.Connections <= 0 {
+		extra.Connections = f.config.Connections
+		if extra.Connections <= 0 {
+			extra.Connections = 1
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) Start() (err error) {
+	// Avoid request extra modified by extension
+	if err = base.ParseReqExtra[ftp.ReqExtra](f.meta.Req); err != nil {
+		return
+	}
+	connections := f.meta.Opts.Extra.(*ftp.OptsExtra).Connections
+	if f.data.Chunks == nil {
+		f.data.Chunks = fetcher.SplitChunks(f.meta, connections)
+	}
+	f.downloader = &fetcher.ChunkDownloader{
+		Ctl:    f.ctl,
+		Meta:   f.meta,
+		Source: f,
+		Retry:  fetcher.BuildRetryPolicy(f.config.Retry),
+	}
+	return f.downloader.Start(f.data.Chunks, connections, func(ctx context.Context, err error) {
+		f.doneCh <- err
+	})
+}
+
+func (f *Fetcher) Pause() (err error) {
+	if f.downloader != nil {
+		f.downloader.Pause()
+	}
+	return
+}
+
+func (f *Fetcher) Close() (err error) {
+	return f.Pause()
+}
+
+func (f *Fetcher) Meta() *fetcher.FetcherMeta {
+	return f.meta
+}
+
+func (f *Fetcher) Stats() any {
+	return &ftp.Stats{
+		Chunks:          len(f.data.Chunks),
+		CompletedChunks: fetcher.CompletedChunks(f.data.Chunks),
+	}
+}
+
+// Progress returns the downloaded bytes of each selected file
+func (f *Fetcher) Progress() fetcher.Progress {
+	return fetcher.ChunksProgress(f.meta, f.data.Chunks)
+}
+
+func (f *Fetcher) Wait() (err error) {
+	return <-f.doneCh
+}
+
+// Host returns the host of the server, the connection slots of the host are shared by the connections of all tasks
+func (f *Fetcher) Host(file int) string {
+	u, err := url.Parse(f.meta.Req.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// Open retrieves the file from the offset of the chunk, the control connection of the worker is reused by its next chunks
+func (f *Fetcher) Open(ctx context.Context, w *fetcher.Worker, c *fetcher.Chunk) (io.ReadCloser, error) {
+	// The control connection out of sync can't be reused
+	if conn, ok := w.Conn.(*client); ok && conn.broken {
+		w.CloseConn()
+	}
+	if w.Conn == nil {
+		conn, err := f.dial(ctx, w.Index)
+		if err != nil {
+			return nil, err
+		}
+		w.Conn = conn
+	}
+	conn := w.Conn.(*client)
+	// The transfer is interrupted by closing the connection when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.conn.Close()
+	})
+	r, err := conn.retr(ctx, f.remotePath(c.File), c.Begin+c.Downloaded)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	return &chunkReader{
+		dataReader: r,
+		chunk:      c,
+		last:       c.End == f.meta.Res.Files[c.File].Size-1,
+		stop:       stop,
+	}, nil
+}
+
+// chunkReader reads the transfer of the chunk, the last chunk of the file reads the end of the transfer,
+// so the control connection can be reused.
+type chunkReader struct {
+	*dataReader
+	chunk *fetcher.Chunk
+	last  bool
+	stop  func() bool
+}
+
+func (r *chunkReader) Close() error {
+	defer r.stop()
+	if !r.eof && r.last && r.chunk.Remain() == 0 {
+		r.Read(make([]byte, 1))
+	}
+	return r.dataReader.Close()
+}
+
+// dial connects the server of the request url, the nth connection is bound to the nth local address first
+func (f *Fetcher) dial(ctx context.Context, n int) (*client, error) {
+	u, err := url.Parse(f.meta.Req.URL)
+	if err != nil {
+		return nil, err
+	}
+	d, err := dialer.New(f.ctl, f.meta.Req, n)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := f.ctl.GetTLSConfig(f.meta.Req.TLS, f.meta.Req.SkipVerifyCert)
+	if err != nil {
+		return nil, err
+	}
+	extra := f.reqExtra()
+	mode := f.config.Mode
+	if extra.Mode != "" {
+		mode = extra.Mode
+	}
+	implicitTLS := strings.EqualFold(u.Scheme, "ftps")
+	port := u.Port()
+	if port == "" {
+		port = "21"
+		if implicitTLS {
+			port = "990"
+		}
+	}
+	password, _ := u.User.Password()
+	return dial(ctx, &dialOptions{
+		addr:        net.JoinHostPort(u.Hostname(), port),
+		user:        u.User.Username(),
+		password:    password,
+		implicitTLS: implicitTLS,
+		explicitTLS: !implicitTLS && extra.ExplicitTLS,
+		tlsConfig:   tlsConfig,
+		active:      mode == ftp.ModeActive,
+		dialer:      d,
+	})
+}
+
+// remotePath returns the path of the file on the server
+func (f *Fetcher) remotePath(index int) string {
+	u, _ := url.Parse(f.meta.Req.URL)
+	root := remoteRoot(u)
+	if f.meta.Res.Name == "" {
+		return root
+	}
+	file := f.meta.Res.Files[index]
+	return path.Join(root, file.Path, file.Name)
+}
+
+func (f *Fetcher) reqExtra() *ftp.ReqExtra {
+	if f.meta.Req.Extra == nil {
+		return &ftp.ReqExtra{}
+	}
+	return f.meta.Req.Extra.(*ftp.ReqExtra)
+}
+
+// remoteRoot returns the path of the url on the server
+func remoteRoot(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// parseName returns the file or directory name of the url, the host name is used for the root directory
+func parseName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "" || name == "/" || name == "." {
+		return u.Hostname()
+	}
+	return name
+}
+
+type fetcherData struct {
+	Chunks []*fetcher.Chunk
+}
+
+// clone returns the copy of the data to store, the chunks are written by the workers while storing
+func (d *fetcherData) clone() *fetcherData {
+	return &fetcherData{
+		Chunks: fetcher.CloneChunks(d.Chunks),
+	}
+}
+
+type FetcherManager struct {
+}
+
+func (fm *FetcherManager) Name() string {
+	return "ftp"
+}
+
+func (fm *FetcherManager) Filters() []*fetcher.SchemeFilter {
+	return []*fetcher.SchemeFilter{
+		{
+			Type:    fetcher.FilterTypeUrl,
+			Pattern: "FTP",
+		},
+		{
+			Type:    fetcher.FilterTypeUrl,
+			Pattern: "FTPS",
+		},
+	}
+}
+
+func (fm *FetcherManager) Build() fetcher.Fetcher {
+	return &Fetcher{}
+}
+
+func (fm *FetcherManager) ParseName(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return parseName(pu)
+}
+
+func (fm *FetcherManager) AutoRename() bool {
+	return true
+}
+
+func (fm *FetcherManager) DefaultConfig() any {
+	return &config{
+		Connections: 4,
+		Mode:        ftp.ModePassive,
+	}
+}
+
+func (fm *FetcherManager) Store(f fetcher.Fetcher) (data any, err error) {
+	_f := f.(*Fetcher)
+	return _f.data.clone(), nil
+}
+
+func (fm *FetcherManager) Restore() (v any, f func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher) {
+	return &fetcherData{}, func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher {
+		fetcher := &Fetcher{
+			meta: meta,
+			data: v.(*fetcherData),
+		}
+		base.ParseReqExtra[ftp.ReqExtra](fetcher.meta.Req)
+		base.ParseOptsExtra[ftp.OptsExtra](fetcher.meta.Opts)
+		return fetcher
+	}
+}
+
+func (fm *FetcherManager) Close() error {
+	return nil
+}
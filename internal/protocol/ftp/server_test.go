@@ -0,0 +1,336 @@
+package ftp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/GopeedLab/gopeed/internal/test"
+)
+
+type testServerOptions struct {
+	// root is the directory served by the server
+	root string
+	// implicitTLS wraps the control connections in TLS, requireTLS refuses to log in before AUTH TLS
+	implicitTLS bool
+	requireTLS  bool
+	disableMlst bool
+	disableRest bool
+	// disableEpsv makes the client fall back to PASV, disablePassive makes the client use the active mode
+	disableEpsv    bool
+	disablePassive bool
+	// unsafeNames are listed as the files of each directory, they don't exist
+	unsafeNames []string
+}
+
+// startTestFtpServer starts a minimal ftp server for the fetcher tests, it serves the files of the root directory read-only.
+func startTestFtpServer(opts *testServerOptions) net.Listener {
+	certPem, keyPem := test.GenerateCert()
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		panic(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if opts.implicitTLS {
+				conn = tls.Server(conn, tlsConfig)
+			}
+			s := &testSession{
+				opts:      opts,
+				tlsConfig: tlsConfig,
+			}
+			s.setConn(conn)
+			go s.serve()
+		}
+	}()
+	return listener
+}
+
+type testSession struct {
+	opts      *testServerOptions
+	tlsConfig *tls.Config
+	conn      net.Conn
+	r         *bufio.Reader
+
+	secure    bool
+	protected bool
+	loggedIn  bool
+	rest      int64
+	// pasvListener accepts the passive data connection, activeAddr is the address of the active data connection
+	pasvListener net.Listener
+	activeAddr   string
+}
+
+func (s *testSession) setConn(conn net.Conn) {
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+}
+
+func (s *testSession) reply(code int, format string, args ...any) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+}
+
+func (s *testSession) serve() {
+	defer s.conn.Close()
+	s.secure = s.opts.implicitTLS
+	s.reply(220, "gopeed test server")
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		command = strings.ToUpper(command)
+		if !s.loggedIn && command != "USER" && command != "PASS" && command != "AUTH" && command != "FEAT" && command != "QUIT" {
+			s.reply(530, "not logged in")
+			continue
+		}
+		switch command {
+		case "AUTH":
+			s.reply(234, "AUTH TLS ok")
+			s.setConn(tls.Server(s.conn, s.tlsConfig))
+			s.secure = true
+		case "USER":
+			if s.opts.requireTLS && !s.secure {
+				s.reply(530, "TLS required")
+				continue
+			}
+			s.reply(331, "password required")
+		case "PASS":
+			s.loggedIn = true
+			s.reply(230, "logged in")
+		case "PBSZ":
+			s.reply(200, "PBSZ=0")
+		case "PROT":
+			s.protected = strings.EqualFold(arg, "P")
+			s.reply(200, "PROT ok")
+		case "FEAT":
+			var features strings.Builder
+			features.WriteString("211-Features:\r\n SIZE\r\n MDTM\r\n UTF8\r\n EPSV\r\n")
+			if !s.opts.disableMlst {
+				features.WriteString(" MLST type*;size*;modify*;\r\n")
+			}
+			if !s.opts.disableRest {
+				features.WriteString(" REST STREAM\r\n")
+			}
+			features.WriteString("211 End\r\n")
+			s.conn.Write([]byte(features.String()))
+		case "OPTS", "TYPE", "NOOP":
+			s.reply(200, "ok")
+		case "QUIT":
+			s.reply(221, "bye")
+			return
+		case "CWD":
+			if info, err := os.Stat(s.localPath(arg)); err != nil || !info.IsDir() {
+				s.reply(550, "not a directory")
+				continue
+			}
+			s.reply(250, "ok")
+		case "SIZE":
+			info, err := os.Stat(s.localPath(arg))
+			if err != nil || info.IsDir() {
+				s.reply(550, "not a file")
+				continue
+			}
+			s.reply(213, "%d", info.Size())
+		case "MDTM":
+			info, err := os.Stat(s.localPath(arg))
+			if err != nil {
+				s.reply(550, "not found")
+				continue
+			}
+			s.reply(213, "%s", info.ModTime().UTC().Format("20060102150405"))
+		case "MLST":
+			if s.opts.disableMlst {
+				s.reply(502, "not implemented")
+				continue
+			}
+			info, err := os.Stat(s.localPath(arg))
+			if err != nil {
+				s.reply(550, "not found")
+				continue
+			}
+			fmt.Fprintf(s.conn, "250-Listing %s\r\n %s %s\r\n250 End\r\n", arg, facts(info), arg)
+		case "EPSV":
+			if s.opts.disablePassive || s.opts.disableEpsv {
+				s.reply(502, "not implemented")
+				continue
+			}
+			if !s.listenPassive() {
+				continue
+			}
+			s.reply(229, "Entering Extended Passive Mode (|||%d|)", s.pasvListener.Addr().(*net.TCPAddr).Port)
+		case "PASV":
+			if s.opts.disablePassive {
+				s.reply(502, "not implemented")
+				continue
+			}
+			if !s.listenPassive() {
+				continue
+			}
+			port := s.pasvListener.Addr().(*net.TCPAddr).Port
+			s.reply(227, "Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff)
+		case "PORT":
+			fields := strings.Split(arg, ",")
+			if len(fields) != 6 {
+				s.reply(501, "invalid address")
+				continue
+			}
+			p1, _ := strconv.Atoi(fields[4])
+			p2, _ := strconv.Atoi(fields[5])
+			s.activeAddr = net.JoinHostPort(strings.Join(fields[:4], "."), strconv.Itoa(p1<<8|p2))
+			s.reply(200, "PORT ok")
+		case "EPRT":
+			fields := strings.Split(arg, "|")
+			if len(fields) != 5 {
+				s.reply(501, "invalid address")
+				continue
+			}
+			s.activeAddr = net.JoinHostPort(fields[2], fields[3])
+			s.reply(200, "EPRT ok")
+		case "REST":
+			s.rest, _ = strconv.ParseInt(arg, 10, 64)
+			s.reply(350, "restarting at %d", s.rest)
+		case "RETR":
+			s.retr(arg)
+		case "LIST", "MLSD":
+			s.list(command, arg)
+		default:
+			s.reply(502, "not implemented")
+		}
+	}
+}
+
+// localPath maps the path on the server to the path in the root directory
+func (s *testSession) localPath(p string) string {
+	return filepath.Join(s.opts.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+func (s *testSession) listenPassive() bool {
+	if s.pasvListener != nil {
+		s.pasvListener.Close()
+	}
+	var err error
+	if s.pasvListener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		s.reply(425, "can't open data connection")
+		return false
+	}
+	return true
+}
+
+// openData opens the data connection prepared by the last EPSV, PASV, PORT or EPRT
+func (s *testSession) openData() (conn net.Conn, err error) {
+	if s.pasvListener != nil {
+		conn, err = s.pasvListener.Accept()
+		s.pasvListener.Close()
+		s.pasvListener = nil
+	} else if s.activeAddr != "" {
+		conn, err = net.Dial("tcp", s.activeAddr)
+		s.activeAddr = ""
+	} else {
+		err = fmt.Errorf("no data connection")
+	}
+	if err != nil {
+		return
+	}
+	if s.protected {
+		tlsConn := tls.Server(conn, s.tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+	return
+}
+
+func (s *testSession) retr(p string) {
+	offset := s.rest
+	s.rest = 0
+	file, err := os.Open(s.localPath(p))
+	if err != nil {
+		s.reply(550, "not found")
+		return
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		s.reply(550, "invalid offset")
+		return
+	}
+	s.reply(150, "opening data connection")
+	conn, err := s.openData()
+	if err != nil {
+		s.reply(425, "can't open data connection")
+		return
+	}
+	_, err = io.Copy(conn, file)
+	conn.Close()
+	if err != nil {
+		s.reply(426, "transfer aborted")
+		return
+	}
+	s.reply(226, "transfer complete")
+}
+
+func (s *testSession) list(command string, p string) {
+	entries, err := os.ReadDir(s.localPath(p))
+	if err != nil {
+		s.reply(550, "not a directory")
+		return
+	}
+	s.reply(150, "opening data connection")
+	conn, err := s.openData()
+	if err != nil {
+		s.reply(425, "can't open data connection")
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if command == "MLSD" {
+			fmt.Fprintf(conn, "%s %s\r\n", facts(info), e.Name())
+			continue
+		}
+		mode := "-rw-r--r--"
+		if info.IsDir() {
+			mode = "drwxr-xr-x"
+		}
+		fmt.Fprintf(conn, "%s 1 owner group %d %s %s\r\n", mode, info.Size(), info.ModTime().Format("Jan _2 15:04"), e.Name())
+	}
+	for _, name := range s.opts.unsafeNames {
+		if command == "MLSD" {
+			fmt.Fprintf(conn, "type=file;size=1; %s\r\n", name)
+			continue
+		}
+		fmt.Fprintf(conn, "-rw-r--r-- 1 owner group 1 Jan  1 12:00 %s\r\n", name)
+	}
+	conn.Close()
+	s.reply(226, "transfer complete")
+}
+
+func facts(info os.FileInfo) string {
+	typ := "file"
+	if info.IsDir() {
+		typ = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s;", typ, info.Size(), info.ModTime().UTC().Format("20060102150405"))
+}
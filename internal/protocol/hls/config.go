@@ -0,0 +1,9 @@
+package hls
+
+import "github.com/GopeedLab/gopeed/pkg/base"
+
+type config struct {
+	UserAgent   string            `json:"userAgent"`
+	Connections int               `json:"connections"`
+	Retry       *base.RetryPolicy `json:"retry"`
+}
@@ -0,0 +1,567 @@
+package hls
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/fetcher"
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/protocol/hls"
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	readTimeout = 15 * time.Second
+	// segmentsDirSuffix is the suffix of the directory that stores the downloaded segments before concatenation
+	segmentsDirSuffix = ".segments"
+)
+
+type Fetcher struct {
+	ctl    *controller.Controller
+	config *config
+	doneCh chan error
+
+	meta *fetcher.FetcherMeta
+	data *fetcherData
+	// segmentsLock guards the progress of the segments, which is updated by the workers concurrently
+	segmentsLock sync.RWMutex
+	retry        *base.RetryPolicy
+
+	keys     map[string][]byte
+	keysLock sync.Mutex
+	// keyGroup dedupes the concurrent requests of the same key
+	keyGroup singleflight.Group
+
+	cancel context.CancelFunc
+	eg     *errgroup.Group
+}
+
+func (f *Fetcher) Setup(ctl *controller.Controller) {
+	f.ctl = ctl
+	f.doneCh = make(chan error, 1)
+	if f.meta == nil {
+		f.meta = &fetcher.FetcherMeta{}
+	}
+	if f.data == nil {
+		f.data = &fetcherData{}
+	}
+	f.keys = make(map[string][]byte)
+	f.ctl.GetConfig(&f.config)
+	return
+}
+
+func (f *Fetcher) Resolve(req *base.Request) error {
+	if err := base.ParseReqExtra[hls.ReqExtra](req); err != nil {
+		return err
+	}
+	f.meta.Req = req
+	p, err := f.loadPlaylist()
+	if err != nil {
+		return err
+	}
+	ext := defaultVariantExt
+	if p.Fmp4 {
+		ext = fmp4VariantExt
+	}
+	f.meta.Res = &base.Resource{
+		Range: false,
+		Files: []*base.FileInfo{
+			{
+				Name: parseName(req.URL, ext),
+			},
+		},
+	}
+	return nil
+}
+
+func (f *Fetcher) Create(opts *base.Options) error {
+	f.meta.Opts = opts
+
+	if err := base.ParseOptsExtra[hls.OptsExtra](f.meta.Opts); err != nil {
+		return err
+	}
+	if opts.Extra == nil {
+		opts.Extra = &hls.OptsExtra{}
+	}
+	extra := opts.Extra.(*hls.OptsExtra)
+	if extra.Connections <= 0 {
+		extra.Connections = f.config.Connections
+		if extra.Connections <= 0 {
+			extra.Connections = 1
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) Start() (err error) {
+	// Avoid request extra modified by extension
+	if err = base.ParseReqExtra[hls.ReqExtra](f.meta.Req); err != nil {
+		return
+	}
+	// The resource may be resolved by extension, load the segments from the playlist
+	if f.data.Segments == nil {
+		if _, err = f.loadPlaylist(); err != nil {
+			return
+		}
+	}
+	if err = os.MkdirAll(f.segmentsDir(), os.ModePerm); err != nil {
+		return
+	}
+	return f.fetch()
+}
+
+func (f *Fetcher) Pause() (err error) {
+	if f.cancel != nil {
+		f.cancel()
+		// wait for pause handle complete
+		f.eg.Wait()
+	}
+	return
+}
+
+func (f *Fetcher) Close() (err error) {
+	if err = f.Pause(); err != nil {
+		return
+	}
+	if f.meta.Res != nil && f.meta.Opts != nil {
+		return os.RemoveAll(f.segmentsDir())
+	}
+	return
+}
+
+func (f *Fetcher) Meta() *fetcher.FetcherMeta {
+	return f.meta
+}
+
+func (f *Fetcher) Stats() any {
+	f.segmentsLock.RLock()
+	defer f.segmentsLock.RUnlock()
+
+	completed := 0
+	for _, s := range f.data.Segments {
+		if s.Completed {
+			completed++
+		}
+	}
+	return &hls.Stats{
+		Segments:          len(f.data.Segments),
+		CompletedSegments: completed,
+	}
+}
+
+func (f *Fetcher) Progress() fetcher.Progress {
+	f.segmentsLock.RLock()
+	defer f.segmentsLock.RUnlock()
+
+	p := make(fetcher.Progress, 0)
+	if len(f.data.Segments) > 0 {
+		total := int64(0)
+		for _, s := range f.data.Segments {
+			total += s.Downloaded
+		}
+		p = append(p, total)
+	}
+	return p
+}
+
+func (f *Fetcher) Wait() (err error) {
+	return <-f.doneCh
+}
+
+// loadPlaylist downloads and parses the playlist, if it is a master playlist, the variant stream will be selected and loaded.
+func (f *Fetcher) loadPlaylist() (*playlist, error) {
+	extra := f.reqExtra()
+	client, err := ihttp.NewClient(f.ctl, f.meta.Req)
+	if err != nil {
+		return nil, err
+	}
+	p, err := f.fetchPlaylist(client, f.meta.Req.URL, &extra.ReqExtra)
+	if err != nil {
+		return nil, err
+	}
+	if p.isMaster() {
+		v := p.selectVariant(extra.Bandwidth)
+		p, err = f.fetchPlaylist(client, v.URL, &fhttp.ReqExtra{Header: extra.Header})
+		if err != nil {
+			return nil, err
+		}
+		if p.isMaster() {
+			return nil, ErrInvalidPlaylist
+		}
+	}
+	f.data.Segments = p.Segments
+	return p, nil
+}
+
+func (f *Fetcher) fetchPlaylist(client *http.Client, playlistUrl string, extra *fhttp.ReqExtra) (*playlist, error) {
+	httpReq, err := ihttp.NewRequest(nil, playlistUrl, extra, f.config.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != base.HttpCodeOK {
+		return nil, ihttp.NewRequestError(resp.StatusCode, resp.Status)
+	}
+	// Relative URIs are resolved against the final URL after redirects
+	return parsePlaylist(resp.Body, resp.Request.URL)
+}
+
+func (f *Fetcher) fetch() error {
+	client, err := ihttp.NewClient(f.ctl, f.meta.Req)
+	if err != nil {
+		return err
+	}
+	f.retry = fetcher.BuildRetryPolicy(f.config.Retry)
+	var ctx context.Context
+	ctx, f.cancel = context.WithCancel(context.Background())
+	f.eg, _ = errgroup.WithContext(ctx)
+
+	indexCh := make(chan int, len(f.data.Segments))
+	for i, s := range f.data.Segments {
+		if !s.Completed {
+			indexCh <- i
+		}
+	}
+	close(indexCh)
+
+	var (
+		errLock    sync.Mutex
+		segmentErr error
+	)
+	connections := f.meta.Opts.Extra.(*hls.OptsExtra).Connections
+	for i := 0; i < connections; i++ {
+		f.eg.Go(func() error {
+			for index := range indexCh {
+				if err := f.downloadSegment(ctx, client, index); err != nil {
+					// if canceled, fail fast
+					if errors.Is(err, context.Canceled) {
+						return err
+					}
+					errLock.Lock()
+					if segmentErr == nil {
+						segmentErr = err
+					}
+					errLock.Unlock()
+					return nil
+				}
+			}
+			return nil
+		})
+	}
+
+	go func() {
+		err := f.eg.Wait()
+		// error returned only if canceled, just return
+		if err != nil {
+			return
+		}
+		if segmentErr != nil {
+			f.doneCh <- segmentErr
+			return
+		}
+		f.doneCh <- f.concat()
+	}()
+	return nil
+}
+
+func (f *Fetcher) downloadSegment(ctx context.Context, client *http.Client, index int) error {
+	s := f.data.Segments[index]
+	return fetcher.Retry(ctx, f.retry, f.retryable, func() error {
+		return f.doDownloadSegment(ctx, client, index, s)
+	})
+}
+
+// retryable returns whether the failed request can be retried, the status codes are filtered by the retry policy
+func (f *Fetcher) retryable(err error) bool {
+	var re *ihttp.RequestError
+	if errors.As(err, &re) {
+		return f.retry.Retryable(re.Code)
+	}
+	return true
+}
+
+// updateSegment updates the progress of the segment, which is read by Progress and Store concurrently
+func (f *Fetcher) updateSegment(update func()) {
+	f.segmentsLock.Lock()
+	defer f.segmentsLock.Unlock()
+
+	update()
+}
+
+func (f *Fetcher) doDownloadSegment(ctx context.Context, client *http.Client, index int, s *segment) error {
+	f.updateSegment(func() {
+		s.Downloaded = 0
+	})
+	httpReq, err := ihttp.NewRequest(ctx, s.URL, &fhttp.ReqExtra{Header: f.reqExtra().Header}, f.config.UserAgent)
+	if err != nil {
+		return err
+	}
+	if s.Length > 0 {
+		httpReq.Header.Set(base.HttpHeaderRange, fmt.Sprintf(base.HttpHeaderRangeFormat, s.Offset, s.Offset+s.Length-1))
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != base.HttpCodeOK && resp.StatusCode != base.HttpCodePartialContent {
+		return ihttp.NewResponseError(resp)
+	}
+
+	var reader io.Reader = &progressReader{
+		r: ihttp.NewTimeoutReader(resp.Body, readTimeout),
+		add: func(n int) {
+			f.updateSegment(func() {
+				s.Downloaded += int64(n)
+			})
+		},
+	}
+	if s.Key != nil {
+		if reader, err = f.decrypter(ctx, client, s, reader); err != nil {
+			return err
+		}
+	}
+	// The segment is decrypted while it is written, the partial file of a failed request is truncated by the retry
+	file, err := os.Create(f.segmentPath(index))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	f.updateSegment(func() {
+		s.Completed = true
+	})
+	return nil
+}
+
+// decrypter returns the reader which decrypts the AES-128 encrypted segment
+func (f *Fetcher) decrypter(ctx context.Context, client *http.Client, s *segment, r io.Reader) (io.Reader, error) {
+	key, err := f.getKey(ctx, client, s.Key.URL)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if s.Key.IV != "" {
+		ivBytes, err := hex.DecodeString(s.Key.IV)
+		if err != nil {
+			return nil, err
+		}
+		// Left pad the IV to 16 bytes
+		copy(iv[aes.BlockSize-len(ivBytes):], ivBytes)
+	} else {
+		binary.BigEndian.PutUint64(iv[8:], uint64(s.Sequence))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return newCbcReader(r, cipher.NewCBCDecrypter(block, iv)), nil
+}
+
+func (f *Fetcher) getKey(ctx context.Context, client *http.Client, keyUrl string) ([]byte, error) {
+	f.keysLock.Lock()
+	key, ok := f.keys[keyUrl]
+	f.keysLock.Unlock()
+	if ok {
+		return key, nil
+	}
+	// The lock is not held during the request, the segments of other keys are not blocked
+	v, err, _ := f.keyGroup.Do(keyUrl, func() (any, error) {
+		key, err := f.fetchKey(ctx, client, keyUrl)
+		if err != nil {
+			return nil, err
+		}
+		f.keysLock.Lock()
+		f.keys[keyUrl] = key
+		f.keysLock.Unlock()
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func (f *Fetcher) fetchKey(ctx context.Context, client *http.Client, keyUrl string) ([]byte, error) {
+	httpReq, err := ihttp.NewRequest(ctx, keyUrl, &fhttp.ReqExtra{Header: f.reqExtra().Header}, f.config.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != base.HttpCodeOK {
+		return nil, ihttp.NewRequestError(resp.StatusCode, resp.Status)
+	}
+	key, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 16 {
+		return nil, fmt.Errorf("invalid AES-128 key length: %d", len(key))
+	}
+	return key, nil
+}
+
+// concat concatenates all the segments into the temporary file in order, renames it to the output file when done,
+// and then removes the segments directory.
+func (f *Fetcher) concat() error {
+	name := f.meta.PartFilepath()
+	file, err := f.ctl.Touch(name, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var size int64
+	for i := range f.data.Segments {
+		n, err := func() (int64, error) {
+			sf, err := os.Open(f.segmentPath(i))
+			if err != nil {
+				return 0, err
+			}
+			defer sf.Close()
+			return io.Copy(file, sf)
+		}()
+		if err != nil {
+			return err
+		}
+		size += n
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(name, f.meta.SingleFilepath()); err != nil {
+		return err
+	}
+	f.meta.Res.Size = size
+	f.meta.Res.Files[0].Size = size
+	return os.RemoveAll(f.segmentsDir())
+}
+
+func (f *Fetcher) reqExtra() *hls.ReqExtra {
+	if f.meta.Req.Extra == nil {
+		return &hls.ReqExtra{}
+	}
+	return f.meta.Req.Extra.(*hls.ReqExtra)
+}
+
+func (f *Fetcher) segmentsDir() string {
+	return f.meta.SingleFilepath() + segmentsDirSuffix
+}
+
+func (f *Fetcher) segmentPath(index int) string {
+	return filepath.Join(f.segmentsDir(), fmt.Sprintf("%06d", index))
+}
+
+// parseName returns the output file name from the playlist URL, the extension is replaced with ext.
+func parseName(u string, ext string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(pu.Path)
+	if name == "" || name == "/" || name == "." {
+		return pu.Hostname() + ext
+	}
+	name, _ = url.PathUnescape(name)
+	return strings.TrimSuffix(name, path.Ext(name)) + ext
+}
+
+type fetcherData struct {
+	Segments []*segment
+}
+
+type FetcherManager struct {
+}
+
+func (fm *FetcherManager) Name() string {
+	return "hls"
+}
+
+func (fm *FetcherManager) Filters() []*fetcher.SchemeFilter {
+	return []*fetcher.SchemeFilter{
+		{
+			Type:    fetcher.FilterTypeFile,
+			Pattern: "M3U8",
+		},
+	}
+}
+
+func (fm *FetcherManager) Build() fetcher.Fetcher {
+	return &Fetcher{}
+}
+
+func (fm *FetcherManager) ParseName(u string) string {
+	return parseName(u, defaultVariantExt)
+}
+
+func (fm *FetcherManager) AutoRename() bool {
+	return true
+}
+
+func (fm *FetcherManager) DefaultConfig() any {
+	return &config{
+		UserAgent:   ihttp.DefaultUserAgent,
+		Connections: 8,
+	}
+}
+
+func (fm *FetcherManager) Store(f fetcher.Fetcher) (data any, err error) {
+	_f := f.(*Fetcher)
+	_f.segmentsLock.RLock()
+	defer _f.segmentsLock.RUnlock()
+
+	// Snapshot the segments, the progress is updated by the workers concurrently
+	segments := make([]*segment, len(_f.data.Segments))
+	for i, s := range _f.data.Segments {
+		sc := *s
+		segments[i] = &sc
+	}
+	return &fetcherData{Segments: segments}, nil
+}
+
+func (fm *FetcherManager) Restore() (v any, f func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher) {
+	return &fetcherData{}, func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher {
+		fetcher := &Fetcher{
+			meta: meta,
+			data: v.(*fetcherData),
+		}
+		base.ParseReqExtra[hls.ReqExtra](fetcher.meta.Req)
+		base.ParseOptsExtra[hls.OptsExtra](fetcher.meta.Opts)
+		return fetcher
+	}
+}
+
+func (fm *FetcherManager) Close() error {
+	return nil
+}
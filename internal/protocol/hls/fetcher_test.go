@@ -0,0 +1,310 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/test"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/protocol/hls"
+)
+
+const (
+	testSegmentCount = 10
+	testSegmentSize  = 64*1024 + 7
+)
+
+type testStream struct {
+	key      []byte
+	segments [][]byte
+	// failures is the number of the next segment requests which respond 503
+	failures atomic.Int32
+}
+
+func (ts *testStream) content() []byte {
+	return bytes.Join(ts.segments, nil)
+}
+
+// startTestHlsServer serves a master playlist and an AES-128 encrypted media playlist,
+// the first half segments use the media sequence as IV and the others use the explicit IV.
+func startTestHlsServer(t *testing.T) (net.Listener, *testStream) {
+	ts := &testStream{
+		key: make([]byte, 16),
+	}
+	rand.Read(ts.key)
+	for i := 0; i < testSegmentCount; i++ {
+		seg := make([]byte, testSegmentSize)
+		rand.Read(seg)
+		ts.segments = append(ts.segments, seg)
+	}
+	explicitIV := make([]byte, aes.BlockSize)
+	rand.Read(explicitIV)
+
+	var media strings.Builder
+	media.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:100\n")
+	media.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"/key.bin\"\n")
+	for i := 0; i < testSegmentCount; i++ {
+		if i == testSegmentCount/2 {
+			media.WriteString(fmt.Sprintf("#EXT-X-KEY:METHOD=AES-128,URI=\"/key.bin\",IV=0x%x\n", explicitIV))
+		}
+		media.WriteString(fmt.Sprintf("#EXTINF:10.0,\nseg%d.ts\n", i))
+	}
+	media.WriteString("#EXT-X-ENDLIST\n")
+
+	encrypt := func(i int) []byte {
+		iv := make([]byte, aes.BlockSize)
+		if i >= testSegmentCount/2 {
+			copy(iv, explicitIV)
+		} else {
+			binary.BigEndian.PutUint64(iv[8:], uint64(100+i))
+		}
+		padding := aes.BlockSize - len(ts.segments[i])%aes.BlockSize
+		data := append(append([]byte{}, ts.segments[i]...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+		block, _ := aes.NewCipher(ts.key)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+		return data
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100000\nlow/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=900000\nhigh/index.m3u8\n"))
+	})
+	mux.HandleFunc("/high/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(media.String()))
+	})
+	mux.HandleFunc("/key.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(ts.key)
+	})
+	for i := 0; i < testSegmentCount; i++ {
+		i := i
+		mux.HandleFunc(fmt.Sprintf("/high/seg%d.ts", i), func(w http.ResponseWriter, r *http.Request) {
+			if ts.failures.Add(-1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(encrypt(i))
+		})
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, mux)
+	return listener, ts
+}
+
+func TestFetcher_Resolve(t *testing.T) {
+	listener, _ := startTestHlsServer(t)
+	defer listener.Close()
+
+	fetcher := buildFetcher()
+	err := fetcher.Resolve(&base.Request{
+		URL: "http://" + listener.Addr().String() + "/master.m3u8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetcher.Meta().Res.Files[0].Name != "master.ts" {
+		t.Errorf("Resolve() got = %v, want %v", fetcher.Meta().Res.Files[0].Name, "master.ts")
+	}
+	if len(fetcher.data.Segments) != testSegmentCount {
+		t.Errorf("Resolve() got = %v, want %v", len(fetcher.data.Segments), testSegmentCount)
+	}
+}
+
+func TestFetcher_Download(t *testing.T) {
+	listener, ts := startTestHlsServer(t)
+	defer listener.Close()
+
+	downloadAndCheck(listener, ts, 1, t)
+	downloadAndCheck(listener, ts, 4, t)
+}
+
+func TestFetcher_DownloadRetry(t *testing.T) {
+	listener, ts := startTestHlsServer(t)
+	defer listener.Close()
+
+	tests := []struct {
+		name    string
+		retry   *base.RetryPolicy
+		wantErr bool
+	}{
+		{"retryable", &base.RetryPolicy{MaxAttempts: 3, BaseBackoff: 10}, false},
+		{"not retryable code", &base.RetryPolicy{MaxAttempts: 3, BaseBackoff: 10, RetryableCodes: []int{http.StatusTooManyRequests}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := buildConfigFetcher(&config{
+				Connections: 4,
+				Retry:       tt.retry,
+			})
+			if err := fetcher.Resolve(&base.Request{
+				URL: "http://" + listener.Addr().String() + "/master.m3u8",
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := fetcher.Create(&base.Options{
+				Name: test.DownloadName,
+				Path: test.Dir,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			defer fetcher.Close()
+			defer os.Remove(test.DownloadFile)
+
+			ts.failures.Store(2)
+			if err := fetcher.Start(); err != nil {
+				t.Fatal(err)
+			}
+			// The progress is read while the segments are downloading
+			done := make(chan error, 1)
+			go func() {
+				done <- fetcher.Wait()
+			}()
+			var err error
+		loop:
+			for {
+				select {
+				case err = <-done:
+					break loop
+				default:
+					fetcher.Progress()
+					fetcher.Stats()
+					new(FetcherManager).Store(fetcher)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Download() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				assertContent(ts, t)
+			}
+		})
+	}
+}
+
+func TestFetcher_DownloadResume(t *testing.T) {
+	listener, ts := startTestHlsServer(t)
+	defer listener.Close()
+
+	fetcher := downloadReady(listener, 2, t)
+	defer os.Remove(test.DownloadFile)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := new(FetcherManager)
+	data, err := fm.Store(fetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := json.Marshal(data)
+	v, f := fm.Restore()
+	json.Unmarshal(buf, v)
+	restored := f(fetcher.Meta(), v)
+	restored.Setup(buildController(fm))
+	if err := restored.Create(fetcher.Meta().Opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(ts, t)
+}
+
+func downloadAndCheck(listener net.Listener, ts *testStream, connections int, t *testing.T) {
+	fetcher := downloadReady(listener, connections, t)
+	defer os.Remove(test.DownloadFile)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(ts, t)
+	if _, err := os.Stat(fetcher.segmentsDir()); !os.IsNotExist(err) {
+		t.Errorf("Download() segments dir should be removed, got = %v", err)
+	}
+	if _, err := os.Stat(fetcher.meta.PartFilepath()); !os.IsNotExist(err) {
+		t.Errorf("Download() part file should be renamed, got = %v", err)
+	}
+	stats := fetcher.Stats().(*hls.Stats)
+	if stats.CompletedSegments != testSegmentCount {
+		t.Errorf("Stats() got = %v, want %v", stats.CompletedSegments, testSegmentCount)
+	}
+}
+
+func assertContent(ts *testStream, t *testing.T) {
+	got, err := os.ReadFile(test.DownloadFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, ts.content()) {
+		t.Errorf("Download() got = %v bytes, want %v bytes", len(got), len(ts.content()))
+	}
+}
+
+func downloadReady(listener net.Listener, connections int, t *testing.T) *Fetcher {
+	fetcher := buildFetcher()
+	err := fetcher.Resolve(&base.Request{
+		URL: "http://" + listener.Addr().String() + "/master.m3u8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fetcher.Create(&base.Options{
+		Name: test.DownloadName,
+		Path: test.Dir,
+		Extra: hls.OptsExtra{
+			Connections: connections,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetcher
+}
+
+func buildController(fm *FetcherManager) *controller.Controller {
+	ctl := controller.NewController()
+	ctl.GetConfig = func(v any) {
+		json.Unmarshal([]byte(test.ToJson(fm.DefaultConfig())), v)
+	}
+	return ctl
+}
+
+func buildConfigFetcher(cfg *config) *Fetcher {
+	fetcher := new(FetcherManager).Build()
+	ctl := controller.NewController()
+	ctl.GetConfig = func(v any) {
+		json.Unmarshal([]byte(test.ToJson(cfg)), v)
+	}
+	fetcher.Setup(ctl)
+	return fetcher.(*Fetcher)
+}
+
+func buildFetcher() *Fetcher {
+	fm := new(FetcherManager)
+	fetcher := fm.Build()
+	fetcher.Setup(buildController(fm))
+	return fetcher.(*Fetcher)
+}
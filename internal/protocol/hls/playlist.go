@@ -0,0 +1,300 @@
+package hls
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	tagHeader         = "#EXTM3U"
+	tagStreamInf      = "#EXT-X-STREAM-INF:"
+	tagInf            = "#EXTINF:"
+	tagKey            = "#EXT-X-KEY:"
+	tagMap            = "#EXT-X-MAP:"
+	tagByteRange      = "#EXT-X-BYTERANGE:"
+	tagMediaSequence  = "#EXT-X-MEDIA-SEQUENCE:"
+	tagEndList        = "#EXT-X-ENDLIST"
+	keyMethodNone     = "NONE"
+	keyMethodAES128   = "AES-128"
+	attrBandwidth     = "BANDWIDTH"
+	attrResolution    = "RESOLUTION"
+	attrMethod        = "METHOD"
+	attrURI           = "URI"
+	attrIV            = "IV"
+	attrByteRange     = "BYTERANGE"
+	defaultVariantExt = ".ts"
+	fmp4VariantExt    = ".mp4"
+)
+
+var ErrInvalidPlaylist = errors.New("invalid m3u8 playlist")
+
+type variant struct {
+	Bandwidth  int
+	Resolution string
+	URL        string
+}
+
+type segmentKey struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// IV is hex encoded, if it is empty, the media sequence number of the segment is used as IV
+	IV string `json:"iv"`
+}
+
+type segment struct {
+	URL      string      `json:"url"`
+	Sequence int64       `json:"sequence"`
+	Key      *segmentKey `json:"key"`
+	// Offset and Length are the byte range of the segment, Length is zero means the whole resource
+	Offset     int64 `json:"offset"`
+	Length     int64 `json:"length"`
+	Downloaded int64 `json:"downloaded"`
+	Completed  bool  `json:"completed"`
+}
+
+type playlist struct {
+	Variants []*variant
+	Segments []*segment
+	// Fmp4 is true if the segments are fragmented mp4 with an init section
+	Fmp4    bool
+	EndList bool
+}
+
+func (p *playlist) isMaster() bool {
+	return len(p.Variants) > 0
+}
+
+// selectVariant returns the variant with the closest bandwidth, if bandwidth is zero, the highest bandwidth variant is returned.
+func (p *playlist) selectVariant(bandwidth int) *variant {
+	var selected *variant
+	for _, v := range p.Variants {
+		if selected == nil {
+			selected = v
+			continue
+		}
+		if bandwidth <= 0 {
+			if v.Bandwidth > selected.Bandwidth {
+				selected = v
+			}
+			continue
+		}
+		if abs(v.Bandwidth-bandwidth) < abs(selected.Bandwidth-bandwidth) {
+			selected = v
+		}
+	}
+	return selected
+}
+
+// parsePlaylist parses the master or media playlist, relative URIs are resolved against baseUrl.
+func parsePlaylist(r io.Reader, baseUrl *url.URL) (*playlist, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	p := &playlist{}
+	var (
+		headerFound bool
+		sequence    int64
+		key         *segmentKey
+		streamInf   map[string]string
+		segmentTag  bool
+		byteRange   *[2]int64
+		nextOffset  int64
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !headerFound {
+			if !strings.HasPrefix(line, tagHeader) {
+				return nil, ErrInvalidPlaylist
+			}
+			headerFound = true
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, tagStreamInf):
+			streamInf = parseAttributes(line[len(tagStreamInf):])
+		case strings.HasPrefix(line, tagMediaSequence):
+			v, err := strconv.ParseInt(line[len(tagMediaSequence):], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid media sequence: %w", err)
+			}
+			sequence = v
+		case strings.HasPrefix(line, tagKey):
+			attrs := parseAttributes(line[len(tagKey):])
+			method := attrs[attrMethod]
+			if method == keyMethodNone {
+				key = nil
+				continue
+			}
+			if method != keyMethodAES128 {
+				return nil, fmt.Errorf("unsupported encryption method: %s", method)
+			}
+			keyUrl, err := resolveUrl(baseUrl, attrs[attrURI])
+			if err != nil {
+				return nil, err
+			}
+			key = &segmentKey{
+				Method: method,
+				URL:    keyUrl,
+			}
+			if iv := attrs[attrIV]; iv != "" {
+				iv = strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")
+				if _, err := hex.DecodeString(iv); err != nil {
+					return nil, fmt.Errorf("invalid key iv: %w", err)
+				}
+				key.IV = iv
+			}
+		case strings.HasPrefix(line, tagMap):
+			attrs := parseAttributes(line[len(tagMap):])
+			mapUrl, err := resolveUrl(baseUrl, attrs[attrURI])
+			if err != nil {
+				return nil, err
+			}
+			s := &segment{
+				URL:      mapUrl,
+				Sequence: -1,
+			}
+			if br := attrs[attrByteRange]; br != "" {
+				length, offset, err := parseByteRange(br, 0)
+				if err != nil {
+					return nil, err
+				}
+				s.Offset = offset
+				s.Length = length
+			}
+			p.Segments = append(p.Segments, s)
+			p.Fmp4 = true
+		case strings.HasPrefix(line, tagInf):
+			segmentTag = true
+		case strings.HasPrefix(line, tagByteRange):
+			length, offset, err := parseByteRange(line[len(tagByteRange):], nextOffset)
+			if err != nil {
+				return nil, err
+			}
+			byteRange = &[2]int64{offset, length}
+		case strings.HasPrefix(line, tagEndList):
+			p.EndList = true
+		case strings.HasPrefix(line, "#"):
+			// ignore other tags and comments
+		default:
+			u, err := resolveUrl(baseUrl, line)
+			if err != nil {
+				return nil, err
+			}
+			if streamInf != nil {
+				bandwidth, _ := strconv.Atoi(streamInf[attrBandwidth])
+				p.Variants = append(p.Variants, &variant{
+					Bandwidth:  bandwidth,
+					Resolution: streamInf[attrResolution],
+					URL:        u,
+				})
+				streamInf = nil
+				continue
+			}
+			if !segmentTag {
+				continue
+			}
+			s := &segment{
+				URL:      u,
+				Sequence: sequence,
+				Key:      key,
+			}
+			if byteRange != nil {
+				s.Offset = byteRange[0]
+				s.Length = byteRange[1]
+				nextOffset = s.Offset + s.Length
+				byteRange = nil
+			}
+			p.Segments = append(p.Segments, s)
+			sequence++
+			segmentTag = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !headerFound || (len(p.Variants) == 0 && len(p.Segments) == 0) {
+		return nil, ErrInvalidPlaylist
+	}
+	return p, nil
+}
+
+// parseAttributes parses the attribute list, e.g. BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value = s[1:]
+				s = ""
+			} else {
+				value = s[1 : end+1]
+				s = s[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				value = s
+				s = ""
+			} else {
+				value = s[:end]
+				s = s[end:]
+			}
+		}
+		attrs[name] = value
+		s = strings.TrimPrefix(s, ",")
+	}
+	return attrs
+}
+
+// parseByteRange parses the byte range in format <length>[@<offset>], if offset is absent, defaultOffset is used.
+func parseByteRange(s string, defaultOffset int64) (length int64, offset int64, err error) {
+	parts := strings.SplitN(s, "@", 2)
+	length, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid byte range: %w", err)
+	}
+	offset = defaultOffset
+	if len(parts) == 2 {
+		offset, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid byte range: %w", err)
+		}
+	}
+	return
+}
+
+func resolveUrl(baseUrl *url.URL, ref string) (string, error) {
+	if ref == "" {
+		return "", ErrInvalidPlaylist
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return baseUrl.ResolveReference(u).String(), nil
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
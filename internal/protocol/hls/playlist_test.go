@@ -0,0 +1,112 @@
+package hls
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePlaylist_Master(t *testing.T) {
+	baseUrl, _ := url.Parse("http://127.0.0.1/live/master.m3u8")
+	p, err := parsePlaylist(strings.NewReader(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=640x360,CODECS="avc1.4d401f,mp4a.40.2"
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,RESOLUTION=1280x720
+mid/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=7680000,RESOLUTION=1920x1080
+http://cdn.example.com/high/index.m3u8
+`), baseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*variant{
+		{Bandwidth: 1280000, Resolution: "640x360", URL: "http://127.0.0.1/live/low/index.m3u8"},
+		{Bandwidth: 2560000, Resolution: "1280x720", URL: "http://127.0.0.1/live/mid/index.m3u8"},
+		{Bandwidth: 7680000, Resolution: "1920x1080", URL: "http://cdn.example.com/high/index.m3u8"},
+	}
+	if !reflect.DeepEqual(p.Variants, want) {
+		t.Errorf("parsePlaylist() got = %v, want %v", p.Variants, want)
+	}
+	if got := p.selectVariant(0); got != p.Variants[2] {
+		t.Errorf("selectVariant() got = %v, want %v", got, p.Variants[2])
+	}
+	if got := p.selectVariant(2000000); got != p.Variants[1] {
+		t.Errorf("selectVariant() got = %v, want %v", got, p.Variants[1])
+	}
+}
+
+func TestParsePlaylist_Media(t *testing.T) {
+	baseUrl, _ := url.Parse("http://127.0.0.1/live/index.m3u8")
+	p, err := parsePlaylist(strings.NewReader(`#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:7
+#EXTINF:9.009,
+seg0.ts
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x000102030405060708090a0b0c0d0e0f
+#EXTINF:9.009,
+seg1.ts
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/key2.bin"
+#EXTINF:3.003,
+#EXT-X-BYTERANGE:1000@2000
+all.ts
+#EXTINF:3.003,
+#EXT-X-BYTERANGE:500
+all.ts
+#EXT-X-ENDLIST
+`), baseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*segment{
+		{URL: "http://127.0.0.1/live/seg0.ts", Sequence: 7},
+		{URL: "http://127.0.0.1/live/seg1.ts", Sequence: 8, Key: &segmentKey{
+			Method: keyMethodAES128,
+			URL:    "http://127.0.0.1/live/key.bin",
+			IV:     "000102030405060708090a0b0c0d0e0f",
+		}},
+		{URL: "http://127.0.0.1/live/all.ts", Sequence: 9, Key: &segmentKey{
+			Method: keyMethodAES128,
+			URL:    "http://127.0.0.1/keys/key2.bin",
+		}, Offset: 2000, Length: 1000},
+		{URL: "http://127.0.0.1/live/all.ts", Sequence: 10, Key: &segmentKey{
+			Method: keyMethodAES128,
+			URL:    "http://127.0.0.1/keys/key2.bin",
+		}, Offset: 3000, Length: 500},
+	}
+	if !reflect.DeepEqual(p.Segments, want) {
+		t.Errorf("parsePlaylist() got = %v, want %v", p.Segments, want)
+	}
+	if !p.EndList {
+		t.Errorf("parsePlaylist() got = %v, want %v", p.EndList, true)
+	}
+}
+
+func TestParsePlaylist_Invalid(t *testing.T) {
+	baseUrl, _ := url.Parse("http://127.0.0.1/index.m3u8")
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "no header",
+			data: "seg0.ts\n",
+		},
+		{
+			name: "empty",
+			data: "#EXTM3U\n",
+		},
+		{
+			name: "unsupported encryption",
+			data: "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"key\"\n#EXTINF:1,\nseg0.ts\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePlaylist(strings.NewReader(tt.data), baseUrl); err == nil {
+				t.Errorf("parsePlaylist() got = %v, want error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package hls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+)
+
+var (
+	ErrInvalidSegmentSize = errors.New("invalid encrypted segment size")
+	// ErrInvalidPadding is returned when the PKCS7 padding of the decrypted segment is invalid, e.g. the key is wrong
+	ErrInvalidPadding = errors.New("invalid padding of the encrypted segment")
+)
+
+// progressReader reports the read bytes to add
+type progressReader struct {
+	r   io.Reader
+	add func(n int)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.add(n)
+	}
+	return n, err
+}
+
+// cbcReader decrypts the CBC encrypted stream, the last block is held back until the end of the stream
+// to remove the PKCS7 padding.
+type cbcReader struct {
+	r    io.Reader
+	mode cipher.BlockMode
+	// in is the read data which is not decrypted yet, out is the decrypted data which is not returned yet
+	in      []byte
+	out     []byte
+	spare   []byte
+	readBuf []byte
+	eof     bool
+}
+
+func newCbcReader(r io.Reader, mode cipher.BlockMode) *cbcReader {
+	return &cbcReader{
+		r:       r,
+		mode:    mode,
+		readBuf: make([]byte, 32*1024),
+	}
+}
+
+func (r *cbcReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads the next data and decrypts the complete blocks except the last one
+func (r *cbcReader) fill() error {
+	n, err := r.r.Read(r.readBuf)
+	r.in = append(r.in, r.readBuf[:n]...)
+	if err == io.EOF {
+		r.eof = true
+		return r.final()
+	}
+	if err != nil {
+		return err
+	}
+	keep := len(r.in) % aes.BlockSize
+	if keep == 0 {
+		keep = aes.BlockSize
+	}
+	ready := len(r.in) - keep
+	if ready <= 0 {
+		return nil
+	}
+	r.out = r.in[:ready]
+	r.mode.CryptBlocks(r.out, r.out)
+	// The decrypted blocks are returned before the next fill, so the buffers of in and out are swapped by each fill
+	next := append(r.spare[:0], r.in[ready:]...)
+	r.spare = r.in
+	r.in = next
+	return nil
+}
+
+// final decrypts the last block and removes the padding
+func (r *cbcReader) final() error {
+	if len(r.in) == 0 || len(r.in)%aes.BlockSize != 0 {
+		return ErrInvalidSegmentSize
+	}
+	r.mode.CryptBlocks(r.in, r.in)
+	padding := int(r.in[len(r.in)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return ErrInvalidPadding
+	}
+	for _, b := range r.in[len(r.in)-padding:] {
+		if int(b) != padding {
+			return ErrInvalidPadding
+		}
+	}
+	r.out = r.in[:len(r.in)-padding]
+	r.in = nil
+	return nil
+}
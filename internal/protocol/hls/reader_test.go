@@ -0,0 +1,64 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// encryptCbc encrypts the data padded by the padding bytes
+func encryptCbc(key []byte, iv []byte, data []byte, padding []byte) []byte {
+	data = append(append([]byte{}, data...), padding...)
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+func TestCbcReader(t *testing.T) {
+	key := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	rand.Read(key)
+	rand.Read(iv)
+	block, _ := aes.NewCipher(key)
+
+	for _, size := range []int{0, 1, 15, 16, 17, 64*1024 + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+		padding := aes.BlockSize - size%aes.BlockSize
+		encrypted := encryptCbc(key, iv, data, bytes.Repeat([]byte{byte(padding)}, padding))
+		for _, r := range []io.Reader{bytes.NewReader(encrypted), iotest.OneByteReader(bytes.NewReader(encrypted))} {
+			got, err := io.ReadAll(newCbcReader(r, cipher.NewCBCDecrypter(block, iv)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Read() got = %v bytes, want %v bytes of the size %v", len(got), len(data), size)
+			}
+		}
+	}
+
+	tests := []struct {
+		name      string
+		encrypted []byte
+		want      error
+	}{
+		{"empty", nil, ErrInvalidSegmentSize},
+		{"partial block", make([]byte, aes.BlockSize+1), ErrInvalidSegmentSize},
+		{"zero padding", encryptCbc(key, iv, make([]byte, 15), []byte{0}), ErrInvalidPadding},
+		{"oversized padding", encryptCbc(key, iv, make([]byte, 15), []byte{17}), ErrInvalidPadding},
+		{"mismatched padding", encryptCbc(key, iv, make([]byte, 13), []byte{1, 2, 3}), ErrInvalidPadding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := io.ReadAll(newCbcReader(bytes.NewReader(tt.encrypted), cipher.NewCBCDecrypter(block, iv)))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Read() got = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package http
+
+import (
+	"context"
+	"time"
+
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+)
+
+const (
+	// adaptiveGain is the min speed ratio after adding a connection, otherwise the speed is considered flattened
+	adaptiveGain = 1.1
+	// adaptiveCooldown is the ticks to wait before adding connections again after a connection is dropped
+	adaptiveCooldown = 5
+)
+
+// adaptiveInterval is the interval of measuring the throughput, it is a variable for testing
+var adaptiveInterval = 2 * time.Second
+
+// buildAdaptive returns the adaptive connections of the task, the options take precedence over the config,
+// returns nil if it is disabled or the server doesn't support range requests.
+func (f *Fetcher) buildAdaptive() *fhttp.AdaptiveConnections {
+	if !f.meta.Res.Range {
+		return nil
+	}
+	adaptive := f.config.Adaptive
+	var connections int
+	if extra, ok := f.meta.Opts.Extra.(*fhttp.OptsExtra); ok {
+		connections = extra.Connections
+		if extra.Adaptive != nil {
+			adaptive = extra.Adaptive
+		}
+	}
+	if adaptive == nil || !adaptive.Enable {
+		return nil
+	}
+	result := *adaptive
+	if result.MaxConnections <= 0 {
+		result.MaxConnections = max(connections, 1)
+	}
+	if result.MinConnections <= 0 {
+		result.MinConnections = 1
+	}
+	if result.MinConnections > result.MaxConnections {
+		result.MinConnections = result.MaxConnections
+	}
+	return &result
+}
+
+// adapt measures the aggregate throughput periodically, adds a connection while the speed keeps rising,
+// and drops one when the speed flattens or the server starts throttling.
+func (f *Fetcher) adapt(ctx context.Context, runsDone <-chan struct{}) {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+
+	var (
+		lastDownloaded = f.downloaded()
+		lastSpeed      float64
+		// probing is true if a connection was added in the last tick
+		probing  bool
+		cooldown int
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-runsDone:
+			return
+		case <-ticker.C:
+		}
+
+		downloaded := f.downloaded()
+		speed := float64(downloaded-lastDownloaded) / adaptiveInterval.Seconds()
+		lastDownloaded = downloaded
+		prevSpeed := lastSpeed
+		lastSpeed = speed
+
+		if f.throttled.Swap(0) > 0 {
+			f.dropConnection()
+			probing = false
+			cooldown = adaptiveCooldown
+			continue
+		}
+		if cooldown > 0 {
+			cooldown--
+			continue
+		}
+		if probing {
+			probing = false
+			if speed < prevSpeed*adaptiveGain {
+				f.dropConnection()
+				cooldown = adaptiveCooldown
+				continue
+			}
+		}
+		probing = f.addConnection(ctx)
+	}
+}
+
+// downloaded returns the downloaded bytes of all connections
+func (f *Fetcher) downloaded() int64 {
+	var total int64
+	for _, c := range f.snapshotConnections() {
+		total += c.Downloaded
+	}
+	return total
+}
+
+// activeConnections returns the running connections which are not dropped, the caller must hold the help lock.
+func (f *Fetcher) activeConnections() []*connection {
+	active := make([]*connection, 0, len(f.connections))
+	for _, c := range f.connections {
+		if c.running && !c.dropped.Load() {
+			active = append(active, c)
+		}
+	}
+	return active
+}
+
+// addConnection splits a chunk to a new connection, returns false if the max connections is reached
+// or there is no chunk large enough to split.
+func (f *Fetcher) addConnection(ctx context.Context) bool {
+	f.helpLock.Lock()
+	defer f.helpLock.Unlock()
+
+	if f.runs == 0 || len(f.activeConnections()) >= f.adaptive.MaxConnections {
+		return false
+	}
+	c := &connection{
+		Chunk:  newChunk(0, 0),
+		Source: len(f.connections) % len(f.sources),
+	}
+	if !f.takeChunk(c) {
+		return false
+	}
+	f.connections = append(f.connections, c)
+	f.startRun(ctx, c)
+	return true
+}
+
+// dropConnection cancels the latest added connection if the min connections is not reached,
+// its remain chunk will be taken over by the others.
+func (f *Fetcher) dropConnection() {
+	f.helpLock.Lock()
+	defer f.helpLock.Unlock()
+
+	active := f.activeConnections()
+	if len(active) <= f.adaptive.MinConnections {
+		return
+	}
+	c := active[len(active)-1]
+	c.dropped.Store(true)
+	c.cancel()
+}
@@ -0,0 +1,359 @@
+package http
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+)
+
+// authenticator holds the credentials of a download, it is shared by all connections,
+// so the digest challenge is reused by the later requests instead of being challenged again.
+type authenticator struct {
+	// host is the host of the request url, the credentials of request extra are only sent to it
+	host  string
+	auth  *fhttp.Auth
+	netrc *netrc
+
+	lock    sync.Mutex
+	digests map[string]*digestChallenge
+	// basicHosts are the hosts which challenged the auto-detected auth with basic scheme
+	basicHosts map[string]bool
+}
+
+func newAuthenticator(req *base.Request, netrcPath string) (*authenticator, error) {
+	a := &authenticator{
+		digests:    make(map[string]*digestChallenge),
+		basicHosts: make(map[string]bool),
+	}
+	if extra, ok := req.Extra.(*fhttp.ReqExtra); ok && extra.Auth != nil {
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		a.host = u.Host
+		a.auth = extra.Auth
+	}
+	if netrcPath != "" {
+		if strings.HasPrefix(netrcPath, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				netrcPath = filepath.Join(home, netrcPath[2:])
+			}
+		}
+		n, err := loadNetrc(netrcPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		a.netrc = n
+	}
+	return a, nil
+}
+
+// credentials returns the credentials of the url, the credentials of request extra take precedence over .netrc.
+func (a *authenticator) credentials(u *url.URL) *fhttp.Auth {
+	if a.auth != nil && strings.EqualFold(u.Host, a.host) {
+		return a.auth
+	}
+	if a.netrc != nil {
+		if m := a.netrc.lookup(u.Hostname()); m != nil && m.login != "" {
+			return &fhttp.Auth{
+				Username: m.login,
+				Password: m.password,
+			}
+		}
+	}
+	return nil
+}
+
+// challengedAuthorization returns the authorization header with the cached challenge of the host,
+// returns empty if the host has not been challenged.
+func (a *authenticator) challengedAuthorization(req *http.Request, cred *fhttp.Auth) string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.basicHosts[req.URL.Host] {
+		return basicAuthorization(cred)
+	}
+	challenge, ok := a.digests[req.URL.Host]
+	if !ok {
+		return ""
+	}
+	challenge.nc++
+	return challenge.authorization(req.Method, req.URL.RequestURI(), cred.Username, cred.Password, newCnonce(), challenge.nc)
+}
+
+// respond returns the authorization header for the challenges of the 401 response, returns empty if no challenge is supported.
+func (a *authenticator) respond(req *http.Request, cred *fhttp.Auth, resp *http.Response) string {
+	challenges := parseChallenges(resp.Header.Values(base.HttpHeaderWWWAuthenticate))
+	if cred.Type == "" || cred.Type == fhttp.AuthTypeDigest {
+		for _, c := range challenges {
+			if c.scheme != "digest" {
+				continue
+			}
+			if digest := newDigestChallenge(c.params); digest != nil {
+				a.lock.Lock()
+				a.digests[req.URL.Host] = digest
+				a.lock.Unlock()
+				return a.challengedAuthorization(req, cred)
+			}
+		}
+	}
+	if cred.Type == "" {
+		for _, c := range challenges {
+			if c.scheme == "basic" {
+				a.lock.Lock()
+				a.basicHosts[req.URL.Host] = true
+				a.lock.Unlock()
+				return basicAuthorization(cred)
+			}
+		}
+	}
+	return ""
+}
+
+// authTransport adds the authorization header to the requests, the digest and auto-detected auth
+// resend the request after the server challenges it with 401 response.
+type authTransport struct {
+	next http.RoundTripper
+	auth *authenticator
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The Authorization header specified by the user is not overridden
+	if req.Header.Get(base.HttpHeaderAuthorization) != "" {
+		return t.next.RoundTrip(req)
+	}
+	cred := t.auth.credentials(req.URL)
+	if cred == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	authReq := req.Clone(req.Context())
+	switch cred.Type {
+	case fhttp.AuthTypeBearer:
+		authReq.Header.Set(base.HttpHeaderAuthorization, "Bearer "+cred.Token)
+		return t.next.RoundTrip(authReq)
+	case fhttp.AuthTypeBasic:
+		authReq.Header.Set(base.HttpHeaderAuthorization, basicAuthorization(cred))
+		return t.next.RoundTrip(authReq)
+	}
+
+	if authorization := t.auth.challengedAuthorization(req, cred); authorization != "" {
+		authReq.Header.Set(base.HttpHeaderAuthorization, authorization)
+	}
+	resp, err := t.next.RoundTrip(authReq)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	retryReq, ok := rewindRequest(req)
+	if !ok {
+		return resp, nil
+	}
+	authorization := t.auth.respond(req, cred, resp)
+	if authorization == "" {
+		return resp, nil
+	}
+	resp.Body.Close()
+	retryReq.Header.Set(base.HttpHeaderAuthorization, authorization)
+	return t.next.RoundTrip(retryReq)
+}
+
+// rewindRequest clones the request with a new body, returns false if the body can't be read again.
+func rewindRequest(req *http.Request) (*http.Request, bool) {
+	clone := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return clone, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	clone.Body = body
+	return clone, true
+}
+
+func basicAuthorization(cred *fhttp.Auth) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(cred.Username+":"+cred.Password))
+}
+
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenges parses the WWW-Authenticate headers, a header may contain multiple challenges, see RFC 7235 4.1
+func parseChallenges(values []string) []*challenge {
+	challenges := make([]*challenge, 0)
+	for _, v := range values {
+		var current *challenge
+		s := v
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			token, rest := readAuthToken(s)
+			if token == "" {
+				break
+			}
+			rest = strings.TrimLeft(rest, " \t")
+			if current != nil && strings.HasPrefix(rest, "=") {
+				var value string
+				value, s = readAuthValue(strings.TrimLeft(rest[1:], " \t"))
+				current.params[strings.ToLower(token)] = value
+				continue
+			}
+			current = &challenge{
+				scheme: strings.ToLower(token),
+				params: make(map[string]string),
+			}
+			challenges = append(challenges, current)
+			s = rest
+		}
+	}
+	return challenges
+}
+
+func readAuthToken(s string) (string, string) {
+	i := strings.IndexAny(s, " \t,=")
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func readAuthValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		i := strings.IndexAny(s, " \t,")
+		if i == -1 {
+			return s, ""
+		}
+		return s[:i], s[i:]
+	}
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				sb.WriteByte(s[i])
+			}
+		case '"':
+			return sb.String(), s[i+1:]
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String(), ""
+}
+
+// digestChallenge is the digest challenge of the server, see RFC 7616
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	// qop is empty for the legacy RFC 2069 digest, otherwise it is always auth
+	qop string
+	// nc is the count of requests sent with the nonce
+	nc uint32
+}
+
+// newDigestChallenge returns nil if the algorithm or qop of the challenge is not supported
+func newDigestChallenge(params map[string]string) *digestChallenge {
+	c := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		algorithm: params["algorithm"],
+	}
+	if c.nonce == "" || c.hash() == nil {
+		return nil
+	}
+	if qop, ok := params["qop"]; ok {
+		for _, q := range strings.Split(qop, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				c.qop = "auth"
+			}
+		}
+		// Only auth-int is offered
+		if c.qop == "" {
+			return nil
+		}
+	}
+	return c
+}
+
+func (c *digestChallenge) hash() func() hash.Hash {
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(c.algorithm), "-sess")) {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	default:
+		return nil
+	}
+}
+
+func (c *digestChallenge) authorization(method, uri, username, password, cnonce string, nc uint32) string {
+	newHash := c.hash()
+	h := func(s string) string {
+		hh := newHash()
+		hh.Write([]byte(s))
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+	ncValue := fmt.Sprintf("%08x", nc)
+	ha1 := h(username + ":" + c.realm + ":" + password)
+	if strings.HasSuffix(strings.ToLower(c.algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	var response string
+	if c.qop != "" {
+		response = h(strings.Join([]string{ha1, c.nonce, ncValue, cnonce, c.qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	params := []string{
+		"username=" + quote(username),
+		"realm=" + quote(c.realm),
+		"nonce=" + quote(c.nonce),
+		"uri=" + quote(uri),
+	}
+	if c.algorithm != "" {
+		params = append(params, "algorithm="+c.algorithm)
+	}
+	params = append(params, "response="+quote(response))
+	if c.opaque != "" {
+		params = append(params, "opaque="+quote(c.opaque))
+	}
+	if c.qop != "" {
+		params = append(params, "qop="+c.qop, "nc="+ncValue, "cnonce="+quote(cnonce))
+	}
+	return "Digest " + strings.Join(params, ", ")
+}
+
+func newCnonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	got := parseChallenges([]string{
+		`Basic realm="simple", Digest realm="a, b", nonce="n\"1", qop="auth,auth-int", algorithm=SHA-256`,
+		`Bearer`,
+	})
+	want := []*challenge{
+		{scheme: "basic", params: map[string]string{"realm": "simple"}},
+		{scheme: "digest", params: map[string]string{"realm": "a, b", "nonce": `n"1`, "qop": "auth,auth-int", "algorithm": "SHA-256"}},
+		{scheme: "bearer", params: map[string]string{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseChallenges() got = %v, want %v", got, want)
+	}
+}
+
+func TestNewDigestChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   *digestChallenge
+	}{
+		{
+			name:   "legacy",
+			params: map[string]string{"realm": "r", "nonce": "n"},
+			want:   &digestChallenge{realm: "r", nonce: "n"},
+		},
+		{
+			name:   "qop auth",
+			params: map[string]string{"realm": "r", "nonce": "n", "qop": "auth-int, auth", "algorithm": "SHA-256-sess"},
+			want:   &digestChallenge{realm: "r", nonce: "n", qop: "auth", algorithm: "SHA-256-sess"},
+		},
+		{
+			name:   "qop auth-int only",
+			params: map[string]string{"realm": "r", "nonce": "n", "qop": "auth-int"},
+		},
+		{
+			name:   "unsupported algorithm",
+			params: map[string]string{"realm": "r", "nonce": "n", "algorithm": "SHA-512-256"},
+		},
+		{
+			name:   "no nonce",
+			params: map[string]string{"realm": "r"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newDigestChallenge(tt.params); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newDigestChallenge() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestChallenge_Authorization(t *testing.T) {
+	// The example of RFC 2617 3.5
+	c := &digestChallenge{
+		realm:  "testrealm@host.com",
+		nonce:  "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		opaque: "5ccc069c403ebaf9f0171e9517f40e41",
+		qop:    "auth",
+	}
+	got := c.authorization("GET", "/dir/index.html", "Mufasa", "Circle Of Life", "0a4f113b", 1)
+	want := `Digest username="Mufasa", realm="testrealm@host.com", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/dir/index.html", response="6629fae49393a05397450978507c4ef1", opaque="5ccc069c403ebaf9f0171e9517f40e41", qop=auth, nc=00000001, cnonce="0a4f113b"`
+	if got != want {
+		t.Errorf("authorization() got = %v, want %v", got, want)
+	}
+}
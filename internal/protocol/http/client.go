@@ -0,0 +1,170 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/resolver"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Safari/537.36"
+
+// NewClient builds the http client for the download request,
+// it is also used by other protocols which are transferred over http.
+func NewClient(ctl *controller.Controller, req *base.Request) (*http.Client, error) {
+	return newClient(ctl, req, fhttp.ProtocolHTTP1, 0)
+}
+
+// newClient builds the http client of the protocol, the nth client is bound to the nth local address first.
+func newClient(ctl *controller.Controller, req *base.Request, protocol fhttp.Protocol, n int) (*http.Client, error) {
+	tlsConfig, err := ctl.GetTLSConfig(req.TLS, req.SkipVerifyCert)
+	if err != nil {
+		return nil, err
+	}
+	proxy := ctl.GetProxy(req.Proxy)
+	// QUIC can't be transferred over the http and socks5 proxies
+	if protocol == fhttp.ProtocolHTTP3 && proxy != nil {
+		protocol = fhttp.ProtocolHTTP2
+	}
+	var locals []net.IP
+	if ctl.GetBind != nil {
+		if locals, err = ctl.GetBind(req.Bind).LocalIPs(); err != nil {
+			return nil, err
+		}
+		locals = resolver.Rotate(locals, n)
+	}
+	// The QUIC connections share one udp socket which isn't bound to the local addresses
+	if protocol == fhttp.ProtocolHTTP3 && len(locals) > 0 {
+		protocol = fhttp.ProtocolHTTP2
+	}
+
+	dialer := &net.Dialer{
+		Timeout: connectTimeout,
+	}
+	var transport http.RoundTripper
+	if protocol == fhttp.ProtocolHTTP3 {
+		transport = &http3.Transport{
+			TLSClientConfig: tlsConfig,
+			Dial:            dialQUIC(ctl.Resolver),
+		}
+	} else {
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(protocol == fhttp.ProtocolHTTP2)
+		transport = &http.Transport{
+			DialContext:     ctl.Resolver.DialContext(dialer, locals),
+			Proxy:           proxy,
+			TLSClientConfig: tlsConfig,
+			Protocols:       protocols,
+		}
+	}
+	return &http.Client{
+		Transport: transport,
+		Jar:       NewCookieJar(ctl, req),
+	}, nil
+}
+
+// dialQUIC returns the QUIC dial function of HTTP/3 which connects the addresses resolved by the resolver in order,
+// the tls server name is set to the host by the transport.
+func dialQUIC(r *resolver.Resolver) func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	return func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := r.LookupHost(ctx, host, port)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn quic.EarlyConnection
+			conn, err = quic.DialAddrEarly(ctx, net.JoinHostPort(ip, port), tlsCfg, cfg)
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// closeClient closes the connections of the client, the QUIC transport also releases its udp socket.
+func closeClient(client *http.Client) {
+	transport := client.Transport
+	if at, ok := transport.(*authTransport); ok {
+		transport = at.next
+	}
+	if closer, ok := transport.(io.Closer); ok {
+		closer.Close()
+		return
+	}
+	if ci, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+// NewCookieJar returns the cookie jar of the cookie profile if the request specifies one,
+// otherwise returns a new in-memory cookie jar.
+func NewCookieJar(ctl *controller.Controller, req *base.Request) http.CookieJar {
+	if req.CookieProfile != "" && ctl.GetCookieJar != nil {
+		if jar := ctl.GetCookieJar(req.CookieProfile); jar != nil {
+			return jar
+		}
+	}
+	jar, _ := cookiejar.New(nil)
+	return jar
+}
+
+// NewRequest builds the http request with the method, headers and body in request extra,
+// if the User-Agent header is not specified, the userAgent will be used.
+func NewRequest(ctx context.Context, reqUrl string, extra *fhttp.ReqExtra, userAgent string) (httpReq *http.Request, err error) {
+	var (
+		method string
+		body   io.Reader
+	)
+	headers := http.Header{}
+	if extra == nil {
+		method = http.MethodGet
+	} else {
+		if extra.Method != "" {
+			method = extra.Method
+		} else {
+			method = http.MethodGet
+		}
+		if len(extra.Header) > 0 {
+			for k, v := range extra.Header {
+				headers.Set(k, v)
+			}
+		}
+		if extra.Body != "" {
+			body = bytes.NewBufferString(extra.Body)
+		}
+	}
+	if _, ok := headers[base.HttpHeaderUserAgent]; !ok {
+		headers.Set(base.HttpHeaderUserAgent, userAgent)
+	}
+
+	if ctx != nil {
+		httpReq, err = http.NewRequestWithContext(ctx, method, reqUrl, body)
+	} else {
+		httpReq, err = http.NewRequest(method, reqUrl, body)
+	}
+	if err != nil {
+		return
+	}
+	httpReq.Header = headers
+	// Override Host header
+	if host := headers.Get(base.HttpHeaderHost); host != "" {
+		httpReq.Host = host
+	}
+	return httpReq, nil
+}
@@ -1,7 +1,30 @@
 package http
 
+import fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+
 type config struct {
-	UserAgent      string `json:"userAgent"`
-	Connections    int    `json:"connections"`
-	UseServerCtime bool   `json:"useServerCtime"`
+	UserAgent      string             `json:"userAgent"`
+	Connections    int                `json:"connections"`
+	UseServerCtime bool               `json:"useServerCtime"`
+	Retry          *fhttp.RetryPolicy `json:"retry"`
+	// Protocol is the http version of the requests, empty means HTTP/1.1
+	Protocol fhttp.Protocol `json:"protocol"`
+	// Adaptive scales the connections by the measured throughput instead of using fixed connections
+	Adaptive *fhttp.AdaptiveConnections `json:"adaptive"`
+	// Stall re-requests the connections which are slower than the min speed
+	Stall *fhttp.StallDetection `json:"stall"`
+	// PartFile downloads to a temporary .part file and renames it on completion, nil means enabled
+	PartFile *bool `json:"partFile"`
+	// ChunkHash stores the hash of the tail of each chunk with the progress, the tail is verified before resuming
+	ChunkHash bool `json:"chunkHash"`
+	// WriteBuffer is the size of the write buffer of each connection in bytes, zero means the default size
+	WriteBuffer int `json:"writeBuffer"`
+	// SingleWriter writes the file in a single goroutine, so the connections don't wait for the disk
+	SingleWriter bool `json:"singleWriter"`
+	// Netrc is the path of .netrc file, it is used when the request has no credentials
+	Netrc string `json:"netrc"`
+}
+
+func (c *config) partFile() bool {
+	return c.PartFile == nil || *c.PartFile
 }
@@ -1,30 +1,30 @@
 package http
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"mime"
-	"net"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GopeedLab/gopeed/internal/controller"
 	"github.com/GopeedLab/gopeed/internal/fetcher"
 	"github.com/GopeedLab/gopeed/pkg/base"
 	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/util"
 	"github.com/xiaoqidun/setft"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -33,9 +33,19 @@ const (
 	helpMinSize    = 1 * 1024 * 1024
 )
 
+var (
+	ErrMirrorMismatch = errors.New("mirror file size mismatch")
+	// ErrRemoteFileChanged is returned when the remote file is changed since the task was resolved,
+	// the downloaded data can't be continued.
+	ErrRemoteFileChanged = errors.New("remote file changed")
+)
+
 type RequestError struct {
 	Code int
 	Msg  string
+
+	// retryAfter is the delay requested by the server with Retry-After header
+	retryAfter time.Duration
 }
 
 func NewRequestError(code int, msg string) *RequestError {
@@ -46,19 +56,50 @@ func (re *RequestError) Error() string {
 	return fmt.Sprintf("http request fail,code:%d", re.Code)
 }
 
+// NewResponseError returns the request error of the failed response, with the delay requested by the Retry-After header
+func NewResponseError(resp *http.Response) *RequestError {
+	re := NewRequestError(resp.StatusCode, resp.Status)
+	re.retryAfter = parseRetryAfter(resp)
+	return re
+}
+
+// RetryDelay returns the delay requested by the server, it implements fetcher.RetryDelayer
+func (re *RequestError) RetryDelay() time.Duration {
+	return re.retryAfter
+}
+
 type chunk struct {
 	Begin      int64
 	End        int64
 	Downloaded int64
+	// TailHash is the crc32 of the last downloaded bytes when the progress was stored, zero means not hashed
+	TailHash uint32
 }
 
 type connection struct {
 	Chunk      *chunk
 	Downloaded int64
 	Completed  bool
+	// Source is the index of the download source, 0 is the request url and the others are the mirrors
+	Source int
 
 	failed     bool
 	retryTimes int
+	// failures is the consecutive failure times of the connection, used to calculate the retry backoff
+	failures int
+	// protocol is the negotiated protocol of the last response
+	protocol string
+	// stalls is the times the connection was re-requested because of stalling
+	stalls int
+	// stallFailures is the consecutive stall times, the connection hands off its chunk when it exceeds the retry times
+	stallFailures int
+	// err is the result of the last run
+	err    error
+	cancel context.CancelFunc
+	// running is guarded by the help lock
+	running bool
+	// dropped is true if the connection is canceled by the adaptive connections, its remain chunk is taken over by the others
+	dropped atomic.Bool
 }
 
 // get remain to download bytes
@@ -73,20 +114,65 @@ func newChunk(begin int64, end int64) *chunk {
 	}
 }
 
+// source is a download url of the file, the request url and its mirrors are all sources
+type source struct {
+	url          string
+	redirectURL  string
+	redirectLock sync.Mutex
+	// failures is the number of failed requests, connections will be moved to the source with fewer failures
+	failures atomic.Int32
+	// disabled is true if the source serves a different file
+	disabled atomic.Bool
+}
+
 type Fetcher struct {
 	ctl    *controller.Controller
 	config *config
 	doneCh chan error
 
-	meta         *fetcher.FetcherMeta
-	connections  []*connection
-	helpLock     sync.Mutex
-	redirectURL  string
-	redirectLock sync.Mutex
+	meta        *fetcher.FetcherMeta
+	connections []*connection
+	// helpLock guards the chunk ranges and the connections which are added and dropped by the adaptive connections
+	helpLock sync.Mutex
+	// runs is the count of running connection goroutines, runsDone is closed when it drops to zero
+	runs     int
+	runsDone chan struct{}
+	// throttled is the count of 429/503 responses since the last adaptive tick
+	throttled atomic.Int32
+	adaptive  *fhttp.AdaptiveConnections
+	sources   []*source
+	// jar is shared by the resolve and all connections, so the cookies set by the server are sent with the later requests
+	jar http.CookieJar
+	// auth is shared by the resolve and all connections, so the digest challenge is reused
+	auth *authenticator
+	// protocol is the http version of the requests
+	protocol fhttp.Protocol
+	// client is shared by all connections if the protocol multiplexes the requests, otherwise each connection has its own client
+	client *http.Client
+	// etag and lastModified are the validators of the remote file when the task was resolved
+	etag         string
+	lastModified string
 
-	file   *os.File
-	cancel context.CancelFunc
-	eg     *errgroup.Group
+	file *os.File
+	// part is true if the file is downloaded to the temporary part path
+	part bool
+	// clients counts the built clients, the clients are spread across the bind addresses round-robin
+	clients atomic.Int32
+	// writeBuffer is the size of the write buffer of each connection
+	writeBuffer int
+	// writer writes the file for all connections if the single writer is enabled, otherwise each connection writes the file
+	writer *fileWriter
+	// synced is the connections snapshot by the last sync, it is stored instead of the live connections
+	synced []*connection
+	// syncLock serializes the syncs, syncedLock guards the snapshot, so storing is not blocked by a slow sync
+	syncLock   sync.Mutex
+	syncedLock sync.Mutex
+	// limiter limits the download speed of the task
+	limiter *rate.Limiter
+	retry   *fhttp.RetryPolicy
+	stall   *fhttp.StallDetection
+	cancel  context.CancelFunc
+	eg      *errgroup.Group
 }
 
 func (f *Fetcher) Setup(ctl *controller.Controller) {
@@ -104,11 +190,22 @@ func (f *Fetcher) Resolve(req *base.Request) error {
 		return err
 	}
 	f.meta.Req = req
-	httpReq, err := f.buildRequest(nil, req)
+	f.jar = NewCookieJar(f.ctl, req)
+	auth, err := newAuthenticator(req, f.config.Netrc)
+	if err != nil {
+		return err
+	}
+	f.auth = auth
+	f.protocol = f.config.Protocol
+	httpReq, err := f.buildRequest(nil, req.URL)
+	if err != nil {
+		return err
+	}
+	client, err := f.buildClient()
 	if err != nil {
 		return err
 	}
-	client := f.buildClient()
+	defer closeClient(client)
 	// send Range request to check whether the server supports breakpoint continuation
 	// just test one byte, Range: bytes=0-0
 	httpReq.Header.Set(base.HttpHeaderRange, fmt.Sprintf(base.HttpHeaderRangeFormat, 0, 0))
@@ -149,9 +246,11 @@ func (f *Fetcher) Resolve(req *base.Request) error {
 	} else {
 		return NewRequestError(httpResp.StatusCode, httpResp.Status)
 	}
+	f.etag = httpResp.Header.Get(base.HttpHeaderETag)
+	f.lastModified = httpResp.Header.Get(base.HttpHeaderLastModified)
 	// Parse last modified time
 	var lastModifiedTime *time.Time
-	lastModified := httpResp.Header.Get(base.HttpHeaderLastModified)
+	lastModified := f.lastModified
 	if lastModified != "" {
 		// ignore parse error
 		t, _ := time.Parse(time.RFC1123, lastModified)
@@ -221,6 +320,15 @@ func (f *Fetcher) Create(opts *base.Options) error {
 
 func (f *Fetcher) Start() (err error) {
 	name := f.meta.SingleFilepath()
+	f.part = false
+	if f.config.partFile() {
+		partName := f.meta.PartFilepath()
+		// The task started before the part file was enabled continues writing the real path
+		if f.connections == nil || util.IsExistsFile(partName) || !util.IsExistsFile(name) {
+			name = partName
+			f.part = true
+		}
+	}
 	// if file not exist, create it, else open it
 	_, err = os.Stat(name)
 	if err != nil {
@@ -241,10 +349,61 @@ func (f *Fetcher) Start() (err error) {
 		return err
 	}
 
+	if f.jar == nil {
+		f.jar = NewCookieJar(f.ctl, f.meta.Req)
+	}
+	if f.auth == nil {
+		if f.auth, err = newAuthenticator(f.meta.Req, f.config.Netrc); err != nil {
+			return err
+		}
+	}
+	f.sources = f.buildSources()
+	f.limiter = util.NewRateLimiter(f.meta.Opts.DownloadLimit)
+	var (
+		optsRetry *fhttp.RetryPolicy
+		optsStall *fhttp.StallDetection
+	)
+	f.protocol = f.config.Protocol
+	if extra, ok := f.meta.Opts.Extra.(*fhttp.OptsExtra); ok {
+		optsRetry = extra.Retry
+		optsStall = extra.Stall
+		if extra.Protocol != "" {
+			f.protocol = extra.Protocol
+		}
+	}
+	f.retry = fetcher.BuildRetryPolicy(f.config.Retry, optsRetry)
+	f.stall = buildStallDetection(f.config.Stall, optsStall)
+	f.adaptive = f.buildAdaptive()
+	f.client = nil
+	if f.protocol == fhttp.ProtocolHTTP2 || f.protocol == fhttp.ProtocolHTTP3 {
+		if f.client, err = f.buildClient(); err != nil {
+			return err
+		}
+	}
 	if f.connections == nil {
 		f.connections = f.splitConnection()
+	} else {
+		// The mirrors may be changed after restore
+		for _, c := range f.connections {
+			if c.Source >= len(f.sources) {
+				c.Source = 0
+			}
+		}
+		if err = f.verifyTails(); err != nil {
+			return err
+		}
+	}
+	f.syncedLock.Lock()
+	f.synced = f.copyConnections()
+	f.syncedLock.Unlock()
+	f.writeBuffer = f.config.WriteBuffer
+	if f.writeBuffer <= 0 {
+		f.writeBuffer = defaultWriteBuffer
+	}
+	f.writer = nil
+	if f.config.SingleWriter {
+		f.writer = newFileWriter(f.file)
 	}
-	f.redirectURL = ""
 	f.fetch()
 	return
 }
@@ -254,6 +413,11 @@ func (f *Fetcher) Pause() (err error) {
 		f.cancel()
 		// wait for pause handle complete
 		f.eg.Wait()
+		// flush the data before the progress is stored
+		err = f.Sync()
+		if f.writer != nil {
+			f.writer.close()
+		}
 		f.file.Close()
 	}
 	return
@@ -272,12 +436,19 @@ func (f *Fetcher) Meta() *fetcher.FetcherMeta {
 
 func (f *Fetcher) Stats() any {
 	statsConnections := make([]*fhttp.StatsConnection, 0)
-	for _, connection := range f.connections {
+	for _, connection := range f.snapshotConnections() {
+		var sourceUrl string
+		if connection.Source < len(f.sources) {
+			sourceUrl = f.sources[connection.Source].url
+		}
 		statsConnections = append(statsConnections, &fhttp.StatsConnection{
+			URL:        sourceUrl,
 			Downloaded: connection.Downloaded,
 			Completed:  connection.Completed,
 			Failed:     connection.failed,
 			RetryTimes: connection.retryTimes,
+			Protocol:   connection.protocol,
+			Stalls:     connection.stalls,
 		})
 	}
 	return &fhttp.Stats{
@@ -287,9 +458,9 @@ func (f *Fetcher) Stats() any {
 
 func (f *Fetcher) Progress() fetcher.Progress {
 	p := make(fetcher.Progress, 0)
-	if len(f.connections) > 0 {
+	if connections := f.snapshotConnections(); len(connections) > 0 {
 		total := int64(0)
-		for _, connection := range f.connections {
+		for _, connection := range connections {
 			total += connection.Downloaded
 		}
 		p = append(p, total)
@@ -297,6 +468,12 @@ func (f *Fetcher) Progress() fetcher.Progress {
 	return p
 }
 
+func (f *Fetcher) snapshotConnections() []*connection {
+	f.helpLock.Lock()
+	defer f.helpLock.Unlock()
+	return slices.Clone(f.connections)
+}
+
 func (f *Fetcher) Wait() (err error) {
 	return <-f.doneCh
 }
@@ -305,51 +482,145 @@ func (f *Fetcher) fetch() {
 	var ctx context.Context
 	ctx, f.cancel = context.WithCancel(context.Background())
 	f.eg, _ = errgroup.WithContext(ctx)
-	connectionErrs := make([]error, len(f.connections))
-	for i := 0; i < len(f.connections); i++ {
-		i := i
+	f.runs = 0
+	f.runsDone = make(chan struct{})
+	f.throttled.Store(0)
+	f.helpLock.Lock()
+	for _, connection := range f.connections {
+		f.startRun(ctx, connection)
+	}
+	f.helpLock.Unlock()
+	if f.adaptive != nil {
+		runsDone := f.runsDone
 		f.eg.Go(func() error {
-			err := f.run(i, ctx)
-			// if canceled, fail fast
-			if errors.Is(err, context.Canceled) {
-				return err
-			}
-			connectionErrs[i] = err
+			f.adapt(ctx, runsDone)
 			return nil
 		})
 	}
 
+	client := f.client
 	go func() {
 		err := f.eg.Wait()
-		// error returned only if canceled, just return
+		if client != nil {
+			closeClient(client)
+		}
+		connections := f.snapshotConnections()
+		// error returned only if canceled or a connection failed fatally
 		if err != nil {
-			return
+			if !slices.ContainsFunc(connections, func(c *connection) bool {
+				return isFatal(c.err)
+			}) {
+				return
+			}
 		}
 		// check all fetch results, if any error, return
-		for _, chunkErr := range connectionErrs {
-			if chunkErr != nil {
-				err = chunkErr
+		for _, c := range connections {
+			if c.err != nil {
+				err = c.err
 				break
 			}
 		}
 
+		if f.writer != nil {
+			if werr := f.writer.close(); err == nil {
+				err = werr
+			}
+		}
+		// Flush the part file to disk before renaming it, so the real path never points to incomplete data
+		if err == nil && f.part {
+			err = f.file.Sync()
+		}
 		f.file.Close()
+		name := f.file.Name()
+		if err == nil && f.part {
+			name = f.meta.SingleFilepath()
+			err = os.Rename(f.file.Name(), name)
+		}
 		// Update file last modified time
 		if f.config.UseServerCtime && f.meta.Res.Files[0].Ctime != nil {
-			setft.SetFileTime(f.file.Name(), time.Now(), *f.meta.Res.Files[0].Ctime, *f.meta.Res.Files[0].Ctime)
+			setft.SetFileTime(name, time.Now(), *f.meta.Res.Files[0].Ctime, *f.meta.Res.Files[0].Ctime)
 		}
 		f.doneCh <- err
 	}()
 }
 
-func (f *Fetcher) run(index int, ctx context.Context) (err error) {
-	connection := f.connections[index]
+// startRun runs the connection in the errgroup, the caller must hold the help lock.
+func (f *Fetcher) startRun(ctx context.Context, connection *connection) {
+	runCtx, cancel := context.WithCancel(ctx)
+	connection.cancel = cancel
+	connection.dropped.Store(false)
+	connection.running = true
+	connection.err = nil
+	f.runs++
+	f.eg.Go(func() error {
+		err := f.run(connection, runCtx)
+		cancel()
+
+		f.helpLock.Lock()
+		defer f.helpLock.Unlock()
+		connection.running = false
+		defer func() {
+			f.runs--
+			if f.runs == 0 {
+				close(f.runsDone)
+			}
+		}()
+		// if remote file changed or disk is full, stop all connections
+		if isFatal(err) {
+			connection.err = err
+			f.cancel()
+			return err
+		}
+		// The dropped connection leaves its remain chunk to the running connections,
+		// resume it if no one is left to take over the chunk.
+		if connection.dropped.Load() && ctx.Err() == nil {
+			if connection.Chunk.remain() <= 0 {
+				connection.Completed = true
+			} else if !f.hasRunning() {
+				f.startRun(ctx, connection)
+			}
+			return nil
+		}
+		// if canceled, fail fast
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+		connection.err = err
+		return nil
+	})
+}
+
+// isFatal returns whether the error stops all connections, retrying can't recover from it
+func isFatal(err error) bool {
+	return errors.Is(err, ErrRemoteFileChanged) || util.IsDiskFull(err)
+}
+
+// hasRunning returns whether any connection is running, the caller must hold the help lock.
+func (f *Fetcher) hasRunning() bool {
+	for _, c := range f.connections {
+		if c.running {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fetcher) run(connection *connection, ctx context.Context) (err error) {
 	connection.failed = false
 	connection.retryTimes = 0
-	var (
-		client = f.buildClient()
-		buf    = make([]byte, 8192)
-	)
+	connection.failures = 0
+	connection.stallFailures = 0
+	client := f.client
+	if client == nil {
+		if client, err = f.buildClient(); err != nil {
+			return err
+		}
+		defer closeClient(client)
+	}
+	buf := getBuffer(f.writeBuffer)
+	defer func() {
+		putBuffer(buf)
+	}()
 
 	downloadChunk := func(chunk *chunk) (err error) {
 		// retry until all remain chunks failed
@@ -361,8 +632,8 @@ func (f *Fetcher) run(index int, ctx context.Context) (err error) {
 			// if all chunks failed, return
 			if connection.failed {
 				allFailed := true
-				for _, c := range f.connections {
-					if c.Completed {
+				for _, c := range f.snapshotConnections() {
+					if c.Completed || c.dropped.Load() {
 						continue
 					}
 					if !c.failed {
@@ -371,7 +642,7 @@ func (f *Fetcher) run(index int, ctx context.Context) (err error) {
 					}
 				}
 				if allFailed {
-					if connection.retryTimes >= 3 {
+					if connection.retryTimes >= f.retry.MaxAttempts {
 						return
 					} else {
 						connection.retryTimes++
@@ -379,32 +650,59 @@ func (f *Fetcher) run(index int, ctx context.Context) (err error) {
 				}
 			}
 
-			err = func() error {
+			src := f.sources[connection.Source]
+			err = func() (err error) {
 				var (
 					httpReq *http.Request
 					resp    *http.Response
+					// release frees the connection slot of the host after the response is read
+					release = func() {}
 				)
-				f.redirectLock.Lock()
-				if f.redirectURL != "" {
-					f.redirectLock.Unlock()
+				reqCtx, cancelReq := context.WithCancelCause(ctx)
+				defer cancelReq(nil)
+				defer func() {
+					release()
+				}()
+				defer func() {
+					if err != nil && ctx.Err() == nil && errors.Is(context.Cause(reqCtx), errConnectionStalled) {
+						err = errConnectionStalled
+					}
+				}()
+				src.redirectLock.Lock()
+				if src.redirectURL != "" {
+					src.redirectLock.Unlock()
 				}
 				err = func() (err error) {
 					defer func() {
-						if f.redirectURL == "" {
+						if src.redirectURL == "" {
 							if err == nil {
-								f.redirectURL = resp.Request.URL.String()
+								src.redirectURL = resp.Request.URL.String()
 							}
-							f.redirectLock.Unlock()
+							src.redirectLock.Unlock()
 						}
 					}()
 
-					httpReq, err = f.buildRequest(ctx, f.meta.Req)
+					reqUrl := src.url
+					if src.redirectURL != "" {
+						reqUrl = src.redirectURL
+					}
+					httpReq, err = f.buildRequest(reqCtx, reqUrl)
+					if err != nil {
+						return
+					}
+					// Queue for a connection slot of the host, the slots are shared by the connections of all tasks
+					acquired, err := f.ctl.HostLimiter.Acquire(reqCtx, httpReq.URL.Hostname())
 					if err != nil {
 						return
 					}
+					release = acquired
 					if f.meta.Res.Range {
 						httpReq.Header.Set(base.HttpHeaderRange,
 							fmt.Sprintf(base.HttpHeaderRangeFormat, chunk.Begin+chunk.Downloaded, chunk.End))
+						// The server will respond the full file if the remote file is changed
+						if ifRange := f.ifRange(); ifRange != "" && connection.Source == 0 {
+							httpReq.Header.Set(base.HttpHeaderIfRange, ifRange)
+						}
 					} else {
 						chunk.Downloaded = 0
 					}
@@ -420,34 +718,84 @@ func (f *Fetcher) run(index int, ctx context.Context) (err error) {
 
 				defer resp.Body.Close()
 				if resp.StatusCode != base.HttpCodeOK && resp.StatusCode != base.HttpCodePartialContent {
-					err = NewRequestError(resp.StatusCode, resp.Status)
-					return err
+					return NewResponseError(resp)
+				}
+				if connection.Source == 0 && f.checkRemoteChanged(resp) {
+					return ErrRemoteFileChanged
+				}
+				// The mirror must serve the same file as the request url
+				if connection.Source > 0 && !f.checkSourceSize(resp) {
+					src.disabled.Store(true)
+					return ErrMirrorMismatch
 				}
 				connection.failed = false
+				connection.failures = 0
+				connection.protocol = resp.Proto
+				meter := &stallMeter{}
+				if f.stall != nil {
+					go watchStall(reqCtx, cancelReq, f.stall, meter)
+				}
+				// The read bytes are buffered and written when the buffer is full or the response ends,
+				// the counters are increased after writing, so the stored progress never counts the buffered bytes.
+				filled := 0
+				write := func() error {
+					if f.meta.Res.Range {
+						// The chunk may be shrunk by a helper connection
+						filled = int(min(int64(filled), max(chunk.remain(), 0)))
+					}
+					if filled == 0 {
+						return nil
+					}
+					data, offset := buf[:filled], chunk.Begin+chunk.Downloaded
+					if f.writer != nil {
+						// The writer owns the buffer until it is written
+						buf = getBuffer(f.writeBuffer)
+						if err := f.writer.write(data, offset); err != nil {
+							return err
+						}
+					} else if _, err := f.file.WriteAt(data, offset); err != nil {
+						return err
+					}
+					chunk.Downloaded += int64(filled)
+					connection.Downloaded += int64(filled)
+					filled = 0
+					return nil
+				}
+				// Keep the buffered bytes if the response is interrupted
+				defer func() {
+					if werr := write(); err == nil {
+						err = werr
+					}
+				}()
 				reader := NewTimeoutReader(resp.Body, readTimeout)
 				for {
-					n, err := reader.Read(buf)
+					n, err := reader.Read(buf[filled:])
 					if n > 0 {
+						waitStart := time.Now()
+						if err := f.waitRateLimit(ctx, n); err != nil {
+							return err
+						}
+						meter.waited.Add(int64(time.Since(waitStart)))
+						meter.received.Add(int64(n))
 						finished := false
 						if f.meta.Res.Range {
-							remain := chunk.remain()
+							remain := chunk.remain() - int64(filled)
 							// If downloaded bytes exceed the remain bytes, only write remain bytes
 							if remain < int64(n) {
-								n = int(remain)
+								n = int(max(remain, 0))
 								finished = true
 							}
 						}
-
-						_, err := f.file.WriteAt(buf[:n], chunk.Begin+chunk.Downloaded)
-						if err != nil {
-							return err
-						}
-						chunk.Downloaded += int64(n)
-						connection.Downloaded += int64(n)
+						filled += n
 
 						if finished {
 							return nil
 						}
+						if filled == len(buf) {
+							if err := write(); err != nil {
+								return err
+							}
+						}
 					}
 					if err != nil {
 						if err == io.EOF {
@@ -458,15 +806,52 @@ func (f *Fetcher) run(index int, ctx context.Context) (err error) {
 				}
 			}()
 			if err != nil {
-				// If canceled, do not retry
-				if errors.Is(err, context.Canceled) {
+				// If canceled or failed fatally, do not retry
+				if errors.Is(err, context.Canceled) || isFatal(err) {
 					return
 				}
-				// retry request after 1 second
+				// Re-request the stalled connection after backoff, move to another source if there are mirrors
+				if errors.Is(err, errConnectionStalled) {
+					connection.stalls++
+					connection.stallFailures++
+					src.failures.Add(1)
+					connection.Source = f.nextSource(connection.Source)
+					// The connection keeps stalling, leave the chunk to the running connections or fail if none is left
+					if connection.stallFailures > f.retry.MaxAttempts {
+						if f.handOff(connection) {
+							err = nil
+						}
+						return
+					}
+					if sleepErr := fetcher.SleepBackoff(ctx, fetcher.Backoff(f.retry, connection.stallFailures, err)); sleepErr != nil {
+						err = sleepErr
+						return
+					}
+					continue
+				}
+				var re *RequestError
+				if errors.As(err, &re) {
+					// The server is overloaded, let the adaptive connections back off
+					if re.Code == http.StatusTooManyRequests || re.Code == http.StatusServiceUnavailable {
+						f.throttled.Add(1)
+					}
+					// If the status code is not retryable or the server asks to retry later than the max backoff, fail the connection
+					if !f.retry.Retryable(re.Code) || fetcher.RetryDelayExceeded(f.retry, err) {
+						return
+					}
+				}
+				// retry request after backoff, and move to another source if there are mirrors
 				connection.failed = true
-				time.Sleep(time.Second)
+				connection.failures++
+				src.failures.Add(1)
+				connection.Source = f.nextSource(connection.Source)
+				if sleepErr := fetcher.SleepBackoff(ctx, fetcher.Backoff(f.retry, connection.failures, err)); sleepErr != nil {
+					err = sleepErr
+					return
+				}
 				continue
 			}
+			connection.stallFailures = 0
 			break
 		}
 		return
@@ -476,6 +861,10 @@ func (f *Fetcher) run(index int, ctx context.Context) (err error) {
 		if err = downloadChunk(connection.Chunk); err != nil {
 			return
 		}
+		// The chunk is handed off to the other connections
+		if connection.dropped.Load() {
+			return
+		}
 
 		// check this connection is completed
 		if !f.meta.Res.Range || !f.helpOtherConnection(connection) {
@@ -485,15 +874,62 @@ func (f *Fetcher) run(index int, ctx context.Context) (err error) {
 	}
 }
 
+// waitRateLimit blocks until the read bytes are allowed by both the task and the global speed limits
+func (f *Fetcher) waitRateLimit(ctx context.Context, n int) error {
+	if err := util.WaitRateLimit(ctx, f.limiter, n); err != nil {
+		return err
+	}
+	return util.WaitRateLimit(ctx, f.ctl.DownloadLimiter, n)
+}
+
 func (f *Fetcher) helpOtherConnection(helper *connection) bool {
 	f.helpLock.Lock()
 	defer f.helpLock.Unlock()
 
+	if f.takeChunk(helper) {
+		return true
+	}
+	// Mark the helper completed under the lock, so the dropped connections know it won't take over their chunks
+	helper.Completed = true
+	helper.running = false
+	return false
+}
+
+// handOff drops the stalled connection, its remain chunk is taken over by the other running connections,
+// returns false if no other connection is running.
+func (f *Fetcher) handOff(connection *connection) bool {
+	f.helpLock.Lock()
+	defer f.helpLock.Unlock()
+
+	for _, c := range f.connections {
+		if c != connection && c.running {
+			connection.dropped.Store(true)
+			return true
+		}
+	}
+	return false
+}
+
+// takeChunk assigns a chunk to the helper, the caller must hold the help lock.
+func (f *Fetcher) takeChunk(helper *connection) bool {
+	// take over the remain chunk of the dropped connection
+	for _, r := range f.connections {
+		if r == helper || r.Completed || r.running || !r.dropped.Load() || r.Chunk.remain() <= 0 {
+			continue
+		}
+		helper.Chunk.Begin = r.Chunk.Begin + r.Chunk.Downloaded
+		helper.Chunk.End = r.Chunk.End
+		helper.Chunk.Downloaded = 0
+		r.Chunk.End = helper.Chunk.Begin - 1
+		r.Completed = true
+		return true
+	}
+
 	// find the slowest connection
 	var maxRemainConnection *connection
 	var maxRemain int64
 	for _, r := range f.connections {
-		if r == helper || r.Completed {
+		if r == helper || r.Completed || r.dropped.Load() {
 			continue
 		}
 
@@ -516,60 +952,95 @@ func (f *Fetcher) helpOtherConnection(helper *connection) bool {
 	return true
 }
 
-func (f *Fetcher) buildRequest(ctx context.Context, req *base.Request) (httpReq *http.Request, err error) {
-	var reqUrl string
-	if f.redirectURL != "" {
-		reqUrl = f.redirectURL
-	} else {
-		reqUrl = req.URL
+func (f *Fetcher) buildRequest(ctx context.Context, reqUrl string) (httpReq *http.Request, err error) {
+	var extra *fhttp.ReqExtra
+	if f.meta.Req.Extra != nil {
+		extra = f.meta.Req.Extra.(*fhttp.ReqExtra)
 	}
+	return NewRequest(ctx, reqUrl, extra, f.config.UserAgent)
+}
 
-	var (
-		method string
-		body   io.Reader
-	)
-	headers := http.Header{}
-	if req.Extra == nil {
-		method = http.MethodGet
-	} else {
-		extra := req.Extra.(*fhttp.ReqExtra)
-		if extra.Method != "" {
-			method = extra.Method
-		} else {
-			method = http.MethodGet
-		}
-		if len(extra.Header) > 0 {
-			for k, v := range extra.Header {
-				headers.Set(k, v)
+// buildSources returns the request url and its mirrors
+func (f *Fetcher) buildSources() []*source {
+	sources := []*source{{url: f.meta.Req.URL}}
+	if f.meta.Req.Extra != nil {
+		for _, mirror := range f.meta.Req.Extra.(*fhttp.ReqExtra).Mirrors {
+			if mirror == "" || mirror == f.meta.Req.URL {
+				continue
 			}
+			sources = append(sources, &source{url: mirror})
 		}
-		if extra.Body != "" {
-			body = bytes.NewBufferString(extra.Body)
+	}
+	return sources
+}
+
+// nextSource returns the source with the fewest failures, starting from the next of current source,
+// so that the connections on a failed source will be spread over the others.
+func (f *Fetcher) nextSource(current int) int {
+	next := current
+	var minFailures int32 = -1
+	for i := 1; i <= len(f.sources); i++ {
+		index := (current + i) % len(f.sources)
+		src := f.sources[index]
+		if src.disabled.Load() {
+			continue
+		}
+		if failures := src.failures.Load(); minFailures == -1 || failures < minFailures {
+			next = index
+			minFailures = failures
+		}
+	}
+	return next
+}
+
+// checkSourceSize checks whether the file size of the response matches the resolved resource
+func (f *Fetcher) checkSourceSize(resp *http.Response) bool {
+	if f.meta.Res.Size <= 0 {
+		return true
+	}
+	if resp.StatusCode == base.HttpCodePartialContent {
+		contentTotal := path.Base(resp.Header.Get(base.HttpHeaderContentRange))
+		if contentTotal == "" || contentTotal == "*" {
+			return true
 		}
+		total, err := strconv.ParseInt(contentTotal, 10, 64)
+		return err == nil && total == f.meta.Res.Size
 	}
-	if _, ok := headers[base.HttpHeaderUserAgent]; !ok {
-		headers.Set(base.HttpHeaderUserAgent, f.config.UserAgent)
+	return resp.ContentLength < 0 || resp.ContentLength == f.meta.Res.Size
+}
+
+// ifRange returns the validator for If-Range header, weak etag can't be used for If-Range.
+func (f *Fetcher) ifRange() string {
+	if f.etag != "" && !strings.HasPrefix(f.etag, "W/") {
+		return f.etag
 	}
+	return f.lastModified
+}
 
-	if ctx != nil {
-		httpReq, err = http.NewRequestWithContext(ctx, method, reqUrl, body)
-	} else {
-		httpReq, err = http.NewRequest(method, reqUrl, body)
+// checkRemoteChanged checks whether the remote file is changed since the task was resolved by the validators.
+func (f *Fetcher) checkRemoteChanged(resp *http.Response) bool {
+	if !f.meta.Res.Range {
+		return false
 	}
-	if err != nil {
-		return
+	// The server validates If-Range, it responds the full file instead of the range if the file is changed,
+	// the etag of the response is not compared, it may differ between the nodes of a cdn
+	if resp.Request.Header.Get(base.HttpHeaderIfRange) != "" {
+		return resp.StatusCode == base.HttpCodeOK
 	}
-	httpReq.Header = headers
-	// Override Host header
-	if host := headers.Get(base.HttpHeaderHost); host != "" {
-		httpReq.Host = host
+	// Only a weak etag is available, compare it by the weak comparison
+	if etag := resp.Header.Get(base.HttpHeaderETag); f.etag != "" && etag != "" {
+		return strings.TrimPrefix(etag, "W/") != strings.TrimPrefix(f.etag, "W/")
 	}
-	return httpReq, nil
+	return false
 }
 
 func (f *Fetcher) splitConnection() (connections []*connection) {
 	if f.meta.Res.Range {
 		optConnections := f.meta.Opts.Extra.(*fhttp.OptsExtra).Connections
+		// The adaptive connections start with the min connections and scale up by the throughput
+		if f.adaptive != nil {
+			optConnections = f.adaptive.MinConnections
+		}
 		// 每个连接平均需要下载的分块大小
 		chunkSize := f.meta.Res.Size / int64(optConnections)
 		connections = make([]*connection, optConnections)
@@ -585,7 +1056,8 @@ func (f *Fetcher) splitConnection() (connections []*connection) {
 				end = begin + chunkSize - 1
 			}
 			connections[i] = &connection{
-				Chunk: newChunk(begin, end),
+				Chunk:  newChunk(begin, end),
+				Source: i % len(f.sources),
 			}
 		}
 	} else {
@@ -598,22 +1070,17 @@ func (f *Fetcher) splitConnection() (connections []*connection) {
 	return
 }
 
-func (f *Fetcher) buildClient() *http.Client {
-	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout: connectTimeout,
-		}).DialContext,
-		Proxy: f.ctl.GetProxy(f.meta.Req.Proxy),
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: f.meta.Req.SkipVerifyCert,
-		},
+func (f *Fetcher) buildClient() (*http.Client, error) {
+	client, err := newClient(f.ctl, f.meta.Req, f.protocol, int(f.clients.Add(1)-1))
+	if err != nil {
+		return nil, err
 	}
-	// Cookie handle
-	jar, _ := cookiejar.New(nil)
-	return &http.Client{
-		Transport: transport,
-		Jar:       jar,
+	client.Jar = f.jar
+	client.Transport = &authTransport{
+		next: client.Transport,
+		auth: f.auth,
 	}
+	return client, nil
 }
 
 func decodeMangledString(mangled string) string {
@@ -626,6 +1093,9 @@ func decodeMangledString(mangled string) string {
 
 type fetcherData struct {
 	Connections []*connection
+	// ETag and LastModified are the validators of the remote file, used to detect the remote file changes on resume
+	ETag         string
+	LastModified string
 }
 
 type FetcherManager struct {
@@ -672,16 +1142,20 @@ func (fm *FetcherManager) AutoRename() bool {
 }
 
 func (fm *FetcherManager) DefaultConfig() any {
+	partFile := true
 	return &config{
-		UserAgent:   "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Safari/537.36",
+		UserAgent:   DefaultUserAgent,
 		Connections: 16,
+		PartFile:    &partFile,
 	}
 }
 
 func (fm *FetcherManager) Store(f fetcher.Fetcher) (data any, err error) {
 	_f := f.(*Fetcher)
 	return &fetcherData{
-		Connections: _f.connections,
+		Connections:  _f.storedConnections(),
+		ETag:         _f.etag,
+		LastModified: _f.lastModified,
 	}, nil
 }
 
@@ -696,6 +1170,8 @@ func (fm *FetcherManager) Restore() (v any, f func(meta *fetcher.FetcherMeta, v
 		if len(fd.Connections) > 0 {
 			fetcher.connections = fd.Connections
 		}
+		fetcher.etag = fd.ETag
+		fetcher.lastModified = fd.LastModified
 		return fetcher
 	}
 }
@@ -1,17 +1,32 @@
 package http
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/GopeedLab/gopeed/internal/controller"
 	"github.com/GopeedLab/gopeed/internal/fetcher"
+	"github.com/GopeedLab/gopeed/internal/hostlimit"
+	"github.com/GopeedLab/gopeed/internal/resolver"
 	"github.com/GopeedLab/gopeed/internal/test"
 	"github.com/GopeedLab/gopeed/pkg/base"
 	"github.com/GopeedLab/gopeed/pkg/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/util"
+	"github.com/quic-go/quic-go/http3"
+	"io"
+	"log"
+	"math/rand"
 	"net"
 	gohttp "net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -213,6 +228,1423 @@ func TestFetcher_DownloadWithProxy(t *testing.T) {
 	downloadWithProxy(httpListener, proxyListener, t)
 }
 
+func TestFetcher_DownloadWithMirrors(t *testing.T) {
+	listener := test.StartTestFileServer()
+	defer listener.Close()
+	mirrorListener := test.StartTestFileServer()
+	defer mirrorListener.Close()
+	// An unavailable mirror, the connections on it should be moved to the others
+	deadListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadMirror := "http://" + deadListener.Addr().String() + "/" + test.BuildName
+	deadListener.Close()
+
+	fetcher := downloadReady(listener, 6, t)
+	fetcher.Meta().Req.Extra = &http.ReqExtra{
+		Mirrors: []string{
+			"http://" + mirrorListener.Addr().String() + "/" + test.BuildName,
+			deadMirror,
+		},
+	}
+	err = fetcher.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fetcher.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := test.FileMd5(test.BuildFile)
+	got := test.FileMd5(test.DownloadFile)
+	if want != got {
+		t.Errorf("Download() got = %v, want %v", got, want)
+	}
+	stats := fetcher.Stats().(*http.Stats)
+	var mirrorDownloaded int64
+	for _, conn := range stats.Connections {
+		if conn.URL == deadMirror {
+			t.Errorf("Stats() got = %v, want connection moved to another source", conn.URL)
+		}
+		if strings.Contains(conn.URL, mirrorListener.Addr().String()) {
+			mirrorDownloaded += conn.Downloaded
+		}
+	}
+	if mirrorDownloaded == 0 {
+		t.Errorf("Stats() got = %v, want mirror downloaded bytes > 0", mirrorDownloaded)
+	}
+}
+
+func TestFetcher_DownloadWithMismatchMirror(t *testing.T) {
+	listener := test.StartTestFileServer()
+	defer listener.Close()
+	mismatchServer := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			w.Header().Set("Content-Range", "bytes 0-0/1")
+			w.WriteHeader(base.HttpCodePartialContent)
+			w.Write([]byte{0})
+		}),
+	}
+	mismatchListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go mismatchServer.Serve(mismatchListener)
+	defer mismatchServer.Close()
+
+	fetcher := downloadReady(listener, 4, t)
+	fetcher.Meta().Req.Extra = &http.ReqExtra{
+		Mirrors: []string{
+			"http://" + mismatchListener.Addr().String() + "/" + test.BuildName,
+		},
+	}
+	err = fetcher.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fetcher.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := test.FileMd5(test.BuildFile)
+	got := test.FileMd5(test.DownloadFile)
+	if want != got {
+		t.Errorf("Download() got = %v, want %v", got, want)
+	}
+}
+
+func TestFetcher_DownloadSpeedLimit(t *testing.T) {
+	data := make([]byte, 256*1024)
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		taskLimit   int64
+		globalLimit int64
+	}{
+		{
+			name:      "task",
+			taskLimit: 128 * 1024,
+		},
+		{
+			name:        "global",
+			globalLimit: 128 * 1024,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := downloadReady(listener, 4, t)
+			fetcher.Meta().Opts.DownloadLimit = tt.taskLimit
+			util.SetRateLimit(fetcher.(*Fetcher).ctl.DownloadLimiter, tt.globalLimit)
+
+			start := time.Now()
+			if err := fetcher.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := fetcher.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			// The first 128KB is allowed immediately by the burst, the rest needs one second
+			if used := time.Since(start); used < 900*time.Millisecond {
+				t.Errorf("Download() used = %v, want >= %v", used, time.Second)
+			}
+			if got := fetcher.Progress().TotalDownloaded(); got != int64(len(data)) {
+				t.Errorf("Download() got = %v, want %v", got, len(data))
+			}
+		})
+	}
+}
+
+func TestFetcher_DownloadResumeRemoteChanged(t *testing.T) {
+	contents := [][]byte{
+		bytes.Repeat([]byte{1}, 512*1024),
+		bytes.Repeat([]byte{2}, 512*1024),
+	}
+	type remote struct {
+		etag    string
+		content []byte
+		// ifRangeMatch makes the server treat If-Range as matched regardless of the etag, like a cdn node
+		ifRangeMatch bool
+	}
+	var current atomic.Pointer[remote]
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			rm := current.Load()
+			w.Header().Set(base.HttpHeaderETag, rm.etag)
+			if rm.ifRangeMatch {
+				r.Header.Del(base.HttpHeaderIfRange)
+			}
+			gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(rm.content))
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		before  *remote
+		after   *remote
+		changed bool
+	}{
+		{
+			name:   "unchanged",
+			before: &remote{etag: `"v0"`, content: contents[0]},
+			after:  &remote{etag: `"v0"`, content: contents[0]},
+		},
+		{
+			name:    "changed",
+			before:  &remote{etag: `"v0"`, content: contents[0]},
+			after:   &remote{etag: `"v1"`, content: contents[1]},
+			changed: true,
+		},
+		{
+			name:   "cdn node etag",
+			before: &remote{etag: `"node1"`, content: contents[0]},
+			after:  &remote{etag: `"node2"`, content: contents[0], ifRangeMatch: true},
+		},
+		{
+			name:   "weak etag unchanged",
+			before: &remote{etag: `W/"v0"`, content: contents[0]},
+			after:  &remote{etag: `"v0"`, content: contents[0]},
+		},
+		{
+			name:    "weak etag changed",
+			before:  &remote{etag: `W/"v0"`, content: contents[0]},
+			after:   &remote{etag: `W/"v1"`, content: contents[1]},
+			changed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current.Store(tt.before)
+			fetcher := downloadReady(listener, 4, t)
+			fetcher.Meta().Opts.DownloadLimit = 256 * 1024
+			if err := fetcher.Start(); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond * 500)
+			if err := fetcher.Pause(); err != nil {
+				t.Fatal(err)
+			}
+			fm := new(FetcherManager)
+			data, err := fm.Store(fetcher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			current.Store(tt.after)
+
+			v, f := fm.Restore()
+			json.Unmarshal([]byte(test.ToJson(data)), v)
+			restored := f(fetcher.Meta(), v)
+			restored.Setup(fetcher.(*Fetcher).ctl)
+			if err := restored.Start(); err != nil {
+				t.Fatal(err)
+			}
+			err = restored.Wait()
+			if tt.changed {
+				if !errors.Is(err, ErrRemoteFileChanged) {
+					t.Errorf("Download() got = %v, want %v", err, ErrRemoteFileChanged)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(test.DownloadFile)
+			if !bytes.Equal(got, contents[0]) {
+				t.Errorf("Download() got = %v bytes, want %v bytes", len(got), len(contents[0]))
+			}
+		})
+	}
+}
+
+func TestFetcher_DownloadRetryPolicy(t *testing.T) {
+	data := make([]byte, 64*1024)
+	var requests atomic.Int32
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			switch r.URL.Path {
+			case "/limited":
+				// The first download request is rate limited
+				if requests.Add(1) == 2 {
+					w.Header().Set(base.HttpHeaderRetryAfter, "1")
+					w.WriteHeader(gohttp.StatusTooManyRequests)
+					return
+				}
+				gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+			default:
+				// Only the resolve request succeeds
+				if r.Header.Get(base.HttpHeaderRange) == "bytes=0-0" {
+					gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+					return
+				}
+				w.WriteHeader(gohttp.StatusForbidden)
+			}
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	download := func(path string, retry *http.RetryPolicy) (time.Duration, error) {
+		fetcher := buildFetcher()
+		if err := fetcher.Resolve(&base.Request{
+			URL: "http://" + listener.Addr().String() + path,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fetcher.Create(&base.Options{
+			Name: test.DownloadName,
+			Path: test.Dir,
+			Extra: http.OptsExtra{
+				Connections: 1,
+				Retry:       retry,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if err := fetcher.Start(); err != nil {
+			t.Fatal(err)
+		}
+		err := fetcher.Wait()
+		return time.Since(start), err
+	}
+
+	used, err := download("/limited", &http.RetryPolicy{
+		BaseBackoff: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used < 900*time.Millisecond {
+		t.Errorf("Download() used = %v, want >= %v", used, time.Second)
+	}
+
+	used, err = download("/forbidden", &http.RetryPolicy{
+		RetryableCodes: []int{gohttp.StatusTooManyRequests},
+	})
+	var re *RequestError
+	if !errors.As(err, &re) || re.Code != gohttp.StatusForbidden {
+		t.Errorf("Download() got = %v, want %v", err, gohttp.StatusForbidden)
+	}
+	if used > 500*time.Millisecond {
+		t.Errorf("Download() used = %v, want no retry", used)
+	}
+}
+
+func TestFetcher_DownloadWithResolveCookie(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 256*1024)
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			if _, err := r.Cookie("session"); err != nil {
+				// Only the resolve request is allowed without cookie
+				if r.Header.Get(base.HttpHeaderRange) != fmt.Sprintf(base.HttpHeaderRangeFormat, 0, 0) {
+					w.WriteHeader(gohttp.StatusForbidden)
+					return
+				}
+				gohttp.SetCookie(w, &gohttp.Cookie{Name: "session", Value: "1", Path: "/"})
+			}
+			gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	os.Remove(test.DownloadFile)
+	defer os.Remove(test.DownloadFile)
+	fetcher := downloadReady(listener, 4, t)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(test.DownloadFile)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Download() got = %v bytes, want %v bytes", len(got), len(data))
+	}
+}
+
+func TestFetcher_DownloadWithAuth(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 256*1024)
+	const (
+		username = "user"
+		password = "pass"
+		token    = "token"
+		realm    = "test"
+		nonce    = "abcdef"
+	)
+	var challenges atomic.Int32
+	newServer := func(scheme string) net.Listener {
+		server := gohttp.Server{
+			Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+				authorization := r.Header.Get(base.HttpHeaderAuthorization)
+				var ok bool
+				switch scheme {
+				case "basic":
+					u, p, has := r.BasicAuth()
+					ok = has && u == username && p == password
+				case "bearer":
+					ok = authorization == "Bearer "+token
+				case "digest":
+					if cs := parseChallenges([]string{authorization}); len(cs) == 1 && cs[0].scheme == "digest" {
+						params := cs[0].params
+						nc, _ := strconv.ParseUint(params["nc"], 16, 32)
+						c := &digestChallenge{realm: realm, nonce: nonce, qop: "auth"}
+						want := parseChallenges([]string{c.authorization(r.Method, params["uri"], username, password, params["cnonce"], uint32(nc))})
+						ok = params["uri"] == r.URL.RequestURI() && params["response"] == want[0].params["response"]
+					}
+				}
+				if !ok {
+					challenges.Add(1)
+					if scheme == "digest" {
+						w.Header().Set(base.HttpHeaderWWWAuthenticate, fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth"`, realm, nonce))
+					} else {
+						w.Header().Set(base.HttpHeaderWWWAuthenticate, fmt.Sprintf(`Basic realm="%s"`, realm))
+					}
+					w.WriteHeader(gohttp.StatusUnauthorized)
+					return
+				}
+				gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+			}),
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(listener)
+		t.Cleanup(func() {
+			server.Close()
+		})
+		return listener
+	}
+
+	netrcFile := test.Dir + "/.netrc"
+	if err := os.WriteFile(netrcFile, []byte("machine 127.0.0.1 login "+username+" password "+password+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(netrcFile)
+
+	tests := []struct {
+		name           string
+		scheme         string
+		auth           *http.Auth
+		netrc          bool
+		wantChallenges int32
+	}{
+		{
+			name:   "basic",
+			scheme: "basic",
+			auth:   &http.Auth{Type: http.AuthTypeBasic, Username: username, Password: password},
+		},
+		{
+			name:   "bearer",
+			scheme: "bearer",
+			auth:   &http.Auth{Type: http.AuthTypeBearer, Token: token},
+		},
+		{
+			name:           "digest",
+			scheme:         "digest",
+			auth:           &http.Auth{Type: http.AuthTypeDigest, Username: username, Password: password},
+			wantChallenges: 1,
+		},
+		{
+			name:           "auto basic",
+			scheme:         "basic",
+			auth:           &http.Auth{Username: username, Password: password},
+			wantChallenges: 1,
+		},
+		{
+			name:           "netrc digest",
+			scheme:         "digest",
+			netrc:          true,
+			wantChallenges: 1,
+		},
+		{
+			name:   "unauthorized",
+			scheme: "basic",
+			auth:   &http.Auth{Type: http.AuthTypeBasic, Username: username, Password: "wrong"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenges.Store(0)
+			listener := newServer(tt.scheme)
+			cfg := config{Connections: 4}
+			if tt.netrc {
+				cfg.Netrc = netrcFile
+			}
+			f := buildConfigFetcher(cfg)
+			err := f.Resolve(&base.Request{
+				URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+				Extra: &http.ReqExtra{
+					Auth: tt.auth,
+				},
+			})
+			if tt.name == "unauthorized" {
+				var re *RequestError
+				if !errors.As(err, &re) || re.Code != gohttp.StatusUnauthorized {
+					t.Fatalf("Resolve() got = %v, want 401", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Create(&base.Options{
+				Name: test.DownloadName,
+				Path: test.Dir,
+				Extra: http.OptsExtra{
+					Connections: 4,
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(test.DownloadFile)
+			if err := f.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(test.DownloadFile)
+			if !bytes.Equal(got, data) {
+				t.Errorf("Download() got = %v bytes, want %v bytes", len(got), len(data))
+			}
+			if challenges.Load() != tt.wantChallenges {
+				t.Errorf("Download() challenges got = %v, want %v", challenges.Load(), tt.wantChallenges)
+			}
+		})
+	}
+}
+
+func TestFetcher_DownloadWithTLS(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 256*1024)
+	serverCert, serverKey := test.GenerateCert()
+	clientCert, clientKey := test.GenerateCert()
+	serverPair, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+		}),
+		// Suppress the handshake error logs
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	caFile := test.Dir + "ca.pem"
+	if err := os.WriteFile(caFile, serverCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile)
+
+	tests := []struct {
+		name           string
+		tls            *base.TLSConfig
+		skipVerifyCert bool
+		wantErr        bool
+	}{
+		{
+			name: "ca and client cert",
+			tls:  &base.TLSConfig{CaCert: string(serverCert), ClientCert: string(clientCert), ClientKey: string(clientKey)},
+		},
+		{
+			name: "ca file",
+			tls:  &base.TLSConfig{CaCert: caFile, ClientCert: string(clientCert), ClientKey: string(clientKey)},
+		},
+		{
+			name:           "skip verify cert",
+			tls:            &base.TLSConfig{ClientCert: string(clientCert), ClientKey: string(clientKey)},
+			skipVerifyCert: true,
+		},
+		{
+			name:    "no client cert",
+			tls:     &base.TLSConfig{CaCert: string(serverCert)},
+			wantErr: true,
+		},
+		{
+			name:    "unknown ca",
+			tls:     &base.TLSConfig{ClientCert: string(clientCert), ClientKey: string(clientKey)},
+			wantErr: true,
+		},
+		{
+			name:    "invalid ca",
+			tls:     &base.TLSConfig{CaCert: "-----BEGIN CERTIFICATE-----"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := buildFetcher()
+			err := f.Resolve(&base.Request{
+				URL:            "https://" + listener.Addr().String() + "/" + test.BuildName,
+				TLS:            tt.tls,
+				SkipVerifyCert: tt.skipVerifyCert,
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Resolve() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Create(&base.Options{
+				Name: test.DownloadName,
+				Path: test.Dir,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(test.DownloadFile)
+			if err := f.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(test.DownloadFile)
+			if !bytes.Equal(got, data) {
+				t.Errorf("Download() got = %v bytes, want %v bytes", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestFetcher_DownloadWithProtocol(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 256*1024)
+	// remoteAddrs records the client connections of the download requests
+	var remoteAddrs sync.Map
+	handler := gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		if r.Header.Get(base.HttpHeaderRange) != fmt.Sprintf(base.HttpHeaderRangeFormat, 0, 0) {
+			remoteAddrs.Store(r.RemoteAddr, true)
+		}
+		gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+	})
+	cert, key := test.GenerateCert()
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcpListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer := &gohttp.Server{Handler: handler}
+	go tcpServer.Serve(tcpListener)
+	defer tcpServer.Close()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quicServer := &http3.Server{
+		Handler: handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{pair},
+		}),
+	}
+	go quicServer.Serve(udpConn)
+	defer quicServer.Close()
+
+	tests := []struct {
+		name           string
+		configProtocol http.Protocol
+		optsProtocol   http.Protocol
+		addr           string
+		want           string
+		// wantConns is the count of client connections, zero means not checked
+		wantConns int
+	}{
+		{
+			name: "default",
+			addr: tcpListener.Addr().String(),
+			want: "HTTP/1.1",
+		},
+		{
+			name:           "http2",
+			configProtocol: http.ProtocolHTTP2,
+			addr:           tcpListener.Addr().String(),
+			want:           "HTTP/2.0",
+			wantConns:      1,
+		},
+		{
+			name:           "force http1 by options",
+			configProtocol: http.ProtocolHTTP2,
+			optsProtocol:   http.ProtocolHTTP1,
+			addr:           tcpListener.Addr().String(),
+			want:           "HTTP/1.1",
+		},
+		{
+			name:           "http3",
+			configProtocol: http.ProtocolHTTP3,
+			addr:           udpConn.LocalAddr().String(),
+			want:           "HTTP/3.0",
+			wantConns:      1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remoteAddrs.Clear()
+			f := buildConfigFetcher(config{Connections: 4, Protocol: tt.configProtocol})
+			req := &base.Request{
+				URL: "https://" + tt.addr + "/" + test.BuildName,
+				TLS: &base.TLSConfig{CaCert: string(cert)},
+			}
+			if err := f.Resolve(req); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Create(&base.Options{
+				Name: test.DownloadName,
+				Path: test.Dir,
+				Extra: http.OptsExtra{
+					Connections: 4,
+					Protocol:    tt.optsProtocol,
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(test.DownloadFile)
+			if err := f.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(test.DownloadFile)
+			if !bytes.Equal(got, data) {
+				t.Errorf("Download() got = %v bytes, want %v bytes", len(got), len(data))
+			}
+			for _, c := range f.Stats().(*http.Stats).Connections {
+				if c.Protocol != tt.want {
+					t.Errorf("Stats() protocol got = %v, want %v", c.Protocol, tt.want)
+				}
+			}
+			if tt.wantConns > 0 {
+				conns := 0
+				remoteAddrs.Range(func(key, value any) bool {
+					conns++
+					return true
+				})
+				if conns != tt.wantConns {
+					t.Errorf("Download() connections got = %v, want %v", conns, tt.wantConns)
+				}
+			}
+		})
+	}
+}
+
+// rateReader limits the throughput of each response, so the aggregate speed rises with the connections
+type rateReader struct {
+	*bytes.Reader
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	return r.Reader.Read(p[:min(len(p), 32*1024)])
+}
+
+func TestFetcher_DownloadWithAdaptive(t *testing.T) {
+	defer func(interval time.Duration) {
+		adaptiveInterval = interval
+	}(adaptiveInterval)
+	adaptiveInterval = 100 * time.Millisecond
+
+	data := make([]byte, 8*1024*1024)
+	rand.Read(data)
+	var (
+		active    atomic.Int32
+		maxActive atomic.Int32
+		// throttleAt is the active requests which the server starts responding 429, 0 means no limit
+		throttleAt atomic.Int32
+	)
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			n := active.Add(1)
+			defer active.Add(-1)
+			if limit := throttleAt.Load(); limit > 0 && n >= limit {
+				w.WriteHeader(gohttp.StatusTooManyRequests)
+				return
+			}
+			for {
+				m := maxActive.Load()
+				if n <= m || maxActive.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			gohttp.ServeContent(w, r, test.BuildName, time.Time{}, &rateReader{bytes.NewReader(data)})
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	download := func(adaptive *http.AdaptiveConnections) *Fetcher {
+		fetcher := buildFetcher()
+		if err := fetcher.Resolve(&base.Request{
+			URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fetcher.Create(&base.Options{
+			Name: test.DownloadName,
+			Path: test.Dir,
+			Extra: http.OptsExtra{
+				Connections: 4,
+				Adaptive:    adaptive,
+				Retry: &http.RetryPolicy{
+					BaseBackoff: 10,
+					MaxBackoff:  50,
+				},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fetcher.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := fetcher.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(test.DownloadFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Download() got = %v, want %v", len(got), len(data))
+		}
+		os.Remove(test.DownloadFile)
+		return fetcher
+	}
+
+	t.Run("scale up", func(t *testing.T) {
+		maxActive.Store(0)
+		fetcher := download(&http.AdaptiveConnections{
+			Enable:         true,
+			MinConnections: 1,
+		})
+		// The max connections defaults to the connections of the options
+		if got := maxActive.Load(); got < 2 || got > 4 {
+			t.Errorf("Download() max active connections = %v, want [2, 4]", got)
+		}
+		var downloaded int64
+		for _, c := range fetcher.Stats().(*http.Stats).Connections {
+			downloaded += c.Downloaded
+		}
+		if downloaded != int64(len(data)) {
+			t.Errorf("Download() downloaded = %v, want %v", downloaded, len(data))
+		}
+	})
+
+	t.Run("drop when throttled", func(t *testing.T) {
+		throttleAt.Store(3)
+		defer throttleAt.Store(0)
+		fetcher := download(&http.AdaptiveConnections{
+			Enable:         true,
+			MinConnections: 1,
+			MaxConnections: 8,
+		})
+		dropped := 0
+		for _, c := range fetcher.snapshotConnections() {
+			if c.dropped.Load() {
+				dropped++
+			}
+		}
+		if dropped == 0 {
+			t.Errorf("Download() dropped connections = 0, want > 0")
+		}
+	})
+
+	t.Run("fixed connections", func(t *testing.T) {
+		maxActive.Store(0)
+		fetcher := download(nil)
+		if got := len(fetcher.Stats().(*http.Stats).Connections); got != 4 {
+			t.Errorf("Stats() connections = %v, want %v", got, 4)
+		}
+	})
+}
+
+func TestFetcher_DownloadWithStall(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	var requests atomic.Int32
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			// The first download request trickles a few bytes per second
+			if r.Header.Get(base.HttpHeaderRange) != "bytes=0-0" && requests.Add(1) == 1 {
+				w.Header().Set(base.HttpHeaderContentRange, fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+				w.WriteHeader(gohttp.StatusPartialContent)
+				for i := 0; i < 100; i++ {
+					if _, err := w.Write(data[i : i+1]); err != nil {
+						return
+					}
+					w.(gohttp.Flusher).Flush()
+					time.Sleep(100 * time.Millisecond)
+				}
+				return
+			}
+			gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fetcher := buildConfigFetcher(config{
+		Connections: 1,
+		Stall: &http.StallDetection{
+			MinSpeed: 1024,
+			Window:   300,
+		},
+	})
+	if err := fetcher.Resolve(&base.Request{
+		URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Create(&base.Options{
+		Name: test.DownloadName,
+		Path: test.Dir,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(test.DownloadFile)
+	start := time.Now()
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if used := time.Since(start); used > 3*time.Second {
+		t.Errorf("Download() used = %v, want the stalled connection re-requested", used)
+	}
+	got, err := os.ReadFile(test.DownloadFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Download() got = %v, want %v", len(got), len(data))
+	}
+	stats := fetcher.Stats().(*http.Stats)
+	if stats.Connections[0].Stalls != 1 {
+		t.Errorf("Stats() stalls = %v, want %v", stats.Connections[0].Stalls, 1)
+	}
+}
+
+func TestFetcher_DownloadWithPersistentStall(t *testing.T) {
+	data := make([]byte, 256*1024)
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			if r.Header.Get(base.HttpHeaderRange) == "bytes=0-0" {
+				gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+				return
+			}
+			// All download requests trickle
+			w.Header().Set(base.HttpHeaderContentRange, fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+			w.WriteHeader(gohttp.StatusPartialContent)
+			for i := 0; i < 100; i++ {
+				if _, err := w.Write(data[i : i+1]); err != nil {
+					return
+				}
+				w.(gohttp.Flusher).Flush()
+				time.Sleep(100 * time.Millisecond)
+			}
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fetcher := buildConfigFetcher(config{
+		Connections: 1,
+		Retry: &http.RetryPolicy{
+			MaxAttempts: 2,
+			BaseBackoff: 10,
+		},
+		Stall: &http.StallDetection{
+			MinSpeed: 1024,
+			Window:   200,
+		},
+	})
+	if err := fetcher.Resolve(&base.Request{
+		URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Create(&base.Options{
+		Name: test.DownloadName,
+		Path: test.Dir,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The failed download is left in the part file
+	defer os.Remove(fetcher.Meta().PartFilepath())
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); !errors.Is(err, errConnectionStalled) {
+		t.Errorf("Download() got = %v, want %v", err, errConnectionStalled)
+	}
+	// The stalled connection is re-requested until the retry times are used up
+	stats := fetcher.Stats().(*http.Stats)
+	if stats.Connections[0].Stalls != 3 {
+		t.Errorf("Stats() stalls = %v, want %v", stats.Connections[0].Stalls, 3)
+	}
+}
+
+func TestFetcher_DownloadWithStallHandOff(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	var stalled atomic.Int32
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			rangeHeader := r.Header.Get(base.HttpHeaderRange)
+			if rangeHeader == "bytes=0-0" {
+				gohttp.ServeContent(w, r, test.BuildName, time.Time{}, bytes.NewReader(data))
+				return
+			}
+			// The requests of the first chunk stall until the chunk is handed off
+			if strings.HasPrefix(rangeHeader, "bytes=0-") && stalled.Add(1) <= 3 {
+				w.Header().Set(base.HttpHeaderContentRange, fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+				w.WriteHeader(gohttp.StatusPartialContent)
+				w.(gohttp.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+			// The other requests are slow but not stalled, so the connection is still running when the chunk is handed off
+			var begin, end int
+			fmt.Sscanf(rangeHeader, "bytes=%d-%d", &begin, &end)
+			w.Header().Set(base.HttpHeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", begin, end, len(data)))
+			w.WriteHeader(gohttp.StatusPartialContent)
+			for i := begin; i <= end; i += 8 * 1024 {
+				if _, err := w.Write(data[i:min(i+8*1024, end+1)]); err != nil {
+					return
+				}
+				w.(gohttp.Flusher).Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fetcher := buildConfigFetcher(config{
+		Connections: 2,
+		Retry: &http.RetryPolicy{
+			MaxAttempts: 2,
+			BaseBackoff: 10,
+		},
+		Stall: &http.StallDetection{
+			MinSpeed: 1024,
+			Window:   200,
+		},
+	})
+	if err := fetcher.Resolve(&base.Request{
+		URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Create(&base.Options{
+		Name: test.DownloadName,
+		Path: test.Dir,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(test.DownloadFile)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(test.DownloadFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Download() got = %v, want %v", len(got), len(data))
+	}
+	stats := fetcher.Stats().(*http.Stats)
+	if stats.Connections[0].Stalls != 3 {
+		t.Errorf("Stats() stalls = %v, want %v", stats.Connections[0].Stalls, 3)
+	}
+}
+
+func TestFetcher_DownloadWithPartFile(t *testing.T) {
+	listener := test.StartTestSlowFileServer(500 * time.Millisecond)
+	defer listener.Close()
+
+	download := func(partFile bool) {
+		os.Remove(test.DownloadFile)
+		fetcher := doDownloadReady(buildConfigFetcher(config{
+			Connections: 1,
+			PartFile:    &partFile,
+		}), listener, 0, t)
+		if err := fetcher.Start(); err != nil {
+			t.Fatal(err)
+		}
+		partName := fetcher.Meta().PartFilepath()
+		if got := util.IsExistsFile(partName); got != partFile {
+			t.Errorf("Start() part file exists = %v, want %v", got, partFile)
+		}
+		if got := util.IsExistsFile(test.DownloadFile); got == partFile {
+			t.Errorf("Start() file exists = %v, want %v", got, !partFile)
+		}
+		if err := fetcher.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if util.IsExistsFile(partName) {
+			t.Errorf("Wait() part file exists = true, want false")
+		}
+		want := test.FileMd5(test.BuildFile)
+		got := test.FileMd5(test.DownloadFile)
+		if want != got {
+			t.Errorf("Download() got = %v, want %v", got, want)
+		}
+		os.Remove(test.DownloadFile)
+	}
+
+	download(true)
+	download(false)
+}
+
+func TestFetcher_DownloadWithChunkHash(t *testing.T) {
+	data := make([]byte, 2*1024*1024)
+	rand.Read(data)
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			gohttp.ServeContent(w, r, test.BuildName, time.Time{}, &rateReader{bytes.NewReader(data)})
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	cfg := config{
+		Connections: 2,
+		ChunkHash:   true,
+	}
+	fetcher := buildConfigFetcher(cfg)
+	if err := fetcher.Resolve(&base.Request{
+		URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Create(&base.Options{
+		Name: test.DownloadName,
+		Path: test.Dir,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(test.DownloadFile)
+	defer os.Remove(fetcher.Meta().PartFilepath())
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := fetcher.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := new(FetcherManager)
+	stored, err := fm.Store(fetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := stored.(*fetcherData).Connections[0].Chunk
+	if chunk.Downloaded == 0 || chunk.TailHash == 0 {
+		t.Fatalf("Store() chunk = %+v, want downloaded and hashed", chunk)
+	}
+	// Corrupt the last downloaded byte of the first chunk, as if it was lost before reaching disk
+	file, err := os.OpenFile(fetcher.Meta().PartFilepath(), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := chunk.Begin + chunk.Downloaded - 1
+	if _, err := file.WriteAt([]byte{^data[offset]}, offset); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	_, restore := fm.Restore()
+	restored := restore(fetcher.Meta(), stored)
+	ctl := controller.NewController()
+	ctl.GetConfig = func(v any) {
+		json.Unmarshal([]byte(test.ToJson(cfg)), v)
+	}
+	restored.Setup(ctl)
+	if err := restored.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(test.DownloadFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Download() got = %v, want the corrupted chunk downloaded again", len(got))
+	}
+}
+
+func TestFetcher_DownloadWithWriteBuffer(t *testing.T) {
+	listener := test.StartTestFileServer()
+	defer listener.Close()
+
+	download := func(cfg config) {
+		fetcher := doDownloadReady(buildConfigFetcher(cfg), listener, 0, t)
+		if err := fetcher.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := fetcher.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		want := test.FileMd5(test.BuildFile)
+		got := test.FileMd5(test.DownloadFile)
+		if want != got {
+			t.Errorf("Download() got = %v, want %v", got, want)
+		}
+		os.Remove(test.DownloadFile)
+	}
+
+	// The buffer size is not aligned with the chunks
+	download(config{Connections: 4, WriteBuffer: 1000})
+	download(config{Connections: 4, WriteBuffer: 1000, SingleWriter: true})
+	download(config{Connections: 16, SingleWriter: true})
+}
+
+func TestFetcher_DownloadWithResolver(t *testing.T) {
+	listener := test.StartTestFileServer()
+	defer listener.Close()
+
+	fetcher := buildFetcher()
+	fetcher.ctl.Resolver = resolver.New(&base.DNSConfig{
+		Hosts: []string{"gopeed.test:*:127.0.0.1"},
+	})
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	if err := fetcher.Resolve(&base.Request{
+		URL: "http://" + net.JoinHostPort("gopeed.test", port) + "/" + test.BuildName,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Create(&base.Options{
+		Name: test.DownloadName,
+		Path: test.Dir,
+		Extra: http.OptsExtra{
+			Connections: 4,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(test.DownloadFile)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	want := test.FileMd5(test.BuildFile)
+	got := test.FileMd5(test.DownloadFile)
+	if want != got {
+		t.Errorf("Download() got = %v, want %v", got, want)
+	}
+}
+
+func TestFetcher_DownloadWithBind(t *testing.T) {
+	// The test file server builds the test file, the bound connections are sent to the server recording their addresses
+	fileServer := test.StartTestFileServer()
+	defer fileServer.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var remotes sync.Map
+	go gohttp.Serve(listener, gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		remotes.Store(host, true)
+		gohttp.FileServer(gohttp.Dir(test.Dir)).ServeHTTP(w, r)
+	}))
+
+	fetcher := buildFetcher()
+	if err := fetcher.Resolve(&base.Request{
+		URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+		Bind: &base.BindConfig{
+			Addresses: []string{"127.0.0.2", "127.0.0.3"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Create(&base.Options{
+		Name: test.DownloadName,
+		Path: test.Dir,
+		Extra: http.OptsExtra{
+			Connections: 4,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(test.DownloadFile)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	want := test.FileMd5(test.BuildFile)
+	got := test.FileMd5(test.DownloadFile)
+	if want != got {
+		t.Errorf("Download() got = %v, want %v", got, want)
+	}
+	// The connections are spread across the bind addresses
+	for _, ip := range []string{"127.0.0.2", "127.0.0.3"} {
+		if _, ok := remotes.Load(ip); !ok {
+			t.Errorf("Download() no connection from %v", ip)
+		}
+	}
+	remotes.Range(func(key, value any) bool {
+		if key != "127.0.0.2" && key != "127.0.0.3" {
+			t.Errorf("Download() unexpected connection from %v", key)
+		}
+		return true
+	})
+}
+
+func TestFetcher_DownloadWithHostLimit(t *testing.T) {
+	// The test file server builds the test file, the limited connections are sent to the server counting them
+	fileServer := test.StartTestFileServer()
+	defer fileServer.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var active, maxActive atomic.Int32
+	go gohttp.Serve(listener, gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		active.Add(1)
+		defer active.Add(-1)
+		// The client releases the slot once the body is read, so the next connection may arrive just before
+		// the previous handler returns, sample the count in the middle of the request when that overlap is gone
+		time.Sleep(10 * time.Millisecond)
+		n := active.Load()
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		gohttp.FileServer(gohttp.Dir(test.Dir)).ServeHTTP(w, r)
+	}))
+
+	// The tasks share the limiter of the downloader
+	limiter := hostlimit.New(&base.HostLimitConfig{MaxConnections: 3})
+	var fetchers []*Fetcher
+	for _, name := range []string{test.DownloadName, test.DownloadRename} {
+		fetcher := buildFetcher()
+		fetcher.ctl.HostLimiter = limiter
+		if err := fetcher.Resolve(&base.Request{
+			URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fetcher.Create(&base.Options{
+			Name: name,
+			Path: test.Dir,
+			Extra: http.OptsExtra{
+				Connections: 4,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(test.Dir + name)
+		fetchers = append(fetchers, fetcher)
+	}
+	// The connections of the resolve requests are not limited
+	maxActive.Store(0)
+	for _, fetcher := range fetchers {
+		if err := fetcher.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fetcher := range fetchers {
+		if err := fetcher.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := test.FileMd5(test.BuildFile)
+	for _, file := range []string{test.DownloadFile, test.DownloadRenameFile} {
+		if got := test.FileMd5(file); want != got {
+			t.Errorf("Download() got = %v, want %v", got, want)
+		}
+	}
+	if got := maxActive.Load(); got > 3 {
+		t.Errorf("Download() max connections = %v, want <= %v", got, 3)
+	}
+	if got := limiter.Active(listener.Addr().(*net.TCPAddr).IP.String()); got != 0 {
+		t.Errorf("Download() active connections = %v, want %v", got, 0)
+	}
+}
+
 func TestFetcher_ConfigConnections(t *testing.T) {
 	listener := test.StartTestFileServer()
 	defer listener.Close()
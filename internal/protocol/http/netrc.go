@@ -0,0 +1,102 @@
+package http
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+type netrcMachine struct {
+	name     string
+	login    string
+	password string
+}
+
+// netrc is the parsed .netrc file, the default machine is used when no machine matches.
+type netrc struct {
+	machines []*netrcMachine
+	def      *netrcMachine
+}
+
+func loadNetrc(path string) (*netrc, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseNetrc(file)
+}
+
+// parseNetrc parses the .netrc file, the macros are skipped.
+func parseNetrc(r io.Reader) (*netrc, error) {
+	n := &netrc{}
+	var (
+		current *netrcMachine
+		inMacro bool
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// The macro definition ends with an empty line
+		if inMacro {
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			next := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				current = &netrcMachine{name: strings.ToLower(next())}
+				n.machines = append(n.machines, current)
+			case "default":
+				current = &netrcMachine{}
+				n.def = current
+			case "login":
+				if current != nil {
+					current.login = next()
+				} else {
+					next()
+				}
+			case "password":
+				if current != nil {
+					current.password = next()
+				} else {
+					next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// lookup returns the machine of the host, the port of the host is ignored.
+func (n *netrc) lookup(host string) *netrcMachine {
+	host = strings.ToLower(host)
+	for _, m := range n.machines {
+		if m.name == host {
+			return m
+		}
+	}
+	return n.def
+}
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	n, err := parseNetrc(strings.NewReader(`# comment
+machine Example.com login user password pass
+macdef init
+cd /pub
+machine ignored.com login macro
+
+machine other.com
+	login other
+	account acc
+	password secret
+default login anonymous password guest
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host     string
+		login    string
+		password string
+	}{
+		{"example.com", "user", "pass"},
+		{"OTHER.com", "other", "secret"},
+		{"ignored.com", "anonymous", "guest"},
+		{"unknown.com", "anonymous", "guest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			m := n.lookup(tt.host)
+			if m == nil || m.login != tt.login || m.password != tt.password {
+				t.Errorf("lookup() got = %v, want %v:%v", m, tt.login, tt.password)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+// parseRetryAfter parses the Retry-After header of 429 and 503 responses, it can be seconds or http date.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	retryAfter := resp.Header.Get(base.HttpHeaderRetryAfter)
+	if retryAfter == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(retryAfter); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
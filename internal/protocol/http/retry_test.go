@@ -0,0 +1,46 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/GopeedLab/gopeed/internal/fetcher"
+)
+
+func TestRequestError_RetryDelay(t *testing.T) {
+	re := NewRequestError(http.StatusTooManyRequests, "")
+	re.retryAfter = 5 * time.Second
+	policy := fetcher.BuildRetryPolicy(nil)
+	if got := fetcher.Backoff(policy, 1, re); got != re.retryAfter {
+		t.Errorf("Backoff() got = %v, want %v", got, re.retryAfter)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       int
+		retryAfter string
+		want       time.Duration
+	}{
+		{"Seconds", http.StatusTooManyRequests, "3", 3 * time.Second},
+		{"Date", http.StatusServiceUnavailable, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), time.Hour},
+		{"Past Date", http.StatusServiceUnavailable, "Wed, 21 Oct 2015 07:28:00 GMT", 0},
+		{"Invalid", http.StatusTooManyRequests, "soon", 0},
+		{"Other Code", http.StatusInternalServerError, "3", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tt.code,
+				Header:     http.Header{},
+			}
+			resp.Header.Set("Retry-After", tt.retryAfter)
+			// http date has second precision
+			if got := parseRetryAfter(resp); got > tt.want || got < tt.want-time.Second {
+				t.Errorf("parseRetryAfter() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
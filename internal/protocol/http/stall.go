@@ -0,0 +1,75 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+)
+
+const defaultStallWindow = 10000
+
+// errConnectionStalled is the cancel cause of the request whose speed stays below the min speed
+var errConnectionStalled = errors.New("connection stalled")
+
+// buildStallDetection merges the stall detection of the options into the config,
+// returns nil if the min speed is not set.
+func buildStallDetection(detections ...*fhttp.StallDetection) *fhttp.StallDetection {
+	result := &fhttp.StallDetection{
+		Window: defaultStallWindow,
+	}
+	for _, d := range detections {
+		if d == nil {
+			continue
+		}
+		if d.MinSpeed > 0 {
+			result.MinSpeed = d.MinSpeed
+		}
+		if d.Window > 0 {
+			result.Window = d.Window
+		}
+	}
+	if result.MinSpeed <= 0 {
+		return nil
+	}
+	return result
+}
+
+// stallMeter counts the received bytes of a response and the time spent waiting for the speed limits,
+// the waiting time is excluded from the measured speed, so a connection throttled by the user is not a stall.
+type stallMeter struct {
+	received atomic.Int64
+	waited   atomic.Int64
+}
+
+// watchStall cancels the request with errConnectionStalled if the speed stays below the min speed for a whole window,
+// it returns when the request context is done.
+func watchStall(ctx context.Context, cancel context.CancelCauseFunc, detection *fhttp.StallDetection, meter *stallMeter) {
+	window := time.Duration(detection.Window) * time.Millisecond
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	var lastReceived, lastWaited int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		received, waited := meter.received.Load(), meter.waited.Load()
+		elapsed := window - time.Duration(waited-lastWaited)
+		bytes := received - lastReceived
+		lastReceived, lastWaited = received, waited
+		// Most of the window is spent on the speed limits, the speed is not measurable
+		if elapsed < window/2 {
+			continue
+		}
+		if float64(bytes)/elapsed.Seconds() < float64(detection.MinSpeed) {
+			cancel(errConnectionStalled)
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+)
+
+func TestBuildStallDetection(t *testing.T) {
+	if got := buildStallDetection(&fhttp.StallDetection{Window: 1000}, nil); got != nil {
+		t.Errorf("buildStallDetection() got = %v, want nil", got)
+	}
+
+	got := buildStallDetection(&fhttp.StallDetection{
+		MinSpeed: 1024,
+	}, &fhttp.StallDetection{
+		Window: 3000,
+	})
+	want := &fhttp.StallDetection{
+		MinSpeed: 1024,
+		Window:   3000,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildStallDetection() got = %v, want %v", got, want)
+	}
+}
+
+func TestWatchStall(t *testing.T) {
+	detection := &fhttp.StallDetection{
+		MinSpeed: 1024,
+		Window:   50,
+	}
+
+	watch := func(feed func(meter *stallMeter)) error {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		defer cancel(nil)
+		meter := &stallMeter{}
+		done := make(chan struct{})
+		go func() {
+			watchStall(ctx, cancel, detection, meter)
+			close(done)
+		}()
+		feedCtx, feedCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+		defer feedCancel()
+		for feedCtx.Err() == nil {
+			feed(meter)
+			time.Sleep(5 * time.Millisecond)
+		}
+		cancel(nil)
+		<-done
+		return context.Cause(ctx)
+	}
+
+	if err := watch(func(meter *stallMeter) {
+		meter.received.Add(1)
+	}); !errors.Is(err, errConnectionStalled) {
+		t.Errorf("watchStall() trickling got = %v, want %v", err, errConnectionStalled)
+	}
+	if err := watch(func(meter *stallMeter) {
+		meter.received.Add(1024)
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("watchStall() fast got = %v, want %v", err, context.Canceled)
+	}
+	// The time waiting for the speed limits is not a stall
+	if err := watch(func(meter *stallMeter) {
+		meter.received.Add(1)
+		meter.waited.Add(int64(5 * time.Millisecond))
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("watchStall() limited got = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,121 @@
+package http
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/GopeedLab/gopeed/pkg/util"
+)
+
+// tailSize is the max size of the chunk tail which is hashed
+const tailSize = 64 * 1024
+
+// Sync flushes the written data to disk and snapshots the connections, Store persists the snapshot,
+// so the stored progress never exceeds the data on disk.
+func (f *Fetcher) Sync() error {
+	f.syncLock.Lock()
+	defer f.syncLock.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	// The counters are copied before flushing, the data they count has been written
+	connections := f.copyConnections()
+	if f.writer != nil {
+		if err := f.writer.flush(); err != nil {
+			return err
+		}
+	}
+	if err := util.SyncData(f.file); err != nil {
+		// The file is closed when the download is complete
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		}
+		return err
+	}
+	for _, c := range connections {
+		c.Chunk.TailHash = 0
+		if f.config.ChunkHash && f.meta.Res.Range {
+			hash, err := f.tailHash(c.Chunk)
+			if err != nil {
+				if errors.Is(err, os.ErrClosed) {
+					return nil
+				}
+				return err
+			}
+			c.Chunk.TailHash = hash
+		}
+	}
+	f.syncedLock.Lock()
+	f.synced = connections
+	f.syncedLock.Unlock()
+	return nil
+}
+
+// copyConnections returns a copy of the connections for storing, the chunk ranges are consistent under the help lock.
+func (f *Fetcher) copyConnections() []*connection {
+	f.helpLock.Lock()
+	defer f.helpLock.Unlock()
+
+	copies := make([]*connection, len(f.connections))
+	for i, c := range f.connections {
+		// The connection counter is read first, it is increased after the chunk counter
+		downloaded := c.Downloaded
+		chunk := *c.Chunk
+		copies[i] = &connection{
+			Chunk:      &chunk,
+			Downloaded: downloaded,
+			Completed:  c.Completed,
+			Source:     c.Source,
+		}
+	}
+	return copies
+}
+
+// storedConnections returns the connections snapshot by the last sync
+func (f *Fetcher) storedConnections() []*connection {
+	f.syncedLock.Lock()
+	defer f.syncedLock.Unlock()
+
+	if f.synced != nil {
+		return f.synced
+	}
+	return f.snapshotConnections()
+}
+
+// tailHash returns the crc32 of the last downloaded bytes of the chunk
+func (f *Fetcher) tailHash(c *chunk) (uint32, error) {
+	if c.Downloaded <= 0 {
+		return 0, nil
+	}
+	size := min(c.Downloaded, tailSize)
+	buf := make([]byte, size)
+	if _, err := f.file.ReadAt(buf, c.Begin+c.Downloaded-size); err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(buf), nil
+}
+
+// verifyTails restarts the chunks whose tail doesn't match the stored hash,
+// the data may be lost before it reached disk, e.g. a power loss.
+func (f *Fetcher) verifyTails() error {
+	for _, c := range f.connections {
+		if c.Chunk.TailHash == 0 {
+			continue
+		}
+		hash, err := f.tailHash(c.Chunk)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if err == nil && hash == c.Chunk.TailHash {
+			continue
+		}
+		c.Downloaded = max(c.Downloaded-c.Chunk.Downloaded, 0)
+		c.Chunk.Downloaded = 0
+		c.Chunk.TailHash = 0
+		c.Completed = false
+	}
+	return nil
+}
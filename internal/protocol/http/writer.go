@@ -0,0 +1,136 @@
+package http
+
+import (
+	"os"
+	"sync"
+)
+
+const (
+	// defaultWriteBuffer is the default size of the write buffer of each connection
+	defaultWriteBuffer = 128 * 1024
+	// writeQueueSize is the max number of buffers queued for the file writer, it bounds the memory used by slow disks
+	writeQueueSize = 16
+)
+
+// bufferPools are the write buffer pools keyed by the buffer size, they are shared by all tasks
+var bufferPools sync.Map
+
+func getBuffer(size int) []byte {
+	pool, ok := bufferPools.Load(size)
+	if !ok {
+		pool, _ = bufferPools.LoadOrStore(size, &sync.Pool{
+			New: func() any {
+				buf := make([]byte, size)
+				return &buf
+			},
+		})
+	}
+	return *pool.(*sync.Pool).Get().(*[]byte)
+}
+
+func putBuffer(buf []byte) {
+	buf = buf[:cap(buf)]
+	if pool, ok := bufferPools.Load(len(buf)); ok {
+		pool.(*sync.Pool).Put(&buf)
+	}
+}
+
+type writeRequest struct {
+	buf    []byte
+	offset int64
+	// barrier is closed when the writes queued before it are done
+	barrier chan struct{}
+}
+
+// fileWriter writes the buffers of all connections to the file in a single goroutine,
+// so the connections keep reading while the disk is busy.
+type fileWriter struct {
+	file  *os.File
+	queue chan writeRequest
+	done  chan struct{}
+
+	// lock guards the queue from being closed while writing to it
+	lock   sync.RWMutex
+	closed bool
+	// err is the first write error, the later writes are dropped
+	err     error
+	errLock sync.Mutex
+}
+
+func newFileWriter(file *os.File) *fileWriter {
+	w := &fileWriter{
+		file:  file,
+		queue: make(chan writeRequest, writeQueueSize),
+		done:  make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+func (w *fileWriter) loop() {
+	defer close(w.done)
+	for req := range w.queue {
+		if req.barrier != nil {
+			close(req.barrier)
+			continue
+		}
+		if w.Err() == nil {
+			if _, err := w.file.WriteAt(req.buf, req.offset); err != nil {
+				w.errLock.Lock()
+				w.err = err
+				w.errLock.Unlock()
+			}
+		}
+		putBuffer(req.buf)
+	}
+}
+
+// Err returns the first write error
+func (w *fileWriter) Err() error {
+	w.errLock.Lock()
+	defer w.errLock.Unlock()
+	return w.err
+}
+
+// write queues the buffer to be written at the offset, the writer owns the buffer and puts it back to the pool after written.
+func (w *fileWriter) write(buf []byte, offset int64) error {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if err := w.Err(); err != nil || w.closed {
+		putBuffer(buf)
+		if err == nil {
+			err = os.ErrClosed
+		}
+		return err
+	}
+	w.queue <- writeRequest{buf: buf, offset: offset}
+	return nil
+}
+
+// flush waits until the queued writes are done and returns the first write error
+func (w *fileWriter) flush() error {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if w.closed {
+		return w.Err()
+	}
+	barrier := make(chan struct{})
+	w.queue <- writeRequest{barrier: barrier}
+	<-barrier
+	return w.Err()
+}
+
+// close waits until the queued writes are done and stops the writer, it can be called more than once.
+func (w *fileWriter) close() error {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.lock.Unlock()
+
+	<-w.done
+	return w.Err()
+}
@@ -0,0 +1,126 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/internal/test"
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+func TestFileWriter(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "writer.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	const size = 1024
+	w := newFileWriter(file)
+	want := make([]byte, 0, size*64)
+	// Queue more buffers than the queue size, the later writes block until the former are written
+	for i := 0; i < 64; i++ {
+		buf := getBuffer(size)
+		for j := range buf {
+			buf[j] = byte(i)
+		}
+		want = append(want, buf...)
+		if err := w.write(buf, int64(i*size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("flush() got = %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Errorf("close() got = %v, want nil", err)
+	}
+	if err := w.write(getBuffer(size), 0); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write() got = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestFileWriter_Error(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "writer.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	w := newFileWriter(file)
+	if err := w.write(getBuffer(1024), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.flush(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("flush() got = %v, want %v", err, os.ErrClosed)
+	}
+	// The write error is sticky, the later writes are rejected
+	if err := w.write(getBuffer(1024), 0); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write() got = %v, want %v", err, os.ErrClosed)
+	}
+	w.close()
+}
+
+func BenchmarkFetcher_Download(b *testing.B) {
+	listener := test.StartTestFileServer()
+	defer listener.Close()
+
+	benchmarks := []struct {
+		writeBuffer  int
+		singleWriter bool
+	}{
+		{writeBuffer: 8 * 1024},
+		{writeBuffer: 128 * 1024},
+		{writeBuffer: 1024 * 1024},
+		{writeBuffer: 128 * 1024, singleWriter: true},
+		{writeBuffer: 1024 * 1024, singleWriter: true},
+	}
+	for _, bm := range benchmarks {
+		name := fmt.Sprintf("buffer=%dKB", bm.writeBuffer/1024)
+		if bm.singleWriter {
+			name += "/single-writer"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(test.BuildSize)
+			for i := 0; i < b.N; i++ {
+				fetcher := buildConfigFetcher(config{
+					Connections:  16,
+					WriteBuffer:  bm.writeBuffer,
+					SingleWriter: bm.singleWriter,
+				})
+				if err := fetcher.Resolve(&base.Request{
+					URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+				}); err != nil {
+					b.Fatal(err)
+				}
+				if err := fetcher.Create(&base.Options{
+					Name: test.DownloadName,
+					Path: b.TempDir(),
+				}); err != nil {
+					b.Fatal(err)
+				}
+				if err := fetcher.Start(); err != nil {
+					b.Fatal(err)
+				}
+				if err := fetcher.Wait(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package ipfs
+
+import "github.com/GopeedLab/gopeed/pkg/base"
+
+type config struct {
+	UserAgent   string `json:"userAgent"`
+	Connections int    `json:"connections"`
+	// Gateways are the trustless gateways to fetch the blocks from when there is no embedded node,
+	// they are tried in order for each block. There are no default gateways, the public gateways see the requested cids,
+	// e.g. https://trustless-gateway.link must be opted in.
+	Gateways []string          `json:"gateways"`
+	Retry    *base.RetryPolicy `json:"retry"`
+}
@@ -0,0 +1,533 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/fetcher"
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/protocol/ipfs"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+var (
+	ErrInvalidPath = errors.New("invalid ipfs path")
+	ErrEmptyDir    = errors.New("empty directory")
+	// ErrNoGateways is returned when there is neither the embedded node nor the gateways, the gateways must be opted in
+	ErrNoGateways = errors.New("no ipfs node or gateways")
+)
+
+type Fetcher struct {
+	ctl    *controller.Controller
+	config *config
+	doneCh chan error
+
+	meta *fetcher.FetcherMeta
+	data *fetcherData
+
+	// fm provides the dag service of the embedded node, it is read when the dag is created,
+	// because the node can be started or stopped after the fetcher is built
+	fm *FetcherManager
+	// dag is shared by the workers, closeDag releases the gateway connections
+	dag        format.DAGService
+	closeDag   func()
+	downloader *fetcher.ChunkDownloader
+}
+
+func (f *Fetcher) Setup(ctl *controller.Controller) {
+	f.ctl = ctl
+	f.doneCh = make(chan error, 1)
+	if f.meta == nil {
+		f.meta = &fetcher.FetcherMeta{}
+	}
+	if f.data == nil {
+		f.data = &fetcherData{}
+	}
+	f.ctl.GetConfig(&f.config)
+	return
+}
+
+func (f *Fetcher) Resolve(req *base.Request) error {
+	if err := base.ParseReqExtra[ipfs.ReqExtra](req); err != nil {
+		return err
+	}
+	f.meta.Req = req
+	dag, closeDag, err := f.newDag()
+	if err != nil {
+		return err
+	}
+	defer closeDag()
+
+	res, cids, err := f.resolve(context.Background(), dag)
+	if err != nil {
+		return err
+	}
+	f.meta.Res = res
+	f.data.Cids = cids
+	return nil
+}
+
+// resolve returns the resource of the path and the cids of its files, the directories are walked recursively
+func (f *Fetcher) resolve(ctx context.Context, dag format.DAGService) (*base.Resource, []string, error) {
+	root, segments, err := parsePath(f.meta.Req.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	nd, err := dag.Get(ctx, root)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, segment := range segments {
+		dir, err := uio.NewDirectoryFromNode(dag, nd)
+		if err != nil {
+			return nil, nil, err
+		}
+		if nd, err = dir.Find(ctx, segment); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", segment, err)
+		}
+	}
+	isDir, size, mtime, err := stat(nd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := &base.Resource{
+		// The files are read from any offset by seeking the dag
+		Range: true,
+	}
+	var cids []string
+	if isDir {
+		res.Name = parseName(f.meta.Req.URL)
+		if res.Files, cids, err = walk(ctx, dag, nd, ""); err != nil {
+			return nil, nil, err
+		}
+		if len(res.Files) == 0 {
+			return nil, nil, ErrEmptyDir
+		}
+	} else {
+		res.Files = []*base.FileInfo{
+			{
+				Name:  parseName(f.meta.Req.URL),
+				Size:  size,
+				Ctime: mtime,
+			},
+		}
+		cids = []string{nd.Cid().String()}
+	}
+	res.CalcSize(nil)
+	return res, cids, nil
+}
+
+// walk lists the files of the directory, the file paths are relative to the root directory
+func walk(ctx context.Context, dag format.DAGService, nd format.Node, dirPath string) ([]*base.FileInfo, []string, error) {
+	dir, err := uio.NewDirectoryFromNode(dag, nd)
+	if err != nil {
+		return nil, nil, err
+	}
+	var links []*format.Link
+	if err = dir.ForEachLink(ctx, func(link *format.Link) error {
+		links = append(links, link)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Name < links[j].Name
+	})
+
+	var (
+		files []*base.FileInfo
+		cids  []string
+	)
+	for _, link := range links {
+		// The names come from the untrusted dag, they must not escape the download directory
+		if !fetcher.IsLocalName(link.Name) {
+			continue
+		}
+		child, err := link.GetNode(ctx, dag)
+		if err != nil {
+			return nil, nil, err
+		}
+		isDir, size, mtime, err := stat(child)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path.Join(dirPath, link.Name), err)
+		}
+		if isDir {
+			subFiles, subCids, err := walk(ctx, dag, child, path.Join(dirPath, link.Name))
+			if err != nil {
+				return nil, nil, err
+			}
+			files = append(files, subFiles...)
+			cids = append(cids, subCids...)
+			continue
+		}
+		files = append(files, &base.FileInfo{
+			Name:  link.Name,
+			Path:  dirPath,
+			Size:  size,
+			Ctime: mtime,
+		})
+		cids = append(cids, child.Cid().String())
+	}
+	return files, cids, nil
+}
+
+// stat returns whether the node is a directory, the size and the modification time of the file
+func stat(nd format.Node) (isDir bool, size int64, mtime *time.Time, err error) {
+	switch n := nd.(type) {
+	case *merkledag.RawNode:
+		return false, int64(len(n.RawData())), nil, nil
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(n.Data())
+		if err != nil {
+			return false, 0, nil, err
+		}
+		switch fsn.Type() {
+		case unixfs.TDirectory, unixfs.THAMTShard:
+			isDir = true
+		case unixfs.TFile, unixfs.TRaw:
+			size = int64(fsn.FileSize())
+		default:
+			return false, 0, nil, fmt.Errorf("unsupported unixfs type: %s", fsn.Type())
+		}
+		if t := fsn.ModTime(); !t.IsZero() {
+			mtime = &t
+		}
+		return isDir, size, mtime, nil
+	default:
+		return false, 0, nil, fmt.Errorf("unsupported node: %s", nd.Cid())
+	}
+}
+
+// newDag returns the dag service of the embedded node, or the dag service which fetches the blocks from the gateways.
+// The fetched blocks are not stored, the files are written to the download directory directly.
+func (f *Fetcher) newDag() (format.DAGService, func(), error) {
+	if node := f.fm.Node(); node != nil {
+		return node, func() {}, nil
+	}
+	gateways := f.gateways(f.reqExtra())
+	if len(gateways) == 0 {
+		return nil, nil, ErrNoGateways
+	}
+	client, err := ihttp.NewClient(f.ctl, f.meta.Req)
+	if err != nil {
+		return nil, nil, err
+	}
+	exchange := &gatewayExchange{
+		client:    client,
+		userAgent: f.config.UserAgent,
+		gateways:  gateways,
+	}
+	// The inlined blocks of the identity cids are not fetched
+	bs := blockstore.NewIdStore(blockstore.NewBlockstore(ds.NewNullDatastore()))
+	return merkledag.NewDAGService(blockservice.New(bs, exchange)), func() {
+		exchange.Close()
+	}, nil
+}
+
+// gateways returns the gateways of the request extra, or the gateways of the config if the request has none
+func (f *Fetcher) gateways(extra *ipfs.ReqExtra) []string {
+	if extra != nil && len(extra.Gateways) > 0 {
+		return extra.Gateways
+	}
+	return f.config.Gateways
+}
+
+// CheckRequest refuses the request when there is neither the embedded node nor the gateways,
+// so the task is not created to fail when it starts.
+func (f *Fetcher) CheckRequest(req *base.Request) error {
+	if f.fm.Node() != nil {
+		return nil
+	}
+	// The extra is parsed on the copy of the request, the request must not be modified
+	r := *req
+	if err := base.ParseReqExtra[ipfs.ReqExtra](&r); err != nil {
+		return err
+	}
+	extra, _ := r.Extra.(*ipfs.ReqExtra)
+	if len(f.gateways(extra)) == 0 {
+		return ErrNoGateways
+	}
+	return nil
+}
+
+func (f *Fetcher) Create(opts *base.Options) error {
+	f.meta.Opts = opts
+
+	if err := base.ParseOptsExtra[ipfs.OptsExtra](f.meta.Opts); err != nil {
+		return err
+	}
+	if opts.Extra == nil {
+		opts.Extra = &ipfs.OptsExtra{}
+	}
+	extra := opts.Extra.(*ipfs.OptsExtra)
+	if extra.Connections <= 0 {
+		extra.Connections = f.config.Connections
+		if extra.Connections <= 0 {
+			extra.Connections = 1
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) Start() (err error) {
+	// Avoid request extra modified by extension
+	if err = base.ParseReqExtra[ipfs.ReqExtra](f.meta.Req); err != nil {
+		return
+	}
+	if f.dag, f.closeDag, err = f.newDag(); err != nil {
+		return
+	}
+	// The resource may be resolved by extension, load the cids from the dag
+	if f.data.Cids == nil {
+		var res *base.Resource
+		if res, f.data.Cids, err = f.resolve(context.Background(), f.dag); err != nil {
+			return
+		}
+		if len(res.Files) != len(f.meta.Res.Files) {
+			return fmt.Errorf("the files of %s are changed", f.meta.Req.URL)
+		}
+	}
+	connections := f.meta.Opts.Extra.(*ipfs.OptsExtra).Connections
+	if f.data.Chunks == nil {
+		f.data.Chunks = fetcher.SplitChunks(f.meta, connections)
+	}
+	f.downloader = &fetcher.ChunkDownloader{
+		Ctl:    f.ctl,
+		Meta:   f.meta,
+		Source: f,
+		Retry:  fetcher.BuildRetryPolicy(f.config.Retry),
+	}
+	return f.downloader.Start(f.data.Chunks, connections, func(ctx context.Context, err error) {
+		f.closeDag()
+		f.doneCh <- err
+	})
+}
+
+func (f *Fetcher) Pause() (err error) {
+	if f.downloader != nil {
+		f.downloader.Pause()
+	}
+	if f.closeDag != nil {
+		f.closeDag()
+	}
+	return
+}
+
+func (f *Fetcher) Close() (err error) {
+	return f.Pause()
+}
+
+func (f *Fetcher) Meta() *fetcher.FetcherMeta {
+	return f.meta
+}
+
+func (f *Fetcher) Stats() any {
+	return &ipfs.Stats{
+		Chunks:          len(f.data.Chunks),
+		CompletedChunks: fetcher.CompletedChunks(f.data.Chunks),
+	}
+}
+
+// Progress returns the downloaded bytes of each selected file
+func (f *Fetcher) Progress() fetcher.Progress {
+	return fetcher.ChunksProgress(f.meta, f.data.Chunks)
+}
+
+func (f *Fetcher) Wait() (err error) {
+	return <-f.doneCh
+}
+
+// Host returns no host, the blocks are fetched from the node or the gateways in turn
+func (f *Fetcher) Host(file int) string {
+	return ""
+}
+
+// Open reads the file from the offset of the chunk by seeking the dag
+func (f *Fetcher) Open(ctx context.Context, w *fetcher.Worker, c *fetcher.Chunk) (io.ReadCloser, error) {
+	fileCid, err := cid.Decode(f.data.Cids[c.File])
+	if err != nil {
+		return nil, err
+	}
+	nd, err := f.dag.Get(ctx, fileCid)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := uio.NewDagReader(ctx, nd, f.dag)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = reader.Seek(c.Begin+c.Downloaded, io.SeekStart); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (f *Fetcher) reqExtra() *ipfs.ReqExtra {
+	if f.meta.Req.Extra == nil {
+		return &ipfs.ReqExtra{}
+	}
+	return f.meta.Req.Extra.(*ipfs.ReqExtra)
+}
+
+// parsePath returns the root cid and the path segments of the ipfs://<cid>/<path> url or the /ipfs/<cid>/<path> path
+func parsePath(rawUrl string) (root cid.Cid, segments []string, err error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	var p string
+	switch {
+	case strings.EqualFold(u.Scheme, "ipfs"):
+		p = u.Host + "/" + u.Path
+	case u.Scheme == "" && strings.HasPrefix(u.Path, "/ipfs/"):
+		p = strings.TrimPrefix(u.Path, "/ipfs/")
+	default:
+		return cid.Undef, nil, ErrInvalidPath
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 {
+		return cid.Undef, nil, ErrInvalidPath
+	}
+	if root, err = cid.Decode(segments[0]); err != nil {
+		return cid.Undef, nil, err
+	}
+	return root, segments[1:], nil
+}
+
+// parseName returns the name of the file or directory, the filename parameter of the gateway urls takes precedence,
+// the cid is used for the root.
+func parseName(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	if name := u.Query().Get("filename"); name != "" {
+		return name
+	}
+	root, segments, err := parsePath(rawUrl)
+	if err != nil {
+		return ""
+	}
+	if len(segments) > 0 {
+		return segments[len(segments)-1]
+	}
+	return root.String()
+}
+
+type fetcherData struct {
+	// Cids are the cids of the resource files
+	Cids   []string
+	Chunks []*fetcher.Chunk
+}
+
+// clone returns the copy of the data to store, the chunks are written by the workers while storing
+func (d *fetcherData) clone() *fetcherData {
+	return &fetcherData{
+		Cids:   d.Cids,
+		Chunks: fetcher.CloneChunks(d.Chunks),
+	}
+}
+
+type FetcherManager struct {
+	lock sync.RWMutex
+	node format.DAGService
+}
+
+// SetNode sets the dag service of the embedded node, the blocks are fetched from the gateways of the config or the request if it is nil.
+// The kubo node of the mobile app is started and stopped apart from the downloader, so the node can be set at any time.
+func (fm *FetcherManager) SetNode(node format.DAGService) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+
+	fm.node = node
+}
+
+// Node returns the dag service of the embedded node, nil if the node is not set
+func (fm *FetcherManager) Node() format.DAGService {
+	fm.lock.RLock()
+	defer fm.lock.RUnlock()
+
+	return fm.node
+}
+
+func (fm *FetcherManager) Name() string {
+	return "ipfs"
+}
+
+func (fm *FetcherManager) Filters() []*fetcher.SchemeFilter {
+	return []*fetcher.SchemeFilter{
+		{
+			Type:    fetcher.FilterTypeUrl,
+			Pattern: "IPFS",
+		},
+	}
+}
+
+// MatchRequest matches the /ipfs/<cid> paths, which have no scheme
+func (fm *FetcherManager) MatchRequest(req *base.Request) bool {
+	return strings.HasPrefix(req.URL, "/ipfs/")
+}
+
+func (fm *FetcherManager) Build() fetcher.Fetcher {
+	return &Fetcher{fm: fm}
+}
+
+func (fm *FetcherManager) ParseName(u string) string {
+	return parseName(u)
+}
+
+func (fm *FetcherManager) AutoRename() bool {
+	return true
+}
+
+func (fm *FetcherManager) DefaultConfig() any {
+	return &config{
+		UserAgent:   ihttp.DefaultUserAgent,
+		Connections: 4,
+	}
+}
+
+func (fm *FetcherManager) Store(f fetcher.Fetcher) (data any, err error) {
+	_f := f.(*Fetcher)
+	return _f.data.clone(), nil
+}
+
+func (fm *FetcherManager) Restore() (v any, f func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher) {
+	return &fetcherData{}, func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher {
+		fetcher := &Fetcher{
+			meta: meta,
+			data: v.(*fetcherData),
+			fm:   fm,
+		}
+		base.ParseReqExtra[ipfs.ReqExtra](fetcher.meta.Req)
+		base.ParseOptsExtra[ipfs.OptsExtra](fetcher.meta.Opts)
+		return fetcher
+	}
+}
+
+func (fm *FetcherManager) Close() error {
+	return nil
+}
@@ -0,0 +1,390 @@
+package ipfs
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/test"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/protocol/ipfs"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+const testFileSize = 5*1024*1024 + 7
+
+// testFiles are the files of the test directory, the paths are relative to it
+var testFiles = map[string]int64{
+	"a.data":         128*1024 + 3,
+	"b.data":         0,
+	"sub/c d.data":   testChunkSize*2 + 1,
+	"sub/deep/e.txt": 16,
+}
+
+func randBytes(size int64) []byte {
+	buf := make([]byte, size)
+	rand.Read(buf)
+	return buf
+}
+
+type testData struct {
+	node  *testNode
+	file  format.Node
+	data  []byte
+	dir   format.Node
+	files map[string][]byte
+}
+
+func prepareTestData(t *testing.T) *testData {
+	td := &testData{
+		node:  newTestNode(),
+		data:  randBytes(testFileSize),
+		files: make(map[string][]byte),
+	}
+	for name, size := range testFiles {
+		td.files[name] = randBytes(size)
+	}
+	td.file = td.node.addFile(t, td.data)
+	td.dir = td.node.addDir(t, td.files)
+	return td
+}
+
+func TestFetcher_Resolve(t *testing.T) {
+	td := prepareTestData(t)
+
+	fetcher := buildFetcher(td.node, nil)
+	if err := fetcher.Resolve(&base.Request{
+		URL: "ipfs://" + td.file.Cid().String() + "?filename=file.data",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res := fetcher.Meta().Res
+	if !res.Range || res.Name != "" || res.Size != testFileSize || len(res.Files) != 1 || res.Files[0].Name != "file.data" {
+		t.Errorf("Resolve() got = %v, want a ranged file of %d bytes", test.ToJson(res), testFileSize)
+	}
+
+	fetcher = buildFetcher(td.node, nil)
+	if err := fetcher.Resolve(&base.Request{
+		URL: "/ipfs/" + td.dir.Cid().String(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res = fetcher.Meta().Res
+	if res.Name != td.dir.Cid().String() || len(res.Files) != len(testFiles) {
+		t.Fatalf("Resolve() got = %v, want the dir files", test.ToJson(res))
+	}
+	var size int64
+	for _, file := range res.Files {
+		want, ok := testFiles[filepath.ToSlash(filepath.Join(file.Path, file.Name))]
+		if !ok || file.Size != want {
+			t.Errorf("Resolve() got unexpected file = %v", test.ToJson(file))
+		}
+		size += file.Size
+	}
+	if res.Size != size {
+		t.Errorf("Resolve() got size = %v, want %v", res.Size, size)
+	}
+
+	// The paths under the root are resolved through the directories
+	fetcher = buildFetcher(td.node, nil)
+	if err := fetcher.Resolve(&base.Request{
+		URL: "ipfs://" + td.dir.Cid().String() + "/sub/c%20d.data",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res = fetcher.Meta().Res; res.Name != "" || res.Files[0].Name != "c d.data" || res.Size != testFiles["sub/c d.data"] {
+		t.Errorf("Resolve() got = %v, want the sub file", test.ToJson(res))
+	}
+	fetcher = buildFetcher(td.node, nil)
+	if err := fetcher.Resolve(&base.Request{
+		URL: "ipfs://" + td.dir.Cid().String() + "/sub/",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res = fetcher.Meta().Res; res.Name != "sub" || len(res.Files) != 2 {
+		t.Errorf("Resolve() got = %v, want the sub dir", test.ToJson(res))
+	}
+}
+
+func TestFetcher_ResolveError(t *testing.T) {
+	td := prepareTestData(t)
+
+	for _, u := range []string{
+		"ipfs://" + td.dir.Cid().String() + "/missing.data",
+		"ipfs://not-a-cid",
+		"/ipfs/",
+	} {
+		if err := buildFetcher(td.node, nil).Resolve(&base.Request{URL: u}); err == nil {
+			t.Errorf("Resolve(%s) got = %v, want error", u, err)
+		}
+	}
+}
+
+func TestFetcher_ResolveUnsafeNames(t *testing.T) {
+	td := prepareTestData(t)
+	file := td.node.addFile(t, randBytes(16))
+	dir := td.node.addLinks(t, map[string]format.Node{
+		"ok.data":        file,
+		"..":             td.dir,
+		".":              td.dir,
+		`..\escape.data`: file,
+		"../escape.data": file,
+	})
+
+	fetcher := buildFetcher(td.node, nil)
+	if err := fetcher.Resolve(&base.Request{
+		URL: "ipfs://" + dir.Cid().String(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The names which would escape the download directory are skipped
+	if res := fetcher.Meta().Res; len(res.Files) != 1 || res.Files[0].Name != "ok.data" || res.Files[0].Path != "" {
+		t.Errorf("Resolve() got = %v, want the safe file only", test.ToJson(res.Files))
+	}
+}
+
+func TestFetcher_Download(t *testing.T) {
+	td := prepareTestData(t)
+
+	req := &base.Request{
+		URL: "ipfs://" + td.file.Cid().String(),
+	}
+	downloadAndCheck(t, td, req, 1)
+	fetcher := downloadAndCheck(t, td, req, 4)
+	stats := fetcher.Stats().(*ipfs.Stats)
+	if stats.Chunks != 4 || stats.CompletedChunks != 4 {
+		t.Errorf("Stats() got = %v, want 4 completed chunks", test.ToJson(stats))
+	}
+}
+
+func TestFetcher_DownloadFromGateway(t *testing.T) {
+	td := prepareTestData(t)
+	corrupted, corruptedRequests := startTestGateway(td.node, true)
+	defer corrupted.Close()
+	gateway, requests := startTestGateway(td.node, false)
+	defer gateway.Close()
+
+	// The blocks of the corrupted gateway are rejected, they are fetched from the next gateway
+	req := &base.Request{
+		URL: "ipfs://" + td.file.Cid().String(),
+		Extra: &ipfs.ReqExtra{
+			Gateways: []string{corrupted.URL, gateway.URL},
+		},
+	}
+	downloadAndCheck(t, td, req, 4)
+	if corruptedRequests.Load() == 0 || requests.Load() == 0 {
+		t.Errorf("Download() got %v and %v gateway requests, want both gateways requested", corruptedRequests.Load(), requests.Load())
+	}
+
+	req = &base.Request{
+		URL: "ipfs://" + td.file.Cid().String(),
+		Extra: &ipfs.ReqExtra{
+			Gateways: []string{corrupted.URL},
+		},
+	}
+	if err := buildFetcher(nil, nil).Resolve(req); err == nil {
+		t.Errorf("Resolve() got = %v, want error", err)
+	}
+	// The public gateways are not used by default
+	err := buildFetcher(nil, nil).Resolve(&base.Request{
+		URL: "ipfs://" + td.file.Cid().String(),
+	})
+	if !errors.Is(err, ErrNoGateways) {
+		t.Errorf("Resolve() got = %v, want %v", err, ErrNoGateways)
+	}
+}
+
+func TestFetcher_DownloadDir(t *testing.T) {
+	td := prepareTestData(t)
+	gateway, _ := startTestGateway(td.node, false)
+	defer gateway.Close()
+
+	fetcher := buildFetcher(nil, &config{
+		Connections: 4,
+		Gateways:    []string{gateway.URL},
+	})
+	if err := fetcher.Resolve(&base.Request{
+		URL: "/ipfs/" + td.dir.Cid().String() + "?filename=dir",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Only download the files under the sub directory
+	var selected []int
+	for i, file := range fetcher.Meta().Res.Files {
+		if strings.HasPrefix(file.Path, "sub") {
+			selected = append(selected, i)
+		}
+	}
+	if err := fetcher.Create(&base.Options{
+		Path:        t.TempDir(),
+		SelectFiles: selected,
+		Extra: ipfs.OptsExtra{
+			Connections: 2,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range td.files {
+		got := filepath.Join(fetcher.Meta().Opts.Path, "dir", filepath.FromSlash(name))
+		if !strings.HasPrefix(name, "sub/") {
+			if _, err := os.Stat(got); !os.IsNotExist(err) {
+				t.Errorf("Download() got unselected file %s", got)
+			}
+			continue
+		}
+		assertFile(t, data, got)
+	}
+}
+
+func TestFetcher_DownloadResume(t *testing.T) {
+	td := prepareTestData(t)
+
+	fetcher := downloadReady(t, td.node, &base.Request{
+		URL: "ipfs://" + td.file.Cid().String(),
+	}, 4)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := new(FetcherManager)
+	fm.SetNode(td.node.dag)
+	data, err := fm.Store(fetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := json.Marshal(data)
+	v, f := fm.Restore()
+	json.Unmarshal(buf, v)
+	restored := f(fetcher.Meta(), v)
+	restored.Setup(buildController(fm.DefaultConfig()))
+	if err := restored.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, td.data, fetcher.Meta().SingleFilepath())
+}
+
+func TestFetcherManager_MatchRequest(t *testing.T) {
+	fm := new(FetcherManager)
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"/ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", true},
+		{"ipfs://bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", false},
+		{"http://127.0.0.1/ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", false},
+	}
+	for _, tt := range tests {
+		if got := fm.MatchRequest(&base.Request{URL: tt.url}); got != tt.want {
+			t.Errorf("MatchRequest(%s) got = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestFetcherManager_ParseName(t *testing.T) {
+	fm := new(FetcherManager)
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"ipfs://QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG", "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"},
+		{"ipfs://QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG/readme", "readme"},
+		{"/ipfs/QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG/docs/", "docs"},
+		{"/ipfs/QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG?filename=file.zip", "file.zip"},
+		{"ipfs://invalid", ""},
+	}
+	for _, tt := range tests {
+		if got := fm.ParseName(tt.url); got != tt.want {
+			t.Errorf("ParseName(%s) got = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func downloadAndCheck(t *testing.T, td *testData, req *base.Request, connections int) *Fetcher {
+	var node *testNode
+	if req.Extra == nil {
+		node = td.node
+	}
+	fetcher := downloadReady(t, node, req, connections)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, td.data, fetcher.Meta().SingleFilepath())
+	var downloaded int64
+	for _, p := range fetcher.Progress() {
+		downloaded += p
+	}
+	if downloaded != testFileSize {
+		t.Errorf("Progress() got = %v, want %v", downloaded, testFileSize)
+	}
+	return fetcher
+}
+
+func assertFile(t *testing.T, want []byte, got string) {
+	buf, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(want) {
+		t.Errorf("Download() got file %s not equal to the ipfs file", got)
+	}
+}
+
+func downloadReady(t *testing.T, node *testNode, req *base.Request, connections int) *Fetcher {
+	fetcher := buildFetcher(node, nil)
+	if err := fetcher.Resolve(req); err != nil {
+		t.Fatal(err)
+	}
+	err := fetcher.Create(&base.Options{
+		Path: t.TempDir(),
+		Extra: ipfs.OptsExtra{
+			Connections: connections,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetcher
+}
+
+func buildController(cfg any) *controller.Controller {
+	ctl := controller.NewController()
+	ctl.GetConfig = func(v any) {
+		json.Unmarshal([]byte(test.ToJson(cfg)), v)
+	}
+	return ctl
+}
+
+// buildFetcher builds the fetcher of the node with the config, nil node means the gateways, nil config means the default config
+func buildFetcher(node *testNode, cfg *config) *Fetcher {
+	fm := new(FetcherManager)
+	if node != nil {
+		fm.SetNode(node.dag)
+	}
+	fetcher := fm.Build()
+	if cfg == nil {
+		fetcher.Setup(buildController(fm.DefaultConfig()))
+	} else {
+		fetcher.Setup(buildController(cfg))
+	}
+	return fetcher.(*Fetcher)
+}
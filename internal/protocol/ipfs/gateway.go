@@ -0,0 +1,115 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// maxBlockSize is larger than the 2MiB limit of the bitswap blocks
+	maxBlockSize     = 4 * 1024 * 1024
+	blockTimeout     = 30 * time.Second
+	blockConcurrency = 8
+)
+
+var ErrBlockMismatch = errors.New("block does not match the cid")
+
+// gatewayExchange fetches the raw blocks from the trustless gateways, the blocks are verified by the hashes of the cids,
+// so the gateways don't need to be trusted.
+type gatewayExchange struct {
+	client    *http.Client
+	userAgent string
+	gateways  []string
+}
+
+func (e *gatewayExchange) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	err := errors.New("no gateways")
+	for _, gateway := range e.gateways {
+		var b blocks.Block
+		if b, err = e.fetchBlock(ctx, gateway, c); err == nil {
+			return b, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("fetch block %s: %w", c, err)
+}
+
+// GetBlocks fetches the blocks in parallel, the blocks which can't be fetched are not sent to the channel
+func (e *gatewayExchange) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		eg, ctx := errgroup.WithContext(ctx)
+		eg.SetLimit(blockConcurrency)
+		for _, c := range cids {
+			eg.Go(func() error {
+				b, err := e.GetBlock(ctx, c)
+				if err != nil {
+					return nil
+				}
+				select {
+				case out <- b:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}
+		eg.Wait()
+	}()
+	return out, nil
+}
+
+func (e *gatewayExchange) fetchBlock(ctx context.Context, gateway string, c cid.Cid) (blocks.Block, error) {
+	ctx, cancel := context.WithTimeout(ctx, blockTimeout)
+	defer cancel()
+	httpReq, err := ihttp.NewRequest(ctx, strings.TrimSuffix(gateway, "/")+"/ipfs/"+c.String()+"?format=raw", nil, e.userAgent)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "application/vnd.ipld.raw")
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ihttp.NewRequestError(resp.StatusCode, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBlockSize {
+		return nil, fmt.Errorf("block larger than %d bytes", maxBlockSize)
+	}
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, ErrBlockMismatch
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func (e *gatewayExchange) NotifyNewBlocks(ctx context.Context, blocks ...blocks.Block) error {
+	return nil
+}
+
+func (e *gatewayExchange) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
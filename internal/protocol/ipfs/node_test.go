@@ -0,0 +1,132 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs/importer"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+// testChunkSize splits the test files into multiple blocks
+const testChunkSize = 256 * 1024
+
+// testNode is an in-process node without network, the files are added to the in-memory blockstore
+type testNode struct {
+	blockstore blockstore.Blockstore
+	dag        format.DAGService
+}
+
+func newTestNode() *testNode {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	return &testNode{
+		blockstore: bs,
+		dag:        merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))),
+	}
+}
+
+// addFile adds the file of the data, the file is chunked into the blocks of testChunkSize
+func (n *testNode) addFile(t *testing.T, data []byte) format.Node {
+	nd, err := importer.BuildDagFromReader(n.dag, chunker.NewSizeSplitter(bytes.NewReader(data), testChunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+// addDir adds the directory of the files, the paths are relative to the directory and separated by slashes
+func (n *testNode) addDir(t *testing.T, files map[string][]byte) format.Node {
+	ctx := context.Background()
+	children := make(map[string]map[string][]byte)
+	dir, err := uio.NewDirectory(n.dag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if sub, rest, ok := strings.Cut(name, "/"); ok {
+			if children[sub] == nil {
+				children[sub] = make(map[string][]byte)
+			}
+			children[sub][rest] = data
+			continue
+		}
+		if err = dir.AddChild(ctx, name, n.addFile(t, data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, subFiles := range children {
+		if err = dir.AddChild(ctx, name, n.addDir(t, subFiles)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.dag.Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+// addLinks adds the directory of the nodes, the link names are added as they are, e.g. the names with the dot segments
+func (n *testNode) addLinks(t *testing.T, links map[string]format.Node) format.Node {
+	ctx := context.Background()
+	dir, err := uio.NewDirectory(n.dag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, child := range links {
+		if err = dir.AddChild(ctx, name, child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.dag.Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+// startTestGateway starts a trustless gateway which serves the raw blocks of the node,
+// a corrupted gateway serves the wrong data of the blocks.
+func startTestGateway(node *testNode, corrupted bool) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+		if err != nil || r.URL.Query().Get("format") != "raw" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, err := node.blockstore.Get(r.Context(), c)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data := b.RawData()
+		if corrupted {
+			data = append([]byte{0}, data...)
+		}
+		w.Header().Set("Content-Type", "application/vnd.ipld.raw")
+		w.Write(data)
+	}))
+	return server, &requests
+}
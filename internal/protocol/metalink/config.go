@@ -0,0 +1,6 @@
+package metalink
+
+type config struct {
+	UserAgent   string `json:"userAgent"`
+	Connections int    `json:"connections"`
+}
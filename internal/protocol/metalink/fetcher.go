@@ -0,0 +1,556 @@
+package metalink
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/fetcher"
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/protocol/metalink"
+	"github.com/GopeedLab/gopeed/pkg/util"
+)
+
+// fileFetcher is the http fetcher that downloads a file of the metalink
+type fileFetcher struct {
+	index   int
+	fetcher fetcher.Fetcher
+	waitCh  chan error
+}
+
+type Fetcher struct {
+	ctl    *controller.Controller
+	config *config
+	doneCh chan error
+
+	meta *fetcher.FetcherMeta
+	data *fetcherData
+
+	lock    sync.Mutex
+	current *fileFetcher
+	cancel  context.CancelFunc
+	runWg   sync.WaitGroup
+}
+
+func (f *Fetcher) Setup(ctl *controller.Controller) {
+	f.ctl = ctl
+	f.doneCh = make(chan error, 1)
+	if f.meta == nil {
+		f.meta = &fetcher.FetcherMeta{}
+	}
+	if f.data == nil {
+		f.data = &fetcherData{}
+	}
+	f.ctl.GetConfig(&f.config)
+	return
+}
+
+func (f *Fetcher) Resolve(req *base.Request) error {
+	f.meta.Req = req
+	if err := f.load(); err != nil {
+		return err
+	}
+
+	res := &base.Resource{
+		Range: true,
+		Files: make([]*base.FileInfo, len(f.data.Files)),
+	}
+	if len(f.data.Files) > 1 {
+		res.Name = parseName(req.URL)
+	}
+	for i, file := range f.data.Files {
+		res.Files[i] = &base.FileInfo{
+			Name: file.Name,
+			Path: file.Path,
+			Size: file.Size,
+			Req: &base.Request{
+				URL: file.Urls[0],
+			},
+		}
+	}
+	res.CalcSize(nil)
+	f.meta.Res = res
+	return nil
+}
+
+func (f *Fetcher) Create(opts *base.Options) (err error) {
+	f.meta.Opts = opts
+	if f.meta.Res != nil {
+		opts.InitSelectFiles(len(f.meta.Res.Files))
+	}
+	return nil
+}
+
+func (f *Fetcher) Start() (err error) {
+	// The resource may be resolved by extension, load the files from the metalink
+	if f.data.Files == nil {
+		if err = f.load(); err != nil {
+			return
+		}
+	}
+	f.meta.Opts.InitSelectFiles(len(f.data.Files))
+	if f.data.Progress == nil {
+		f.data.Progress = make([]*fileProgress, len(f.data.Files))
+		for i := range f.data.Progress {
+			f.data.Progress[i] = &fileProgress{}
+		}
+	}
+
+	var ctx context.Context
+	ctx, f.cancel = context.WithCancel(context.Background())
+	f.runWg.Add(1)
+	go func() {
+		defer f.runWg.Done()
+		err := f.run(ctx)
+		// if canceled, just return
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		f.doneCh <- err
+	}()
+	return
+}
+
+func (f *Fetcher) Pause() (err error) {
+	if f.cancel == nil {
+		return
+	}
+	f.cancel()
+	f.lock.Lock()
+	current := f.current
+	f.lock.Unlock()
+	if current != nil {
+		err = current.fetcher.Pause()
+	}
+	// wait for pause handle complete
+	f.runWg.Wait()
+	return
+}
+
+func (f *Fetcher) Close() (err error) {
+	if err = f.Pause(); err != nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.current != nil {
+		return f.current.fetcher.Close()
+	}
+	return
+}
+
+func (f *Fetcher) Meta() *fetcher.FetcherMeta {
+	return f.meta
+}
+
+func (f *Fetcher) Stats() any {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	stats := &metalink.Stats{}
+	if f.current != nil {
+		stats.File = f.data.Files[f.current.index].Name
+		if hs, ok := f.current.fetcher.Stats().(*fhttp.Stats); ok {
+			stats.Connections = hs.Connections
+		}
+	}
+	return stats
+}
+
+func (f *Fetcher) Progress() fetcher.Progress {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	p := make(fetcher.Progress, len(f.meta.Opts.SelectFiles))
+	if f.data.Progress == nil {
+		return p
+	}
+	for i, selectIndex := range f.meta.Opts.SelectFiles {
+		if f.current != nil && f.current.index == selectIndex {
+			p[i] = f.current.fetcher.Progress().TotalDownloaded()
+		} else {
+			p[i] = f.data.Progress[selectIndex].Downloaded
+		}
+	}
+	return p
+}
+
+func (f *Fetcher) Wait() (err error) {
+	return <-f.doneCh
+}
+
+// load reads and parses the metalink from the request url
+func (f *Fetcher) load() error {
+	reader, err := f.openMetalink()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	files, err := parse(reader)
+	if err != nil {
+		return err
+	}
+	f.data.Files = files
+	return nil
+}
+
+// run downloads the selected files one by one, each file is downloaded by the http fetcher with mirrors
+func (f *Fetcher) run(ctx context.Context) error {
+	for _, index := range f.meta.Opts.SelectFiles {
+		if f.data.Progress[index].Completed {
+			continue
+		}
+		ff, err := f.prepareFileFetcher(ctx, index)
+		if err != nil {
+			return err
+		}
+		if err := ff.fetcher.Start(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err = <-ff.waitCh:
+		}
+		if err != nil {
+			return err
+		}
+		name := ff.fetcher.Meta().SingleFilepath()
+		if err := verify(name, f.data.Files[index]); err != nil {
+			return err
+		}
+
+		f.lock.Lock()
+		f.data.Progress[index].Completed = true
+		f.data.Progress[index].Downloaded = ff.fetcher.Progress().TotalDownloaded()
+		f.data.Progress[index].Fetcher = nil
+		f.current = nil
+		f.lock.Unlock()
+	}
+	return nil
+}
+
+// prepareFileFetcher returns the http fetcher of the file, it will be restored if the file was partially downloaded.
+func (f *Fetcher) prepareFileFetcher(ctx context.Context, index int) (*fileFetcher, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	// Resume the paused file fetcher
+	if f.current != nil && f.current.index == index {
+		return f.current, nil
+	}
+
+	fm := &ihttp.FetcherManager{}
+	file := f.data.Files[index]
+	progress := f.data.Progress[index]
+	var ft fetcher.Fetcher
+	if progress.Fetcher != nil {
+		v, restore := fm.Restore()
+		if err := util.MapToStruct(progress.Fetcher.Data, v); err != nil {
+			return nil, err
+		}
+		ft = restore(&fetcher.FetcherMeta{
+			Req: progress.Fetcher.Req,
+			Res: progress.Fetcher.Res,
+		}, v)
+		ft.Setup(f.buildFileController(fm))
+	} else {
+		ft = fm.Build()
+		ft.Setup(f.buildFileController(fm))
+		if err := f.resolveFile(ft, file); err != nil {
+			return nil, err
+		}
+	}
+	err := ft.Create(&base.Options{
+		Name:          f.fileName(file),
+		Path:          f.filePath(file),
+		DownloadLimit: f.meta.Opts.DownloadLimit,
+		Extra: &fhttp.OptsExtra{
+			Connections: f.config.Connections,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ff := &fileFetcher{
+		index:   index,
+		fetcher: ft,
+		waitCh:  make(chan error, 1),
+	}
+	go func() {
+		ff.waitCh <- ft.Wait()
+	}()
+	f.current = ff
+	progress.Fetcher = &fileFetcherData{
+		Req: ft.Meta().Req,
+		Res: ft.Meta().Res,
+	}
+	return ff, nil
+}
+
+// resolveFile resolves the file from the urls by priority, the first url which has the same file size is used,
+// and the others are used as mirrors.
+func (f *Fetcher) resolveFile(ft fetcher.Fetcher, file *file) (err error) {
+	for i, u := range file.Urls {
+		mirrors := make([]string, 0, len(file.Urls)-1)
+		mirrors = append(mirrors, file.Urls[:i]...)
+		mirrors = append(mirrors, file.Urls[i+1:]...)
+		req := &base.Request{
+			URL:            u,
+			Proxy:          f.meta.Req.Proxy,
+			SkipVerifyCert: f.meta.Req.SkipVerifyCert,
+			Extra: &fhttp.ReqExtra{
+				Mirrors: mirrors,
+			},
+		}
+		if err = ft.Resolve(req); err != nil {
+			continue
+		}
+		if file.Size > 0 && ft.Meta().Res.Size != file.Size {
+			err = fmt.Errorf("file size mismatch: %s", u)
+			continue
+		}
+		return nil
+	}
+	return
+}
+
+// buildFileController builds the controller for the http fetcher, the files use the global http config,
+// e.g. the retry policy and auth, the user agent and connections are overridden by the metalink config.
+func (f *Fetcher) buildFileController(fm fetcher.FetcherManager) *controller.Controller {
+	ctl := *f.ctl
+	ctl.GetConfig = func(v any) {
+		f.ctl.GetProtocolConfig(fm.Name(), v)
+		override := make(map[string]any)
+		if f.config.UserAgent != "" {
+			override["userAgent"] = f.config.UserAgent
+		}
+		if f.config.Connections > 0 {
+			override["connections"] = f.config.Connections
+		}
+		util.MapToStruct(override, v)
+	}
+	return &ctl
+}
+
+func (f *Fetcher) filePath(file *file) string {
+	return path.Join(f.meta.RootDirPath(), file.Path)
+}
+
+// fileName returns the name of the file, the single file can be renamed by options.
+func (f *Fetcher) fileName(file *file) string {
+	if f.meta.Res.Name == "" && len(f.data.Files) == 1 && f.meta.Opts.Name != "" {
+		return f.meta.Opts.Name
+	}
+	return file.Name
+}
+
+// verify checks the file hash and piece hashes
+func verify(name string, file *file) error {
+	if file.Checksum != nil {
+		if err := file.Checksum.Verify(name); err != nil {
+			return err
+		}
+	}
+	if file.Pieces != nil {
+		if err := verifyPieces(name, file.Pieces); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyPieces(name string, p *pieces) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for i, expected := range p.Hashes {
+		h, err := util.NewHash(string(p.Algorithm))
+		if err != nil {
+			return err
+		}
+		n, err := io.CopyN(h, file, p.Length)
+		if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+			return err
+		}
+		actual := hex.EncodeToString(h.Sum(nil))
+		if !strings.EqualFold(actual, expected) {
+			return fmt.Errorf("piece %d: %w", i, &base.ChecksumError{
+				Algorithm: p.Algorithm,
+				Expected:  expected,
+				Actual:    actual,
+			})
+		}
+	}
+	return nil
+}
+
+// openMetalink opens the metalink from http url, local file path, file url or data uri
+func (f *Fetcher) openMetalink() (io.ReadCloser, error) {
+	req := f.meta.Req
+	switch util.ParseSchema(req.URL) {
+	case "HTTP", "HTTPS":
+		if err := base.ParseReqExtra[fhttp.ReqExtra](req); err != nil {
+			return nil, err
+		}
+		var extra *fhttp.ReqExtra
+		if req.Extra != nil {
+			extra = req.Extra.(*fhttp.ReqExtra)
+		}
+		httpReq, err := ihttp.NewRequest(context.Background(), req.URL, extra, f.config.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		client, err := ihttp.NewClient(f.ctl, req)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: http status %d", ErrInvalidMetalink, resp.StatusCode)
+		}
+		return resp.Body, nil
+	case "DATA":
+		_, data := util.ParseDataUri(req.URL)
+		if data == nil {
+			return nil, ErrInvalidMetalink
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	case "FILE":
+		fileUrl, err := url.Parse(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(filepath.FromSlash(fileUrl.Path))
+	default:
+		return os.Open(req.URL)
+	}
+}
+
+// parseName returns the metalink file name without extension
+func parseName(u string) string {
+	if util.ParseSchema(u) == "DATA" {
+		return ""
+	}
+	if fileUrl, err := url.Parse(u); err == nil && fileUrl.Scheme != "" {
+		u = fileUrl.Path
+	}
+	name := filepath.Base(u)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+type fileFetcherData struct {
+	Req  *base.Request
+	Res  *base.Resource
+	Data any
+}
+
+type fileProgress struct {
+	Downloaded int64
+	Completed  bool
+	// Fetcher is the stored data of the http fetcher which is downloading the file
+	Fetcher *fileFetcherData
+}
+
+type fetcherData struct {
+	Files    []*file
+	Progress []*fileProgress
+}
+
+type FetcherManager struct {
+}
+
+func (fm *FetcherManager) Name() string {
+	return "metalink"
+}
+
+func (fm *FetcherManager) Filters() []*fetcher.SchemeFilter {
+	return []*fetcher.SchemeFilter{
+		{
+			Type:    fetcher.FilterTypeFile,
+			Pattern: "META4",
+		},
+		{
+			Type:    fetcher.FilterTypeFile,
+			Pattern: "METALINK",
+		},
+		{
+			Type:    fetcher.FilterTypeBase64,
+			Pattern: "APPLICATION/METALINK4+XML",
+		},
+		{
+			Type:    fetcher.FilterTypeBase64,
+			Pattern: "APPLICATION/METALINK+XML",
+		},
+	}
+}
+
+func (fm *FetcherManager) Build() fetcher.Fetcher {
+	return &Fetcher{}
+}
+
+func (fm *FetcherManager) ParseName(u string) string {
+	return parseName(u)
+}
+
+func (fm *FetcherManager) AutoRename() bool {
+	return true
+}
+
+func (fm *FetcherManager) DefaultConfig() any {
+	return &config{
+		UserAgent:   ihttp.DefaultUserAgent,
+		Connections: 16,
+	}
+}
+
+func (fm *FetcherManager) Store(f fetcher.Fetcher) (data any, err error) {
+	_f := f.(*Fetcher)
+	_f.lock.Lock()
+	defer _f.lock.Unlock()
+
+	if _f.current != nil {
+		httpData, err := (&ihttp.FetcherManager{}).Store(_f.current.fetcher)
+		if err != nil {
+			return nil, err
+		}
+		_f.data.Progress[_f.current.index].Fetcher.Data = httpData
+	}
+	return _f.data, nil
+}
+
+func (fm *FetcherManager) Restore() (v any, f func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher) {
+	return &fetcherData{}, func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher {
+		return &Fetcher{
+			meta: meta,
+			data: v.(*fetcherData),
+		}
+	}
+}
+
+func (fm *FetcherManager) Close() error {
+	return nil
+}
@@ -0,0 +1,257 @@
+package metalink
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	"github.com/GopeedLab/gopeed/internal/test"
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+const testPieceLength = 64 * 1024
+
+type testFile struct {
+	name string
+	data []byte
+}
+
+var testFiles = []*testFile{
+	{name: "a.bin", data: randomData(300*1024 + 7)},
+	{name: "sub/b.bin", data: randomData(100 * 1024)},
+}
+
+func randomData(size int) []byte {
+	buf := make([]byte, size)
+	rand.Read(buf)
+	return buf
+}
+
+func startTestServer(t *testing.T) net.Listener {
+	mux := http.NewServeMux()
+	for _, tf := range testFiles {
+		tf := tf
+		mux.HandleFunc("/"+tf.name, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, tf.name, time.Time{}, bytes.NewReader(tf.data))
+		})
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, mux)
+	return listener
+}
+
+// buildMetalink builds the metalink data uri, the highest priority url of each file is unreachable.
+func buildMetalink(listener net.Listener, corruptHash bool, corruptPiece bool) string {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8"?><metalink xmlns="urn:ietf:params:xml:ns:metalink">`)
+	for _, tf := range testFiles {
+		hash := sha256.Sum256(tf.data)
+		hashHex := hex.EncodeToString(hash[:])
+		if corruptHash {
+			hashHex = strings.Repeat("0", len(hashHex))
+		}
+		sb.WriteString(fmt.Sprintf(`<file name="%s"><size>%d</size><hash type="sha-256">%s</hash>`, tf.name, len(tf.data), hashHex))
+		sb.WriteString(fmt.Sprintf(`<pieces length="%d" type="sha-1">`, testPieceLength))
+		for i := 0; i < len(tf.data); i += testPieceLength {
+			end := min(i+testPieceLength, len(tf.data))
+			piece := sha1.Sum(tf.data[i:end])
+			pieceHex := hex.EncodeToString(piece[:])
+			if corruptPiece && i > 0 {
+				pieceHex = strings.Repeat("0", len(pieceHex))
+			}
+			sb.WriteString(fmt.Sprintf(`<hash>%s</hash>`, pieceHex))
+		}
+		sb.WriteString(`</pieces>`)
+		sb.WriteString(fmt.Sprintf(`<url priority="1">http://127.0.0.1:1/%s</url>`, tf.name))
+		sb.WriteString(fmt.Sprintf(`<url priority="2">http://%s/%s</url>`, listener.Addr().String(), tf.name))
+		sb.WriteString(`</file>`)
+	}
+	sb.WriteString(`</metalink>`)
+	return "data:application/metalink4+xml;base64," + base64.StdEncoding.EncodeToString([]byte(sb.String()))
+}
+
+func TestFetcher_Resolve(t *testing.T) {
+	listener := startTestServer(t)
+	defer listener.Close()
+
+	fetcher := buildFetcher()
+	if err := fetcher.Resolve(&base.Request{URL: buildMetalink(listener, false, false)}); err != nil {
+		t.Fatal(err)
+	}
+	res := fetcher.Meta().Res
+	if len(res.Files) != len(testFiles) {
+		t.Fatalf("Resolve() got = %v, want %v", len(res.Files), len(testFiles))
+	}
+	if res.Files[1].Name != "b.bin" || res.Files[1].Path != "sub" {
+		t.Errorf("Resolve() got = %v, want %v", res.Files[1], testFiles[1].name)
+	}
+	if res.Size != int64(len(testFiles[0].data)+len(testFiles[1].data)) {
+		t.Errorf("Resolve() got = %v, want %v", res.Size, len(testFiles[0].data)+len(testFiles[1].data))
+	}
+}
+
+func TestFetcher_Download(t *testing.T) {
+	listener := startTestServer(t)
+	defer listener.Close()
+
+	dir := t.TempDir()
+	fetcher := downloadReady(buildMetalink(listener, false, false), dir, t)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(dir, t)
+}
+
+func TestFetcher_DownloadResume(t *testing.T) {
+	listener := startTestServer(t)
+	defer listener.Close()
+
+	dir := t.TempDir()
+	fetcher := downloadReady(buildMetalink(listener, false, false), dir, t)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := new(FetcherManager)
+	data, err := fm.Store(fetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := json.Marshal(data)
+	v, f := fm.Restore()
+	if err := json.Unmarshal(buf, v); err != nil {
+		t.Fatal(err)
+	}
+	restored := f(fetcher.Meta(), v)
+	restored.Setup(buildController(fm))
+	if err := restored.Create(fetcher.Meta().Opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(dir, t)
+}
+
+func TestFetcher_DownloadVerifyFailed(t *testing.T) {
+	listener := startTestServer(t)
+	defer listener.Close()
+
+	tests := []struct {
+		name         string
+		corruptHash  bool
+		corruptPiece bool
+	}{
+		{
+			name:        "hash",
+			corruptHash: true,
+		},
+		{
+			name:         "pieces",
+			corruptPiece: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := downloadReady(buildMetalink(listener, tt.corruptHash, tt.corruptPiece), t.TempDir(), t)
+			if err := fetcher.Start(); err != nil {
+				t.Fatal(err)
+			}
+			var checksumErr *base.ChecksumError
+			if err := fetcher.Wait(); !errors.As(err, &checksumErr) {
+				t.Errorf("Wait() got = %v, want %v", err, checksumErr)
+			}
+		})
+	}
+}
+
+func TestFetcher_BuildFileController(t *testing.T) {
+	fetcher := buildFetcher()
+	fetcher.config.UserAgent = ""
+	fetcher.config.Connections = 8
+	fetcher.ctl.GetProtocolConfig = func(name string, v any) {
+		if name != "http" {
+			t.Errorf("GetProtocolConfig() got = %v, want %v", name, "http")
+		}
+		json.Unmarshal([]byte(`{"userAgent":"global","connections":2,"retry":{"maxAttempts":7}}`), v)
+	}
+	var got map[string]any
+	fetcher.buildFileController(&ihttp.FetcherManager{}).GetConfig(&got)
+	want := map[string]any{
+		"userAgent":   "global",
+		"connections": float64(8),
+		"retry":       map[string]any{"maxAttempts": float64(7)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetConfig() got = %v, want %v", got, want)
+	}
+}
+
+func assertFiles(dir string, t *testing.T) {
+	for _, tf := range testFiles {
+		got, err := os.ReadFile(filepath.Join(dir, tf.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tf.data) {
+			t.Errorf("Download() %s got = %v bytes, want %v bytes", tf.name, len(got), len(tf.data))
+		}
+	}
+}
+
+func downloadReady(u string, dir string, t *testing.T) *Fetcher {
+	fetcher := buildFetcher()
+	if err := fetcher.Resolve(&base.Request{URL: u}); err != nil {
+		t.Fatal(err)
+	}
+	err := fetcher.Create(&base.Options{
+		Path: dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetcher
+}
+
+func buildController(fm *FetcherManager) *controller.Controller {
+	ctl := controller.NewController()
+	ctl.GetConfig = func(v any) {
+		json.Unmarshal([]byte(test.ToJson(fm.DefaultConfig())), v)
+	}
+	return ctl
+}
+
+func buildFetcher() *Fetcher {
+	fm := new(FetcherManager)
+	fetcher := fm.Build()
+	fetcher.Setup(buildController(fm))
+	return fetcher.(*Fetcher)
+}
@@ -0,0 +1,188 @@
+package metalink
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/util"
+)
+
+var ErrInvalidMetalink = errors.New("invalid metalink")
+
+// lowestPriority is the priority of the url without priority attribute, see RFC 5854 4.2.16.1
+const lowestPriority = 999999
+
+// Hash algorithms ordered by strength, the strongest supported one is used for verification
+var hashAlgorithms = []base.ChecksumAlgorithm{
+	base.ChecksumAlgorithmSHA512,
+	base.ChecksumAlgorithmSHA256,
+	base.ChecksumAlgorithmSHA1,
+	base.ChecksumAlgorithmMD5,
+}
+
+// metalinkXml supports both metalink 4.0 (RFC 5854) and metalink 3.0 formats
+type metalinkXml struct {
+	XMLName xml.Name   `xml:"metalink"`
+	Files   []*fileXml `xml:"file"`
+	FilesV3 []*fileXml `xml:"files>file"`
+}
+
+type fileXml struct {
+	Name   string       `xml:"name,attr"`
+	Size   int64        `xml:"size"`
+	Hashes []*hashXml   `xml:"hash"`
+	Pieces []*piecesXml `xml:"pieces"`
+	Urls   []*urlXml    `xml:"url"`
+
+	Verification struct {
+		Hashes []*hashXml   `xml:"hash"`
+		Pieces []*piecesXml `xml:"pieces"`
+	} `xml:"verification"`
+	ResourceUrls []*urlXml `xml:"resources>url"`
+}
+
+type hashXml struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type piecesXml struct {
+	Type   string     `xml:"type,attr"`
+	Length int64      `xml:"length,attr"`
+	Hashes []*hashXml `xml:"hash"`
+}
+
+type urlXml struct {
+	// Priority is used by metalink 4.0, lower value has higher priority
+	Priority int `xml:"priority,attr"`
+	// Preference is used by metalink 3.0, higher value has higher priority
+	Preference int    `xml:"preference,attr"`
+	Value      string `xml:",chardata"`
+}
+
+type file struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Urls are ordered by priority
+	Urls     []string       `json:"urls"`
+	Checksum *base.Checksum `json:"checksum"`
+	Pieces   *pieces        `json:"pieces"`
+}
+
+type pieces struct {
+	Algorithm base.ChecksumAlgorithm `json:"algorithm"`
+	Length    int64                  `json:"length"`
+	Hashes    []string               `json:"hashes"`
+}
+
+// parse parses the metalink document, only the files which have supported urls are returned.
+func parse(r io.Reader) ([]*file, error) {
+	var m metalinkXml
+	if err := xml.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetalink, err)
+	}
+	fileXmls := append(m.Files, m.FilesV3...)
+	files := make([]*file, 0, len(fileXmls))
+	for _, fx := range fileXmls {
+		name := path.Clean(strings.ReplaceAll(fx.Name, "\\", "/"))
+		// The file name must be a relative path and must not contain "..", see RFC 5854 4.1.2.1
+		if name == "" || name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("%w: invalid file name %q", ErrInvalidMetalink, fx.Name)
+		}
+		f := &file{
+			Name: path.Base(name),
+			Path: util.Dir(name),
+			Size: fx.Size,
+			Urls: sortUrls(append(fx.Urls, fx.ResourceUrls...)),
+		}
+		if len(f.Urls) == 0 {
+			continue
+		}
+		f.Checksum = selectHash(append(fx.Hashes, fx.Verification.Hashes...))
+		f.Pieces = selectPieces(append(fx.Pieces, fx.Verification.Pieces...))
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w: no downloadable file", ErrInvalidMetalink)
+	}
+	return files, nil
+}
+
+func sortUrls(urls []*urlXml) []string {
+	type priorityUrl struct {
+		priority int
+		url      string
+	}
+	pus := make([]*priorityUrl, 0, len(urls))
+	for _, u := range urls {
+		value := strings.TrimSpace(u.Value)
+		schema := util.ParseSchema(value)
+		if schema != "HTTP" && schema != "HTTPS" {
+			continue
+		}
+		priority := lowestPriority
+		if u.Priority > 0 {
+			priority = u.Priority
+		} else if u.Preference > 0 {
+			priority = lowestPriority - u.Preference
+		}
+		pus = append(pus, &priorityUrl{
+			priority: priority,
+			url:      value,
+		})
+	}
+	sort.SliceStable(pus, func(i, j int) bool {
+		return pus[i].priority < pus[j].priority
+	})
+	result := make([]string, 0, len(pus))
+	for _, pu := range pus {
+		result = append(result, pu.url)
+	}
+	return result
+}
+
+func selectHash(hashes []*hashXml) *base.Checksum {
+	for _, algorithm := range hashAlgorithms {
+		for _, h := range hashes {
+			if normalizeHashType(h.Type) == algorithm {
+				return &base.Checksum{
+					Algorithm: algorithm,
+					Value:     strings.TrimSpace(h.Value),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func selectPieces(piecesXmls []*piecesXml) *pieces {
+	for _, algorithm := range hashAlgorithms {
+		for _, px := range piecesXmls {
+			if normalizeHashType(px.Type) != algorithm || px.Length <= 0 || len(px.Hashes) == 0 {
+				continue
+			}
+			p := &pieces{
+				Algorithm: algorithm,
+				Length:    px.Length,
+				Hashes:    make([]string, 0, len(px.Hashes)),
+			}
+			for _, h := range px.Hashes {
+				p.Hashes = append(p.Hashes, strings.TrimSpace(h.Value))
+			}
+			return p
+		}
+	}
+	return nil
+}
+
+// normalizeHashType converts the hash type to checksum algorithm, e.g. sha-256 -> sha256
+func normalizeHashType(t string) base.ChecksumAlgorithm {
+	return base.ChecksumAlgorithm(strings.ReplaceAll(strings.ToLower(strings.TrimSpace(t)), "-", ""))
+}
@@ -0,0 +1,138 @@
+package metalink
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+)
+
+func TestParse_V4(t *testing.T) {
+	files, err := parse(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="example.iso">
+    <size>14471447</size>
+    <hash type="md5">7220daac52d41e181b0b9050149e9a5e</hash>
+    <hash type="sha-256">a883c66f0c2d5a2f9bcb0f2b8dd7b66cd7fd8c6dd80fe4d9e4d3f8e6a2b51c1a</hash>
+    <pieces length="262144" type="sha-1">
+      <hash>8c93e98a77516ad66900b3954562a59d214234e0</hash>
+      <hash>8c93e98a77516ad66900b3954562a59d214234e1</hash>
+    </pieces>
+    <url priority="2">http://mirror2.example.com/example.iso</url>
+    <url priority="1">https://mirror1.example.com/example.iso</url>
+    <url>http://mirror3.example.com/example.iso</url>
+    <url priority="1">ftp://ftp.example.com/example.iso</url>
+  </file>
+  <file name="docs/readme.txt">
+    <url>http://example.com/readme.txt</url>
+  </file>
+  <file name="torrent-only.iso">
+    <metaurl mediatype="torrent">http://example.com/example.torrent</metaurl>
+  </file>
+</metalink>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*file{
+		{
+			Name: "example.iso",
+			Size: 14471447,
+			Urls: []string{
+				"https://mirror1.example.com/example.iso",
+				"http://mirror2.example.com/example.iso",
+				"http://mirror3.example.com/example.iso",
+			},
+			Checksum: &base.Checksum{
+				Algorithm: base.ChecksumAlgorithmSHA256,
+				Value:     "a883c66f0c2d5a2f9bcb0f2b8dd7b66cd7fd8c6dd80fe4d9e4d3f8e6a2b51c1a",
+			},
+			Pieces: &pieces{
+				Algorithm: base.ChecksumAlgorithmSHA1,
+				Length:    262144,
+				Hashes: []string{
+					"8c93e98a77516ad66900b3954562a59d214234e0",
+					"8c93e98a77516ad66900b3954562a59d214234e1",
+				},
+			},
+		},
+		{
+			Name: "readme.txt",
+			Path: "docs",
+			Urls: []string{"http://example.com/readme.txt"},
+		},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("parse() got = %v, want %v", files, want)
+	}
+}
+
+func TestParse_V3(t *testing.T) {
+	files, err := parse(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="example.iso">
+      <size>1024</size>
+      <verification>
+        <hash type="sha1">8c93e98a77516ad66900b3954562a59d214234e0</hash>
+      </verification>
+      <resources>
+        <url type="http" preference="10">http://low.example.com/example.iso</url>
+        <url type="http" preference="100">http://high.example.com/example.iso</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*file{
+		{
+			Name: "example.iso",
+			Size: 1024,
+			Urls: []string{
+				"http://high.example.com/example.iso",
+				"http://low.example.com/example.iso",
+			},
+			Checksum: &base.Checksum{
+				Algorithm: base.ChecksumAlgorithmSHA1,
+				Value:     "8c93e98a77516ad66900b3954562a59d214234e0",
+			},
+		},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("parse() got = %v, want %v", files, want)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "not xml",
+			data: "gopeed",
+		},
+		{
+			name: "absolute path",
+			data: `<metalink><file name="/etc/passwd"><url>http://example.com/a</url></file></metalink>`,
+		},
+		{
+			name: "parent path",
+			data: `<metalink><file name="../a"><url>http://example.com/a</url></file></metalink>`,
+		},
+		{
+			name: "no url",
+			data: `<metalink><file name="a"></file></metalink>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parse(strings.NewReader(tt.data)); !errors.Is(err, ErrInvalidMetalink) {
+				t.Errorf("parse() got = %v, want %v", err, ErrInvalidMetalink)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package s3
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/util"
+)
+
+const (
+	defaultRegion = "us-east-1"
+	// maxListSize limits the size of a ListObjectsV2 response, the objects are listed page by page
+	maxListSize  = 16 * 1024 * 1024
+	maxErrorSize = 64 * 1024
+)
+
+var (
+	ErrMissingBucket = errors.New("missing bucket")
+	ErrEmptyPrefix   = errors.New("no objects under the prefix")
+	// ErrObjectChanged is returned when the object is overwritten during the download, the ETag doesn't match
+	ErrObjectChanged = errors.New("object changed")
+)
+
+var (
+	md5ETagRegex       = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	multipartETagRegex = regexp.MustCompile(`^[0-9a-f]{32}-(\d+)$`)
+)
+
+// ResponseError is the error response of the S3 api
+type ResponseError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("s3 request fail,code:%d,error:%s,message:%s", e.StatusCode, e.Code, e.Message)
+}
+
+type object struct {
+	Key   string
+	Size  int64
+	ETag  string
+	Mtime *time.Time
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		ETag         string `xml:"ETag"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// api sends the requests of the bucket, they are signed if the credentials are set
+type api struct {
+	client    *http.Client
+	userAgent string
+	bucket    string
+	// endpoint is the url of the S3-compatible store, nil means the AWS endpoint
+	endpoint *url.URL
+	region   string
+	// creds is nil for the anonymous requests
+	creds *credentials
+}
+
+// newApi builds the api of the request bucket, the request extra takes precedence over the protocol config
+func (f *Fetcher) newApi(client *http.Client) (*api, error) {
+	bucket, _, err := parseUrl(f.meta.Req.URL)
+	if err != nil {
+		return nil, err
+	}
+	extra := f.reqExtra()
+	a := &api{
+		client:    client,
+		userAgent: f.config.UserAgent,
+		bucket:    bucket,
+		region:    cmp.Or(extra.Region, f.config.Region, defaultRegion),
+	}
+	if endpoint := cmp.Or(extra.Endpoint, f.config.Endpoint); endpoint != "" {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		if a.endpoint, err = url.Parse(endpoint); err != nil {
+			return nil, err
+		}
+	}
+	// The credentials are not mixed up, the key pair of the config is not used with the key id of the request
+	if extra.AccessKeyID != "" {
+		a.creds = &credentials{
+			accessKeyID:     extra.AccessKeyID,
+			secretAccessKey: extra.SecretAccessKey,
+			sessionToken:    extra.SessionToken,
+		}
+	} else if f.config.AccessKeyID != "" {
+		a.creds = &credentials{
+			accessKeyID:     f.config.AccessKeyID,
+			secretAccessKey: f.config.SecretAccessKey,
+			sessionToken:    f.config.SessionToken,
+		}
+	}
+	return a, nil
+}
+
+// objectUrl returns the url of the object, the bucket url is returned for the empty key.
+// The custom endpoints and the buckets with dots are addressed in the path style, the others in the virtual-hosted style.
+func (a *api) objectUrl(key string, query url.Values) string {
+	var host, p string
+	switch {
+	case a.endpoint != nil:
+		host = a.endpoint.Scheme + "://" + a.endpoint.Host
+		p = strings.TrimSuffix(a.endpoint.EscapedPath(), "/") + "/" + escape(a.bucket, true)
+	case strings.Contains(a.bucket, "."):
+		host = "https://s3." + a.region + ".amazonaws.com"
+		p = "/" + escape(a.bucket, true)
+	default:
+		host = "https://" + a.bucket + ".s3." + a.region + ".amazonaws.com"
+	}
+	if key != "" {
+		p += "/" + escape(key, false)
+	} else if p == "" {
+		p = "/"
+	}
+	if len(query) > 0 {
+		return host + p + "?" + query.Encode()
+	}
+	return host + p
+}
+
+// do sends the request of the object, the error responses are returned as *ResponseError
+func (a *api) do(ctx context.Context, method string, key string, query url.Values, header http.Header) (*http.Response, error) {
+	httpReq, err := ihttp.NewRequest(ctx, a.objectUrl(key, query), &fhttp.ReqExtra{Method: method}, a.userAgent)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		httpReq.Header[k] = v
+	}
+	if a.creds != nil {
+		signV4(httpReq, a.creds, a.region, time.Now())
+	}
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, readResponseError(resp)
+	}
+	return resp, nil
+}
+
+func readResponseError(resp *http.Response) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	// The responses of HEAD have no body
+	xml.NewDecoder(io.LimitReader(resp.Body, maxErrorSize)).Decode(&body)
+	if body.Code == "" {
+		body.Code = http.StatusText(resp.StatusCode)
+	}
+	return &ResponseError{
+		StatusCode: resp.StatusCode,
+		Code:       body.Code,
+		Message:    body.Message,
+	}
+}
+
+// headObject returns the object of the key, partNumber is the part to return the size of, 0 means the whole object
+func (a *api) headObject(ctx context.Context, key string, partNumber int) (*object, *http.Response, error) {
+	var query url.Values
+	if partNumber > 0 {
+		query = url.Values{"partNumber": {strconv.Itoa(partNumber)}}
+	}
+	resp, err := a.do(ctx, http.MethodHead, key, query, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	obj := &object{
+		Key:  key,
+		Size: resp.ContentLength,
+		ETag: resp.Header.Get("ETag"),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		obj.Mtime = &t
+	}
+	return obj, resp, nil
+}
+
+// listObjects lists the objects under the prefix page by page, the folder placeholders ending with slash are skipped
+func (a *api) listObjects(ctx context.Context, prefix string) ([]*object, error) {
+	var (
+		objects []*object
+		token   string
+	)
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := a.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(io.LimitReader(resp.Body, maxListSize)).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			if strings.HasSuffix(c.Key, "/") {
+				continue
+			}
+			obj := &object{
+				Key:  c.Key,
+				Size: c.Size,
+				ETag: c.ETag,
+			}
+			if t, err := time.Parse(time.RFC3339, c.LastModified); err == nil {
+				obj.Mtime = &t
+			}
+			objects = append(objects, obj)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// verifyETag checks the downloaded file against the ETag of the object, the ETag of a single part upload is the MD5 of the object,
+// the ETag of a multipart upload is the MD5 of the concatenated part MD5s with the number of parts.
+// The ETags which are not the MD5 digests are not verified, e.g. the objects encrypted by KMS or customer keys,
+// neither are the multipart uploads whose part count can't be derived from the size of the first part.
+func (a *api) verifyETag(ctx context.Context, name string, obj *object) error {
+	etag := strings.ToLower(strings.Trim(obj.ETag, `"`))
+	parts := 0
+	if m := multipartETagRegex.FindStringSubmatch(etag); m != nil {
+		parts, _ = strconv.Atoi(m[1])
+	} else if !md5ETagRegex.MatchString(etag) {
+		return nil
+	}
+	// The size of the first part is the part size of the upload, the parts except the last one have the same size
+	_, resp, err := a.headObject(ctx, obj.Key, min(parts, 1))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(resp.Header.Get("X-Amz-Server-Side-Encryption"), "aws:kms") ||
+		resp.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return nil
+	}
+	var actual string
+	if parts == 0 {
+		actual, err = util.FileChecksum(name, string(base.ChecksumAlgorithmMD5))
+	} else {
+		partSize := resp.ContentLength
+		// The parts have different sizes if the count doesn't match, the sizes can't be known without a request for each part
+		if partSize <= 0 || (obj.Size+partSize-1)/partSize != int64(parts) {
+			return nil
+		}
+		actual, err = multipartMd5(name, partSize)
+		// The count may match by chance, the mismatch is confirmed by the size of each part
+		if err == nil && actual != etag {
+			var sizes []int64
+			if sizes, err = a.partSizes(ctx, obj.Key, parts); err == nil {
+				actual, err = multipartMd5(name, sizes...)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if actual != etag {
+		return &base.ChecksumError{
+			Algorithm: base.ChecksumAlgorithmMD5,
+			Expected:  etag,
+			Actual:    actual,
+		}
+	}
+	return nil
+}
+
+// partSizes returns the size of each part of the multipart upload
+func (a *api) partSizes(ctx context.Context, key string, parts int) ([]int64, error) {
+	sizes := make([]int64, 0, parts)
+	for i := 1; i <= parts; i++ {
+		_, resp, err := a.headObject(ctx, key, i)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, resp.ContentLength)
+	}
+	return sizes, nil
+}
+
+// multipartMd5 returns the multipart ETag of the file uploaded by the parts of the sizes, the last size is used for the rest parts
+func multipartMd5(name string, partSizes ...int64) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var (
+		sums  []byte
+		parts int
+	)
+	for {
+		partSize := partSizes[min(parts, len(partSizes)-1)]
+		h := md5.New()
+		n, err := io.CopyN(h, file, partSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		if n == 0 && parts > 0 {
+			break
+		}
+		sums = h.Sum(sums)
+		parts++
+		if n < partSize {
+			break
+		}
+	}
+	sum := md5.Sum(sums)
+	return hex.EncodeToString(sum[:]) + "-" + strconv.Itoa(parts), nil
+}
+
+// parseUrl returns the bucket and the key of the s3 url, the key ending with slash or empty is a prefix
+func parseUrl(rawUrl string) (bucket string, key string, err error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Host == "" {
+		return "", "", ErrMissingBucket
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
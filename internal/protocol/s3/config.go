@@ -0,0 +1,15 @@
+package s3
+
+import "github.com/GopeedLab/gopeed/pkg/base"
+
+type config struct {
+	UserAgent   string `json:"userAgent"`
+	Connections int    `json:"connections"`
+	// Endpoint, Region and the credentials are used by the requests which don't set them in the request extra
+	Endpoint        string            `json:"endpoint"`
+	Region          string            `json:"region"`
+	AccessKeyID     string            `json:"accessKeyId"`
+	SecretAccessKey string            `json:"secretAccessKey"`
+	SessionToken    string            `json:"sessionToken"`
+	Retry           *base.RetryPolicy `json:"retry"`
+}
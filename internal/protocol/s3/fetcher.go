@@ -0,0 +1,377 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/fetcher"
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/protocol/s3"
+)
+
+const readTimeout = 15 * time.Second
+
+type Fetcher struct {
+	ctl    *controller.Controller
+	config *config
+	doneCh chan error
+
+	meta *fetcher.FetcherMeta
+	data *fetcherData
+
+	// api is shared by the workers, the connections are reused across the objects
+	api        *api
+	downloader *fetcher.ChunkDownloader
+}
+
+func (f *Fetcher) Setup(ctl *controller.Controller) {
+	f.ctl = ctl
+	f.doneCh = make(chan error, 1)
+	if f.meta == nil {
+		f.meta = &fetcher.FetcherMeta{}
+	}
+	if f.data == nil {
+		f.data = &fetcherData{}
+	}
+	f.ctl.GetConfig(&f.config)
+	return
+}
+
+func (f *Fetcher) Resolve(req *base.Request) error {
+	if err := base.ParseReqExtra[s3.ReqExtra](req); err != nil {
+		return err
+	}
+	f.meta.Req = req
+	client, err := ihttp.NewClient(f.ctl, req)
+	if err != nil {
+		return err
+	}
+	defer client.CloseIdleConnections()
+	a, err := f.newApi(client)
+	if err != nil {
+		return err
+	}
+	objects, prefix, isPrefix, err := f.resolveObjects(context.Background(), a)
+	if err != nil {
+		return err
+	}
+
+	res := &base.Resource{
+		Range: true,
+	}
+	if isPrefix {
+		res.Name = parseName(req.URL)
+	}
+	for _, obj := range objects {
+		file := &base.FileInfo{
+			Name:  path.Base(obj.Key),
+			Size:  obj.Size,
+			Ctime: obj.Mtime,
+		}
+		if isPrefix {
+			rel := strings.TrimPrefix(obj.Key, prefix)
+			file.Name = path.Base(rel)
+			if dir := path.Dir(rel); dir != "." {
+				file.Path = dir
+			}
+		}
+		res.Files = append(res.Files, file)
+	}
+	res.CalcSize(nil)
+	f.meta.Res = res
+	f.data.Objects = objects
+	return nil
+}
+
+// resolveObjects returns the object of the url key, or the objects under the prefix which is returned with them.
+// The key without the trailing slash is looked up as an object first, then as a prefix.
+func (f *Fetcher) resolveObjects(ctx context.Context, a *api) (objects []*object, prefix string, isPrefix bool, err error) {
+	_, key, err := parseUrl(f.meta.Req.URL)
+	if err != nil {
+		return
+	}
+	var headErr error
+	if key != "" && !strings.HasSuffix(key, "/") {
+		obj, _, err := a.headObject(ctx, key, 0)
+		if err == nil {
+			return []*object{obj}, "", false, nil
+		}
+		var re *ResponseError
+		if !errors.As(err, &re) || re.StatusCode != http.StatusNotFound {
+			return nil, "", false, err
+		}
+		headErr = err
+		key += "/"
+	}
+	if objects, err = a.listObjects(ctx, key); err != nil {
+		return
+	}
+	// The keys relative to the prefix are the file paths, the keys with the dot segments would escape the download directory
+	objects = slices.DeleteFunc(objects, func(obj *object) bool {
+		return !fetcher.IsLocalPath(strings.TrimPrefix(obj.Key, key))
+	})
+	if len(objects) == 0 {
+		// The key is neither an object nor a prefix
+		if headErr != nil {
+			return nil, "", false, headErr
+		}
+		return nil, "", false, ErrEmptyPrefix
+	}
+	return objects, key, true, nil
+}
+
+func (f *Fetcher) Create(opts *base.Options) error {
+	f.meta.Opts = opts
+
+	if err := base.ParseOptsExtra[s3.OptsExtra](f.meta.Opts); err != nil {
+		return err
+	}
+	if opts.Extra == nil {
+		opts.Extra = &s3.OptsExtra{}
+	}
+	extra := opts.Extra.(*s3.OptsExtra)
+	if extra.Connections <= 0 {
+		extra.Connections = f.config.Connections
+		if extra.Connections <= 0 {
+			extra.Connections = 1
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) Start() (err error) {
+	// Avoid request extra modified by extension
+	if err = base.ParseReqExtra[s3.ReqExtra](f.meta.Req); err != nil {
+		return
+	}
+	client, err := ihttp.NewClient(f.ctl, f.meta.Req)
+	if err != nil {
+		return
+	}
+	if f.api, err = f.newApi(client); err != nil {
+		return
+	}
+	// The resource may be resolved by extension, load the objects from the bucket
+	if f.data.Objects == nil {
+		if f.data.Objects, _, _, err = f.resolveObjects(context.Background(), f.api); err != nil {
+			return
+		}
+		if len(f.data.Objects) != len(f.meta.Res.Files) {
+			return fmt.Errorf("the objects of %s are changed", f.meta.Req.URL)
+		}
+	}
+	connections := f.meta.Opts.Extra.(*s3.OptsExtra).Connections
+	if f.data.Chunks == nil {
+		f.data.Chunks = fetcher.SplitChunks(f.meta, connections)
+	}
+	f.downloader = &fetcher.ChunkDownloader{
+		Ctl:    f.ctl,
+		Meta:   f.meta,
+		Source: f,
+		Retry:  fetcher.BuildRetryPolicy(f.config.Retry),
+	}
+	return f.downloader.Start(f.data.Chunks, connections, func(ctx context.Context, err error) {
+		if err == nil {
+			err = f.verify(ctx)
+		}
+		f.api.client.CloseIdleConnections()
+		f.doneCh <- err
+	})
+}
+
+func (f *Fetcher) Pause() (err error) {
+	if f.downloader != nil {
+		f.downloader.Pause()
+	}
+	if f.api != nil {
+		f.api.client.CloseIdleConnections()
+	}
+	return
+}
+
+func (f *Fetcher) Close() (err error) {
+	return f.Pause()
+}
+
+func (f *Fetcher) Meta() *fetcher.FetcherMeta {
+	return f.meta
+}
+
+func (f *Fetcher) Stats() any {
+	return &s3.Stats{
+		Chunks:          len(f.data.Chunks),
+		CompletedChunks: fetcher.CompletedChunks(f.data.Chunks),
+	}
+}
+
+// Progress returns the downloaded bytes of each selected file
+func (f *Fetcher) Progress() fetcher.Progress {
+	return fetcher.ChunksProgress(f.meta, f.data.Chunks)
+}
+
+func (f *Fetcher) Wait() (err error) {
+	return <-f.doneCh
+}
+
+// verify checks the selected files against the ETags after all of them are downloaded
+func (f *Fetcher) verify(ctx context.Context) error {
+	for _, index := range f.meta.SelectedFiles() {
+		if err := f.api.verifyETag(ctx, f.meta.Filepath(index), f.data.Objects[index]); err != nil {
+			return fmt.Errorf("%s: %w", f.data.Objects[index].Key, err)
+		}
+	}
+	return nil
+}
+
+// Retryable returns whether the request may succeed by retrying, the client errors except throttling are not retried
+func (f *Fetcher) Retryable(err error) bool {
+	if errors.Is(err, ErrObjectChanged) {
+		return false
+	}
+	var re *ResponseError
+	if errors.As(err, &re) {
+		return re.StatusCode >= 500 || re.StatusCode == http.StatusTooManyRequests || re.StatusCode == http.StatusRequestTimeout
+	}
+	return true
+}
+
+// Host returns the host of the endpoint, the connection slots of the host are shared by the connections of all tasks
+func (f *Fetcher) Host(file int) string {
+	u, err := url.Parse(f.api.objectUrl(f.data.Objects[file].Key, nil))
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// Open requests the range of the chunk, the chunks must be the parts of the same object version
+func (f *Fetcher) Open(ctx context.Context, w *fetcher.Worker, c *fetcher.Chunk) (io.ReadCloser, error) {
+	obj := f.data.Objects[c.File]
+	header := http.Header{}
+	header.Set(base.HttpHeaderRange, fmt.Sprintf(base.HttpHeaderRangeFormat, c.Begin+c.Downloaded, c.End))
+	if obj.ETag != "" {
+		header.Set("If-Match", obj.ETag)
+	}
+	resp, err := f.api.do(ctx, http.MethodGet, obj.Key, nil, header)
+	if err != nil {
+		var re *ResponseError
+		if errors.As(err, &re) && re.StatusCode == http.StatusPreconditionFailed {
+			return nil, ErrObjectChanged
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, ihttp.NewRequestError(resp.StatusCode, resp.Status)
+	}
+	return &bodyReader{
+		Reader: ihttp.NewTimeoutReader(resp.Body, readTimeout),
+		Closer: resp.Body,
+	}, nil
+}
+
+// bodyReader reads the response body with the read timeout
+type bodyReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (f *Fetcher) reqExtra() *s3.ReqExtra {
+	if f.meta.Req.Extra == nil {
+		return &s3.ReqExtra{}
+	}
+	return f.meta.Req.Extra.(*s3.ReqExtra)
+}
+
+// parseName returns the object or prefix name of the url, the bucket name is used for the root prefix
+func parseName(rawUrl string) string {
+	bucket, key, err := parseUrl(rawUrl)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(key)
+	if key == "" || name == "/" || name == "." {
+		return bucket
+	}
+	return name
+}
+
+type fetcherData struct {
+	// Objects are the objects of the resource files, the ETags are verified after downloading
+	Objects []*object
+	Chunks  []*fetcher.Chunk
+}
+
+// clone returns the copy of the data to store, the chunks are written by the workers while storing
+func (d *fetcherData) clone() *fetcherData {
+	return &fetcherData{
+		Objects: d.Objects,
+		Chunks:  fetcher.CloneChunks(d.Chunks),
+	}
+}
+
+type FetcherManager struct {
+}
+
+func (fm *FetcherManager) Name() string {
+	return "s3"
+}
+
+func (fm *FetcherManager) Filters() []*fetcher.SchemeFilter {
+	return []*fetcher.SchemeFilter{
+		{
+			Type:    fetcher.FilterTypeUrl,
+			Pattern: "S3",
+		},
+	}
+}
+
+func (fm *FetcherManager) Build() fetcher.Fetcher {
+	return &Fetcher{}
+}
+
+func (fm *FetcherManager) ParseName(u string) string {
+	return parseName(u)
+}
+
+func (fm *FetcherManager) AutoRename() bool {
+	return true
+}
+
+func (fm *FetcherManager) DefaultConfig() any {
+	return &config{
+		UserAgent:   ihttp.DefaultUserAgent,
+		Connections: 4,
+	}
+}
+
+func (fm *FetcherManager) Store(f fetcher.Fetcher) (data any, err error) {
+	_f := f.(*Fetcher)
+	return _f.data.clone(), nil
+}
+
+func (fm *FetcherManager) Restore() (v any, f func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher) {
+	return &fetcherData{}, func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher {
+		fetcher := &Fetcher{
+			meta: meta,
+			data: v.(*fetcherData),
+		}
+		base.ParseReqExtra[s3.ReqExtra](fetcher.meta.Req)
+		base.ParseOptsExtra[s3.OptsExtra](fetcher.meta.Opts)
+		return fetcher
+	}
+}
+
+func (fm *FetcherManager) Close() error {
+	return nil
+}
@@ -0,0 +1,221 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	testBucket    = "bucket"
+	testAccessKey = "AKIDTEST"
+	testSecretKey = "secret"
+	testRegion    = "eu-west-1"
+)
+
+type testObject struct {
+	data  []byte
+	etag  string
+	mtime time.Time
+	// partSizes are the part sizes of the multipart upload, empty means a single part upload
+	partSizes []int64
+	// kms means the object is encrypted by KMS, the ETag is not the MD5 digest
+	kms bool
+}
+
+// newTestObject returns the object uploaded by the parts of the size, zero means a single part upload
+func newTestObject(data []byte, partSize int64) *testObject {
+	if partSize == 0 {
+		return newMultipartTestObject(data, nil)
+	}
+	var partSizes []int64
+	for begin := int64(0); begin < int64(len(data)); begin += partSize {
+		partSizes = append(partSizes, min(partSize, int64(len(data))-begin))
+	}
+	return newMultipartTestObject(data, partSizes)
+}
+
+// newMultipartTestObject returns the object uploaded by the parts of the sizes, empty means a single part upload
+func newMultipartTestObject(data []byte, partSizes []int64) *testObject {
+	obj := &testObject{
+		data:      data,
+		mtime:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		partSizes: partSizes,
+	}
+	if len(partSizes) == 0 {
+		sum := md5.Sum(data)
+		obj.etag = `"` + hex.EncodeToString(sum[:]) + `"`
+		return obj
+	}
+	var (
+		sums  []byte
+		begin int64
+	)
+	for _, size := range partSizes {
+		sum := md5.Sum(data[begin : begin+size])
+		sums = append(sums, sum[:]...)
+		begin += size
+	}
+	sum := md5.Sum(sums)
+	obj.etag = `"` + hex.EncodeToString(sum[:]) + "-" + strconv.Itoa(len(partSizes)) + `"`
+	return obj
+}
+
+type testServer struct {
+	*httptest.Server
+	// creds verifies the signatures of the requests, nil means the anonymous requests are allowed
+	creds *credentials
+	// listPageSize is the max keys of a ListObjectsV2 page
+	listPageSize int
+
+	lock    sync.Mutex
+	objects map[string]*testObject
+	// lists and gets count the received ListObjectsV2 and GetObject requests
+	lists atomic.Int32
+	gets  atomic.Int32
+}
+
+// startTestS3Server starts a S3-compatible server of the test bucket, the bucket is addressed in the path style
+func startTestS3Server(objects map[string]*testObject, creds *credentials) *testServer {
+	s := &testServer{
+		creds:        creds,
+		listPageSize: 2,
+		objects:      objects,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	if s.creds != nil && !s.verifySignature(r) {
+		s.writeError(w, r, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testBucket {
+		s.writeError(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		s.lists.Add(1)
+		s.list(w, r)
+		return
+	}
+
+	s.lock.Lock()
+	obj, ok := s.objects[key]
+	s.lock.Unlock()
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", obj.etag)
+	if obj.kms {
+		w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+	}
+	if partNumber := r.URL.Query().Get("partNumber"); partNumber != "" && r.Method == http.MethodHead {
+		size := int64(len(obj.data))
+		if n, _ := strconv.Atoi(partNumber); n > 0 && n <= len(obj.partSizes) {
+			size = obj.partSizes[n-1]
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("Last-Modified", obj.mtime.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusPartialContent)
+		return
+	}
+	if r.Method == http.MethodGet {
+		s.gets.Add(1)
+	}
+	http.ServeContent(w, r, key, obj.mtime, bytes.NewReader(obj.data))
+}
+
+func (s *testServer) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	s.lock.Lock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	end := min(start+s.listPageSize, len(keys))
+
+	type content struct {
+		Key          string
+		Size         int
+		ETag         string
+		LastModified string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{
+		IsTruncated: end < len(keys),
+	}
+	for _, key := range keys[start:end] {
+		obj := s.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			Size:         len(obj.data),
+			ETag:         obj.etag,
+			LastModified: obj.mtime.Format("2006-01-02T15:04:05.000Z"),
+		})
+	}
+	s.lock.Unlock()
+	if result.IsTruncated {
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// verifySignature signs the request again with the server credentials and compares the signatures
+func (s *testServer) verifySignature(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	now, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if auth == "" || err != nil {
+		return false
+	}
+	region := testRegion
+	if _, cred, ok := strings.Cut(auth, "Credential="); ok {
+		if parts := strings.Split(cred, "/"); len(parts) > 2 {
+			region = parts[2]
+		}
+	}
+	signed := r.Clone(r.Context())
+	signed.Header.Del("Authorization")
+	signV4(signed, s.creds, region, now)
+	return region == testRegion && signed.Header.Get("Authorization") == auth
+}
+
+func (s *testServer) writeError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name `xml:"Error"`
+			Code    string
+			Message string
+		}{Code: code, Message: http.StatusText(status)})
+	}
+}
+
+// setObject replaces the object of the key
+func (s *testServer) setObject(key string, obj *testObject) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects[key] = obj
+}
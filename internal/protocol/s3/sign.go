@@ -0,0 +1,128 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	signService   = "s3"
+	amzDateFormat = "20060102T150405Z"
+	// emptyPayloadHash is the sha256 of the empty body, the requests to resolve and download have no body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type credentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// signV4 signs the request without body by AWS signature version 4 in the Authorization header,
+// the host, the range and the x-amz-* headers are signed.
+func signV4(req *http.Request, creds *credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	scope := strings.Join([]string{amzDate[:8], region, signService, "aws4_request"}, "/")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		amzDate,
+		scope,
+		hexSha256(canonicalRequest),
+	}, "\n")
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, s := range []string{amzDate[:8], region, signService, "aws4_request"} {
+		key = hmacSha256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery returns the query sorted by the names and the values
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, escape(k, true)+"="+escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escape encodes the string by the rules of AWS signature, all bytes except the unreserved characters are encoded,
+// the slashes are kept in the paths.
+func escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hexSha256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,13 @@
+package sftp
+
+import "github.com/GopeedLab/gopeed/pkg/base"
+
+type config struct {
+	Connections int `json:"connections"`
+	// KnownHostsFile is the known_hosts file to verify the host keys, empty means ~/.ssh/known_hosts
+	KnownHostsFile string `json:"knownHostsFile"`
+	// PrivateKeyFile is the private key of the requests which don't set it, Passphrase decrypts the encrypted private keys
+	PrivateKeyFile string            `json:"privateKeyFile"`
+	Passphrase     string            `json:"passphrase"`
+	Retry          *base.RetryPolicy `json:"retry"`
+}
@@ -0,0 +1,406 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/fetcher"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	fsftp "github.com/GopeedLab/gopeed/pkg/protocol/sftp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// readBufSize is larger than the max sftp packet, so a read is sent as the concurrent requests
+const readBufSize = 256 * 1024
+
+var ErrEmptyDirectory = errors.New("empty directory")
+
+type Fetcher struct {
+	ctl    *controller.Controller
+	config *config
+	doneCh chan error
+
+	meta *fetcher.FetcherMeta
+	data *fetcherData
+
+	downloader *fetcher.ChunkDownloader
+
+	// conn is the ssh connection shared by the sftp channels of the workers
+	connLock sync.Mutex
+	conn     *ssh.Client
+}
+
+func (f *Fetcher) Setup(ctl *controller.Controller) {
+	f.ctl = ctl
+	f.doneCh = make(chan error, 1)
+	if f.meta == nil {
+		f.meta = &fetcher.FetcherMeta{}
+	}
+	if f.data == nil {
+		f.data = &fetcherData{}
+	}
+	f.ctl.GetConfig(&f.config)
+	return
+}
+
+func (f *Fetcher) Resolve(req *base.Request) error {
+	if err := base.ParseReqExtra[fsftp.ReqExtra](req); err != nil {
+		return err
+	}
+	f.meta.Req = req
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conn, err := f.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	p := remoteRoot(u)
+	info, err := client.Stat(p)
+	if err != nil {
+		return err
+	}
+	res := &base.Resource{
+		Range: true,
+	}
+	if info.IsDir() {
+		res.Name = parseName(u)
+		if res.Files, err = walk(ctx, client, p, ""); err != nil {
+			return err
+		}
+		if len(res.Files) == 0 {
+			return ErrEmptyDirectory
+		}
+	} else {
+		mtime := info.ModTime()
+		res.Files = []*base.FileInfo{
+			{
+				Name:  parseName(u),
+				Size:  info.Size(),
+				Ctime: &mtime,
+			},
+		}
+	}
+	res.CalcSize(nil)
+	f.meta.Res = res
+	return nil
+}
+
+// walk lists the regular files of the directory recursively, the file paths are relative to the root directory.
+// The symlinks are skipped, they may point out of the directory or loop.
+func walk(ctx context.Context, client *sftp.Client, root string, rel string) ([]*base.FileInfo, error) {
+	infos, err := client.ReadDirContext(ctx, path.Join(root, rel))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	var files []*base.FileInfo
+	for _, info := range infos {
+		// The names come from the untrusted server, they must not escape the download directory
+		if !fetcher.IsLocalName(info.Name()) {
+			continue
+		}
+		switch {
+		case info.Mode().IsRegular():
+			mtime := info.ModTime()
+			files = append(files, &base.FileInfo{
+				Name:  info.Name(),
+				Path:  rel,
+				Size:  info.Size(),
+				Ctime: &mtime,
+			})
+		case info.IsDir():
+			subFiles, err := walk(ctx, client, root, path.Join(rel, info.Name()))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, subFiles...)
+		}
+	}
+	return files, nil
+}
+
+func (f *Fetcher) Create(opts *base.Options) error {
+	f.meta.Opts = opts
+
+	if err := base.ParseOptsExtra[fsftp.OptsExtra](f.meta.Opts); err != nil {
+		return err
+	}
+	if opts.Extra == nil {
+		opts.Extra = &fsftp.OptsExtra{}
+	}
+	extra := opts.Extra.(*fsftp.OptsExtra)
+	if extra.Connections <= 0 {
+		extra.Connections = f.config.Connections
+		if extra.Connections <= 0 {
+			extra.Connections = 1
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) Start() (err error) {
+	// Avoid request extra modified by extension
+	if err = base.ParseReqExtra[fsftp.ReqExtra](f.meta.Req); err != nil {
+		return
+	}
+	connections := f.meta.Opts.Extra.(*fsftp.OptsExtra).Connections
+	if f.data.Chunks == nil {
+		f.data.Chunks = fetcher.SplitChunks(f.meta, connections)
+	}
+	f.downloader = &fetcher.ChunkDownloader{
+		Ctl:     f.ctl,
+		Meta:    f.meta,
+		Source:  f,
+		Retry:   fetcher.BuildRetryPolicy(f.config.Retry),
+		BufSize: readBufSize,
+	}
+	return f.downloader.Start(f.data.Chunks, connections, func(ctx context.Context, err error) {
+		f.closeConn()
+		f.doneCh <- err
+	})
+}
+
+func (f *Fetcher) Pause() (err error) {
+	if f.downloader != nil {
+		f.downloader.Pause()
+	}
+	f.closeConn()
+	return
+}
+
+func (f *Fetcher) Close() (err error) {
+	return f.Pause()
+}
+
+func (f *Fetcher) Meta() *fetcher.FetcherMeta {
+	return f.meta
+}
+
+func (f *Fetcher) Stats() any {
+	return &fsftp.Stats{
+		Chunks:          len(f.data.Chunks),
+		CompletedChunks: fetcher.CompletedChunks(f.data.Chunks),
+	}
+}
+
+// Progress returns the downloaded bytes of each selected file
+func (f *Fetcher) Progress() fetcher.Progress {
+	return fetcher.ChunksProgress(f.meta, f.data.Chunks)
+}
+
+func (f *Fetcher) Wait() (err error) {
+	return <-f.doneCh
+}
+
+// Host returns the host of the server, the connection slots of the host are shared by the connections of all tasks
+func (f *Fetcher) Host(file int) string {
+	u, err := url.Parse(f.meta.Req.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// Open opens the file at the offset of the chunk, the sftp channel of the worker is reused by its next chunks
+func (f *Fetcher) Open(ctx context.Context, w *fetcher.Worker, c *fetcher.Chunk) (io.ReadCloser, error) {
+	if w.Conn == nil {
+		conn, err := f.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		client, err := sftp.NewClient(conn)
+		if err != nil {
+			return nil, err
+		}
+		w.Conn = client
+	}
+	client := w.Conn.(*sftp.Client)
+	// The read is interrupted by closing the channel when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+	})
+	remote, err := client.Open(f.remotePath(c.File))
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	if _, err = remote.Seek(c.Begin+c.Downloaded, io.SeekStart); err != nil {
+		remote.Close()
+		stop()
+		return nil, err
+	}
+	return &remoteReader{File: remote, stop: stop}, nil
+}
+
+// remoteReader stops interrupting the channel when the file is closed
+type remoteReader struct {
+	*sftp.File
+	stop func() bool
+}
+
+func (r *remoteReader) Close() error {
+	r.stop()
+	return r.File.Close()
+}
+
+// connect returns the shared ssh connection, it is dialed on the first use and after it is broken
+func (f *Fetcher) connect(ctx context.Context) (*ssh.Client, error) {
+	f.connLock.Lock()
+	defer f.connLock.Unlock()
+	if f.conn != nil {
+		return f.conn, nil
+	}
+	conn, err := f.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f.conn = conn
+	go func() {
+		conn.Wait()
+		f.connLock.Lock()
+		defer f.connLock.Unlock()
+		if f.conn == conn {
+			f.conn = nil
+		}
+	}()
+	return conn, nil
+}
+
+func (f *Fetcher) closeConn() {
+	f.connLock.Lock()
+	defer f.connLock.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// remotePath returns the path of the file on the server
+func (f *Fetcher) remotePath(index int) string {
+	u, _ := url.Parse(f.meta.Req.URL)
+	root := remoteRoot(u)
+	if f.meta.Res.Name == "" {
+		return root
+	}
+	file := f.meta.Res.Files[index]
+	return path.Join(root, file.Path, file.Name)
+}
+
+func (f *Fetcher) reqExtra() *fsftp.ReqExtra {
+	if f.meta.Req.Extra == nil {
+		return &fsftp.ReqExtra{}
+	}
+	return f.meta.Req.Extra.(*fsftp.ReqExtra)
+}
+
+// remoteRoot returns the path of the url on the server, the paths under /~ are relative to the home directory,
+// e.g. sftp://host/~/file is the file in the home directory and sftp://host/file is the file in the root directory.
+func remoteRoot(u *url.URL) string {
+	p := u.Path
+	if p == "/~" || strings.HasPrefix(p, "/~/") {
+		return "." + p[2:]
+	}
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+// parseName returns the file or directory name of the url, the host name is used for the root and home directories
+func parseName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "" || name == "/" || name == "." || name == "~" {
+		return u.Hostname()
+	}
+	return name
+}
+
+type fetcherData struct {
+	Chunks []*fetcher.Chunk
+}
+
+// clone returns the copy of the data to store, the chunks are written by the workers while storing
+func (d *fetcherData) clone() *fetcherData {
+	return &fetcherData{
+		Chunks: fetcher.CloneChunks(d.Chunks),
+	}
+}
+
+type FetcherManager struct {
+}
+
+func (fm *FetcherManager) Name() string {
+	return "sftp"
+}
+
+func (fm *FetcherManager) Filters() []*fetcher.SchemeFilter {
+	return []*fetcher.SchemeFilter{
+		{
+			Type:    fetcher.FilterTypeUrl,
+			Pattern: "SFTP",
+		},
+	}
+}
+
+func (fm *FetcherManager) Build() fetcher.Fetcher {
+	return &Fetcher{}
+}
+
+func (fm *FetcherManager) ParseName(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return parseName(pu)
+}
+
+func (fm *FetcherManager) AutoRename() bool {
+	return true
+}
+
+func (fm *FetcherManager) DefaultConfig() any {
+	return &config{
+		Connections: 4,
+	}
+}
+
+func (fm *FetcherManager) Store(f fetcher.Fetcher) (data any, err error) {
+	_f := f.(*Fetcher)
+	return _f.data.clone(), nil
+}
+
+func (fm *FetcherManager) Restore() (v any, f func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher) {
+	return &fetcherData{}, func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher {
+		fetcher := &Fetcher{
+			meta: meta,
+			data: v.(*fetcherData),
+		}
+		base.ParseReqExtra[fsftp.ReqExtra](fetcher.meta.Req)
+		base.ParseOptsExtra[fsftp.OptsExtra](fetcher.meta.Opts)
+		return fetcher
+	}
+}
+
+func (fm *FetcherManager) Close() error {
+	return nil
+}
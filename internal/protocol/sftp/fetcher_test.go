@@ -0,0 +1,422 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/test"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	fsftp "github.com/GopeedLab/gopeed/pkg/protocol/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testFileName = "file 1.data"
+	testFileSize = 5*1024*1024 + 7
+)
+
+// testFiles are the files of the served directory, the paths are relative to it
+var testFiles = map[string]int64{
+	"dir/a.data":     128*1024 + 3,
+	"dir/b.data":     0,
+	"dir/sub/c.data": 64 * 1024,
+}
+
+// prepareTestRoot creates the served files in a temp directory
+func prepareTestRoot(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]int64{testFileName: testFileSize}
+	for name, size := range testFiles {
+		files[name] = size
+	}
+	for name, size := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, size)
+		rand.Read(buf)
+		if err := os.WriteFile(name, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func buildUrl(server *testServer, user *url.Userinfo, p string) string {
+	return (&url.URL{
+		Scheme: "sftp",
+		User:   user,
+		Host:   server.addr(),
+		Path:   filepath.ToSlash(p),
+	}).String()
+}
+
+func TestFetcher_Resolve(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestSftpServer(t)
+	defer server.Close()
+
+	fetcher := buildFetcher(nil)
+	err := fetcher.Resolve(&base.Request{
+		URL:            buildUrl(server, url.UserPassword(testUser, testPassword), filepath.Join(root, testFileName)),
+		SkipVerifyCert: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := fetcher.Meta().Res
+	if !res.Range || res.Name != "" || res.Size != testFileSize || len(res.Files) != 1 || res.Files[0].Name != testFileName {
+		t.Errorf("Resolve() got = %v, want a ranged file %s of %d bytes", test.ToJson(res), testFileName, testFileSize)
+	}
+
+	fetcher = buildFetcher(nil)
+	err = fetcher.Resolve(&base.Request{
+		URL:            buildUrl(server, url.UserPassword(testUser, testPassword), filepath.Join(root, "dir")+"/"),
+		SkipVerifyCert: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = fetcher.Meta().Res
+	if res.Name != "dir" || len(res.Files) != len(testFiles) {
+		t.Fatalf("Resolve() got = %v, want the dir files", test.ToJson(res))
+	}
+	var size int64
+	for _, file := range res.Files {
+		want, ok := testFiles["dir/"+filepath.ToSlash(filepath.Join(file.Path, file.Name))]
+		if !ok || file.Size != want {
+			t.Errorf("Resolve() got unexpected file = %v", test.ToJson(file))
+		}
+		size += file.Size
+	}
+	if res.Size != size {
+		t.Errorf("Resolve() got size = %v, want %v", res.Size, size)
+	}
+}
+
+func TestFetcher_ResolveUnsafeNames(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the backslash is a path separator on windows")
+	}
+	root := prepareTestRoot(t)
+	// The name escapes the download directory on windows
+	if err := os.WriteFile(filepath.Join(root, "dir", `..\escape.data`), []byte("escape"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := startTestSftpServer(t)
+	defer server.Close()
+
+	fetcher := buildFetcher(nil)
+	err := fetcher.Resolve(&base.Request{
+		URL:            buildUrl(server, url.UserPassword(testUser, testPassword), filepath.Join(root, "dir")),
+		SkipVerifyCert: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(fetcher.Meta().Res.Files); got != len(testFiles) {
+		t.Errorf("Resolve() got = %v, want the dir files only", test.ToJson(fetcher.Meta().Res.Files))
+	}
+}
+
+func TestFetcher_ResolveAuthFailed(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestSftpServer(t)
+	defer server.Close()
+
+	for _, user := range []*url.Userinfo{
+		url.UserPassword(testUser, "wrong"),
+		url.User(testUser),
+		nil,
+	} {
+		fetcher := buildFetcher(nil)
+		err := fetcher.Resolve(&base.Request{
+			URL:            buildUrl(server, user, filepath.Join(root, testFileName)),
+			SkipVerifyCert: true,
+		})
+		if err == nil {
+			t.Errorf("Resolve() with user %v got = %v, want error", user, err)
+		}
+	}
+}
+
+func TestFetcher_ResolveKnownHosts(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestSftpServer(t)
+	defer server.Close()
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewPublicKey(otherPub)
+
+	tests := []struct {
+		name           string
+		knownHostsFile string
+		wantErr        bool
+	}{
+		{"known", server.writeKnownHosts(t, server.hostKey.PublicKey()), false},
+		{"mismatch", server.writeKnownHosts(t, otherKey), true},
+		{"missing", filepath.Join(t.TempDir(), "known_hosts"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := buildFetcher(&config{Connections: 4, KnownHostsFile: tt.knownHostsFile})
+			err := fetcher.Resolve(&base.Request{
+				URL: buildUrl(server, url.UserPassword(testUser, testPassword), filepath.Join(root, testFileName)),
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Resolve() got = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFetcher_Download(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestSftpServer(t)
+	defer server.Close()
+
+	req := &base.Request{
+		URL:            buildUrl(server, url.UserPassword(testUser, testPassword), filepath.Join(root, testFileName)),
+		SkipVerifyCert: true,
+	}
+	downloadAndCheck(t, root, req, nil, 1)
+
+	conns, channels := server.conns.Load(), server.channels.Load()
+	downloadAndCheck(t, root, req, nil, 4)
+	// The chunks are read over the sftp channels of a single ssh connection, besides the connection to resolve
+	if got := server.conns.Load() - conns; got != 2 {
+		t.Errorf("Download() got %v ssh connections, want %v", got, 2)
+	}
+	if got := server.channels.Load() - channels; got != 1+4 {
+		t.Errorf("Download() got %v sftp channels, want %v", got, 1+4)
+	}
+}
+
+func TestFetcher_DownloadWithPrivateKey(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestSftpServer(t)
+	defer server.Close()
+	cfg := &config{Connections: 4, KnownHostsFile: server.writeKnownHosts(t, server.hostKey.PublicKey())}
+
+	downloadAndCheck(t, root, &base.Request{
+		URL: buildUrl(server, url.User(testUser), filepath.Join(root, testFileName)),
+		Extra: &fsftp.ReqExtra{
+			PrivateKeyFile: server.writeClientKey(t, ""),
+		},
+	}, cfg, 2)
+
+	// The key file and the passphrase of the config are used if the request doesn't set the key file
+	cfg.PrivateKeyFile = server.writeClientKey(t, testPassphrase)
+	cfg.Passphrase = testPassphrase
+	downloadAndCheck(t, root, &base.Request{
+		URL: buildUrl(server, url.User(testUser), filepath.Join(root, testFileName)),
+	}, cfg, 2)
+}
+
+func TestFetcher_DownloadDir(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestSftpServer(t)
+	defer server.Close()
+
+	fetcher := buildFetcher(nil)
+	if err := fetcher.Resolve(&base.Request{
+		URL:            buildUrl(server, url.UserPassword(testUser, testPassword), filepath.Join(root, "dir")),
+		SkipVerifyCert: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Only download the files in the sub directory
+	var selected []int
+	for i, file := range fetcher.Meta().Res.Files {
+		if file.Path == "sub" {
+			selected = append(selected, i)
+		}
+	}
+	if err := fetcher.Create(&base.Options{
+		Path:        t.TempDir(),
+		SelectFiles: selected,
+		Extra: fsftp.OptsExtra{
+			Connections: 2,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for name := range testFiles {
+		got := filepath.Join(fetcher.Meta().Opts.Path, name)
+		if filepath.Base(filepath.Dir(name)) != "sub" {
+			if _, err := os.Stat(got); !os.IsNotExist(err) {
+				t.Errorf("Download() got unselected file %s", got)
+			}
+			continue
+		}
+		assertFile(t, filepath.Join(root, name), got)
+	}
+	stats := fetcher.Stats().(*fsftp.Stats)
+	if stats.Chunks != len(selected) || stats.CompletedChunks != len(selected) {
+		t.Errorf("Stats() got = %v, want %v completed chunks", test.ToJson(stats), len(selected))
+	}
+}
+
+func TestFetcher_DownloadWithProxy(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestSftpServer(t)
+	defer server.Close()
+	proxyListener := test.StartSocks5Server("", "")
+	defer proxyListener.Close()
+
+	downloadAndCheck(t, root, &base.Request{
+		URL:            buildUrl(server, url.UserPassword(testUser, testPassword), filepath.Join(root, testFileName)),
+		SkipVerifyCert: true,
+		Proxy: &base.RequestProxy{
+			Mode:   base.RequestProxyModeCustom,
+			Scheme: "socks5",
+			Host:   proxyListener.Addr().String(),
+		},
+	}, nil, 2)
+}
+
+func TestFetcher_DownloadResume(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestSftpServer(t)
+	defer server.Close()
+
+	fetcher := downloadReady(t, &base.Request{
+		URL:            buildUrl(server, url.UserPassword(testUser, testPassword), filepath.Join(root, testFileName)),
+		SkipVerifyCert: true,
+	}, nil, 4)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := new(FetcherManager)
+	data, err := fm.Store(fetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := json.Marshal(data)
+	v, f := fm.Restore()
+	json.Unmarshal(buf, v)
+	restored := f(fetcher.Meta(), v)
+	restored.Setup(buildController(fm.DefaultConfig()))
+	if err := restored.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(root, testFileName), fetcher.Meta().SingleFilepath())
+}
+
+func TestFetcherManager_ParseName(t *testing.T) {
+	fm := new(FetcherManager)
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"sftp://usr@127.0.0.1/pub/file.zip", "file.zip"},
+		{"sftp://usr@127.0.0.1/pub/", "pub"},
+		{"sftp://usr@127.0.0.1:2222/~/", "127.0.0.1"},
+		{"sftp://usr@127.0.0.1", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := fm.ParseName(tt.url); got != tt.want {
+			t.Errorf("ParseName(%s) got = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteRoot(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"sftp://usr@127.0.0.1/pub/file.zip", "/pub/file.zip"},
+		{"sftp://usr@127.0.0.1/~/file.zip", "./file.zip"},
+		{"sftp://usr@127.0.0.1/~", "."},
+		{"sftp://usr@127.0.0.1", "/"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := remoteRoot(u); got != tt.want {
+			t.Errorf("remoteRoot(%s) got = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func downloadAndCheck(t *testing.T, root string, req *base.Request, cfg *config, connections int) *Fetcher {
+	fetcher := downloadReady(t, req, cfg, connections)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(root, testFileName), fetcher.Meta().SingleFilepath())
+	var downloaded int64
+	for _, p := range fetcher.Progress() {
+		downloaded += p
+	}
+	if downloaded != testFileSize {
+		t.Errorf("Progress() got = %v, want %v", downloaded, testFileSize)
+	}
+	return fetcher
+}
+
+func assertFile(t *testing.T, want string, got string) {
+	if test.FileMd5(want) != test.FileMd5(got) {
+		t.Errorf("Download() got file %s not equal to %s", got, want)
+	}
+}
+
+func downloadReady(t *testing.T, req *base.Request, cfg *config, connections int) *Fetcher {
+	fetcher := buildFetcher(cfg)
+	if err := fetcher.Resolve(req); err != nil {
+		t.Fatal(err)
+	}
+	err := fetcher.Create(&base.Options{
+		Path: t.TempDir(),
+		Extra: fsftp.OptsExtra{
+			Connections: connections,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetcher
+}
+
+func buildController(cfg any) *controller.Controller {
+	ctl := controller.NewController()
+	ctl.GetConfig = func(v any) {
+		json.Unmarshal([]byte(test.ToJson(cfg)), v)
+	}
+	return ctl
+}
+
+// buildFetcher builds the fetcher with the config, nil means the default config
+func buildFetcher(cfg *config) *Fetcher {
+	fm := new(FetcherManager)
+	fetcher := fm.Build()
+	if cfg == nil {
+		fetcher.Setup(buildController(fm.DefaultConfig()))
+	} else {
+		fetcher.Setup(buildController(cfg))
+	}
+	return fetcher.(*Fetcher)
+}
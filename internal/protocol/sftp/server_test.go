@@ -0,0 +1,164 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	testUser       = "usr"
+	testPassword   = "pwd"
+	testPassphrase = "passphrase"
+)
+
+type testServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	// clientKey is the authorized key of the test user
+	clientKey ed25519.PrivateKey
+	// conns and channels count the accepted ssh connections and sftp channels
+	conns    atomic.Int32
+	channels atomic.Int32
+}
+
+// startTestSftpServer starts a ssh server which serves the sftp subsystem of the local file system,
+// the test user logs in by the password or the client key.
+func startTestSftpServer(t *testing.T) *testServer {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{clientKey: clientPriv}
+	if s.hostKey, err = ssh.NewSignerFromKey(hostPriv); err != nil {
+		t.Fatal(err)
+	}
+	clientPub, err := ssh.NewPublicKey(clientPriv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == testUser && string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == testUser && bytes.Equal(key.Marshal(), clientPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(s.hostKey)
+
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.conns.Add(1)
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range chReqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 &&
+					string(req.Payload[4:4+binary.BigEndian.Uint32(req.Payload)]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				s.channels.Add(1)
+				server, err := sftp.NewServer(ch, sftp.ReadOnly())
+				if err != nil {
+					ch.Close()
+					return
+				}
+				go func() {
+					server.Serve()
+					server.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func (s *testServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *testServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// writeKnownHosts writes the known_hosts file of the server
+func (s *testServer) writeKnownHosts(t *testing.T, hostKey ssh.PublicKey) string {
+	name := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr())}, hostKey)
+	if err := os.WriteFile(name, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// writeClientKey writes the PEM encoded client key file, it is encrypted if the passphrase is not empty
+func (s *testServer) writeClientKey(t *testing.T, passphrase string) string {
+	var (
+		block *pem.Block
+		err   error
+	)
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(s.clientKey, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(s.clientKey, "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
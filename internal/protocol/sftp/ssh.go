@@ -0,0 +1,160 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GopeedLab/gopeed/internal/dialer"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const handshakeTimeout = 15 * time.Second
+
+var ErrMissingUser = errors.New("missing user name in the sftp url")
+
+// dial connects and authenticates the ssh server of the request url, the sftp channels are opened over the connection.
+func (f *Fetcher) dial(ctx context.Context) (*ssh.Client, error) {
+	u, err := url.Parse(f.meta.Req.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.User.Username() == "" {
+		return nil, ErrMissingUser
+	}
+	auth, err := f.authMethods(u)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := f.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	config := &ssh.ClientConfig{
+		User:              u.User.Username(),
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKeyCallback, addr),
+	}
+
+	d, err := dialer.New(f.ctl, f.meta.Req, 0)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake is interrupted by closing the connection when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// authMethods returns the public key authentication if the private key file is set, and the password authentication if the url has a password.
+func (f *Fetcher) authMethods(u *url.URL) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	keyFile := f.config.PrivateKeyFile
+	if extra := f.reqExtra(); extra.PrivateKeyFile != "" {
+		keyFile = extra.PrivateKeyFile
+	}
+	if keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if f.config.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(f.config.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if password, ok := u.User.Password(); ok {
+		methods = append(methods, ssh.Password(password), ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			// The servers which disable the password authentication often ask the password by the keyboard interactive one
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+	return methods, nil
+}
+
+// hostKeyCallback verifies the host keys by the known_hosts file, the verification is skipped if the request skips verifying certs.
+func (f *Fetcher) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if f.meta.Req.SkipVerifyCert {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	file := f.config.KnownHostsFile
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return knownhosts.New(file)
+}
+
+// hostKeyAlgorithms returns the algorithms of the known host keys, so the server offers the known key
+// instead of the preferred one of the client, empty means the default algorithms for the unknown hosts.
+func hostKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	var keyErr *knownhosts.KeyError
+	if err := callback(addr, &net.TCPAddr{}, placeholderKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch typ := known.Key.Type(); typ {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, typ)
+		}
+	}
+	return algorithms
+}
+
+// placeholderKey matches no known host key, it is used to look up the known keys of a host
+type placeholderKey struct{}
+
+func (placeholderKey) Type() string {
+	return "placeholder"
+}
+
+func (placeholderKey) Marshal() []byte {
+	return []byte("placeholder")
+}
+
+func (placeholderKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("placeholder key can't verify")
+}
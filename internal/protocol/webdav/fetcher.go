@@ -0,0 +1,448 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	"github.com/GopeedLab/gopeed/internal/fetcher"
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+	"github.com/GopeedLab/gopeed/pkg/protocol/webdav"
+)
+
+const readTimeout = 15 * time.Second
+
+var (
+	ErrEmptyCollection = errors.New("empty collection")
+	ErrRangeIgnored    = errors.New("the server ignores the range request")
+)
+
+type Fetcher struct {
+	ctl    *controller.Controller
+	config *config
+	doneCh chan error
+
+	meta *fetcher.FetcherMeta
+	data *fetcherData
+
+	// client is shared by the workers, the connections are reused across the files
+	client     *http.Client
+	downloader *fetcher.ChunkDownloader
+}
+
+func (f *Fetcher) Setup(ctl *controller.Controller) {
+	f.ctl = ctl
+	f.doneCh = make(chan error, 1)
+	if f.meta == nil {
+		f.meta = &fetcher.FetcherMeta{}
+	}
+	if f.data == nil {
+		f.data = &fetcherData{}
+	}
+	f.ctl.GetConfig(&f.config)
+	return
+}
+
+func (f *Fetcher) Resolve(req *base.Request) error {
+	if err := base.ParseReqExtra[webdav.ReqExtra](req); err != nil {
+		return err
+	}
+	f.meta.Req = req
+	u, err := httpUrl(req.URL)
+	if err != nil {
+		return err
+	}
+	client, err := ihttp.NewClient(f.ctl, req)
+	if err != nil {
+		return err
+	}
+	defer client.CloseIdleConnections()
+
+	ctx := context.Background()
+	entries, err := f.propfind(ctx, client, u, "0")
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no PROPFIND response of %s", req.URL)
+	}
+	res := &base.Resource{}
+	if entries[0].dir {
+		// The files of a collection are downloaded by the ranged GETs, the servers which ignore the ranges restart them
+		res.Range = true
+		res.Name = parseName(u)
+		if res.Files, err = f.walk(ctx, client, u, u); err != nil {
+			return err
+		}
+		if len(res.Files) == 0 {
+			return ErrEmptyCollection
+		}
+	} else {
+		if res.Range, err = f.probeRange(ctx, client, u); err != nil {
+			return err
+		}
+		res.Files = []*base.FileInfo{
+			{
+				Name:  parseName(u),
+				Size:  entries[0].size,
+				Ctime: entries[0].mtime,
+			},
+		}
+	}
+	res.CalcSize(nil)
+	f.meta.Res = res
+	return nil
+}
+
+// walk lists the files of the collection level by level, the file paths are relative to the root collection.
+// Depth infinity is not used because it is disabled by most servers.
+func (f *Fetcher) walk(ctx context.Context, client *http.Client, root *url.URL, dir *url.URL) ([]*base.FileInfo, error) {
+	entries, err := f.propfind(ctx, client, dir, "1")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].url.Path < entries[j].url.Path
+	})
+	rootPrefix := strings.TrimSuffix(root.Path, "/") + "/"
+	var files []*base.FileInfo
+	for _, e := range entries {
+		// The collection itself is listed as a member
+		if samePath(e.url, dir) {
+			continue
+		}
+		// The members must be under the root collection, the dot segments of the hrefs must not escape it
+		e.url.Path = path.Clean(e.url.Path)
+		e.url.RawPath = ""
+		if !strings.HasPrefix(e.url.Path, rootPrefix) {
+			continue
+		}
+		rel := strings.TrimPrefix(e.url.Path, rootPrefix)
+		if !fetcher.IsLocalPath(rel) {
+			continue
+		}
+		if e.dir {
+			subFiles, err := f.walk(ctx, client, root, e.url)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, subFiles...)
+			continue
+		}
+		dirPath := path.Dir(rel)
+		if dirPath == "." {
+			dirPath = ""
+		}
+		files = append(files, &base.FileInfo{
+			Name:  path.Base(rel),
+			Path:  dirPath,
+			Size:  e.size,
+			Ctime: e.mtime,
+		})
+	}
+	return files, nil
+}
+
+// probeRange returns whether the server supports the range requests of the file
+func (f *Fetcher) probeRange(ctx context.Context, client *http.Client, u *url.URL) (bool, error) {
+	httpReq, err := ihttp.NewRequest(ctx, u.String(), &fhttp.ReqExtra{Header: f.reqExtra().Header}, f.config.UserAgent)
+	if err != nil {
+		return false, err
+	}
+	httpReq.Header.Set(base.HttpHeaderRange, fmt.Sprintf(base.HttpHeaderRangeFormat, 0, 0))
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return true, nil
+	// The range of the empty file is not satisfiable, it needs no range
+	case http.StatusOK, http.StatusRequestedRangeNotSatisfiable:
+		return false, nil
+	default:
+		return false, ihttp.NewRequestError(resp.StatusCode, resp.Status)
+	}
+}
+
+func (f *Fetcher) Create(opts *base.Options) error {
+	f.meta.Opts = opts
+
+	if err := base.ParseOptsExtra[webdav.OptsExtra](f.meta.Opts); err != nil {
+		return err
+	}
+	if opts.Extra == nil {
+		opts.Extra = &webdav.OptsExtra{}
+	}
+	extra := opts.Extra.(*webdav.OptsExtra)
+	if extra.Connections <= 0 {
+		extra.Connections = f.config.Connections
+		if extra.Connections <= 0 {
+			extra.Connections = 1
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) Start() (err error) {
+	// Avoid request extra modified by extension
+	if err = base.ParseReqExtra[webdav.ReqExtra](f.meta.Req); err != nil {
+		return
+	}
+	if f.client, err = ihttp.NewClient(f.ctl, f.meta.Req); err != nil {
+		return
+	}
+	connections := f.meta.Opts.Extra.(*webdav.OptsExtra).Connections
+	if f.data.Chunks == nil {
+		f.data.Chunks = fetcher.SplitChunks(f.meta, connections)
+	}
+	f.downloader = &fetcher.ChunkDownloader{
+		Ctl:    f.ctl,
+		Meta:   f.meta,
+		Source: f,
+		Retry:  fetcher.BuildRetryPolicy(f.config.Retry),
+	}
+	return f.downloader.Start(f.data.Chunks, connections, func(ctx context.Context, err error) {
+		f.client.CloseIdleConnections()
+		f.doneCh <- err
+	})
+}
+
+func (f *Fetcher) Pause() (err error) {
+	if f.downloader != nil {
+		f.downloader.Pause()
+	}
+	if f.client != nil {
+		f.client.CloseIdleConnections()
+	}
+	return
+}
+
+func (f *Fetcher) Close() (err error) {
+	return f.Pause()
+}
+
+func (f *Fetcher) Meta() *fetcher.FetcherMeta {
+	return f.meta
+}
+
+func (f *Fetcher) Stats() any {
+	return &webdav.Stats{
+		Chunks:          len(f.data.Chunks),
+		CompletedChunks: fetcher.CompletedChunks(f.data.Chunks),
+	}
+}
+
+// Progress returns the downloaded bytes of each selected file
+func (f *Fetcher) Progress() fetcher.Progress {
+	return fetcher.ChunksProgress(f.meta, f.data.Chunks)
+}
+
+func (f *Fetcher) Wait() (err error) {
+	return <-f.doneCh
+}
+
+// Host returns the host of the server, the connection slots of the host are shared by the connections of all tasks
+func (f *Fetcher) Host(file int) string {
+	u, err := httpUrl(f.meta.Req.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// Open requests the range of the chunk, the connections are reused by the client across the chunks
+func (f *Fetcher) Open(ctx context.Context, w *fetcher.Worker, c *fetcher.Chunk) (io.ReadCloser, error) {
+	u, err := f.remoteUrl(c.File)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := ihttp.NewRequest(ctx, u.String(), &fhttp.ReqExtra{Header: f.reqExtra().Header}, f.config.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	if f.meta.Res.Range {
+		httpReq.Header.Set(base.HttpHeaderRange, fmt.Sprintf(base.HttpHeaderRangeFormat, c.Begin+c.Downloaded, c.End))
+	}
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignores the range, the full response is only usable by the chunk at the beginning of the file
+		if c.Begin != 0 {
+			resp.Body.Close()
+			return nil, ErrRangeIgnored
+		}
+		c.Restart()
+	default:
+		resp.Body.Close()
+		return nil, ihttp.NewRequestError(resp.StatusCode, resp.Status)
+	}
+	return &bodyReader{
+		Reader: ihttp.NewTimeoutReader(resp.Body, readTimeout),
+		Closer: resp.Body,
+	}, nil
+}
+
+// Retryable returns whether the chunk error may be recovered by retrying
+func (f *Fetcher) Retryable(err error) bool {
+	return !errors.Is(err, ErrRangeIgnored)
+}
+
+// bodyReader reads the response body with the read timeout
+type bodyReader struct {
+	io.Reader
+	io.Closer
+}
+
+// remoteUrl returns the http url of the file
+func (f *Fetcher) remoteUrl(index int) (*url.URL, error) {
+	u, err := httpUrl(f.meta.Req.URL)
+	if err != nil {
+		return nil, err
+	}
+	if f.meta.Res.Name == "" {
+		return u, nil
+	}
+	file := f.meta.Res.Files[index]
+	var elems []string
+	for _, seg := range strings.Split(path.Join(file.Path, file.Name), "/") {
+		elems = append(elems, url.PathEscape(seg))
+	}
+	return u.JoinPath(elems...), nil
+}
+
+func (f *Fetcher) reqExtra() *webdav.ReqExtra {
+	if f.meta.Req.Extra == nil {
+		return &webdav.ReqExtra{}
+	}
+	return f.meta.Req.Extra.(*webdav.ReqExtra)
+}
+
+// httpUrl returns the http url of the request url, dav and davs are the aliases of http and https
+func httpUrl(rawUrl string) (*url.URL, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "dav":
+		u.Scheme = "http"
+	case "davs":
+		u.Scheme = "https"
+	}
+	return u, nil
+}
+
+// parseName returns the file or collection name of the url, the host name is used for the root collection
+func parseName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "" || name == "/" || name == "." {
+		return u.Hostname()
+	}
+	return name
+}
+
+type fetcherData struct {
+	Chunks []*fetcher.Chunk
+}
+
+// clone returns the copy of the data to store, the chunks are written by the workers while storing
+func (d *fetcherData) clone() *fetcherData {
+	return &fetcherData{
+		Chunks: fetcher.CloneChunks(d.Chunks),
+	}
+}
+
+type FetcherManager struct {
+}
+
+func (fm *FetcherManager) Name() string {
+	return "webdav"
+}
+
+func (fm *FetcherManager) Filters() []*fetcher.SchemeFilter {
+	return []*fetcher.SchemeFilter{
+		{
+			Type:    fetcher.FilterTypeUrl,
+			Pattern: "DAV",
+		},
+		{
+			Type:    fetcher.FilterTypeUrl,
+			Pattern: "DAVS",
+		},
+	}
+}
+
+// MatchRequest matches the http and https urls opted in by the request extra
+func (fm *FetcherManager) MatchRequest(req *base.Request) bool {
+	u, err := url.Parse(req.URL)
+	if err != nil || (!strings.EqualFold(u.Scheme, "http") && !strings.EqualFold(u.Scheme, "https")) {
+		return false
+	}
+	// The extra is parsed on a copy, the extra of the other protocols must be kept
+	r := *req
+	if err := base.ParseReqExtra[webdav.ReqExtra](&r); err != nil {
+		return false
+	}
+	extra, ok := r.Extra.(*webdav.ReqExtra)
+	return ok && extra.WebDAV
+}
+
+func (fm *FetcherManager) Build() fetcher.Fetcher {
+	return &Fetcher{}
+}
+
+func (fm *FetcherManager) ParseName(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return parseName(pu)
+}
+
+func (fm *FetcherManager) AutoRename() bool {
+	return true
+}
+
+func (fm *FetcherManager) DefaultConfig() any {
+	return &config{
+		UserAgent:   ihttp.DefaultUserAgent,
+		Connections: 4,
+	}
+}
+
+func (fm *FetcherManager) Store(f fetcher.Fetcher) (data any, err error) {
+	_f := f.(*Fetcher)
+	return _f.data.clone(), nil
+}
+
+func (fm *FetcherManager) Restore() (v any, f func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher) {
+	return &fetcherData{}, func(meta *fetcher.FetcherMeta, v any) fetcher.Fetcher {
+		fetcher := &Fetcher{
+			meta: meta,
+			data: v.(*fetcherData),
+		}
+		base.ParseReqExtra[webdav.ReqExtra](fetcher.meta.Req)
+		base.ParseOptsExtra[webdav.OptsExtra](fetcher.meta.Opts)
+		return fetcher
+	}
+}
+
+func (fm *FetcherManager) Close() error {
+	return nil
+}
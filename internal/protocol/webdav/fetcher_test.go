@@ -0,0 +1,448 @@
+package webdav
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/internal/controller"
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	"github.com/GopeedLab/gopeed/internal/test"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"github.com/GopeedLab/gopeed/pkg/protocol/webdav"
+)
+
+const (
+	testFileName = "file 1.data"
+	testFileSize = 5*1024*1024 + 7
+)
+
+// testFiles are the files of the served collection, the paths are relative to the root
+var testFiles = map[string]int64{
+	"dir/a.data":       128*1024 + 3,
+	"dir/b.data":       0,
+	"dir/sub/c d.data": 64 * 1024,
+}
+
+// prepareTestRoot creates the served files in a temp directory
+func prepareTestRoot(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]int64{testFileName: testFileSize}
+	for name, size := range testFiles {
+		files[name] = size
+	}
+	for name, size := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, size)
+		rand.Read(buf)
+		if err := os.WriteFile(name, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func buildUrl(server *testServer, scheme string, user *url.Userinfo, p string) string {
+	u, _ := url.Parse(server.URL)
+	return (&url.URL{
+		Scheme: scheme,
+		User:   user,
+		Host:   u.Host,
+		Path:   p,
+	}).String()
+}
+
+func TestFetcher_Resolve(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{root: root})
+	defer server.Close()
+
+	fetcher := buildFetcher(nil)
+	if err := fetcher.Resolve(&base.Request{
+		URL: buildUrl(server, "dav", nil, "/"+testFileName),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res := fetcher.Meta().Res
+	if !res.Range || res.Name != "" || res.Size != testFileSize || len(res.Files) != 1 ||
+		res.Files[0].Name != testFileName || res.Files[0].Ctime == nil {
+		t.Errorf("Resolve() got = %v, want a ranged file %s of %d bytes", test.ToJson(res), testFileName, testFileSize)
+	}
+
+	for _, p := range []string{"/dir", "/dir/"} {
+		fetcher = buildFetcher(nil)
+		if err := fetcher.Resolve(&base.Request{
+			URL: buildUrl(server, "dav", nil, p),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		res = fetcher.Meta().Res
+		if !res.Range || res.Name != "dir" || len(res.Files) != len(testFiles) {
+			t.Fatalf("Resolve(%s) got = %v, want the dir files", p, test.ToJson(res))
+		}
+		var size int64
+		for _, file := range res.Files {
+			want, ok := testFiles["dir/"+filepath.ToSlash(filepath.Join(file.Path, file.Name))]
+			if !ok || file.Size != want || file.Ctime == nil {
+				t.Errorf("Resolve(%s) got unexpected file = %v", p, test.ToJson(file))
+			}
+			size += file.Size
+		}
+		if res.Size != size {
+			t.Errorf("Resolve(%s) got size = %v, want %v", p, res.Size, size)
+		}
+	}
+}
+
+func TestFetcher_ResolveUnsafeHrefs(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{
+		root: root,
+		extraHrefs: []string{
+			"/dir/../../escape.data",
+			"/dir/sub/../../../escape.data",
+			"/dir/..%2F..%2Fescape.data",
+			"/dir/..%5C..%5Cescape.data",
+			"/other/escape.data",
+		},
+	})
+	defer server.Close()
+
+	fetcher := buildFetcher(nil)
+	if err := fetcher.Resolve(&base.Request{
+		URL: buildUrl(server, "dav", nil, "/dir/"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The dot segments are cleaned, the hrefs out of the collection and the names with the separators are skipped
+	res := fetcher.Meta().Res
+	if len(res.Files) != len(testFiles) {
+		t.Fatalf("Resolve() got = %v, want the dir files", test.ToJson(res.Files))
+	}
+	for _, file := range res.Files {
+		if _, ok := testFiles["dir/"+path.Join(file.Path, file.Name)]; !ok {
+			t.Errorf("Resolve() got unexpected file = %v", test.ToJson(file))
+		}
+	}
+}
+
+func TestFetcher_ResolveNotFound(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{root: root})
+	defer server.Close()
+
+	fetcher := buildFetcher(nil)
+	err := fetcher.Resolve(&base.Request{
+		URL: buildUrl(server, "dav", nil, "/missing.data"),
+	})
+	var re *ihttp.RequestError
+	if !errors.As(err, &re) || re.Code != http.StatusNotFound {
+		t.Errorf("Resolve() got = %v, want not found", err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "empty"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	fetcher = buildFetcher(nil)
+	err = fetcher.Resolve(&base.Request{
+		URL: buildUrl(server, "dav", nil, "/empty/"),
+	})
+	if !errors.Is(err, ErrEmptyCollection) {
+		t.Errorf("Resolve() got = %v, want %v", err, ErrEmptyCollection)
+	}
+}
+
+func TestFetcher_ResolveAuth(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{root: root, auth: true})
+	defer server.Close()
+
+	fetcher := buildFetcher(nil)
+	err := fetcher.Resolve(&base.Request{
+		URL: buildUrl(server, "dav", url.UserPassword(testUser, "wrong"), "/"+testFileName),
+	})
+	var re *ihttp.RequestError
+	if !errors.As(err, &re) || re.Code != http.StatusUnauthorized {
+		t.Errorf("Resolve() got = %v, want unauthorized", err)
+	}
+
+	downloadAndCheck(t, root, &base.Request{
+		URL: buildUrl(server, "dav", url.UserPassword(testUser, testPassword), "/"+testFileName),
+	}, 2)
+}
+
+func TestFetcher_Download(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{root: root})
+	defer server.Close()
+
+	req := &base.Request{
+		URL: buildUrl(server, "dav", nil, "/"+testFileName),
+	}
+	downloadAndCheck(t, root, req, 1)
+
+	gets := server.gets.Load()
+	fetcher := downloadAndCheck(t, root, req, 4)
+	// The range probe of resolving and a ranged GET of each chunk
+	if got := server.gets.Load() - gets; got != 1+4 {
+		t.Errorf("Download() got %v GET requests, want %v", got, 1+4)
+	}
+	stats := fetcher.Stats().(*webdav.Stats)
+	if stats.Chunks != 4 || stats.CompletedChunks != 4 {
+		t.Errorf("Stats() got = %v, want 4 completed chunks", test.ToJson(stats))
+	}
+}
+
+func TestFetcher_DownloadWithoutRange(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{root: root, disableRange: true})
+	defer server.Close()
+
+	fetcher := downloadAndCheck(t, root, &base.Request{
+		URL: buildUrl(server, "dav", nil, "/"+testFileName),
+	}, 4)
+	if fetcher.Meta().Res.Range {
+		t.Errorf("Resolve() got range = true, want false")
+	}
+	if stats := fetcher.Stats().(*webdav.Stats); stats.Chunks != 1 {
+		t.Errorf("Stats() got = %v, want 1 chunk", test.ToJson(stats))
+	}
+}
+
+func TestFetcher_DownloadDir(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{root: root})
+	defer server.Close()
+
+	fetcher := buildFetcher(nil)
+	if err := fetcher.Resolve(&base.Request{
+		URL: buildUrl(server, "dav", nil, "/dir"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Only download the files in the sub collection
+	var selected []int
+	for i, file := range fetcher.Meta().Res.Files {
+		if file.Path == "sub" {
+			selected = append(selected, i)
+		}
+	}
+	if err := fetcher.Create(&base.Options{
+		Path:        t.TempDir(),
+		SelectFiles: selected,
+		Extra: webdav.OptsExtra{
+			Connections: 2,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for name := range testFiles {
+		got := filepath.Join(fetcher.Meta().Opts.Path, filepath.FromSlash(name))
+		if filepath.Base(filepath.Dir(name)) != "sub" {
+			if _, err := os.Stat(got); !os.IsNotExist(err) {
+				t.Errorf("Download() got unselected file %s", got)
+			}
+			continue
+		}
+		assertFile(t, filepath.Join(root, filepath.FromSlash(name)), got)
+	}
+}
+
+func TestFetcher_DownloadAllDir(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{root: root, disableRange: true})
+	defer server.Close()
+
+	fetcher := downloadReady(t, &base.Request{
+		URL: buildUrl(server, "dav", nil, "/dir/"),
+	}, 4)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// The files of the collection are downloaded from the beginning even if the server ignores the ranges
+	for name := range testFiles {
+		assertFile(t, filepath.Join(root, filepath.FromSlash(name)), filepath.Join(fetcher.Meta().Opts.Path, filepath.FromSlash(name)))
+	}
+}
+
+func TestFetcher_DownloadResume(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{root: root})
+	defer server.Close()
+
+	fetcher := downloadReady(t, &base.Request{
+		URL: buildUrl(server, "dav", nil, "/"+testFileName),
+	}, 4)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := new(FetcherManager)
+	data, err := fm.Store(fetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := json.Marshal(data)
+	v, f := fm.Restore()
+	json.Unmarshal(buf, v)
+	restored := f(fetcher.Meta(), v)
+	restored.Setup(buildController(fm.DefaultConfig()))
+	if err := restored.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(root, testFileName), fetcher.Meta().SingleFilepath())
+}
+
+func TestFetcher_DownloadHttpUrl(t *testing.T) {
+	root := prepareTestRoot(t)
+	server := startTestWebdavServer(testServerOptions{root: root})
+	defer server.Close()
+
+	req := &base.Request{
+		URL: buildUrl(server, "http", nil, "/dir/"),
+		Extra: map[string]any{
+			"webdav": true,
+			"header": map[string]string{"X-Test": "1"},
+		},
+	}
+	if !new(FetcherManager).MatchRequest(req) {
+		t.Fatalf("MatchRequest() got = false, want true")
+	}
+	if _, ok := req.Extra.(map[string]any); !ok {
+		t.Errorf("MatchRequest() modified the request extra = %v", test.ToJson(req.Extra))
+	}
+	fetcher := downloadReady(t, req, 2)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for name := range testFiles {
+		assertFile(t, filepath.Join(root, filepath.FromSlash(name)), filepath.Join(fetcher.Meta().Opts.Path, filepath.FromSlash(name)))
+	}
+}
+
+func TestFetcherManager_MatchRequest(t *testing.T) {
+	fm := new(FetcherManager)
+	tests := []struct {
+		req  *base.Request
+		want bool
+	}{
+		{&base.Request{URL: "http://127.0.0.1/dav/", Extra: &webdav.ReqExtra{WebDAV: true}}, true},
+		{&base.Request{URL: "https://127.0.0.1/dav/", Extra: map[string]any{"webdav": true}}, true},
+		{&base.Request{URL: "http://127.0.0.1/dav/"}, false},
+		{&base.Request{URL: "http://127.0.0.1/dav/", Extra: map[string]any{"method": "GET"}}, false},
+		{&base.Request{URL: "ftp://127.0.0.1/dav/", Extra: map[string]any{"webdav": true}}, false},
+	}
+	for _, tt := range tests {
+		if got := fm.MatchRequest(tt.req); got != tt.want {
+			t.Errorf("MatchRequest(%s) got = %v, want %v", test.ToJson(tt.req), got, tt.want)
+		}
+	}
+}
+
+func TestFetcherManager_ParseName(t *testing.T) {
+	fm := new(FetcherManager)
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"dav://127.0.0.1/pub/file.zip", "file.zip"},
+		{"davs://127.0.0.1/pub/file%201.zip", "file 1.zip"},
+		{"dav://127.0.0.1/pub/", "pub"},
+		{"dav://127.0.0.1:8080/", "127.0.0.1"},
+		{"dav://127.0.0.1", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := fm.ParseName(tt.url); got != tt.want {
+			t.Errorf("ParseName(%s) got = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func downloadAndCheck(t *testing.T, root string, req *base.Request, connections int) *Fetcher {
+	fetcher := downloadReady(t, req, connections)
+	if err := fetcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(root, testFileName), fetcher.Meta().SingleFilepath())
+	var downloaded int64
+	for _, p := range fetcher.Progress() {
+		downloaded += p
+	}
+	if downloaded != testFileSize {
+		t.Errorf("Progress() got = %v, want %v", downloaded, testFileSize)
+	}
+	return fetcher
+}
+
+func assertFile(t *testing.T, want string, got string) {
+	if test.FileMd5(want) != test.FileMd5(got) {
+		t.Errorf("Download() got file %s not equal to %s", got, want)
+	}
+}
+
+func downloadReady(t *testing.T, req *base.Request, connections int) *Fetcher {
+	fetcher := buildFetcher(nil)
+	if err := fetcher.Resolve(req); err != nil {
+		t.Fatal(err)
+	}
+	err := fetcher.Create(&base.Options{
+		Path: t.TempDir(),
+		Extra: webdav.OptsExtra{
+			Connections: connections,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetcher
+}
+
+func buildController(cfg any) *controller.Controller {
+	ctl := controller.NewController()
+	ctl.GetConfig = func(v any) {
+		json.Unmarshal([]byte(test.ToJson(cfg)), v)
+	}
+	return ctl
+}
+
+// buildFetcher builds the fetcher with the config, nil means the default config
+func buildFetcher(cfg *config) *Fetcher {
+	fm := new(FetcherManager)
+	fetcher := fm.Build()
+	if cfg == nil {
+		fetcher.Setup(buildController(fm.DefaultConfig()))
+	} else {
+		fetcher.Setup(buildController(cfg))
+	}
+	return fetcher.(*Fetcher)
+}
@@ -0,0 +1,127 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	ihttp "github.com/GopeedLab/gopeed/internal/protocol/http"
+	fhttp "github.com/GopeedLab/gopeed/pkg/protocol/http"
+)
+
+const (
+	methodPropfind = "PROPFIND"
+	// maxMultistatusSize limits the size of a PROPFIND response, a large collection is listed level by level
+	maxMultistatusSize = 64 * 1024 * 1024
+)
+
+// propfindBody requests the properties to resolve the files, the servers return all properties without a body,
+// which is much larger for some servers.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+  </d:prop>
+</d:propfind>`
+
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"href"`
+		Propstats []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+type entry struct {
+	url   *url.URL
+	dir   bool
+	size  int64
+	mtime *time.Time
+}
+
+// propfind returns the entries of the resource, with its members if the depth is 1.
+// The urls of the entries keep the scheme, credentials and host of the resource url.
+func (f *Fetcher) propfind(ctx context.Context, client *http.Client, u *url.URL, depth string) ([]*entry, error) {
+	httpReq, err := ihttp.NewRequest(ctx, u.String(), &fhttp.ReqExtra{
+		Method: methodPropfind,
+		Header: f.reqExtra().Header,
+		Body:   propfindBody,
+	}, f.config.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Depth", depth)
+	httpReq.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, ihttp.NewRequestError(resp.StatusCode, resp.Status)
+	}
+	var ms multistatus
+	if err = xml.NewDecoder(io.LimitReader(resp.Body, maxMultistatusSize)).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*entry, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := url.Parse(strings.TrimSpace(r.Href))
+		if err != nil {
+			return nil, err
+		}
+		e := &entry{
+			url: withPath(u, href),
+		}
+		for _, ps := range r.Propstats {
+			// The properties which are not found are returned in the propstat of 404
+			if ps.Status != "" && !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				e.dir = true
+			}
+			if ps.Prop.ContentLength != "" {
+				e.size, _ = strconv.ParseInt(strings.TrimSpace(ps.Prop.ContentLength), 10, 64)
+			}
+			if ps.Prop.LastModified != "" {
+				if t, err := http.ParseTime(strings.TrimSpace(ps.Prop.LastModified)); err == nil {
+					e.mtime = &t
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// withPath returns the url of the href path, the href may be an absolute url or an absolute path
+func withPath(u *url.URL, href *url.URL) *url.URL {
+	ref := *u
+	ref.Path = href.Path
+	ref.RawPath = href.RawPath
+	ref.RawQuery = ""
+	ref.Fragment = ""
+	return &ref
+}
+
+// samePath returns whether the urls are the same resource, the collection urls may end with a slash or not
+func samePath(a *url.URL, b *url.URL) bool {
+	return strings.TrimSuffix(a.Path, "/") == strings.TrimSuffix(b.Path, "/")
+}
@@ -0,0 +1,85 @@
+package webdav
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	testUser     = "usr"
+	testPassword = "pwd"
+)
+
+type testServerOptions struct {
+	// root is the served directory
+	root string
+	// auth requires the basic auth of the test user
+	auth bool
+	// disableRange ignores the range requests, the full content is always returned
+	disableRange bool
+	// extraHrefs are listed as the files of every collection, they are not served
+	extraHrefs []string
+}
+
+type testServer struct {
+	*httptest.Server
+	// propfinds and gets count the received PROPFIND and GET requests
+	propfinds atomic.Int32
+	gets      atomic.Int32
+}
+
+// startTestWebdavServer starts a WebDAV server which serves the local directory
+func startTestWebdavServer(opts testServerOptions) *testServer {
+	s := &testServer{}
+	handler := &webdav.Handler{
+		FileSystem: webdav.Dir(opts.root),
+		LockSystem: webdav.NewMemLS(),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.auth {
+			if user, password, ok := r.BasicAuth(); !ok || user != testUser || password != testPassword {
+				w.Header().Set("WWW-Authenticate", `Basic realm="webdav"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		switch r.Method {
+		case methodPropfind:
+			s.propfinds.Add(1)
+		case http.MethodGet:
+			s.gets.Add(1)
+			if opts.disableRange {
+				r.Header.Del("Range")
+			}
+		}
+		if r.Method == methodPropfind && r.Header.Get("Depth") == "1" && len(opts.extraHrefs) > 0 {
+			serveWithExtraHrefs(w, r, handler, opts.extraHrefs)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	return s
+}
+
+// serveWithExtraHrefs appends the responses of the hrefs to the multistatus of the collection
+func serveWithExtraHrefs(w http.ResponseWriter, r *http.Request, handler http.Handler, hrefs []string) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	var extra strings.Builder
+	for _, href := range hrefs {
+		fmt.Fprintf(&extra, `<D:response><D:href>%s</D:href><D:propstat><D:prop><D:resourcetype></D:resourcetype>`+
+			`<D:getcontentlength>1</D:getcontentlength></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`, href)
+	}
+	body := strings.Replace(rec.Body.String(), "</D:multistatus>", extra.String()+"</D:multistatus>", 1)
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(rec.Code)
+	w.Write([]byte(body))
+}
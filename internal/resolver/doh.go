@@ -0,0 +1,172 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dohContentType = "application/dns-message"
+	dohTimeout     = 10 * time.Second
+)
+
+// DoHOptions are the transport options of the DNS-over-HTTPS requests, they follow the network config of the downloads.
+type DoHOptions struct {
+	Proxy     func(*http.Request) (*url.URL, error)
+	TLSConfig *tls.Config
+	// Locals are the local addresses to bind the connections to the endpoints
+	Locals []net.IP
+}
+
+// newDoHClient returns the client of the DoH requests, the endpoint hosts are resolved by the static host overrides
+// or the system resolver, never by DoH itself.
+func (r *Resolver) newDoHClient(opts *DoHOptions) *http.Client {
+	if opts == nil {
+		opts = &DoHOptions{}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             opts.Proxy,
+			TLSClientConfig:   opts.TLSConfig,
+			DialContext:       r.dialContext(&net.Dialer{}, opts.Locals, r.lookupBootstrap),
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: dohTimeout,
+	}
+}
+
+// lookupDoH looks up the host by the DNS-over-HTTPS endpoints in order until one succeeds,
+// it returns the addresses and the min ttl of the answers.
+func lookupDoH(ctx context.Context, client *http.Client, endpoints []string, host string) (addrs []string, ttl time.Duration, err error) {
+	for _, endpoint := range endpoints {
+		if addrs, ttl, err = queryDoH(ctx, client, endpoint, host); err == nil {
+			return
+		}
+	}
+	return
+}
+
+func queryDoH(ctx context.Context, client *http.Client, endpoint string, host string) ([]string, time.Duration, error) {
+	var (
+		addrs  []string
+		minTTL uint32 = math.MaxUint32
+	)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, ttl, err := exchangeDoH(ctx, client, endpoint, host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs = append(addrs, answers...)
+		if len(answers) > 0 {
+			minTTL = min(minTTL, ttl)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: endpoint, IsNotFound: true}
+	}
+	return addrs, time.Duration(minTTL) * time.Second, nil
+}
+
+// exchangeDoH sends the query by RFC 8484 POST request, and returns the addresses and the min ttl of the answers
+func exchangeDoH(ctx context.Context, client *http.Client, endpoint string, host string, qtype dnsmessage.Type) ([]string, uint32, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	builder.EnableCompression()
+	if err = builder.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err = builder.Question(dnsmessage.Question{
+		Name:  name,
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, 0, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("doh server %s responded %s", endpoint, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The host without the records of the type is not an error, the other type may have
+	if header.RCode == dnsmessage.RCodeNameError {
+		return nil, 0, nil
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("doh server %s responded %s", endpoint, header.RCode)
+	}
+	if err = parser.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	var (
+		addrs []string
+		ttl   uint32 = math.MaxUint32
+	)
+	for {
+		answer, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch answer.Type {
+		case dnsmessage.TypeA:
+			r, err := parser.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, net.IP(r.A[:]).String())
+		case dnsmessage.TypeAAAA:
+			r, err := parser.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, net.IP(r.AAAA[:]).String())
+		default:
+			// The CNAME records are followed by the server, their targets are in the answers too
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		ttl = min(ttl, answer.TTL)
+	}
+	return addrs, ttl, nil
+}
@@ -0,0 +1,247 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultCacheTTL is the time to cache the lookups if the config doesn't set it
+const defaultCacheTTL = 5 * time.Minute
+
+// Resolver resolves the host names of the http downloads and the bt trackers, it is shared by all tasks.
+// The static host overrides take precedence, otherwise the host is looked up by the DNS-over-HTTPS endpoints
+// or the system resolver, and the lookups are cached.
+type Resolver struct {
+	lock sync.RWMutex
+	// hosts are the static addresses keyed by host:port, the port * matches any port
+	hosts map[string][]string
+	doh   []string
+	// dohClient sends the DoH requests by the proxy, tls and bind config of the downloads
+	dohClient *http.Client
+	ttl       time.Duration
+	cache     map[string]*cacheEntry
+	// generation is increased when the config is updated, the lookups started before are not cached
+	generation int
+
+	group singleflight.Group
+	// lookup looks up the host by the system resolver, it is replaced in tests
+	lookup func(ctx context.Context, host string) ([]string, error)
+}
+
+type cacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func New(cfg *base.DNSConfig) *Resolver {
+	r := &Resolver{
+		lookup: net.DefaultResolver.LookupHost,
+	}
+	r.dohClient = r.newDoHClient(nil)
+	r.Update(cfg)
+	return r
+}
+
+// SetDoHOptions applies the transport options of the DoH requests, the idle connections of the previous ones are closed.
+func (r *Resolver) SetDoHOptions(opts *DoHOptions) {
+	client := r.newDoHClient(opts)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dohClient.CloseIdleConnections()
+	r.dohClient = client
+}
+
+// Update applies the config and drops the cached lookups, the invalid host overrides are ignored.
+func (r *Resolver) Update(cfg *base.DNSConfig) {
+	if cfg == nil {
+		cfg = &base.DNSConfig{}
+	}
+	hosts := make(map[string][]string)
+	for _, entry := range cfg.Hosts {
+		host, port, addrs, err := ParseHost(entry)
+		if err != nil {
+			continue
+		}
+		key := net.JoinHostPort(host, port)
+		hosts[key] = append(hosts[key], addrs...)
+	}
+	ttl := time.Duration(cfg.CacheTTL) * time.Second
+	if cfg.CacheTTL == 0 {
+		ttl = defaultCacheTTL
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.hosts = hosts
+	r.doh = cfg.DoH
+	r.ttl = ttl
+	r.cache = make(map[string]*cacheEntry)
+	r.generation++
+}
+
+// ParseHost parses the host override in the curl --resolve format, host:port:addr[,addr]...,
+// the port can be * to match any port, and the IPv6 addresses can be enclosed in brackets.
+func ParseHost(entry string) (host string, port string, addrs []string, err error) {
+	parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", nil, &net.AddrError{Err: "invalid host override", Addr: entry}
+	}
+	host, port = strings.ToLower(parts[0]), parts[1]
+	for _, addr := range strings.Split(parts[2], ",") {
+		addr = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(addr), "["), "]")
+		if net.ParseIP(addr) == nil {
+			return "", "", nil, &net.AddrError{Err: "invalid ip address", Addr: addr}
+		}
+		addrs = append(addrs, addr)
+	}
+	return
+}
+
+// LookupHost returns the addresses of the host to connect the port, the nil resolver looks up by the system resolver.
+func (r *Resolver) LookupHost(ctx context.Context, host string, port string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if r == nil {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+	host = strings.ToLower(host)
+
+	r.lock.RLock()
+	addrs, ok := r.lookupStatic(host, port)
+	entry := r.cache[host]
+	doh, dohClient, ttl, generation := r.doh, r.dohClient, r.ttl, r.generation
+	r.lock.RUnlock()
+	if ok {
+		return addrs, nil
+	}
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	// The concurrent connections to the same host share one lookup
+	v, err, _ := r.group.Do(host, func() (any, error) {
+		var (
+			addrs     []string
+			answerTTL = ttl
+			err       error
+		)
+		if len(doh) > 0 {
+			addrs, answerTTL, err = lookupDoH(ctx, dohClient, doh, host)
+		} else {
+			addrs, err = r.lookup(ctx, host)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ttl > 0 {
+			r.lock.Lock()
+			if r.generation == generation {
+				r.cache[host] = &cacheEntry{
+					addrs:   addrs,
+					expires: time.Now().Add(min(ttl, answerTTL)),
+				}
+			}
+			r.lock.Unlock()
+		}
+		return addrs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]string), nil
+}
+
+// lookupStatic returns the static addresses of the host to connect the port, the caller must hold the lock.
+func (r *Resolver) lookupStatic(host string, port string) ([]string, bool) {
+	addrs, ok := r.hosts[net.JoinHostPort(host, port)]
+	if !ok {
+		addrs, ok = r.hosts[net.JoinHostPort(host, "*")]
+	}
+	return addrs, ok
+}
+
+// lookupBootstrap looks up the hosts of the DoH endpoints and proxies by the static host overrides or the system resolver.
+func (r *Resolver) lookupBootstrap(ctx context.Context, host string, port string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	host = strings.ToLower(host)
+
+	r.lock.RLock()
+	addrs, ok := r.lookupStatic(host, port)
+	r.lock.RUnlock()
+	if ok {
+		return addrs, nil
+	}
+	return r.lookup(ctx, host)
+}
+
+// DialContext returns the dial function which connects the addresses resolved by the resolver in order,
+// the connections are bound to the first local address of the same family if the locals are not empty.
+func (r *Resolver) DialContext(dialer *net.Dialer, locals []net.IP) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return r.dialContext(dialer, locals, r.LookupHost)
+}
+
+func (r *Resolver) dialContext(dialer *net.Dialer, locals []net.IP, lookup func(ctx context.Context, host string, port string) ([]string, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := lookup(ctx, host, port)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			d := dialer
+			if len(locals) > 0 {
+				local := LocalIP(locals, net.ParseIP(addr))
+				if local == nil {
+					err = &net.AddrError{Err: "no local address of the same family", Addr: addr}
+					continue
+				}
+				bound := *dialer
+				if strings.HasPrefix(network, "udp") {
+					bound.LocalAddr = &net.UDPAddr{IP: local}
+				} else {
+					bound.LocalAddr = &net.TCPAddr{IP: local}
+				}
+				d = &bound
+			}
+			var conn net.Conn
+			conn, err = d.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// LocalIP returns the first local address of the same family as the remote address, nil if there is none.
+func LocalIP(locals []net.IP, remote net.IP) net.IP {
+	for _, local := range locals {
+		if (local.To4() == nil) == (remote.To4() == nil) {
+			return local
+		}
+	}
+	return nil
+}
+
+// Rotate returns the locals starting from the nth address, it spreads the connections across the local addresses.
+func Rotate(locals []net.IP, n int) []net.IP {
+	if len(locals) < 2 {
+		return locals
+	}
+	n %= len(locals)
+	return append(append([]net.IP{}, locals[n:]...), locals[:n]...)
+}
@@ -0,0 +1,276 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseHost(t *testing.T) {
+	tests := []struct {
+		entry     string
+		wantHost  string
+		wantPort  string
+		wantAddrs []string
+		wantErr   bool
+	}{
+		{entry: "example.com:443:127.0.0.1", wantHost: "example.com", wantPort: "443", wantAddrs: []string{"127.0.0.1"}},
+		{entry: "Example.com:*:127.0.0.1,[::1]", wantHost: "example.com", wantPort: "*", wantAddrs: []string{"127.0.0.1", "::1"}},
+		{entry: "example.com:443:::1", wantHost: "example.com", wantPort: "443", wantAddrs: []string{"::1"}},
+		{entry: "example.com:443", wantErr: true},
+		{entry: "example.com::127.0.0.1", wantErr: true},
+		{entry: "example.com:443:localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			host, port, addrs, err := ParseHost(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if host != tt.wantHost || port != tt.wantPort || !reflect.DeepEqual(addrs, tt.wantAddrs) {
+				t.Errorf("ParseHost() got = %v %v %v, want %v %v %v", host, port, addrs, tt.wantHost, tt.wantPort, tt.wantAddrs)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupHost(t *testing.T) {
+	r := New(&base.DNSConfig{
+		Hosts: []string{"example.com:443:10.0.0.1", "example.com:*:10.0.0.2", "invalid"},
+	})
+	var lookups atomic.Int32
+	r.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		return []string{"10.0.0.3"}, nil
+	}
+
+	lookup := func(host, port string, want []string) {
+		got, err := r.LookupHost(context.Background(), host, port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("LookupHost(%s, %s) got = %v, want %v", host, port, got, want)
+		}
+	}
+	lookup("example.com", "443", []string{"10.0.0.1"})
+	lookup("EXAMPLE.com", "80", []string{"10.0.0.2"})
+	lookup("127.0.0.1", "80", []string{"127.0.0.1"})
+	lookup("gopeed.com", "443", []string{"10.0.0.3"})
+	lookup("gopeed.com", "80", []string{"10.0.0.3"})
+	if got := lookups.Load(); got != 1 {
+		t.Errorf("LookupHost() lookups = %v, want %v", got, 1)
+	}
+
+	// The cache is dropped when the config is updated
+	r.Update(&base.DNSConfig{CacheTTL: -1})
+	lookup("example.com", "443", []string{"10.0.0.3"})
+	lookup("example.com", "443", []string{"10.0.0.3"})
+	if got := lookups.Load(); got != 3 {
+		t.Errorf("LookupHost() lookups = %v, want %v", got, 3)
+	}
+}
+
+// dohHandler answers gopeed.com with 10.0.0.1 and counts the queries
+func dohHandler(queries *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var query dnsmessage.Message
+		if err := query.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		question := query.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RCode: dnsmessage.RCodeSuccess},
+			Questions: query.Questions,
+		}
+		if question.Type == dnsmessage.TypeA && question.Name.String() == "gopeed.com." {
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+			}}
+		}
+		packed, _ := resp.Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(packed)
+	})
+}
+
+func TestResolver_LookupHostDoH(t *testing.T) {
+	var queries atomic.Int32
+	server := httptest.NewServer(dohHandler(&queries))
+	defer server.Close()
+
+	r := New(&base.DNSConfig{
+		// The unreachable endpoint is skipped
+		DoH: []string{"http://127.0.0.1:0/dns-query", server.URL + "/dns-query"},
+	})
+	for i := 0; i < 2; i++ {
+		got, err := r.LookupHost(context.Background(), "gopeed.com", "443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("LookupHost() got = %v, want %v", got, want)
+		}
+	}
+	// The A and AAAA queries are sent once, the second lookup is cached
+	if got := queries.Load(); got != 2 {
+		t.Errorf("LookupHost() queries = %v, want %v", got, 2)
+	}
+
+	_, err := r.LookupHost(context.Background(), "unknown.com", "443")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupHost() got = %v, want not found", err)
+	}
+}
+
+func TestResolver_SetDoHOptions(t *testing.T) {
+	var queries atomic.Int32
+	server := httptest.NewServer(dohHandler(&queries))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	t.Run("host override", func(t *testing.T) {
+		// The endpoint host is resolved by the host overrides, not by DoH itself
+		r := New(&base.DNSConfig{
+			Hosts: []string{"doh.test:*:127.0.0.1"},
+			DoH:   []string{"http://doh.test:" + port + "/dns-query"},
+		})
+		r.lookup = func(ctx context.Context, host string) ([]string, error) {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		got, err := r.LookupHost(context.Background(), "gopeed.com", "443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("LookupHost() got = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		// The unresolvable endpoint is reached by the proxy
+		r := New(&base.DNSConfig{
+			DoH: []string{"http://doh.invalid/dns-query"},
+		})
+		proxyUrl, _ := url.Parse(server.URL)
+		r.SetDoHOptions(&DoHOptions{
+			Proxy: http.ProxyURL(proxyUrl),
+		})
+		got, err := r.LookupHost(context.Background(), "gopeed.com", "443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("LookupHost() got = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestResolver_DialContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("gopeed"))
+			conn.Close()
+		}
+	}()
+
+	r := New(&base.DNSConfig{
+		// The first address is refused, the next one is tried
+		Hosts: []string{"gopeed.test:*:127.0.0.2,127.0.0.1"},
+	})
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	conn, err := r.DialContext(&net.Dialer{}, nil)(context.Background(), "tcp", net.JoinHostPort("gopeed.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, _ := io.ReadAll(conn)
+	if string(got) != "gopeed" {
+		t.Errorf("DialContext() got = %v, want %v", string(got), "gopeed")
+	}
+}
+
+func TestResolver_DialContextBind(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	remoteCh := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			remoteCh <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+
+	var r *Resolver
+	locals := []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.2")}
+	conn, err := r.DialContext(&net.Dialer{}, locals)(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := (<-remoteCh).(*net.TCPAddr).IP.String(); got != "127.0.0.2" {
+		t.Errorf("DialContext() local ip = %v, want %v", got, "127.0.0.2")
+	}
+
+	// No local address of the remote family
+	_, err = r.DialContext(&net.Dialer{}, locals[:1])(context.Background(), "tcp", listener.Addr().String())
+	var addrErr *net.AddrError
+	if !errors.As(err, &addrErr) {
+		t.Errorf("DialContext() got = %v, want address error", err)
+	}
+}
+
+func TestLocalIP(t *testing.T) {
+	locals := []net.IP{net.ParseIP("::1"), net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+	if got := LocalIP(locals, net.ParseIP("1.1.1.1")); !got.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("LocalIP() got = %v, want %v", got, "10.0.0.1")
+	}
+	if got := LocalIP(locals, net.ParseIP("2606:4700::1111")); !got.Equal(net.ParseIP("::1")) {
+		t.Errorf("LocalIP() got = %v, want %v", got, "::1")
+	}
+	if got := LocalIP(locals[1:], net.ParseIP("2606:4700::1111")); got != nil {
+		t.Errorf("LocalIP() got = %v, want nil", got)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	locals := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}
+	for n, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+		got := Rotate(locals, n)
+		if len(got) != len(locals) || got[0].String() != want {
+			t.Errorf("Rotate(%d) got = %v, want first %v", n, got, want)
+		}
+	}
+	if got := Rotate(nil, 1); got != nil {
+		t.Errorf("Rotate() got = %v, want nil", got)
+	}
+}
@@ -2,13 +2,19 @@ package test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/GopeedLab/gopeed/pkg/base"
 	"github.com/armon/go-socks5"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
@@ -385,6 +391,12 @@ func (c *shutdownListener) Close() error {
 	if err := ifExistAndRemove(DownloadRenameFile); err != nil {
 		fmt.Println(err)
 	}
+	// The temporary part files of the unfinished downloads
+	for _, name := range []string{DownloadFile + ".part", DownloadRenameFile + ".part"} {
+		if err := ifExistAndRemove(name); err != nil {
+			fmt.Println(err)
+		}
+	}
 	return closeErr
 }
 
@@ -416,6 +428,36 @@ func StartSocks5Server(usr, pwd string) net.Listener {
 	return listener
 }
 
+// GenerateCert generates a self-signed certificate for 127.0.0.1, it can be used as server cert, client cert and CA.
+func GenerateCert() (certPem []byte, keyPem []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "gopeed test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	certPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return
+}
+
 func AssertResourceEqual(want, got *base.Resource) bool {
 	// Ignore ctime
 	if got != nil && len(got.Files) > 0 {
@@ -23,6 +23,11 @@ const (
 	HttpHeaderContentDisposition = "Content-Disposition"
 	HttpHeaderUserAgent          = "User-Agent"
 	HttpHeaderLastModified       = "Last-Modified"
+	HttpHeaderETag               = "ETag"
+	HttpHeaderIfRange            = "If-Range"
+	HttpHeaderRetryAfter         = "Retry-After"
+	HttpHeaderAuthorization      = "Authorization"
+	HttpHeaderWWWAuthenticate    = "WWW-Authenticate"
 
 	HttpHeaderBytes       = "bytes"
 	HttpHeaderRangeFormat = "bytes=%d-%d"
@@ -1,12 +1,19 @@
 package base
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/GopeedLab/gopeed/pkg/util"
 	"github.com/mattn/go-ieproxy"
 	"golang.org/x/exp/slices"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,6 +28,13 @@ type Request struct {
 	Proxy *RequestProxy `json:"proxy"`
 	// SkipVerifyCert is the flag that skip verify cert
 	SkipVerifyCert bool `json:"skipVerifyCert"`
+	// TLS is special tls config for request, the non-empty fields override the global tls config
+	TLS *TLSConfig `json:"tls"`
+	// CookieProfile is the name of the persistent cookie profile, the cookies of the profile are sent with the request
+	// and the cookies set by the server are saved to the profile
+	CookieProfile string `json:"cookieProfile"`
+	// Bind is special bind config for request, it overrides the global bind config if not empty
+	Bind *BindConfig `json:"bind"`
 }
 
 func (r *Request) Validate() error {
@@ -115,6 +129,12 @@ type Options struct {
 	Path string `json:"path"`
 	// Select file indexes to download
 	SelectFiles []int `json:"selectFiles"`
+	// Checksum is the expected digest of the downloaded file, it will be verified after the download is complete
+	Checksum *Checksum `json:"checksum"`
+	// DownloadLimit is the max download speed of the task in bytes per second, zero means unlimited
+	DownloadLimit int64 `json:"downloadLimit"`
+	// UploadLimit is the max upload speed of the task in bytes per second, zero means unlimited, only for bt
+	UploadLimit int64 `json:"uploadLimit"`
 	// Extra info for specific fetcher
 	Extra any `json:"extra"`
 }
@@ -133,6 +153,77 @@ func (o *Options) Clone() *Options {
 	return util.DeepClone(o)
 }
 
+type ChecksumAlgorithm string
+
+const (
+	ChecksumAlgorithmMD5    ChecksumAlgorithm = "md5"
+	ChecksumAlgorithmSHA1   ChecksumAlgorithm = "sha1"
+	ChecksumAlgorithmSHA256 ChecksumAlgorithm = "sha256"
+	ChecksumAlgorithmSHA512 ChecksumAlgorithm = "sha512"
+	ChecksumAlgorithmCRC32  ChecksumAlgorithm = "crc32"
+)
+
+// checksumSizes is the digest size in bytes of each algorithm
+var checksumSizes = map[ChecksumAlgorithm]int{
+	ChecksumAlgorithmMD5:    16,
+	ChecksumAlgorithmSHA1:   20,
+	ChecksumAlgorithmSHA256: 32,
+	ChecksumAlgorithmSHA512: 64,
+	ChecksumAlgorithmCRC32:  4,
+}
+
+// Checksum is the expected digest of a file
+type Checksum struct {
+	Algorithm ChecksumAlgorithm `json:"algorithm"`
+	// Value is the hex encoded digest
+	Value string `json:"value"`
+}
+
+// Validate normalizes the algorithm to lower case and checks the value is a hex digest of the algorithm size.
+func (c *Checksum) Validate() error {
+	c.Algorithm = ChecksumAlgorithm(strings.ToLower(strings.TrimSpace(string(c.Algorithm))))
+	c.Value = strings.TrimSpace(c.Value)
+	size, ok := checksumSizes[c.Algorithm]
+	if !ok {
+		return fmt.Errorf("invalid checksum algorithm: %s", c.Algorithm)
+	}
+	if len(c.Value) != size*2 {
+		return fmt.Errorf("invalid checksum value")
+	}
+	if _, err := hex.DecodeString(c.Value); err != nil {
+		return fmt.Errorf("invalid checksum value")
+	}
+	return nil
+}
+
+// Verify calculates the digest of the file and compares it with the expected value,
+// returns *ChecksumError if they don't match.
+func (c *Checksum) Verify(name string) error {
+	actual, err := util.FileChecksum(name, string(c.Algorithm))
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, strings.TrimSpace(c.Value)) {
+		return &ChecksumError{
+			Algorithm: c.Algorithm,
+			Expected:  c.Value,
+			Actual:    actual,
+		}
+	}
+	return nil
+}
+
+// ChecksumError is returned when the downloaded file does not match the expected checksum
+type ChecksumError struct {
+	Algorithm ChecksumAlgorithm
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch,algorithm:%s,expected:%s,actual:%s", e.Algorithm, e.Expected, e.Actual)
+}
+
 func ParseReqExtra[E any](req *Request) error {
 	if req.Extra == nil {
 		return nil
@@ -182,6 +273,12 @@ type DownloaderStoreConfig struct {
 	ProtocolConfig map[string]any         `json:"protocolConfig"` // ProtocolConfig is special config for each protocol
 	Extra          map[string]any         `json:"extra"`
 	Proxy          *DownloaderProxyConfig `json:"proxy"`
+	SpeedLimit     *SpeedLimitConfig      `json:"speedLimit"`     // SpeedLimit is the global speed limit of all tasks
+	TLS            *TLSConfig             `json:"tls"`            // TLS is the global tls config of all tasks
+	FileAllocation FileAllocation         `json:"fileAllocation"` // FileAllocation is the disk space allocation mode of the downloaded files
+	DNS            *DNSConfig             `json:"dns"`            // DNS is the host name resolution config of all tasks
+	Bind           *BindConfig            `json:"bind"`           // Bind is the local address config of the outgoing connections of all tasks
+	HostLimit      *HostLimitConfig       `json:"hostLimit"`      // HostLimit is the per-host connection limit shared by all tasks
 }
 
 func (cfg *DownloaderStoreConfig) Init() *DownloaderStoreConfig {
@@ -194,6 +291,21 @@ func (cfg *DownloaderStoreConfig) Init() *DownloaderStoreConfig {
 	if cfg.Proxy == nil {
 		cfg.Proxy = &DownloaderProxyConfig{}
 	}
+	if cfg.SpeedLimit == nil {
+		cfg.SpeedLimit = &SpeedLimitConfig{}
+	}
+	if cfg.TLS == nil {
+		cfg.TLS = &TLSConfig{}
+	}
+	if cfg.DNS == nil {
+		cfg.DNS = &DNSConfig{}
+	}
+	if cfg.Bind == nil {
+		cfg.Bind = &BindConfig{}
+	}
+	if cfg.HostLimit == nil {
+		cfg.HostLimit = &HostLimitConfig{}
+	}
 	return cfg
 }
 
@@ -216,9 +328,207 @@ func (cfg *DownloaderStoreConfig) Merge(beforeCfg *DownloaderStoreConfig) *Downl
 	if cfg.Proxy == nil {
 		cfg.Proxy = beforeCfg.Proxy
 	}
+	if cfg.SpeedLimit == nil {
+		cfg.SpeedLimit = beforeCfg.SpeedLimit
+	}
+	if cfg.TLS == nil {
+		cfg.TLS = beforeCfg.TLS
+	}
+	if cfg.FileAllocation == "" {
+		cfg.FileAllocation = beforeCfg.FileAllocation
+	}
+	if cfg.DNS == nil {
+		cfg.DNS = beforeCfg.DNS
+	}
+	if cfg.Bind == nil {
+		cfg.Bind = beforeCfg.Bind
+	}
+	if cfg.HostLimit == nil {
+		cfg.HostLimit = beforeCfg.HostLimit
+	}
 	return cfg
 }
 
+// DNSConfig is the host name resolution config of the http downloads and the bt trackers.
+type DNSConfig struct {
+	// Hosts are the static host overrides in the curl --resolve format, host:port:addr[,addr]..., the port can be *
+	Hosts []string `json:"hosts"`
+	// DoH are the DNS-over-HTTPS endpoints tried in order, empty means the system resolver
+	DoH []string `json:"doh"`
+	// CacheTTL is the seconds to cache the lookups, zero means 5 minutes and negative disables the cache
+	CacheTTL int `json:"cacheTtl"`
+}
+
+// BindConfig binds the outgoing connections to the local addresses, e.g. to choose the uplink of a multi-homed host.
+type BindConfig struct {
+	// Addresses are the local ip addresses, the connections of a http task are spread across them round-robin
+	Addresses []string `json:"addresses"`
+	// Interface is the network interface whose addresses are used if no address is set
+	Interface string `json:"interface"`
+}
+
+func (b *BindConfig) IsEmpty() bool {
+	return b == nil || (len(b.Addresses) == 0 && b.Interface == "")
+}
+
+// LocalIPs returns the local ip addresses to bind, nil means the connections are not bound.
+func (b *BindConfig) LocalIPs() ([]net.IP, error) {
+	if b.IsEmpty() {
+		return nil, nil
+	}
+	var ips []net.IP
+	for _, addr := range b.Addresses {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address: %s", addr)
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	iface, err := net.InterfaceByName(b.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		// The link-local addresses can't reach the remote hosts
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address on interface: %s", b.Interface)
+	}
+	return ips, nil
+}
+
+// RetryPolicy controls how the failed requests are retried, the backoff doubles after each failure.
+type RetryPolicy struct {
+	// MaxAttempts is the max retry times of a connection when all connections failed
+	MaxAttempts int `json:"maxAttempts"`
+	// BaseBackoff is the backoff of the first retry in milliseconds
+	BaseBackoff int64 `json:"baseBackoff"`
+	// MaxBackoff is the max backoff in milliseconds
+	MaxBackoff int64 `json:"maxBackoff"`
+	// Jitter is the random factor of the backoff in [0, 1], e.g. 0.2 means the backoff varies by ±20%
+	Jitter float64 `json:"jitter"`
+	// RetryableCodes are the status codes which can be retried, empty means all status codes are retryable
+	RetryableCodes []int `json:"retryableCodes"`
+}
+
+// Retryable returns whether the request failed with the status code can be retried
+func (p *RetryPolicy) Retryable(code int) bool {
+	return len(p.RetryableCodes) == 0 || slices.Contains(p.RetryableCodes, code)
+}
+
+// HostLimitConfig limits the connections to each host, the connections of all tasks to the same host share the limit.
+type HostLimitConfig struct {
+	// MaxConnections is the max connections to each host, zero means unlimited
+	MaxConnections int `json:"maxConnections"`
+	// Rules override the max connections of the matched hosts, the first matched rule applies
+	Rules []*HostLimitRule `json:"rules"`
+}
+
+type HostLimitRule struct {
+	// Host is the host name, *.example.com matches the subdomains of example.com
+	Host string `json:"host"`
+	// MaxConnections is the max connections to the host, zero means unlimited
+	MaxConnections int `json:"maxConnections"`
+}
+
+// Limit returns the max connections to the host, zero means unlimited.
+func (c *HostLimitConfig) Limit(host string) int {
+	if c == nil {
+		return 0
+	}
+	for _, rule := range c.Rules {
+		if rule != nil && util.MatchHost(strings.ToLower(rule.Host), host) {
+			return max(rule.MaxConnections, 0)
+		}
+	}
+	return max(c.MaxConnections, 0)
+}
+
+type FileAllocation string
+
+const (
+	// FileAllocationNone grows the file as the data is written
+	FileAllocationNone FileAllocation = "none"
+	// FileAllocationSparse truncates the file to its size, the disk space is allocated as the data is written
+	FileAllocationSparse FileAllocation = "sparse"
+	// FileAllocationFull allocates the whole file on disk before downloading
+	FileAllocationFull FileAllocation = "full"
+)
+
+// SpeedLimitConfig is the global speed limit config, the limits are in bytes per second and zero means unlimited.
+type SpeedLimitConfig struct {
+	DownloadLimit int64 `json:"downloadLimit"`
+	UploadLimit   int64 `json:"uploadLimit"`
+	// Alternative speed limits take effect during the scheduled time of day
+	Alternative *AlternativeSpeedLimitConfig `json:"alternative"`
+}
+
+// Limits returns the download and upload limits which take effect at the given time.
+func (cfg *SpeedLimitConfig) Limits(now time.Time) (download int64, upload int64) {
+	if cfg == nil {
+		return 0, 0
+	}
+	if cfg.Alternative.Active(now) {
+		return cfg.Alternative.DownloadLimit, cfg.Alternative.UploadLimit
+	}
+	return cfg.DownloadLimit, cfg.UploadLimit
+}
+
+type AlternativeSpeedLimitConfig struct {
+	Enable        bool  `json:"enable"`
+	DownloadLimit int64 `json:"downloadLimit"`
+	UploadLimit   int64 `json:"uploadLimit"`
+	// Start and End are the time of day in HH:mm format, the schedule spans midnight if End is not after Start
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Days are the days of week when the schedule starts, empty means every day
+	Days []time.Weekday `json:"days"`
+}
+
+// Active returns whether the alternative speed limits take effect at the given time.
+func (cfg *AlternativeSpeedLimitConfig) Active(now time.Time) bool {
+	if cfg == nil || !cfg.Enable {
+		return false
+	}
+	start, err := time.Parse("15:04", cfg.Start)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse("15:04", cfg.End)
+	if err != nil {
+		return false
+	}
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+	minute := now.Hour()*60 + now.Minute()
+
+	day := now.Weekday()
+	if endMinute > startMinute {
+		if minute < startMinute || minute >= endMinute {
+			return false
+		}
+	} else {
+		if minute < startMinute && minute >= endMinute {
+			return false
+		}
+		// The time after midnight belongs to the schedule which starts on the previous day
+		if minute < startMinute {
+			day = (day + 6) % 7
+		}
+	}
+	return len(cfg.Days) == 0 || slices.Contains(cfg.Days, day)
+}
+
 type DownloaderProxyConfig struct {
 	Enable bool `json:"enable"`
 	// System is the flag that use system proxy
@@ -275,6 +585,74 @@ func (cfg *DownloaderProxyConfig) ToUrl() *url.URL {
 	return util.BuildProxyUrl(cfg.Scheme, cfg.Host, cfg.Usr, cfg.Pwd)
 }
 
+// TLSConfig is the custom certificates of tls connections, each value can be PEM encoded content or a file path.
+type TLSConfig struct {
+	// CaCert is the CA bundle to verify the server, it is trusted in addition to the system CAs
+	CaCert string `json:"caCert"`
+	// ClientCert and ClientKey are the client certificate and private key for mutual TLS
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+}
+
+// BuildTLSConfig builds the tls config, the non-empty fields of the later configs override the earlier ones.
+func BuildTLSConfig(skipVerifyCert bool, configs ...*TLSConfig) (*tls.Config, error) {
+	var caCert, clientCert, clientKey string
+	for _, cfg := range configs {
+		if cfg == nil {
+			continue
+		}
+		if cfg.CaCert != "" {
+			caCert = cfg.CaCert
+		}
+		// The certificate and key must come from the same config
+		if cfg.ClientCert != "" {
+			clientCert = cfg.ClientCert
+			clientKey = cfg.ClientKey
+		}
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: skipVerifyCert,
+	}
+	if caCert != "" {
+		pem, err := loadPem(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("load ca cert failed: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("load ca cert failed: no valid certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if clientCert != "" {
+		certPem, err := loadPem(clientCert)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert failed: %w", err)
+		}
+		keyPem, err := loadPem(clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client key failed: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert failed: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// loadPem returns the value if it is PEM encoded, otherwise reads the file of the path.
+func loadPem(v string) ([]byte, error) {
+	if strings.Contains(v, "-----BEGIN") {
+		return []byte(v), nil
+	}
+	return os.ReadFile(v)
+}
+
 var prcLock sync.Mutex
 
 func safeProxyReloadConf() {
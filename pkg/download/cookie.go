@@ -0,0 +1,434 @@
+package download
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	gohttp "net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const netscapeCookieHeader = "# Netscape HTTP Cookie File"
+
+// netscapeHttpOnlyPrefix is the line prefix of http only cookies in cookies.txt, which is used by curl and browsers
+const netscapeHttpOnlyPrefix = "#HttpOnly_"
+
+var ErrCookieProfileNotFound = errors.New("cookie profile not found")
+
+// cookieSaveDelay is the delay to coalesce the saves of the cookies set by the server
+var cookieSaveDelay = 3 * time.Second
+
+// Cookie is the persisted cookie of a cookie profile
+type Cookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Domain is the domain of the cookie without leading dot
+	Domain string `json:"domain"`
+	// HostOnly means the cookie is only sent to the exact domain, not its subdomains
+	HostOnly bool   `json:"hostOnly"`
+	Path     string `json:"path"`
+	Secure   bool   `json:"secure"`
+	HttpOnly bool   `json:"httpOnly"`
+	// Expires is the unix timestamp in seconds, zero means session cookie
+	Expires int64 `json:"expires"`
+
+	// transient means the session cookie is set by the server, it's only kept in memory
+	transient bool
+}
+
+func (c *Cookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (c *Cookie) expired(now time.Time) bool {
+	return c.Expires > 0 && c.Expires <= now.Unix()
+}
+
+// CookieProfile is a named set of cookies which can be attached to the download request
+type CookieProfile struct {
+	Name    string    `json:"name"`
+	Cookies []*Cookie `json:"cookies"`
+}
+
+// cookieJar is the cookie jar of a cookie profile, the persistent cookies set by the server are saved to the storage,
+// the saves are coalesced and flushed after cookieSaveDelay or when the task stops.
+type cookieJar struct {
+	lock    sync.Mutex
+	jar     *cookiejar.Jar
+	profile *CookieProfile
+	save    func(profile *CookieProfile)
+	dirty   bool
+	timer   *time.Timer
+	deleted bool
+}
+
+func newCookieJar(profile *CookieProfile, save func(profile *CookieProfile)) *cookieJar {
+	j := &cookieJar{
+		profile: profile,
+		save:    save,
+	}
+	j.reload()
+	return j
+}
+
+func (j *cookieJar) Cookies(u *url.URL) []*gohttp.Cookie {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.jar.Cookies(u)
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*gohttp.Cookie) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.jar.SetCookies(u, cookies)
+	changed := false
+	now := time.Now()
+	for _, hc := range cookies {
+		c := toCookie(u, hc, now)
+		if c == nil {
+			continue
+		}
+		c.transient = c.Expires == 0
+		j.upsert(c)
+		changed = true
+	}
+	if changed && !j.deleted {
+		j.dirty = true
+		if j.timer == nil {
+			j.timer = time.AfterFunc(cookieSaveDelay, j.flush)
+		}
+	}
+}
+
+// flush saves the profile if it's changed since the last save
+func (j *cookieJar) flush() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.doFlush()
+}
+
+func (j *cookieJar) doFlush() {
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
+	}
+	if !j.dirty || j.deleted {
+		return
+	}
+	j.dirty = false
+	j.save(&CookieProfile{
+		Name:    j.profile.Name,
+		Cookies: j.persistent(),
+	})
+}
+
+// persistent returns the unexpired cookies of the profile which are not only kept in memory
+func (j *cookieJar) persistent() []*Cookie {
+	now := time.Now()
+	cookies := make([]*Cookie, 0, len(j.profile.Cookies))
+	for _, c := range j.profile.Cookies {
+		if !c.transient && !c.expired(now) {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+// merge adds or replaces the cookies of the profile, it returns the count of merged cookies.
+func (j *cookieJar) merge(cookies []*Cookie) int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for _, c := range cookies {
+		j.upsert(c)
+	}
+	j.reload()
+	j.dirty = true
+	j.doFlush()
+	return len(cookies)
+}
+
+// snapshot returns the cookies of the profile to be exported, the session cookies set by the server are excluded
+func (j *cookieJar) snapshot() []*Cookie {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.persistent()
+}
+
+// upsert replaces the cookie with the same domain, path and name, the expired cookie is removed.
+func (j *cookieJar) upsert(c *Cookie) {
+	now := time.Now()
+	cookies := make([]*Cookie, 0, len(j.profile.Cookies)+1)
+	for _, exist := range j.profile.Cookies {
+		if exist.key() == c.key() || exist.expired(now) {
+			continue
+		}
+		cookies = append(cookies, exist)
+	}
+	if !c.expired(now) {
+		cookies = append(cookies, c)
+	}
+	j.profile.Cookies = cookies
+}
+
+// reload rebuilds the in-memory jar from the profile cookies
+func (j *cookieJar) reload() {
+	j.jar, _ = cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	now := time.Now()
+	for _, c := range j.profile.Cookies {
+		if c.expired(now) {
+			continue
+		}
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		hc := &gohttp.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		if !c.HostOnly {
+			hc.Domain = c.Domain
+		}
+		if c.Expires > 0 {
+			hc.Expires = time.Unix(c.Expires, 0)
+		}
+		j.jar.SetCookies(&url.URL{Scheme: scheme, Host: c.Domain, Path: c.Path}, []*gohttp.Cookie{hc})
+	}
+}
+
+// toCookie converts the cookie set by the server to the persisted cookie, returns nil if the cookie is rejected.
+func toCookie(u *url.URL, hc *gohttp.Cookie, now time.Time) *Cookie {
+	host := strings.ToLower(u.Hostname())
+	if host == "" || hc.Name == "" {
+		return nil
+	}
+	c := &Cookie{
+		Name:     hc.Name,
+		Value:    hc.Value,
+		Domain:   strings.TrimPrefix(strings.ToLower(hc.Domain), "."),
+		Path:     hc.Path,
+		Secure:   hc.Secure,
+		HttpOnly: hc.HttpOnly,
+	}
+	if c.Domain == "" || c.Domain == host {
+		c.Domain = host
+		c.HostOnly = hc.Domain == ""
+	} else if !strings.HasSuffix(host, "."+c.Domain) {
+		// The server can't set cookies for other domains
+		return nil
+	}
+	// The cookies for public suffix like com or co.uk are not allowed
+	if !c.HostOnly {
+		if suffix, _ := publicsuffix.PublicSuffix(c.Domain); suffix == c.Domain {
+			return nil
+		}
+	}
+	if c.Path == "" || c.Path[0] != '/' {
+		c.Path = defaultCookiePath(u.Path)
+	}
+	switch {
+	case hc.MaxAge < 0:
+		c.Expires = now.Unix()
+	case hc.MaxAge > 0:
+		c.Expires = now.Unix() + int64(hc.MaxAge)
+	case !hc.Expires.IsZero():
+		c.Expires = max(hc.Expires.Unix(), 1)
+	}
+	return c
+}
+
+// defaultCookiePath returns the directory of the request path, see RFC 6265 5.1.4
+func defaultCookiePath(p string) string {
+	i := strings.LastIndex(p, "/")
+	if i <= 0 || p[0] != '/' {
+		return "/"
+	}
+	return p[:i]
+}
+
+// parseNetscapeCookies parses the cookies in Netscape cookies.txt format.
+func parseNetscapeCookies(r io.Reader) ([]*Cookie, error) {
+	cookies := make([]*Cookie, 0)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, netscapeHttpOnlyPrefix) {
+			httpOnly = true
+			line = strings.TrimPrefix(line, netscapeHttpOnlyPrefix)
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("invalid cookies.txt line %d", lineNum)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookies.txt line %d: %w", lineNum, err)
+		}
+		domain := strings.ToLower(fields[0])
+		cookies = append(cookies, &Cookie{
+			Name:     fields[5],
+			Value:    strings.Join(fields[6:], "\t"),
+			Domain:   strings.TrimPrefix(domain, "."),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+			Expires:  max(expires, 0),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cookies, nil
+}
+
+// writeNetscapeCookies writes the cookies in Netscape cookies.txt format.
+func writeNetscapeCookies(w io.Writer, cookies []*Cookie) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(netscapeCookieHeader + "\n\n")
+	formatBool := func(b bool) string {
+		if b {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	for _, c := range cookies {
+		domain := c.Domain
+		if !c.HostOnly {
+			domain = "." + domain
+		}
+		if c.HttpOnly {
+			domain = netscapeHttpOnlyPrefix + domain
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, formatBool(!c.HostOnly), c.Path, formatBool(c.Secure), c.Expires, c.Name, c.Value)
+	}
+	return bw.Flush()
+}
+
+// getCookieJar returns the cookie jar of the profile, a new profile is created if it doesn't exist.
+func (d *Downloader) getCookieJar(profile string) (*cookieJar, error) {
+	d.cookieLock.Lock()
+	defer d.cookieLock.Unlock()
+
+	if jar, ok := d.cookieJars[profile]; ok {
+		return jar, nil
+	}
+	cp := &CookieProfile{}
+	exist, err := d.storage.Get(bucketCookie, profile, cp)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		cp = &CookieProfile{
+			Name:    profile,
+			Cookies: make([]*Cookie, 0),
+		}
+	}
+	jar := newCookieJar(cp, func(profile *CookieProfile) {
+		if err := d.storage.Put(bucketCookie, profile.Name, profile); err != nil {
+			d.Logger.Warn().Err(err).Msgf("save cookie profile failed: %s", profile.Name)
+		}
+	})
+	d.cookieJars[profile] = jar
+	return jar, nil
+}
+
+// flushCookieJars saves the pending changes of the cookie jars
+func (d *Downloader) flushCookieJars() {
+	d.cookieLock.Lock()
+	jars := make([]*cookieJar, 0, len(d.cookieJars))
+	for _, jar := range d.cookieJars {
+		jars = append(jars, jar)
+	}
+	d.cookieLock.Unlock()
+
+	for _, jar := range jars {
+		jar.flush()
+	}
+}
+
+// GetCookieProfiles returns the names of all cookie profiles
+func (d *Downloader) GetCookieProfiles() ([]string, error) {
+	var profiles []*CookieProfile
+	if err := d.storage.List(bucketCookie, &profiles); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		names = append(names, profile.Name)
+	}
+	return names, nil
+}
+
+// ImportCookies imports the cookies in Netscape cookies.txt format into the profile, returns the count of imported cookies.
+func (d *Downloader) ImportCookies(profile string, r io.Reader) (int, error) {
+	if profile == "" {
+		return 0, errors.New("invalid cookie profile name")
+	}
+	cookies, err := parseNetscapeCookies(r)
+	if err != nil {
+		return 0, err
+	}
+	jar, err := d.getCookieJar(profile)
+	if err != nil {
+		return 0, err
+	}
+	return jar.merge(cookies), nil
+}
+
+// ExportCookies exports the cookies of the profile in Netscape cookies.txt format.
+func (d *Downloader) ExportCookies(profile string, w io.Writer) error {
+	exist, err := d.storage.Get(bucketCookie, profile, &CookieProfile{})
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return ErrCookieProfileNotFound
+	}
+	jar, err := d.getCookieJar(profile)
+	if err != nil {
+		return err
+	}
+	return writeNetscapeCookies(w, jar.snapshot())
+}
+
+// DeleteCookieProfile deletes the profile and all its cookies
+func (d *Downloader) DeleteCookieProfile(profile string) error {
+	d.cookieLock.Lock()
+	defer d.cookieLock.Unlock()
+
+	if jar, ok := d.cookieJars[profile]; ok {
+		jar.lock.Lock()
+		jar.deleted = true
+		if jar.timer != nil {
+			jar.timer.Stop()
+			jar.timer = nil
+		}
+		jar.lock.Unlock()
+		delete(d.cookieJars, profile)
+	}
+	return d.storage.Delete(bucketCookie, profile)
+}
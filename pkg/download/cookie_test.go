@@ -0,0 +1,258 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"github.com/GopeedLab/gopeed/pkg/base"
+	"net"
+	gohttp "net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseNetscapeCookies(t *testing.T) {
+	content := `# Netscape HTTP Cookie File
+# comment line
+
+.example.com	TRUE	/	TRUE	0	sid	abc
+#HttpOnly_www.example.com	FALSE	/path	FALSE	1893456000	token	a	b
+`
+	cookies, err := parseNetscapeCookies(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Cookie{
+		{
+			Name:   "sid",
+			Value:  "abc",
+			Domain: "example.com",
+			Path:   "/",
+			Secure: true,
+		},
+		{
+			Name:     "token",
+			Value:    "a\tb",
+			Domain:   "www.example.com",
+			HostOnly: true,
+			Path:     "/path",
+			HttpOnly: true,
+			Expires:  1893456000,
+		},
+	}
+	if !reflect.DeepEqual(cookies, want) {
+		t.Fatalf("parseNetscapeCookies() got = %v, want %v", cookies, want)
+	}
+
+	var buf bytes.Buffer
+	if err := writeNetscapeCookies(&buf, cookies); err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseNetscapeCookies(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("writeNetscapeCookies() round trip got = %v, want %v", got, want)
+	}
+
+	if _, err := parseNetscapeCookies(strings.NewReader("example.com\tFALSE\t/\n")); err == nil {
+		t.Errorf("parseNetscapeCookies() expected error for invalid line")
+	}
+}
+
+func TestToCookie(t *testing.T) {
+	u, _ := url.Parse("http://www.example.com/a/b")
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		name   string
+		cookie *gohttp.Cookie
+		want   *Cookie
+	}{
+		{
+			name:   "host only",
+			cookie: &gohttp.Cookie{Name: "a", Value: "1"},
+			want:   &Cookie{Name: "a", Value: "1", Domain: "www.example.com", HostOnly: true, Path: "/a"},
+		},
+		{
+			name:   "parent domain",
+			cookie: &gohttp.Cookie{Name: "a", Value: "1", Domain: ".example.com", Path: "/", MaxAge: 10},
+			want:   &Cookie{Name: "a", Value: "1", Domain: "example.com", Path: "/", Expires: 1010},
+		},
+		{
+			name:   "other domain",
+			cookie: &gohttp.Cookie{Name: "a", Value: "1", Domain: "other.com"},
+		},
+		{
+			name:   "public suffix",
+			cookie: &gohttp.Cookie{Name: "a", Value: "1", Domain: "com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := toCookie(u, tt.cookie, now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("toCookie() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloader_CookieProfile(t *testing.T) {
+	server := gohttp.Server{
+		Handler: gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			if _, err := r.Cookie("token"); err != nil {
+				w.WriteHeader(gohttp.StatusForbidden)
+				return
+			}
+			gohttp.SetCookie(w, &gohttp.Cookie{Name: "session", Value: "s1", Path: "/", MaxAge: 3600})
+			gohttp.SetCookie(w, &gohttp.Cookie{Name: "sid", Value: "s2", Path: "/"})
+			gohttp.ServeContent(w, r, "test.txt", time.Time{}, strings.NewReader("hello"))
+		}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+
+	if err := downloader.ExportCookies("test", &bytes.Buffer{}); !errors.Is(err, ErrCookieProfileNotFound) {
+		t.Fatalf("ExportCookies() got = %v, want %v", err, ErrCookieProfileNotFound)
+	}
+	count, err := downloader.ImportCookies("test", strings.NewReader("127.0.0.1\tFALSE\t/\tFALSE\t0\ttoken\tt1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("ImportCookies() got = %v, want %v", count, 1)
+	}
+	profiles, err := downloader.GetCookieProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(profiles, []string{"test"}) {
+		t.Fatalf("GetCookieProfiles() got = %v, want %v", profiles, []string{"test"})
+	}
+
+	reqUrl := "http://" + listener.Addr().String() + "/test.txt"
+	if _, err := downloader.Resolve(&base.Request{URL: reqUrl}); err == nil {
+		t.Fatal("Resolve() without cookie profile expected error")
+	}
+	if _, err := downloader.Resolve(&base.Request{URL: reqUrl, CookieProfile: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The persistent cookie set by the server should be saved to the profile, the session cookie is only kept in memory
+	downloader.flushCookieJars()
+	jar, err := downloader.getCookieJar("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(reqUrl)
+	if got := len(jar.Cookies(u)); got != 3 {
+		t.Errorf("Cookies() got = %v, want %v", got, 3)
+	}
+	var buf bytes.Buffer
+	if err := downloader.ExportCookies("test", &buf); err != nil {
+		t.Fatal(err)
+	}
+	cookies, err := parseNetscapeCookies(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, c := range cookies {
+		names = append(names, c.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"token", "session"}) {
+		t.Errorf("ExportCookies() got = %v, want %v", names, []string{"token", "session"})
+	}
+	cp := &CookieProfile{}
+	if _, err := downloader.storage.Get(bucketCookie, "test", cp); err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.Cookies) != 2 {
+		t.Errorf("stored cookies got = %v, want %v", len(cp.Cookies), 2)
+	}
+
+	if err := downloader.DeleteCookieProfile("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloader.ExportCookies("test", &buf); !errors.Is(err, ErrCookieProfileNotFound) {
+		t.Errorf("ExportCookies() after delete got = %v, want %v", err, ErrCookieProfileNotFound)
+	}
+}
+
+func TestCookieJar_SetCookies(t *testing.T) {
+	delay := cookieSaveDelay
+	cookieSaveDelay = 50 * time.Millisecond
+	defer func() {
+		cookieSaveDelay = delay
+	}()
+
+	var (
+		lock  sync.Mutex
+		saved []*CookieProfile
+	)
+	jar := newCookieJar(&CookieProfile{Name: "test", Cookies: make([]*Cookie, 0)}, func(profile *CookieProfile) {
+		lock.Lock()
+		defer lock.Unlock()
+		saved = append(saved, profile)
+	})
+	savedCount := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(saved)
+	}
+
+	u, _ := url.Parse("http://www.example.com/")
+	for i := 0; i < 10; i++ {
+		jar.SetCookies(u, []*gohttp.Cookie{
+			{Name: "a", Value: strconv.Itoa(i), MaxAge: 3600},
+			{Name: "sid", Value: strconv.Itoa(i)},
+		})
+	}
+	if got := savedCount(); got != 0 {
+		t.Fatalf("saved count before delay got = %v, want %v", got, 0)
+	}
+	time.Sleep(cookieSaveDelay * 4)
+	if got := savedCount(); got != 1 {
+		t.Fatalf("saved count after delay got = %v, want %v", got, 1)
+	}
+	cookies := saved[0].Cookies
+	if len(cookies) != 1 || cookies[0].Name != "a" || cookies[0].Value != "9" {
+		t.Errorf("saved cookies got = %v, want only the persistent cookie", cookies)
+	}
+	if got := len(jar.Cookies(u)); got != 2 {
+		t.Errorf("Cookies() got = %v, want %v", got, 2)
+	}
+
+	// Nothing is changed, the flush should not save again
+	jar.flush()
+	if got := savedCount(); got != 1 {
+		t.Errorf("saved count after flush got = %v, want %v", got, 1)
+	}
+
+	// The imported session cookie should be saved and exported
+	jar.merge([]*Cookie{{Name: "imported", Value: "1", Domain: "www.example.com", HostOnly: true, Path: "/"}})
+	if got := savedCount(); got != 2 {
+		t.Fatalf("saved count after merge got = %v, want %v", got, 2)
+	}
+	names := make([]string, 0)
+	for _, c := range jar.snapshot() {
+		names = append(names, c.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "imported"}) {
+		t.Errorf("snapshot() got = %v, want %v", names, []string{"a", "imported"})
+	}
+}
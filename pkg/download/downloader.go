@@ -1,16 +1,21 @@
 package download
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"github.com/GopeedLab/gopeed/internal/controller"
 	"github.com/GopeedLab/gopeed/internal/fetcher"
+	"github.com/GopeedLab/gopeed/internal/hostlimit"
 	"github.com/GopeedLab/gopeed/internal/logger"
+	"github.com/GopeedLab/gopeed/internal/resolver"
 	"github.com/GopeedLab/gopeed/pkg/base"
 	"github.com/GopeedLab/gopeed/pkg/protocol/http"
 	"github.com/GopeedLab/gopeed/pkg/util"
 	gonanoid "github.com/matoous/go-nanoid/v2"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/pkgerrors"
+	"golang.org/x/time/rate"
 	"math"
 	gohttp "net/http"
 	"net/url"
@@ -35,11 +40,15 @@ const (
 	bucketExtension = "extension"
 	// downloader extension storage bucket
 	bucketExtensionStorage = "extension_storage"
+	// downloader cookie profile bucket
+	bucketCookie = "cookie"
 )
 
 var (
 	ErrTaskNotFound        = errors.New("task not found")
 	ErrUnSupportedProtocol = errors.New("unsupported protocol")
+	ErrInsufficientSpace   = errors.New("insufficient disk space")
+	ErrChecksumMultiFile   = errors.New("checksum is not supported for multi-file resource")
 )
 
 type Listener func(event *Event)
@@ -75,6 +84,17 @@ type Downloader struct {
 	closed             atomic.Bool
 
 	extensions []*Extension
+
+	cookieLock *sync.Mutex
+	cookieJars map[string]*cookieJar
+
+	// downloadLimiter and uploadLimiter are the global speed limiters shared by all tasks
+	downloadLimiter *rate.Limiter
+	uploadLimiter   *rate.Limiter
+	// resolver resolves the host names for all tasks, its cache is shared by them
+	resolver *resolver.Resolver
+	// hostLimiter limits the connections of all tasks to each host
+	hostLimiter *hostlimit.Limiter
 }
 
 func NewDownloader(cfg *DownloaderConfig) *Downloader {
@@ -94,6 +114,14 @@ func NewDownloader(cfg *DownloaderConfig) *Downloader {
 		checkDuplicateLock: &sync.Mutex{},
 
 		extensions: make([]*Extension, 0),
+
+		cookieLock: &sync.Mutex{},
+		cookieJars: make(map[string]*cookieJar),
+
+		downloadLimiter: util.NewRateLimiter(0),
+		uploadLimiter:   util.NewRateLimiter(0),
+		resolver:        resolver.New(nil),
+		hostLimiter:     hostlimit.New(nil),
 	}
 
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
@@ -107,7 +135,7 @@ func NewDownloader(cfg *DownloaderConfig) *Downloader {
 
 func (d *Downloader) Setup() error {
 	// setup storage
-	if err := d.storage.Setup([]string{bucketTask, bucketSave, bucketConfig, bucketExtension, bucketExtensionStorage}); err != nil {
+	if err := d.storage.Setup([]string{bucketTask, bucketSave, bucketConfig, bucketExtension, bucketExtensionStorage, bucketCookie}); err != nil {
 		return err
 	}
 	// load config from storage
@@ -125,6 +153,9 @@ func (d *Downloader) Setup() error {
 	}
 	// init default config
 	d.cfg.DownloaderStoreConfig.Init()
+	d.updateSpeedLimit()
+	d.updateResolver()
+	d.hostLimiter.Update(d.cfg.HostLimit)
 	// init protocol config, if not exist, use default config
 	for _, fm := range d.cfg.FetchManagers {
 		protocol := fm.Name()
@@ -190,6 +221,8 @@ func (d *Downloader) Setup() error {
 	// calculate download speed every tick
 	go func() {
 		for !d.closed.Load() {
+			// the alternative speed limits may take effect by schedule
+			d.updateSpeedLimit()
 			if len(d.tasks) > 0 {
 				for _, task := range d.tasks {
 					func() {
@@ -227,6 +260,10 @@ func (d *Downloader) Setup() error {
 						if !downloadDataChanged && !uploadDataChanged {
 							return
 						}
+						// the fetcher stores the progress snapshot of the last flush, the flush runs in the background
+						if syncer, ok := task.fetcher.(fetcher.Syncer); ok && task.Status == base.DownloadStatusRunning {
+							d.syncTask(task, syncer)
+						}
 						d.saveTask(task)
 					}()
 				}
@@ -237,10 +274,39 @@ func (d *Downloader) Setup() error {
 	return nil
 }
 
-func (d *Downloader) parseFm(url string) (fetcher.FetcherManager, error) {
+// syncTask flushes the downloaded data of the task in the background at the sync interval, so a slow disk
+// doesn't delay the progress of the other tasks, the flushed progress is stored once the flush is done.
+// The caller must hold the status lock of the task.
+func (d *Downloader) syncTask(task *Task, syncer fetcher.Syncer) {
+	if time.Since(task.syncedAt) < time.Millisecond*time.Duration(d.cfg.SyncInterval) || !task.syncing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer task.syncing.Store(false)
+		if err := syncer.Sync(); err != nil {
+			d.Logger.Warn().Err(err).Msgf("sync task data failed, task id: %s", task.ID)
+			return
+		}
+		task.statusLock.Lock()
+		defer task.statusLock.Unlock()
+		task.syncedAt = time.Now()
+		// check if task is deleted
+		if d.GetTask(task.ID) == nil {
+			return
+		}
+		d.saveTask(task)
+	}()
+}
+
+func (d *Downloader) parseFm(req *base.Request) (fetcher.FetcherManager, error) {
+	for _, fm := range d.cfg.FetchManagers {
+		if matcher, ok := fm.(fetcher.RequestMatcher); ok && matcher.MatchRequest(req) {
+			return fm, nil
+		}
+	}
 	for _, fm := range d.cfg.FetchManagers {
 		for _, filter := range fm.Filters() {
-			if filter.Match(url) {
+			if filter.Match(req.URL) {
 				return fm, nil
 			}
 		}
@@ -248,11 +314,39 @@ func (d *Downloader) parseFm(url string) (fetcher.FetcherManager, error) {
 	return nil, ErrUnSupportedProtocol
 }
 
+// GetFetcherManager returns the fetcher manager of the protocol, nil if the protocol is not registered
+func (d *Downloader) GetFetcherManager(name string) fetcher.FetcherManager {
+	for _, fm := range d.cfg.FetchManagers {
+		if fm.Name() == name {
+			return fm
+		}
+	}
+	return nil
+}
+
 func (d *Downloader) setupFetcher(fm fetcher.FetcherManager, fetcher fetcher.Fetcher) {
 	ctl := controller.NewController()
 	ctl.GetConfig = func(v any) {
 		d.getProtocolConfig(fm.Name(), v)
 	}
+	ctl.GetProtocolConfig = func(name string, v any) {
+		d.getProtocolConfig(name, v)
+	}
+	ctl.GetCookieJar = func(profile string) gohttp.CookieJar {
+		jar, err := d.getCookieJar(profile)
+		if err != nil {
+			d.Logger.Warn().Err(err).Msgf("get cookie profile failed: %s", profile)
+			return nil
+		}
+		return jar
+	}
+	ctl.DownloadLimiter = d.downloadLimiter
+	ctl.UploadLimiter = d.uploadLimiter
+	ctl.Resolver = d.resolver
+	ctl.HostLimiter = d.hostLimiter
+	ctl.FileController = &controller.DefaultFileController{
+		Allocation: d.cfg.FileAllocation,
+	}
 	// Get proxy config, task request proxy config has higher priority, then use global proxy config
 	ctl.GetProxy = func(requestProxy *base.RequestProxy) func(*gohttp.Request) (*url.URL, error) {
 		if requestProxy == nil {
@@ -267,9 +361,21 @@ func (d *Downloader) setupFetcher(fm fetcher.FetcherManager, fetcher fetcher.Fet
 			return d.cfg.Proxy.ToHandler()
 		}
 	}
+	ctl.GetTLSConfig = func(requestTLS *base.TLSConfig, skipVerifyCert bool) (*tls.Config, error) {
+		return base.BuildTLSConfig(skipVerifyCert, d.cfg.TLS, requestTLS)
+	}
+	ctl.GetBind = d.getBind
 	fetcher.Setup(ctl)
 }
 
+// getBind returns the bind config of the request, the global bind config is used if the request doesn't set one
+func (d *Downloader) getBind(requestBind *base.BindConfig) *base.BindConfig {
+	if !requestBind.IsEmpty() {
+		return requestBind
+	}
+	return d.cfg.Bind
+}
+
 func (d *Downloader) saveTask(task *Task) error {
 	data, err := task.fetcherManager.Store(task.fetcher)
 	if err != nil {
@@ -304,7 +410,7 @@ func (d *Downloader) Resolve(req *base.Request) (rr *ResolveResult, err error) {
 		return
 	}
 
-	fetcher, err := d.buildFetcher(req.URL)
+	fetcher, err := d.buildFetcher(req)
 	if err != nil {
 		return
 	}
@@ -351,7 +457,7 @@ func (d *Downloader) remainRunningCount() int {
 
 func (d *Downloader) CreateDirect(req *base.Request, opts *base.Options) (taskId string, err error) {
 	var fetcher fetcher.Fetcher
-	fetcher, err = d.buildFetcher(req.URL)
+	fetcher, err = d.buildFetcher(req)
 	if err != nil {
 		return
 	}
@@ -632,6 +738,18 @@ func (d *Downloader) doDelete(task *Task, force bool) (err error) {
 				return err
 			}
 		}
+		if task.Meta.Res != nil {
+			// The temporary part files are useless without the task, always clean them up
+			if task.Meta.Res.Name != "" {
+				if err := os.RemoveAll(task.Meta.PartFolderPath()); err != nil {
+					return err
+				}
+			} else {
+				if err := util.SafeRemove(task.Meta.PartFilepath()); err != nil {
+					return err
+				}
+			}
+		}
 		if force && task.Meta.Res != nil {
 			if task.Meta.Res.Name != "" {
 				if err := os.RemoveAll(task.Meta.FolderPath()); err != nil {
@@ -663,7 +781,10 @@ func (d *Downloader) Close() error {
 	for _, fm := range d.cfg.FetchManagers {
 		closeArr = append(closeArr, fm.Close)
 	}
-	closeArr = append(closeArr, d.storage.Close)
+	closeArr = append(closeArr, func() error {
+		d.flushCookieJars()
+		return nil
+	}, d.storage.Close)
 	// Make sure all resources are released, if had error, return the last error
 	var lastErr error
 	for i, close := range closeArr {
@@ -776,9 +897,42 @@ func (d *Downloader) GetConfig() (*base.DownloaderStoreConfig, error) {
 
 func (d *Downloader) PutConfig(v *base.DownloaderStoreConfig) error {
 	d.cfg.DownloaderStoreConfig = v
+	d.updateSpeedLimit()
+	d.updateResolver()
+	d.hostLimiter.Update(v.HostLimit)
 	return d.storage.Put(bucketConfig, "config", v)
 }
 
+// updateResolver applies the dns config, the DoH requests go by the global proxy, tls and bind config like the downloads
+func (d *Downloader) updateResolver() {
+	d.resolver.Update(d.cfg.DNS)
+	opts := &resolver.DoHOptions{
+		Proxy: d.cfg.Proxy.ToHandler(),
+	}
+	tlsConfig, err := base.BuildTLSConfig(false, d.cfg.TLS)
+	if err != nil {
+		d.Logger.Warn().Err(err).Msg("build the tls config of the doh requests failed")
+	}
+	opts.TLSConfig = tlsConfig
+	locals, err := d.getBind(nil).LocalIPs()
+	if err != nil {
+		d.Logger.Warn().Err(err).Msg("build the bind addresses of the doh requests failed")
+	}
+	opts.Locals = locals
+	d.resolver.SetDoHOptions(opts)
+}
+
+// updateSpeedLimit applies the global speed limits which take effect now
+func (d *Downloader) updateSpeedLimit() {
+	cfg, err := d.GetConfig()
+	if err != nil || cfg == nil {
+		return
+	}
+	download, upload := cfg.SpeedLimit.Limits(time.Now())
+	util.SetRateLimit(d.downloadLimiter, download)
+	util.SetRateLimit(d.uploadLimiter, upload)
+}
+
 func (d *Downloader) getProtocolConfig(name string, v any) bool {
 	cfg, err := d.GetConfig()
 	if err != nil {
@@ -829,7 +983,16 @@ func (d *Downloader) watch(task *Task) {
 	}
 
 	err := task.fetcher.Wait()
+	d.flushCookieJars()
 	if err != nil {
+		// Pause the task when the disk is full, it can be continued after freeing up the space
+		if util.IsDiskFull(err) {
+			d.Logger.Warn().Err(err).Msgf("disk is full, pause task, task id: %s", task.ID)
+			if err := d.doPause(task); err == nil {
+				d.notifyRunning()
+			}
+			return
+		}
 		d.doOnError(task, err)
 		return
 	}
@@ -839,6 +1002,11 @@ func (d *Downloader) watch(task *Task) {
 		return
 	}
 
+	if err = d.verifyChecksum(task); err != nil {
+		d.doOnError(task, err)
+		return
+	}
+
 	task.Progress.Used = task.timer.Used()
 	if task.Meta.Res.Size == 0 {
 		task.Meta.Res.Size = task.fetcher.Progress().TotalDownloaded()
@@ -878,6 +1046,25 @@ func (d *Downloader) watch(task *Task) {
 	}
 }
 
+// verifyChecksum checks the downloaded file against the expected checksum in task options,
+// only single file task is supported, the resource of a direct created task is only known after resolving,
+// so a multi-file resource is rejected here as well.
+func (d *Downloader) verifyChecksum(task *Task) error {
+	checksum := task.Meta.Opts.Checksum
+	if checksum == nil {
+		return nil
+	}
+	if isMultiFile(task.Meta.Res) {
+		return ErrChecksumMultiFile
+	}
+	return checksum.Verify(task.Meta.SingleFilepath())
+}
+
+// isMultiFile reports whether the resource is a folder or contains more than one file
+func isMultiFile(res *base.Resource) bool {
+	return res.Name != "" || len(res.Files) > 1
+}
+
 func (d *Downloader) doOnError(task *Task, err error) {
 	d.Logger.Warn().Err(err).Msgf("task download failed, task id: %s", task.ID)
 	task.updateStatus(base.DownloadStatusError)
@@ -929,6 +1116,14 @@ func (d *Downloader) doCreate(f fetcher.Fetcher, opts *base.Options) (taskId str
 	if opts.SelectFiles == nil {
 		opts.SelectFiles = make([]int, 0)
 	}
+	if opts.Checksum != nil {
+		if err = opts.Checksum.Validate(); err != nil {
+			return
+		}
+		if res := f.Meta().Res; res != nil && isMultiFile(res) {
+			return "", ErrChecksumMultiFile
+		}
+	}
 
 	meta := f.Meta()
 	meta.Opts = opts
@@ -954,7 +1149,7 @@ func (d *Downloader) doCreate(f fetcher.Fetcher, opts *base.Options) (taskId str
 		}
 	}
 
-	fm, err := d.parseFm(f.Meta().Req.URL)
+	fm, err := d.parseFm(f.Meta().Req)
 	if err != nil {
 		return
 	}
@@ -1015,7 +1210,9 @@ func (d *Downloader) doStart(task *Task) (err error) {
 			d.Logger.Error().Stack().Err(err).Msgf("restore fetcher failed, task id: %s", task.ID)
 			return
 		}
-		isCreate = task.Status == base.DownloadStatusReady
+		// The task queued before its first start is also new, its file name must be checked for duplicates
+		isCreate = task.Status == base.DownloadStatusReady ||
+			(task.Status == base.DownloadStatusWait && task.Progress.Used == 0)
 		task.updateStatus(base.DownloadStatusRunning)
 
 		return
@@ -1050,7 +1247,7 @@ func (d *Downloader) doStart(task *Task) (err error) {
 				if task.Meta.Res.Name != "" {
 					task.Meta.Res.Name = util.ReplaceInvalidFilename(task.Meta.Res.Name)
 					fullDirPath := task.Meta.FolderPath()
-					newName, err := util.CheckDuplicateAndRename(fullDirPath)
+					newName, err := util.CheckDuplicateAndRename(fullDirPath, fetcher.PartSuffix)
 					if err != nil {
 						return err
 					}
@@ -1058,7 +1255,7 @@ func (d *Downloader) doStart(task *Task) (err error) {
 				} else {
 					task.Meta.Res.Files[0].Name = util.ReplaceInvalidFilename(task.Meta.Res.Files[0].Name)
 					fullFilePath := task.Meta.SingleFilepath()
-					newName, err := util.CheckDuplicateAndRename(fullFilePath)
+					newName, err := util.CheckDuplicateAndRename(fullFilePath, fetcher.PartSuffix)
 					if err != nil {
 						return err
 					}
@@ -1068,6 +1265,9 @@ func (d *Downloader) doStart(task *Task) (err error) {
 
 			task.Meta.Res.CalcSize(task.Meta.Opts.SelectFiles)
 		}
+		if err := d.checkFreeSpace(task); err != nil {
+			return err
+		}
 
 		task.Progress.Speed = 0
 		task.timer.Start()
@@ -1089,6 +1289,31 @@ func (d *Downloader) doStart(task *Task) (err error) {
 	return
 }
 
+// checkFreeSpace returns ErrInsufficientSpace if the download volume can't hold the rest of the task
+func (d *Downloader) checkFreeSpace(task *Task) error {
+	if task.Meta.Res == nil || task.Meta.Res.Size <= 0 {
+		return nil
+	}
+	// The space allocated by the existing file is reserved for the task
+	reserved := task.Progress.Downloaded
+	if task.Meta.Res.Name == "" {
+		reserved = max(reserved, util.DiskUsage(task.Meta.SingleFilepath()), util.DiskUsage(task.Meta.PartFilepath()))
+	}
+	need := task.Meta.Res.Size - reserved
+	if need <= 0 {
+		return nil
+	}
+	free, err := util.FreeSpace(task.Meta.Opts.Path)
+	if err != nil {
+		d.Logger.Warn().Err(err).Msgf("get free disk space failed, task id: %s", task.ID)
+		return nil
+	}
+	if free < uint64(need) {
+		return fmt.Errorf("%w: need %s, available %s", ErrInsufficientSpace, util.ByteFmt(need), util.ByteFmt(int64(free)))
+	}
+	return nil
+}
+
 func (d *Downloader) doPause(task *Task) (err error) {
 	isReturn, err := d.statusMut(task, func() (isReturn bool, err error) {
 		if task.Status == base.DownloadStatusPause || task.Status == base.DownloadStatusDone {
@@ -1117,6 +1342,7 @@ func (d *Downloader) doPause(task *Task) (err error) {
 				return err
 			}
 		}
+		d.flushCookieJars()
 		if err := d.storage.Put(bucketTask, task.ID, task.clone()); err != nil {
 			return err
 		}
@@ -1144,7 +1370,7 @@ func logPanic(logDir string) {
 }
 
 func (d *Downloader) assignFetcherManager(task *Task) error {
-	fm, err := d.parseFm(task.Meta.Req.URL)
+	fm, err := d.parseFm(task.Meta.Req)
 	if err != nil {
 		return err
 	}
@@ -1152,14 +1378,19 @@ func (d *Downloader) assignFetcherManager(task *Task) error {
 	return nil
 }
 
-func (d *Downloader) buildFetcher(url string) (fetcher.Fetcher, error) {
-	fm, err := d.parseFm(url)
+func (d *Downloader) buildFetcher(req *base.Request) (fetcher.Fetcher, error) {
+	fm, err := d.parseFm(req)
 	if err != nil {
 		return nil, err
 	}
-	fetcher := fm.Build()
-	d.setupFetcher(fm, fetcher)
-	return fetcher, nil
+	f := fm.Build()
+	d.setupFetcher(fm, f)
+	if checker, ok := f.(fetcher.RequestChecker); ok {
+		if err := checker.CheckRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
 }
 
 func initTask(task *Task) {
@@ -1167,6 +1398,7 @@ func initTask(task *Task) {
 
 	task.statusLock = &sync.Mutex{}
 	task.lock = &sync.Mutex{}
+	task.syncing = &atomic.Bool{}
 	task.speedArr = make([]int64, 0)
 	task.uploadSpeedArr = make([]int64, 0)
 }
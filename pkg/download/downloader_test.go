@@ -1,13 +1,21 @@
 package download
 
 import (
+	"encoding/base64"
+	"errors"
+	"github.com/GopeedLab/gopeed/internal/fetcher"
+	"github.com/GopeedLab/gopeed/internal/protocol/ipfs"
 	"github.com/GopeedLab/gopeed/internal/test"
 	"github.com/GopeedLab/gopeed/pkg/base"
 	"github.com/GopeedLab/gopeed/pkg/protocol/http"
+	ipfsmodel "github.com/GopeedLab/gopeed/pkg/protocol/ipfs"
+	dstest "github.com/ipfs/boxo/ipld/merkledag/test"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -44,6 +52,65 @@ func TestDownloader_Resolve(t *testing.T) {
 	}
 }
 
+func TestDownloader_ParseFm(t *testing.T) {
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+
+	tests := []struct {
+		req  *base.Request
+		want string
+	}{
+		{&base.Request{URL: "http://127.0.0.1/file.zip"}, "http"},
+		{&base.Request{URL: "http://127.0.0.1/index.m3u8?token=xxx"}, "hls"},
+		{&base.Request{URL: "http://127.0.0.1/dav/", Extra: map[string]any{"webdav": true}}, "webdav"},
+		{&base.Request{URL: "dav://127.0.0.1/dav/"}, "webdav"},
+		{&base.Request{URL: "ipfs://bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"}, "ipfs"},
+		{&base.Request{URL: "/ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi/readme"}, "ipfs"},
+	}
+	for _, tt := range tests {
+		fm, err := downloader.parseFm(tt.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fm.Name() != tt.want {
+			t.Errorf("parseFm(%s) got = %v, want %v", test.ToJson(tt.req), fm.Name(), tt.want)
+		}
+	}
+}
+
+func TestDownloader_CreateDirectIpfs(t *testing.T) {
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+
+	req := &base.Request{URL: "/ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"}
+	// The request is refused when there is neither the embedded node nor the gateways
+	if _, err := downloader.CreateDirect(req, &base.Options{Path: t.TempDir()}); !errors.Is(err, ipfs.ErrNoGateways) {
+		t.Fatalf("CreateDirect() got = %v, want %v", err, ipfs.ErrNoGateways)
+	}
+	if len(downloader.GetTasks()) != 0 {
+		t.Fatalf("GetTasks() got = %v, want no task", len(downloader.GetTasks()))
+	}
+	if _, err := downloader.CreateDirect(&base.Request{
+		URL:   req.URL,
+		Extra: &ipfsmodel.ReqExtra{Gateways: []string{"http://127.0.0.1:1"}},
+	}, &base.Options{Path: t.TempDir()}); err != nil {
+		t.Fatalf("CreateDirect() with gateways got = %v, want nil", err)
+	}
+
+	fm := downloader.GetFetcherManager("ipfs").(*ipfs.FetcherManager)
+	fm.SetNode(dstest.Mock())
+	defer fm.SetNode(nil)
+	if _, err := downloader.CreateDirect(req, &base.Options{Path: t.TempDir()}); err != nil {
+		t.Fatalf("CreateDirect() with node got = %v, want nil", err)
+	}
+}
+
 func TestDownloader_Create(t *testing.T) {
 	listener := test.StartTestFileServer()
 	defer listener.Close()
@@ -330,6 +397,139 @@ func doTestDownloaderCreateWithProxy(t *testing.T, auth bool, buildReqProxy func
 	}
 }
 
+func TestDownloader_CreateWithChecksum(t *testing.T) {
+	listener := test.StartTestFileServer()
+	defer listener.Close()
+
+	doTestDownloaderCreateWithChecksum(t, listener, &base.Checksum{
+		Algorithm: base.ChecksumAlgorithmMD5,
+		Value:     test.FileMd5(test.BuildFile),
+	}, func(event *Event) {
+		if event.Key != EventKeyDone {
+			t.Errorf("CreateWithChecksum() got = %v, want %v", event.Key, EventKeyDone)
+		}
+	})
+	doTestDownloaderCreateWithChecksum(t, listener, &base.Checksum{
+		Algorithm: base.ChecksumAlgorithmMD5,
+		Value:     "00000000000000000000000000000000",
+	}, func(event *Event) {
+		if event.Key != EventKeyError {
+			t.Errorf("CreateWithChecksum() got = %v, want %v", event.Key, EventKeyError)
+		}
+		var checksumErr *base.ChecksumError
+		if !errors.As(event.Err, &checksumErr) {
+			t.Errorf("CreateWithChecksum() got = %v, want %v", event.Err, "checksum error")
+		}
+		if event.Task.Status != base.DownloadStatusError {
+			t.Errorf("CreateWithChecksum() got = %v, want %v", event.Task.Status, base.DownloadStatusError)
+		}
+	})
+}
+
+func TestDownloader_CreateWithChecksumMultiFile(t *testing.T) {
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+
+	metalink := `<?xml version="1.0" encoding="UTF-8"?><metalink xmlns="urn:ietf:params:xml:ns:metalink">` +
+		`<file name="a.txt"><size>1</size><url>http://127.0.0.1:1/a.txt</url></file>` +
+		`<file name="b.txt"><size>1</size><url>http://127.0.0.1:1/b.txt</url></file></metalink>`
+	rr, err := downloader.Resolve(&base.Request{
+		URL: "data:application/metalink4+xml;base64," + base64.StdEncoding.EncodeToString([]byte(metalink)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = downloader.Create(rr.ID, &base.Options{
+		Path: test.Dir,
+		Checksum: &base.Checksum{
+			Algorithm: base.ChecksumAlgorithmMD5,
+			Value:     "d41d8cd98f00b204e9800998ecf8427e",
+		},
+	})
+	if !errors.Is(err, ErrChecksumMultiFile) {
+		t.Errorf("CreateWithChecksumMultiFile() got = %v, want %v", err, ErrChecksumMultiFile)
+	}
+}
+
+func doTestDownloaderCreateWithChecksum(t *testing.T, listener net.Listener, checksum *base.Checksum, handler func(event *Event)) {
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	downloader.Listener(func(event *Event) {
+		if event.Key == EventKeyDone || event.Key == EventKeyError {
+			handler(event)
+			wg.Done()
+		}
+	})
+	_, err := downloader.CreateDirect(&base.Request{
+		URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+	}, &base.Options{
+		Path:     test.Dir,
+		Name:     test.DownloadName,
+		Checksum: checksum,
+		Extra: http.OptsExtra{
+			Connections: 4,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func TestDownloader_CreateWithDNS(t *testing.T) {
+	listener := test.StartTestFileServer()
+	defer listener.Close()
+
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+	cfg, _ := downloader.GetConfig()
+	cfg.DNS = &base.DNSConfig{
+		Hosts: []string{"gopeed.test:*:127.0.0.1"},
+	}
+	if err := downloader.PutConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	downloader.Listener(func(event *Event) {
+		if event.Key == EventKeyDone || event.Key == EventKeyError {
+			if event.Key != EventKeyDone {
+				t.Errorf("CreateWithDNS() got = %v, want %v", event.Err, EventKeyDone)
+			}
+			wg.Done()
+		}
+	})
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	if _, err := downloader.CreateDirect(&base.Request{
+		URL: "http://" + net.JoinHostPort("gopeed.test", port) + "/" + test.BuildName,
+	}, &base.Options{
+		Path: test.Dir,
+		Name: test.DownloadName,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	want := test.FileMd5(test.BuildFile)
+	got := test.FileMd5(test.DownloadFile)
+	if want != got {
+		t.Errorf("CreateWithDNS() got = %v, want %v", got, want)
+	}
+}
+
 func TestDownloader_CreateRename(t *testing.T) {
 	listener := test.StartTestFileServer()
 	defer listener.Close()
@@ -375,6 +575,173 @@ func TestDownloader_CreateRename(t *testing.T) {
 	}
 }
 
+func TestDownloader_CreateQueuedRename(t *testing.T) {
+	listener := test.StartTestFileServer()
+	defer listener.Close()
+
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+	cfg, err := downloader.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second task is queued, its file name is checked when it starts
+	cfg.MaxRunning = 1
+	if err := downloader.PutConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &base.Request{
+		URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	downloader.Listener(func(event *Event) {
+		if event.Key == EventKeyDone {
+			wg.Done()
+		}
+	})
+	for i := 0; i < 2; i++ {
+		_, err := downloader.CreateDirect(req, &base.Options{
+			Path: test.Dir,
+			Name: test.DownloadName,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	want := test.FileMd5(test.BuildFile)
+	got := test.FileMd5(test.DownloadFile)
+	if want != got {
+		t.Errorf("Downloader_CreateQueuedRename() got = %v, want %v", got, want)
+	}
+	got = test.FileMd5(test.DownloadRenameFile)
+	if want != got {
+		t.Errorf("Downloader_CreateQueuedRename() got = %v, want %v", got, want)
+	}
+}
+
+func TestDownloader_DeletePartFile(t *testing.T) {
+	listener := test.StartTestSlowFileServer(time.Millisecond * 1000)
+	defer listener.Close()
+
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+
+	id, err := downloader.CreateDirect(&base.Request{
+		URL: "http://" + listener.Addr().String() + "/" + test.BuildName,
+	}, &base.Options{
+		Path: test.Dir,
+		Name: test.DownloadName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the slow resolve, the part file is created when the download starts
+	time.Sleep(time.Millisecond * 1500)
+	partFile := test.DownloadFile + ".part"
+	if _, err := os.Stat(partFile); err != nil {
+		t.Fatalf("part file not found: %v", err)
+	}
+	if _, err := os.Stat(test.DownloadFile); !os.IsNotExist(err) {
+		t.Errorf("download file should not exist before completion, got: %v", err)
+	}
+
+	if err := downloader.Delete(&TaskFilter{IDs: []string{id}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partFile); !os.IsNotExist(err) {
+		t.Errorf("part file should be removed on delete, got: %v", err)
+	}
+}
+
+func TestDownloader_CheckFreeSpace(t *testing.T) {
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+
+	check := func(size int64) error {
+		task := NewTask()
+		task.Meta = &fetcher.FetcherMeta{
+			Opts: &base.Options{
+				Path: test.Dir,
+				Name: test.DownloadName,
+			},
+			Res: &base.Resource{
+				Size:  size,
+				Files: []*base.FileInfo{{Name: test.DownloadName, Size: size}},
+			},
+		}
+		task.Progress = &Progress{}
+		return downloader.checkFreeSpace(task)
+	}
+	if err := check(1024); err != nil {
+		t.Errorf("checkFreeSpace() got = %v, want nil", err)
+	}
+	if err := check(1 << 62); !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("checkFreeSpace() got = %v, want %v", err, ErrInsufficientSpace)
+	}
+}
+
+type blockingSyncer struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (s *blockingSyncer) Sync() error {
+	s.calls.Add(1)
+	<-s.release
+	return nil
+}
+
+func TestDownloader_SyncTask(t *testing.T) {
+	downloader := NewDownloader(nil)
+	if err := downloader.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer downloader.Clear()
+
+	task := NewTask()
+	task.Progress = &Progress{}
+	initTask(task)
+	syncer := &blockingSyncer{release: make(chan struct{})}
+	sync := func() {
+		task.statusLock.Lock()
+		defer task.statusLock.Unlock()
+		downloader.syncTask(task, syncer)
+	}
+
+	// The slow sync runs in the background, the refresh loop is not blocked
+	start := time.Now()
+	sync()
+	sync()
+	if used := time.Since(start); used > time.Second {
+		t.Errorf("syncTask() used = %v, want not blocked", used)
+	}
+	close(syncer.release)
+	for i := 0; task.syncing.Load() && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := syncer.calls.Load(); got != 1 {
+		t.Errorf("Sync() calls = %v, want %v", got, 1)
+	}
+	task.statusLock.Lock()
+	defer task.statusLock.Unlock()
+	if task.syncedAt.IsZero() {
+		t.Errorf("syncTask() syncedAt is not updated")
+	}
+}
+
 func TestDownloader_StoreAndRestore(t *testing.T) {
 	listener := test.StartTestSlowFileServer(time.Millisecond * 2000)
 	defer listener.Close()
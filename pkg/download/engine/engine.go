@@ -1,6 +1,8 @@
 package engine
 
 import (
+	"context"
+	"crypto/tls"
 	_ "embed"
 	"errors"
 	"github.com/GopeedLab/gopeed/pkg/base"
@@ -12,6 +14,7 @@ import (
 	"github.com/dop251/goja"
 	"github.com/dop251/goja_nodejs/eventloop"
 	gojaurl "github.com/dop251/goja_nodejs/url"
+	"net"
 	"time"
 )
 
@@ -111,6 +114,10 @@ func (e *Engine) Close() {
 
 type Config struct {
 	ProxyConfig *base.DownloaderProxyConfig
+	// TLSConfig is used by the xhr requests, nil means the default tls config
+	TLSConfig *tls.Config
+	// DialContext is used by the xhr requests, nil means the default dialer
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 func NewEngine(cfg *Config) *Engine {
@@ -135,7 +142,7 @@ func NewEngine(cfg *Config) *Engine {
 		if err := formdata.Enable(runtime); err != nil {
 			return
 		}
-		if err := xhr.Enable(runtime, cfg.ProxyConfig.ToHandler()); err != nil {
+		if err := xhr.Enable(runtime, cfg.ProxyConfig.ToHandler(), cfg.TLSConfig, cfg.DialContext); err != nil {
 			return
 		}
 		if _, err := runtime.RunString(polyfillScript); err != nil {
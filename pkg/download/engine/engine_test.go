@@ -2,6 +2,8 @@ package engine
 
 import (
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -9,6 +11,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
 	"testing"
@@ -330,6 +333,42 @@ func doTestFetchWithProxy(t *testing.T, usr, pwd string) {
 	}
 }
 
+func TestFetchWithTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	server.TLS.ClientAuth = tls.RequestClientCert
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	engine := NewEngine(&Config{
+		TLSConfig: &tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: server.TLS.Certificates,
+		},
+	})
+	if _, err := engine.RunString(fmt.Sprintf("var host = '%s';", server.URL)); err != nil {
+		t.Fatal(err)
+	}
+	respCode, err := engine.RunString(`
+(async function(){
+	const resp = await fetch(host);
+	return resp.status;
+})()
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respCode != int64(200) {
+		t.Fatalf("fetch with tls failed, want %d, got %d", 200, respCode)
+	}
+}
+
 func TestVm(t *testing.T) {
 	engine := NewEngine(nil)
 
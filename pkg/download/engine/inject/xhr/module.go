@@ -2,6 +2,8 @@ package xhr
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"mime/multipart"
@@ -130,6 +132,8 @@ type XMLHttpRequest struct {
 	responseHeaders http.Header
 	aborted         bool
 	proxyHandler    func(r *http.Request) (*url.URL, error)
+	tlsConfig       *tls.Config
+	dialContext     func(ctx context.Context, network, addr string) (net.Conn, error)
 
 	WithCredentials bool                  `json:"withCredentials"`
 	Upload          *XMLHttpRequestUpload `json:"upload"`
@@ -221,7 +225,9 @@ func (xhr *XMLHttpRequest) Send(data goja.Value) {
 		req.ContentLength = contentLength
 	}
 	transport := &http.Transport{
-		Proxy: xhr.proxyHandler,
+		Proxy:           xhr.proxyHandler,
+		TLSClientConfig: xhr.tlsConfig,
+		DialContext:     xhr.dialContext,
 	}
 	client := &http.Client{
 		Transport: transport,
@@ -346,7 +352,8 @@ func (xhr *XMLHttpRequest) parseData(data goja.Value) any {
 	return data.String()
 }
 
-func Enable(runtime *goja.Runtime, proxyHandler func(r *http.Request) (*url.URL, error)) error {
+func Enable(runtime *goja.Runtime, proxyHandler func(r *http.Request) (*url.URL, error), tlsConfig *tls.Config,
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) error {
 	progressEvent := runtime.ToValue(func(call goja.ConstructorCall) *goja.Object {
 		if len(call.Arguments) < 1 {
 			util.ThrowTypeError(runtime, "Failed to construct 'ProgressEvent': 1 argument required, but only 0 present.")
@@ -361,6 +368,8 @@ func Enable(runtime *goja.Runtime, proxyHandler func(r *http.Request) (*url.URL,
 	xhr := runtime.ToValue(func(call goja.ConstructorCall) *goja.Object {
 		instance := &XMLHttpRequest{
 			proxyHandler: proxyHandler,
+			tlsConfig:    tlsConfig,
+			dialContext:  dialContext,
 			Upload: &XMLHttpRequestUpload{
 				EventProp: &EventProp{
 					eventListeners: make(map[string]func(event *ProgressEvent)),
@@ -1,6 +1,7 @@
 package download
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/GopeedLab/gopeed/internal/logger"
@@ -13,6 +14,7 @@ import (
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"io"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -357,8 +359,22 @@ func doTrigger[T any](d *Downloader, event ActivationEvent, req *base.Request, c
 					if req.Labels == nil {
 						req.Labels = make(map[string]string)
 					}
+					var tlsConfig *tls.Config
+					tlsConfig, err = base.BuildTLSConfig(false, d.cfg.TLS)
+					if err != nil {
+						gopeed.Logger.logger.Error().Err(err).Msgf("[%s] build tls config failed", ext.buildIdentity())
+						return
+					}
+					var locals []net.IP
+					locals, err = d.getBind(req.Bind).LocalIPs()
+					if err != nil {
+						gopeed.Logger.logger.Error().Err(err).Msgf("[%s] build bind addresses failed", ext.buildIdentity())
+						return
+					}
 					engine := engine.NewEngine(&engine.Config{
 						ProxyConfig: d.cfg.Proxy,
+						TLSConfig:   tlsConfig,
+						DialContext: d.resolver.DialContext(&net.Dialer{}, locals),
 					})
 					defer engine.Close()
 					err = engine.Runtime.Set("gopeed", gopeed)
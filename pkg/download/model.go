@@ -5,11 +5,19 @@ import (
 	"github.com/GopeedLab/gopeed/internal/controller"
 	"github.com/GopeedLab/gopeed/internal/fetcher"
 	"github.com/GopeedLab/gopeed/internal/protocol/bt"
+	"github.com/GopeedLab/gopeed/internal/protocol/ftp"
+	"github.com/GopeedLab/gopeed/internal/protocol/hls"
 	"github.com/GopeedLab/gopeed/internal/protocol/http"
+	"github.com/GopeedLab/gopeed/internal/protocol/ipfs"
+	"github.com/GopeedLab/gopeed/internal/protocol/metalink"
+	"github.com/GopeedLab/gopeed/internal/protocol/s3"
+	"github.com/GopeedLab/gopeed/internal/protocol/sftp"
+	"github.com/GopeedLab/gopeed/internal/protocol/webdav"
 	"github.com/GopeedLab/gopeed/pkg/base"
 	"github.com/GopeedLab/gopeed/pkg/util"
 	gonanoid "github.com/matoous/go-nanoid/v2"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +43,10 @@ type Task struct {
 	lock           *sync.Mutex
 	speedArr       []int64
 	uploadSpeedArr []int64
+	// syncedAt is the last time the downloaded data was flushed to disk
+	syncedAt time.Time
+	// syncing is true while the downloaded data is being flushed in the background
+	syncing *atomic.Bool
 }
 
 func NewTask() *Task {
@@ -138,6 +150,7 @@ type DownloaderConfig struct {
 	FetchManagers []fetcher.FetcherManager
 
 	RefreshInterval      int `json:"refreshInterval"` // RefreshInterval time duration to refresh task progress(ms)
+	SyncInterval         int `json:"syncInterval"`    // SyncInterval time duration to flush the downloaded data and store the progress(ms)
 	Storage              Storage
 	StorageDir           string
 	DownloadDirWhiteList []string `json:"downloadDirWhiteList"`
@@ -153,13 +166,27 @@ func (cfg *DownloaderConfig) Init() *DownloaderConfig {
 	}
 	if len(cfg.FetchManagers) == 0 {
 		cfg.FetchManagers = []fetcher.FetcherManager{
+			// hls must be registered before http, because the m3u8 url is also a http url
+			new(hls.FetcherManager),
+			// metalink must be registered before http, because the metalink can be a http url
+			new(metalink.FetcherManager),
 			new(http.FetcherManager),
 			new(bt.FetcherManager),
+			new(ftp.FetcherManager),
+			new(sftp.FetcherManager),
+			// webdav also matches the http urls opted in by the request extra
+			new(webdav.FetcherManager),
+			new(s3.FetcherManager),
+			// ipfs also matches the /ipfs/<cid> paths
+			new(ipfs.FetcherManager),
 		}
 	}
 	if cfg.RefreshInterval == 0 {
 		cfg.RefreshInterval = 350
 	}
+	if cfg.SyncInterval == 0 {
+		cfg.SyncInterval = 3000
+	}
 	if cfg.Storage == nil {
 		cfg.Storage = NewMemStorage()
 	}
@@ -0,0 +1,30 @@
+package ftp
+
+// Mode is the data connection mode
+type Mode string
+
+const (
+	// ModePassive connects the data connections to the server, it works behind NAT and proxies
+	ModePassive Mode = "passive"
+	// ModeActive lets the server connect the data connections back, it falls back to passive when a proxy is used
+	ModeActive Mode = "active"
+)
+
+type ReqExtra struct {
+	// Mode overrides the data connection mode of the ftp protocol config
+	Mode Mode `json:"mode"`
+	// ExplicitTLS upgrades the ftp:// connections to TLS by AUTH TLS, the ftps:// connections use implicit TLS
+	ExplicitTLS bool `json:"explicitTls"`
+}
+
+type OptsExtra struct {
+	// Connections is the number of connections, a single file is split into chunks downloaded in parallel,
+	// the files of a directory are downloaded in parallel
+	Connections int `json:"connections"`
+}
+
+// Stats for download
+type Stats struct {
+	Chunks          int `json:"chunks"`
+	CompletedChunks int `json:"completedChunks"`
+}
@@ -0,0 +1,21 @@
+package hls
+
+import "github.com/GopeedLab/gopeed/pkg/protocol/http"
+
+type ReqExtra struct {
+	http.ReqExtra
+	// Bandwidth is used to select the variant stream from the master playlist,
+	// the variant with the closest bandwidth will be selected, if it is zero, the highest bandwidth variant will be selected.
+	Bandwidth int `json:"bandwidth"`
+}
+
+type OptsExtra struct {
+	// Connections is the number of segments downloaded in parallel
+	Connections int `json:"connections"`
+}
+
+// Stats for download
+type Stats struct {
+	Segments          int `json:"segments"`
+	CompletedSegments int `json:"completedSegments"`
+}
@@ -1,15 +1,81 @@
 package http
 
+import "github.com/GopeedLab/gopeed/pkg/base"
+
 type ReqExtra struct {
 	Method string            `json:"method"`
 	Header map[string]string `json:"header"`
 	Body   string            `json:"body"`
+	// Mirrors are the other urls of the same file, the chunks will be downloaded from the request url and mirrors in parallel
+	Mirrors []string `json:"mirrors"`
+	// Auth is the credentials of the request url, it is not sent to the mirrors and redirected hosts
+	Auth *Auth `json:"auth"`
+}
+
+type AuthType string
+
+const (
+	AuthTypeBasic  AuthType = "basic"
+	AuthTypeDigest AuthType = "digest"
+	AuthTypeBearer AuthType = "bearer"
+)
+
+// Auth is the credentials for http authentication,
+// if the type is empty, the scheme is selected by the challenge of the server.
+type Auth struct {
+	Type     AuthType `json:"type"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	// Token is used by bearer auth
+	Token string `json:"token"`
 }
 
 type OptsExtra struct {
 	Connections int `json:"connections"`
 	// AutoTorrent when task download complete, and it is a .torrent file, it will be auto create a new task for the torrent file
 	AutoTorrent bool `json:"autoTorrent"`
+	// Retry overrides the retry policy of the http protocol config, zero fields use the config values
+	Retry *RetryPolicy `json:"retry"`
+	// Protocol overrides the protocol of the http protocol config
+	Protocol Protocol `json:"protocol"`
+	// Adaptive overrides the adaptive connections of the http protocol config
+	Adaptive *AdaptiveConnections `json:"adaptive"`
+	// Stall overrides the stall detection of the http protocol config, zero fields use the config values
+	Stall *StallDetection `json:"stall"`
+}
+
+// AdaptiveConnections scales the connections by the measured throughput, a connection is added while the
+// aggregate speed keeps rising, and dropped when the speed flattens or the server responds 429/503.
+type AdaptiveConnections struct {
+	Enable bool `json:"enable"`
+	// MinConnections is the initial connections, default is 1
+	MinConnections int `json:"minConnections"`
+	// MaxConnections is the max connections, default is the connections of the options
+	MaxConnections int `json:"maxConnections"`
+}
+
+// Protocol is the http version used by the download requests
+type Protocol string
+
+const (
+	// ProtocolHTTP1 forces HTTP/1.1, each connection downloads over its own tcp connection
+	ProtocolHTTP1 Protocol = "http1"
+	// ProtocolHTTP2 enables HTTP/2 when the server supports it, all connections are multiplexed over one tcp connection
+	ProtocolHTTP2 Protocol = "http2"
+	// ProtocolHTTP3 uses HTTP/3 over QUIC, it falls back to HTTP/2 when a proxy is used
+	ProtocolHTTP3 Protocol = "http3"
+)
+
+// RetryPolicy controls how the failed requests are retried, it is shared by all protocols.
+type RetryPolicy = base.RetryPolicy
+
+// StallDetection re-requests the connection whose speed stays below the min speed for the window,
+// so a trickling connection doesn't hold its chunk until the read timeout.
+type StallDetection struct {
+	// MinSpeed is the min bytes per second of a connection, zero means disabled
+	MinSpeed int64 `json:"minSpeed"`
+	// Window is the duration in milliseconds that the speed must stay below the min speed, default is 10000
+	Window int64 `json:"window"`
 }
 
 // Stats for download
@@ -18,8 +84,14 @@ type Stats struct {
 }
 
 type StatsConnection struct {
-	Downloaded int64 `json:"downloaded"`
-	Completed  bool  `json:"completed"`
-	Failed     bool  `json:"failed"`
-	RetryTimes int   `json:"retryTimes"`
+	// URL is the download source of the connection
+	URL        string `json:"url"`
+	Downloaded int64  `json:"downloaded"`
+	Completed  bool   `json:"completed"`
+	Failed     bool   `json:"failed"`
+	RetryTimes int    `json:"retryTimes"`
+	// Protocol is the negotiated protocol of the last response, e.g. HTTP/1.1, HTTP/2.0, HTTP/3.0
+	Protocol string `json:"protocol"`
+	// Stalls is the times the connection was re-requested because of stalling
+	Stalls int `json:"stalls"`
 }
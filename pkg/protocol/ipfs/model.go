@@ -0,0 +1,18 @@
+package ipfs
+
+type ReqExtra struct {
+	// Gateways are the trustless gateways to fetch the blocks from, they override the gateways of the protocol config
+	Gateways []string `json:"gateways"`
+}
+
+type OptsExtra struct {
+	// Connections is the number of connections, a single file is split into chunks read in parallel,
+	// the files of a directory are downloaded in parallel
+	Connections int `json:"connections"`
+}
+
+// Stats for download
+type Stats struct {
+	Chunks          int `json:"chunks"`
+	CompletedChunks int `json:"completedChunks"`
+}
@@ -0,0 +1,11 @@
+package metalink
+
+import "github.com/GopeedLab/gopeed/pkg/protocol/http"
+
+// Stats for download
+type Stats struct {
+	// File is the name of the file which is downloading
+	File string `json:"file"`
+	// Connections is the http connections of the downloading file
+	Connections []*http.StatsConnection `json:"connections"`
+}
@@ -0,0 +1,26 @@
+package s3
+
+// ReqExtra overrides the protocol config of the request, empty fields fall back to the config
+type ReqExtra struct {
+	// Endpoint is the url of the S3-compatible store, e.g. http://127.0.0.1:9000, the buckets are addressed in the path style.
+	// Empty means the AWS endpoint of the region.
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	// AccessKeyID and SecretAccessKey sign the requests with AWS signature version 4, the requests are anonymous without them
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	// SessionToken is the token of the temporary credentials
+	SessionToken string `json:"sessionToken"`
+}
+
+type OptsExtra struct {
+	// Connections is the number of connections, a single object is split into chunks downloaded in parallel,
+	// the objects of a prefix are downloaded in parallel
+	Connections int `json:"connections"`
+}
+
+// Stats for download
+type Stats struct {
+	Chunks          int `json:"chunks"`
+	CompletedChunks int `json:"completedChunks"`
+}
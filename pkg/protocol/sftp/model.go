@@ -0,0 +1,20 @@
+package sftp
+
+type ReqExtra struct {
+	// PrivateKeyFile is the path of the PEM encoded private key for the public key authentication, it overrides the one
+	// of the protocol config, the key is read on connecting so it is not stored with the task.
+	// The password of the url is used for the password authentication.
+	PrivateKeyFile string `json:"privateKeyFile"`
+}
+
+type OptsExtra struct {
+	// Connections is the number of sftp channels over the ssh connection, a single file is split into chunks read in parallel,
+	// the files of a directory are downloaded in parallel
+	Connections int `json:"connections"`
+}
+
+// Stats for download
+type Stats struct {
+	Chunks          int `json:"chunks"`
+	CompletedChunks int `json:"completedChunks"`
+}
@@ -0,0 +1,20 @@
+package webdav
+
+type ReqExtra struct {
+	// Header is sent with the PROPFIND and GET requests, the credentials of the url are sent by basic auth
+	Header map[string]string `json:"header"`
+	// WebDAV opts the http and https urls in the webdav protocol, they are downloaded by the http protocol by default
+	WebDAV bool `json:"webdav"`
+}
+
+type OptsExtra struct {
+	// Connections is the number of connections, a single file is split into chunks downloaded in parallel,
+	// the files of a collection are downloaded in parallel
+	Connections int `json:"connections"`
+}
+
+// Stats for download
+type Stats struct {
+	Chunks          int `json:"chunks"`
+	CompletedChunks int `json:"completedChunks"`
+}
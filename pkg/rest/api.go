@@ -1,6 +1,7 @@
 package rest
 
 import (
+	"bytes"
 	"github.com/GopeedLab/gopeed/pkg/base"
 	"github.com/GopeedLab/gopeed/pkg/download"
 	"github.com/GopeedLab/gopeed/pkg/rest/model"
@@ -295,6 +296,50 @@ func UpdateExtension(w http.ResponseWriter, r *http.Request) {
 	WriteJson(w, model.NewNilResult())
 }
 
+func GetCookieProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := Downloader.GetCookieProfiles()
+	if err != nil {
+		WriteJson(w, model.NewErrorResult(err.Error()))
+		return
+	}
+	WriteJson(w, model.NewOkResult(profiles))
+}
+
+// ImportCookies imports the request body in Netscape cookies.txt format into the cookie profile
+func ImportCookies(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	profile := vars["profile"]
+	count, err := Downloader.ImportCookies(profile, r.Body)
+	if err != nil {
+		WriteJson(w, model.NewErrorResult(err.Error(), model.CodeInvalidParam))
+		return
+	}
+	WriteJson(w, model.NewOkResult(count))
+}
+
+// ExportCookies exports the cookie profile in Netscape cookies.txt format
+func ExportCookies(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	profile := vars["profile"]
+	var buf bytes.Buffer
+	if err := Downloader.ExportCookies(profile, &buf); err != nil {
+		WriteJson(w, model.NewErrorResult(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func DeleteCookieProfile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	profile := vars["profile"]
+	if err := Downloader.DeleteCookieProfile(profile); err != nil {
+		WriteJson(w, model.NewErrorResult(err.Error()))
+		return
+	}
+	WriteJson(w, model.NewNilResult())
+}
+
 func DoProxy(w http.ResponseWriter, r *http.Request) {
 	target := r.Header.Get("X-Target-Uri")
 	if target == "" {
@@ -124,6 +124,10 @@ func BuildServer(startCfg *model.StartConfig) (*http.Server, net.Listener, error
 	r.Methods(http.MethodDelete).Path("/api/v1/extensions/{identity}").HandlerFunc(DeleteExtension)
 	r.Methods(http.MethodGet).Path("/api/v1/extensions/{identity}/update").HandlerFunc(UpdateCheckExtension)
 	r.Methods(http.MethodPost).Path("/api/v1/extensions/{identity}/update").HandlerFunc(UpdateExtension)
+	r.Methods(http.MethodGet).Path("/api/v1/cookies").HandlerFunc(GetCookieProfiles)
+	r.Methods(http.MethodPost).Path("/api/v1/cookies/{profile}").HandlerFunc(ImportCookies)
+	r.Methods(http.MethodGet).Path("/api/v1/cookies/{profile}").HandlerFunc(ExportCookies)
+	r.Methods(http.MethodDelete).Path("/api/v1/cookies/{profile}").HandlerFunc(DeleteCookieProfile)
 	r.Path("/api/v1/proxy").HandlerFunc(DoProxy)
 	if startCfg.WebEnable {
 		r.PathPrefix("/fs/tasks").Handler(http.FileServer(new(taskFileSystem)))
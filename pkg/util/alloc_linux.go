@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package util
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Preallocate allocates the disk space of the file up to the size, so the download never runs out of space halfway.
+func Preallocate(file *os.File, size int64) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := conn.Control(func(fd uintptr) {
+		err = syscall.Fallocate(int(fd), 0, 0, size)
+	}); err != nil {
+		return err
+	}
+	// The file system doesn't support fallocate, fallback to truncate
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return file.Truncate(size)
+	}
+	return err
+}
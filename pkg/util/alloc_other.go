@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+import "os"
+
+// Preallocate allocates the disk space of the file up to the size, the file is truncated on the platforms without fallocate.
+func Preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// NewHash returns a new hash.Hash for the given algorithm name, supported algorithms are md5, sha1, sha256, sha512 and crc32.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+}
+
+// FileChecksum calculates the hex encoded digest of the file with the given algorithm.
+func FileChecksum(name string, algorithm string) (string, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileChecksum(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "checksum.txt")
+	if err := os.WriteFile(name, []byte("gopeed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		algorithm string
+		want      string
+		wantErr   bool
+	}{
+		{
+			algorithm: "md5",
+			want:      "7220daac52d41e181b0b9050149e9a5e",
+		},
+		{
+			algorithm: "sha1",
+			want:      "8c93e98a77516ad66900b3954562a59d214234e0",
+		},
+		{
+			algorithm: "SHA256",
+			want:      "a883c66fb35ebc4cd07c74155ccd3d1b0ded03a8a02bd89082249f1d8d51c1a7",
+		},
+		{
+			algorithm: "crc32",
+			want:      "c827ed29",
+		},
+		{
+			algorithm: "sha512",
+			want:      "46d789a87e86143f453d0ada597450ceea6dcb20f818a029b0c66d109d6225f5e45c7fafa36ffa380b05a6b14331234ad00c5c90f384a4b1adbe75e02912594e",
+		},
+		{
+			algorithm: "sha384",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			got, err := FileChecksum(name, tt.algorithm)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FileChecksum() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("FileChecksum() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
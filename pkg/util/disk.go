@@ -0,0 +1,35 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FreeSpace returns the free bytes of the volume where the path is, the path may not exist yet.
+func FreeSpace(path string) (uint64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	// Walk up to the nearest existing directory, the download directory is created on start
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	return freeSpace(path)
+}
+
+// DiskUsage returns the bytes allocated on disk for the file, zero if the file does not exist.
+func DiskUsage(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return diskUsage(info)
+}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeSpace(t *testing.T) {
+	// The path doesn't exist, the free space of its existing parent is returned
+	free, err := FreeSpace(filepath.Join(t.TempDir(), "not", "exist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free == 0 {
+		t.Errorf("FreeSpace() got = %v, want > 0", free)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "usage.data")
+	if got := DiskUsage(name); got != 0 {
+		t.Errorf("DiskUsage() got = %v, want 0", got)
+	}
+	if err := os.WriteFile(name, make([]byte, 64*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := DiskUsage(name); got < 64*1024 {
+		t.Errorf("DiskUsage() got = %v, want >= %v", got, 64*1024)
+	}
+}
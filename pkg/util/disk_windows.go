@@ -0,0 +1,30 @@
+package util
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func freeSpace(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
+
+// diskUsage returns the file size, the files created by the downloader are not sparse on windows
+func diskUsage(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+// IsDiskFull returns whether the error is caused by no space left on the disk
+func IsDiskFull(err error) bool {
+	return errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL)
+}
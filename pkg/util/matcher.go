@@ -45,6 +45,11 @@ func parsePattern(pattern string) (scheme string, host string, path string) {
 	return
 }
 
+// MatchHost matches the host with the pattern, * matches any host and *.example.com matches the subdomains.
+func MatchHost(pattern string, host string) bool {
+	return matchHost(pattern, host)
+}
+
 func matchHost(pattern string, host string) bool {
 	if pattern == "*" {
 		return true
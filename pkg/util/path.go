@@ -36,19 +36,27 @@ func SafeRemove(name string) error {
 // CheckDuplicateAndRename rename duplicate file, add suffix (1) (2) ...
 // if file name is a.txt, rename to a (1).txt
 // if directory name is a, rename to a (1)
+// the path with any of the suffixes is also considered duplicate, e.g. the temporary file a.txt.part
 // return new name
-func CheckDuplicateAndRename(path string) (string, error) {
+func CheckDuplicateAndRename(path string, suffixes ...string) (string, error) {
 	dir := syspath.Dir(path)
 	name := syspath.Base(path)
-
-	// if file not exists, return directly
-	_, err := os.Stat(path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return name, nil
+	exists := func(path string) bool {
+		for _, suffix := range append([]string{""}, suffixes...) {
+			if _, err := os.Stat(path + suffix); !os.IsNotExist(err) {
+				return true
+			}
 		}
+		return false
+	}
+
+	if _, err := os.Stat(path); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return "", err
 	}
+	// if file not exists, return directly
+	if !exists(path) {
+		return name, nil
+	}
 
 	index := strings.LastIndex(name, ".")
 	var nameTpl string
@@ -60,7 +68,7 @@ func CheckDuplicateAndRename(path string) (string, error) {
 	for i := 1; ; i++ {
 		newName := fmt.Sprintf(nameTpl, i)
 		newPath := syspath.Join(dir, newName)
-		if _, err := os.Stat(newPath); os.IsNotExist(err) {
+		if !exists(newPath) {
 			return newName, nil
 		}
 	}
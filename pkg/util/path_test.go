@@ -113,9 +113,12 @@ func TestCheckDuplicateAndRename(t *testing.T) {
 	doCheckDuplicateAndRename(t, []string{}, "a", "a")
 	doCheckDuplicateAndRename(t, []string{"a"}, "a", "a (1)")
 	doCheckDuplicateAndRename(t, []string{"a", "a (1)"}, "a", "a (2)")
+
+	doCheckDuplicateAndRename(t, []string{"a.txt.part"}, "a.txt", "a (1).txt", ".part")
+	doCheckDuplicateAndRename(t, []string{"a.txt", "a (1).txt.part"}, "a.txt", "a (2).txt", ".part")
 }
 
-func doCheckDuplicateAndRename(t *testing.T, exitsPaths []string, path string, except string) {
+func doCheckDuplicateAndRename(t *testing.T, exitsPaths []string, path string, except string, suffixes ...string) {
 	for _, path := range exitsPaths {
 		if err := os.MkdirAll(path, 0755); err != nil {
 			t.Fatal(err)
@@ -130,7 +133,7 @@ func doCheckDuplicateAndRename(t *testing.T, exitsPaths []string, path string, e
 		}
 	}()
 
-	got, err := CheckDuplicateAndRename(path)
+	got, err := CheckDuplicateAndRename(path, suffixes...)
 	if err != nil {
 		t.Fatal(err)
 	}
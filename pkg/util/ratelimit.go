@@ -0,0 +1,52 @@
+package util
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst is the minimum burst size of the rate limiter, it must be large enough to fit a single read.
+const minBurst = 64 * 1024
+
+// NewRateLimiter returns a rate limiter of bytes per second, zero or negative limit means unlimited.
+func NewRateLimiter(limit int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, 0)
+	SetRateLimit(l, limit)
+	return l
+}
+
+// SetRateLimit updates the bytes per second of the rate limiter, zero or negative limit means unlimited.
+func SetRateLimit(l *rate.Limiter, limit int64) {
+	if limit <= 0 {
+		if l.Limit() != rate.Inf {
+			l.SetLimit(rate.Inf)
+			l.SetBurst(0)
+		}
+		return
+	}
+	if l.Limit() == rate.Limit(limit) {
+		return
+	}
+	l.SetLimit(rate.Limit(limit))
+	l.SetBurst(int(max(limit, minBurst)))
+}
+
+// WaitRateLimit blocks until n bytes are allowed by the limiter, n can be larger than the burst size.
+func WaitRateLimit(ctx context.Context, l *rate.Limiter, n int) error {
+	if l == nil || l.Limit() == rate.Inf {
+		return nil
+	}
+	for n > 0 {
+		burst := l.Burst()
+		if burst <= 0 {
+			return nil
+		}
+		wait := min(n, burst)
+		if err := l.WaitN(ctx, wait); err != nil {
+			return err
+		}
+		n -= wait
+	}
+	return nil
+}
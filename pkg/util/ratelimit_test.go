@@ -0,0 +1,41 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	if l := NewRateLimiter(0); l.Limit() != rate.Inf {
+		t.Errorf("NewRateLimiter() got = %v, want %v", l.Limit(), rate.Inf)
+	}
+	l := NewRateLimiter(1024)
+	if l.Limit() != 1024 || l.Burst() != minBurst {
+		t.Errorf("NewRateLimiter() got = %v/%v, want %v/%v", l.Limit(), l.Burst(), 1024, minBurst)
+	}
+	SetRateLimit(l, -1)
+	if l.Limit() != rate.Inf {
+		t.Errorf("SetRateLimit() got = %v, want %v", l.Limit(), rate.Inf)
+	}
+}
+
+func TestWaitRateLimit(t *testing.T) {
+	l := NewRateLimiter(minBurst)
+	start := time.Now()
+	// The first burst is allowed immediately, the next burst needs to wait one second
+	if err := WaitRateLimit(context.Background(), l, minBurst*2); err != nil {
+		t.Fatal(err)
+	}
+	if used := time.Since(start); used < 900*time.Millisecond {
+		t.Errorf("WaitRateLimit() used = %v, want >= %v", used, time.Second)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := WaitRateLimit(ctx, l, minBurst); err == nil {
+		t.Errorf("WaitRateLimit() got = %v, want error", err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// SyncData flushes the written data of the file to disk, the metadata is not flushed unless it is needed to read the data.
+func SyncData(file *os.File) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := conn.Control(func(fd uintptr) {
+		err = syscall.Fdatasync(int(fd))
+	}); err != nil {
+		// Control fails only if the file is closed
+		return &os.PathError{Op: "fdatasync", Path: file.Name(), Err: os.ErrClosed}
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+import "os"
+
+// SyncData flushes the written data of the file to disk.
+func SyncData(file *os.File) error {
+	return file.Sync()
+}
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncData(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "sync.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("gopeed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncData(file); err != nil {
+		t.Errorf("SyncData() error = %v, want nil", err)
+	}
+	file.Close()
+	if err := SyncData(file); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("SyncData() error = %v, want %v", err, os.ErrClosed)
+	}
+}